@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpSink publishes forwards to an AMQP 0.9.1 exchange, e.g. RabbitMQ, with a routing key rendered from the event.
+// Every message is persistent and confirmed by the broker
+type amqpSink struct {
+	serverURL  string
+	config     amqp.Config
+	exchange   string
+	routingKey *fieldTemplate
+	// mutex guards connection and channel, which are reopened on the next send after they close
+	mutex      sync.Mutex
+	connection *amqp.Connection
+	channel    *amqp.Channel
+}
+
+func init() {
+	sinkOpeners["amqp"] = openAMQPSink
+	sinkOpeners["amqps"] = openAMQPSink
+}
+
+// openAMQPSink opens amqp://[user:password@]<host>[/<vhost>]?exchange=<exchange>&routing_key=<template>, or amqps://
+// for TLS with the relay TLS settings. The broker is connected on the first send
+func openAMQPSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	routingKey, err := parseFieldTemplate(query.Get("routing_key"))
+	if err != nil {
+		return nil, err
+	}
+	publisher := &amqpSink{exchange: query.Get("exchange"), routingKey: routingKey}
+	if !query.Has("exchange") && !query.Has("routing_key") {
+		return nil, fmt.Errorf("expected ?exchange=<exchange>&routing_key=<template>")
+	}
+	query.Del("exchange")
+	query.Del("routing_key")
+	serverURL := *destinationURL
+	serverURL.RawQuery = query.Encode()
+	publisher.serverURL = serverURL.String()
+	if _, err := amqp.ParseURI(publisher.serverURL); err != nil {
+		return nil, err
+	}
+	publisher.config = amqp.Config{
+		Heartbeat:  10 * time.Second,
+		Dial:       amqp.DefaultDial(5 * time.Second),
+		Properties: amqp.Table{"connection_name": "github_webhook_filter"},
+	}
+	if destinationURL.Scheme == "amqps" {
+		publisher.config.TLSClientConfig = relayClient.Transport.(*http.Transport).TLSClientConfig.Clone()
+	}
+	return publisher, nil
+}
+
+// openChannel returns the confirming channel, reconnecting when it or its connection closed
+func (publisher *amqpSink) openChannel() (*amqp.Channel, error) {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.channel != nil && !publisher.channel.IsClosed() {
+		return publisher.channel, nil
+	}
+	if publisher.connection == nil || publisher.connection.IsClosed() {
+		connection, err := amqp.DialConfig(publisher.serverURL, publisher.config)
+		if err != nil {
+			return nil, err
+		}
+		if publisher.connection != nil {
+			log.Printf("Reconnected to AMQP broker %s", redactURL(publisher.serverURL))
+		}
+		publisher.connection = connection
+	}
+	channel, err := publisher.connection.Channel()
+	if err != nil {
+		publisher.connection.Close()
+		return nil, err
+	}
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	publisher.channel = channel
+	return channel, nil
+}
+
+func (publisher *amqpSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	routingKey, err := publisher.routingKey.render(request.Header, body, topicEscaper.Replace)
+	if err != nil {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error rendering AMQP routing key: %v", err)
+	}
+	channel, err := publisher.openChannel()
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error connecting to AMQP broker: %v", err)
+	}
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, publisher.exchange, routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    request.Header.Get("X-GitHub-Delivery"),
+		Type:         request.Header.Get("X-GitHub-Event"),
+		Timestamp:    time.Now(),
+		Headers:      amqp.Table{"hook_id": request.Header.Get("X-GitHub-Hook-ID")},
+		Body:         body,
+	})
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to AMQP exchange %q: %v", publisher.exchange, err)
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to AMQP exchange %q, no confirmation: %v", publisher.exchange, err)
+	}
+	if !acked {
+		return relayReply{}, fmt.Errorf("AMQP broker rejected the message for exchange %q", publisher.exchange)
+	}
+	log.Printf("AMQP broker confirmed %s to exchange %q", routingKey, publisher.exchange)
+	return relayReply{status: http.StatusOK}, nil
+}
+
+func (publisher *amqpSink) ready() error {
+	_, err := publisher.openChannel()
+	return err
+}
+
+func (publisher *amqpSink) close() {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+	if publisher.connection != nil {
+		publisher.connection.Close()
+	}
+}
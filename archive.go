@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// archiveEntry is a line of the ARCHIVE_PATH file. The fields are the input of replays, so they are only ever added
+// to, never renamed or removed
+type archiveEntry struct {
+	Time       string          `json:"time"`
+	DeliveryID string          `json:"delivery_id"`
+	Event      string          `json:"event"`
+	HookID     string          `json:"hook_id,omitempty"`
+	Path       string          `json:"path"`
+	Verdict    string          `json:"verdict"`
+	Reason     string          `json:"reason"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Verdicts of archive entries
+const (
+	archiveForwarded = "forwarded"
+	archiveFiltered  = "filtered"
+	archiveFailed    = "failed"
+)
+
+// eventArchive appends deliveries to a JSONL file from a background writer so archiving never blocks requests. Its
+// settings are read at startup
+type eventArchive struct {
+	path string
+	// maxBytes is the size from which the file is rotated, 0 for no rotation
+	maxBytes int64
+	// includeFiltered also archives the events that weren't forwarded
+	includeFiltered bool
+	entries         chan archiveEntry
+	// dropped counts the entries lost because the writer fell behind
+	dropped atomic.Int64
+	done    sync.WaitGroup
+}
+
+// eventArchiver is nil when ARCHIVE_PATH is not set
+var eventArchiver *eventArchive
+
+// newEventArchive opens ARCHIVE_PATH for appending and starts its writer, with ARCHIVE_MAX_BYTES and ARCHIVE_FILTERED.
+// Returns nil when archiving is disabled
+func newEventArchive() (*eventArchive, error) {
+	path := os.Getenv("ARCHIVE_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	archive := &eventArchive{path: path, maxBytes: 100 << 20, entries: make(chan archiveEntry, 1024)}
+	if value := os.Getenv("ARCHIVE_MAX_BYTES"); value != "" {
+		var err error
+		if archive.maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || archive.maxBytes < 0 {
+			return nil, fmt.Errorf("ARCHIVE_MAX_BYTES must be a positive number, got %q", value)
+		}
+	}
+	var err error
+	if archive.includeFiltered, err = lookupBool("ARCHIVE_FILTERED", false); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("ARCHIVE_PATH: %w", err)
+	}
+	if archive.includeFiltered {
+		log.Printf("Archiving all events to %s", path)
+	} else {
+		log.Printf("Archiving forwarded events to %s", path)
+	}
+	archive.done.Add(1)
+	go archive.write(file)
+	return archive, nil
+}
+
+// record queues the delivery for archiving, or drops it when the writer fell behind
+func (archive *eventArchive) record(request *http.Request, body []byte, status int, reason string) {
+	verdict := archiveFiltered
+	if reason == reasonForwarded || reason == reasonForwardAccepted {
+		verdict = archiveForwarded
+	} else if status >= 500 {
+		verdict = archiveFailed
+	}
+	// failed forwards are kept so they can be redelivered
+	if verdict == archiveFiltered && !archive.includeFiltered {
+		return
+	}
+	entry := archiveEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		DeliveryID: request.Header.Get("X-GitHub-Delivery"),
+		Event:      request.Header.Get("X-GitHub-Event"),
+		HookID:     request.Header.Get("X-GitHub-Hook-ID"),
+		Path:       request.URL.Path,
+		Verdict:    verdict,
+		Reason:     reason,
+		Payload:    body,
+	}
+	if !json.Valid(body) {
+		entry.Payload, _ = json.Marshal(string(body))
+	}
+	select {
+	case archive.entries <- entry:
+	default:
+		if archive.dropped.Add(1) == 1 {
+			log.Printf("Archive writer fell behind, dropping entries")
+		}
+	}
+}
+
+// write appends the queued entries, flushing every second and rotating the file once it reaches maxBytes
+func (archive *eventArchive) write(file *os.File) {
+	defer archive.done.Done()
+	size := int64(0)
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	writer := bufio.NewWriter(file)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, open := <-archive.entries:
+			if !open {
+				writer.Flush()
+				file.Close()
+				return
+			}
+			line, _ := json.Marshal(entry)
+			line = append(line, '\n')
+			if archive.maxBytes > 0 && size > 0 && size+int64(len(line)) > archive.maxBytes {
+				writer.Flush()
+				if rotated, err := archive.rotate(file); err != nil {
+					log.Printf("Error rotating archive %s, appending to it: %v", archive.path, err)
+				} else {
+					file, size = rotated, 0
+					writer.Reset(file)
+				}
+			}
+			if _, err := writer.Write(line); err != nil {
+				log.Printf("Error archiving delivery %s: %v", entry.DeliveryID, err)
+			}
+			size += int64(len(line))
+		case <-ticker.C:
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error flushing archive %s: %v", archive.path, err)
+			}
+			if dropped := archive.dropped.Swap(0); dropped > 0 {
+				log.Printf("Dropped %d archive entries, the writer fell behind", dropped)
+			}
+		}
+	}
+}
+
+// rotate renames the full file with a timestamp suffix and opens a new one in its place. The renamed file stays open
+// when the new one can't be created
+func (archive *eventArchive) rotate(file *os.File) (*os.File, error) {
+	rotatedPath := archive.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(archive.path, rotatedPath); err != nil {
+		return nil, err
+	}
+	rotated, err := os.OpenFile(archive.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	log.Printf("Rotated archive to %s", rotatedPath)
+	return rotated, nil
+}
+
+// close writes the queued entries and closes the file, on shutdown
+func (archive *eventArchive) close() {
+	close(archive.entries)
+	archive.done.Wait()
+}
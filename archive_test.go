@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestArchive opens an archive in a temporary directory with the environment variables. The test closes it to
+// flush its entries
+func newTestArchive(t *testing.T, env map[string]string) *eventArchive {
+	t.Helper()
+	t.Setenv("ARCHIVE_PATH", filepath.Join(t.TempDir(), "events.jsonl"))
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	archive, err := newEventArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// readArchiveLines returns the lines of an archive file decoded by field name
+func readArchiveLines(t *testing.T, path string) []map[string]json.RawMessage {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []map[string]json.RawMessage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("archive line %q isn't JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func stringField(t *testing.T, line map[string]json.RawMessage, name string) string {
+	t.Helper()
+	var value string
+	if err := json.Unmarshal(line[name], &value); err != nil {
+		t.Fatalf("field %s = %s isn't a string: %v", name, line[name], err)
+	}
+	return value
+}
+
+func TestArchiveEntrySchema(t *testing.T) {
+	archive := newTestArchive(t, map[string]string{"ARCHIVE_FILTERED": "true"})
+	tests := []struct {
+		status      int
+		reason      string
+		wantVerdict string
+	}{
+		{status: http.StatusOK, reason: reasonForwarded, wantVerdict: "forwarded"},
+		{status: http.StatusAccepted, reason: reasonForwardAccepted, wantVerdict: "forwarded"},
+		{status: http.StatusBadGateway, reason: reasonRelayError, wantVerdict: "failed"},
+		{status: http.StatusInternalServerError, reason: reasonTemplateError, wantVerdict: "failed"},
+		{status: http.StatusOK, reason: reasonRepoFiltered, wantVerdict: "filtered"},
+		{status: http.StatusUnauthorized, reason: reasonSignatureInvalid, wantVerdict: "filtered"},
+	}
+	var deliveryIDs []string
+	for _, test := range tests {
+		request := newDelivery("package", testPackagePayload)
+		deliveryIDs = append(deliveryIDs, request.Header.Get("X-GitHub-Delivery"))
+		archive.record(request, []byte(testPackagePayload), test.status, test.reason)
+	}
+	archive.close()
+
+	lines := readArchiveLines(t, archive.path)
+	if len(lines) != len(tests) {
+		t.Fatalf("archived %d lines, want %d", len(lines), len(tests))
+	}
+	wantFields := []string{"delivery_id", "event", "hook_id", "path", "payload", "reason", "time", "verdict"}
+	for index, line := range lines {
+		if fields := slices.Sorted(maps.Keys(line)); !slices.Equal(fields, wantFields) {
+			t.Errorf("line %d has the fields %v, want %v", index, fields, wantFields)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, stringField(t, line, "time")); err != nil {
+			t.Errorf("line %d time isn't RFC 3339: %v", index, err)
+		}
+		for name, want := range map[string]string{"delivery_id": deliveryIDs[index], "event": "package", "hook_id": "1", "path": "/", "verdict": tests[index].wantVerdict, "reason": tests[index].reason} {
+			if got := stringField(t, line, name); got != want {
+				t.Errorf("line %d %s = %q, want %q", index, name, got, want)
+			}
+		}
+		if string(line["payload"]) != testPackagePayload {
+			t.Errorf("line %d payload = %s, want the raw payload", index, line["payload"])
+		}
+	}
+}
+
+func TestArchiveNonJSONPayload(t *testing.T) {
+	archive := newTestArchive(t, nil)
+	const payload = "payload=%7B%22action%22%3A"
+	archive.record(newDelivery("package", payload), []byte(payload), http.StatusOK, reasonForwarded)
+	archive.close()
+	lines := readArchiveLines(t, archive.path)
+	if len(lines) != 1 {
+		t.Fatalf("archived %d lines, want 1", len(lines))
+	}
+	if got := stringField(t, lines[0], "payload"); got != payload {
+		t.Errorf("payload = %q, want the body as a JSON string", got)
+	}
+}
+
+func TestArchiveIncludeFiltered(t *testing.T) {
+	for _, includeFiltered := range []bool{false, true} {
+		t.Run("ARCHIVE_FILTERED="+strconv.FormatBool(includeFiltered), func(t *testing.T) {
+			archive := newTestArchive(t, map[string]string{"ARCHIVE_FILTERED": strconv.FormatBool(includeFiltered)})
+			archive.record(newDelivery("package", testPackagePayload), []byte(testPackagePayload), http.StatusOK, reasonForwarded)
+			archive.record(newDelivery("package", testPackagePayload), []byte(testPackagePayload), http.StatusOK, reasonPackageTypeFiltered)
+			archive.record(newDelivery("package", testPackagePayload), []byte(testPackagePayload), http.StatusBadGateway, reasonRelayError)
+			archive.close()
+			var verdicts []string
+			for _, line := range readArchiveLines(t, archive.path) {
+				verdicts = append(verdicts, stringField(t, line, "verdict"))
+			}
+			want := []string{"forwarded", "failed"}
+			if includeFiltered {
+				want = []string{"forwarded", "filtered", "failed"}
+			}
+			if !slices.Equal(verdicts, want) {
+				t.Errorf("archived verdicts %v, want %v", verdicts, want)
+			}
+		})
+	}
+}
+
+func TestArchiveRotation(t *testing.T) {
+	const maxBytes = 600
+	archive := newTestArchive(t, map[string]string{"ARCHIVE_MAX_BYTES": strconv.Itoa(maxBytes)})
+	var want []string
+	for range 5 {
+		request := newDelivery("package", testPackagePayload)
+		want = append(want, request.Header.Get("X-GitHub-Delivery"))
+		archive.record(request, []byte(testPackagePayload), http.StatusOK, reasonForwarded)
+	}
+	archive.close()
+
+	rotated, err := filepath.Glob(archive.path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) == 0 {
+		t.Fatal("expected the archive to be rotated")
+	}
+	slices.Sort(rotated)
+	var archived []string
+	for _, path := range append(rotated, archive.path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := readArchiveLines(t, path)
+		if len(lines) > 1 && info.Size() > maxBytes {
+			t.Errorf("%s has %d bytes in %d lines, over ARCHIVE_MAX_BYTES", path, info.Size(), len(lines))
+		}
+		for _, line := range lines {
+			archived = append(archived, stringField(t, line, "delivery_id"))
+		}
+	}
+	if !slices.Equal(archived, want) {
+		t.Errorf("archived %v across the files, want %v in order", archived, want)
+	}
+}
+
+func TestArchiveFlushOnClose(t *testing.T) {
+	archive := newTestArchive(t, nil)
+	request := newDelivery("package", testPackagePayload)
+	archive.record(request, []byte(testPackagePayload), http.StatusOK, reasonForwarded)
+	// closed before the periodic flush
+	archive.close()
+	lines := readArchiveLines(t, archive.path)
+	if len(lines) != 1 || stringField(t, lines[0], "delivery_id") != request.Header.Get("X-GitHub-Delivery") {
+		t.Errorf("expected the buffered entry written on close, got %v", lines)
+	}
+}
+
+func TestHandlerArchive(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, nil, relay.URL)
+	archive := newTestArchive(t, nil)
+	previous := eventArchiver
+	eventArchiver = archive
+	t.Cleanup(func() { eventArchiver = previous })
+
+	forwarded := newDelivery("package", testPackagePayload)
+	deliver(forwarded)
+	deliver(newDelivery("issues", `{"action":"opened"}`))
+	archive.close()
+
+	lines := readArchiveLines(t, archive.path)
+	if len(lines) != 1 {
+		t.Fatalf("archived %d lines, want only the forwarded event", len(lines))
+	}
+	if got := stringField(t, lines[0], "delivery_id"); got != forwarded.Header.Get("X-GitHub-Delivery") {
+		t.Errorf("archived delivery %s, want %s", got, forwarded.Header.Get("X-GitHub-Delivery"))
+	}
+	if got := stringField(t, lines[0], "reason"); got != reasonForwarded {
+		t.Errorf("reason = %q, want %q", got, reasonForwarded)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventQueue is the bounded queue drained by the worker pool forwarding events when ASYNC_FORWARD is enabled. Its
+// size, workers and overflow policy are read once at startup
+type eventQueue interface {
+	// enqueue adds the job to the queue. Returns false when the queue is full and rejects new events, or is draining
+	enqueue(job forwardJob) bool
+	// drain stops accepting events and waits for the workers
+	drain()
+	depth() queueDepth
+}
+
+// queueDepth is the backlog of the queue as reported by /health and /stats/filters
+type queueDepth struct {
+	Depth int `json:"depth"`
+	// OldestAgeSeconds is how long the oldest queued event has waited, 0 when the queue is empty
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+// forwardQueue is the in-memory eventQueue. Queued events are lost on restart
+type forwardQueue struct {
+	// shards has a queue per worker when events are ordered by key, so the events of a key are forwarded by the same
+	// worker in arrival order. Otherwise all workers share a single queue
+	shards  []chan forwardJob
+	orderBy string
+	// next spreads the events without an order key over the shards
+	next int
+	// dropOldest makes room for new events when the queue is full instead of rejecting them
+	dropOldest bool
+	workers    sync.WaitGroup
+	mutex      sync.Mutex
+	closed     bool
+	// queuedAt holds when the jobs of each shard were queued, oldest first
+	queuedAt [][]time.Time
+	// coalesce skips queued jobs a newer job of the same coalesceKey was queued after, latest holding the sequence of
+	// the newest job of each key
+	coalesce bool
+	latest   map[string]uint64
+	sequence uint64
+}
+
+// Order keys of ASYNC_ORDER_BY, whose queued events are forwarded one at a time in arrival order
+const (
+	orderByRepo        = "repo"
+	orderByRepoPackage = "repo_package"
+)
+
+// orderKey returns the key of the event whose forwards are kept in order, empty when events aren't ordered or the
+// payload has no repository
+func orderKey(orderBy string, body []byte) string {
+	if orderBy == "" {
+		return ""
+	}
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		Package struct {
+			Name string `json:"name"`
+		} `json:"package"`
+	}
+	json.Unmarshal(body, &payload)
+	if payload.Repository.FullName == "" || orderBy == orderByRepo {
+		return payload.Repository.FullName
+	}
+	return payload.Repository.FullName + "/" + payload.Package.Name
+}
+
+// forwardJob is an event accepted for forwarding with the configuration that accepted it
+type forwardJob struct {
+	request      *http.Request
+	filters      *filterConfig
+	destinations []relayDestination
+	body         []byte
+	summary      string
+	// coalesceKey and sequence let the in-memory queue skip jobs superseded by a newer job of their key
+	coalesceKey string
+	sequence    uint64
+}
+
+var asyncForwards eventQueue
+
+// coalesceKey identifies the queued events of a package version that only the latest of is forwarded with
+// QUEUE_COALESCE. Empty for other events, which are never coalesced
+func coalesceKey(header http.Header, body []byte) string {
+	if canonicalEventType(header.Get("X-GitHub-Event")) != "package" {
+		return ""
+	}
+	var event PackageEvent
+	if json.Unmarshal(body, &event) != nil || event.Package.Name == "" {
+		return ""
+	}
+	version := event.containerTag()
+	if version == "" {
+		version = event.version()
+	}
+	key := fmt.Sprintf("%s/%s:%s", event.Repository.FullName, event.Package.Name, version)
+	if event.Action == "deleted" || event.Action == "restored" {
+		// a delete or restore never replaces the publish of the same version
+		key += " " + event.Action
+	}
+	return key
+}
+
+// newForwardQueue starts the worker pool configured by ASYNC_WORKERS, ASYNC_QUEUE_SIZE, ASYNC_OVERFLOW,
+// ASYNC_ORDER_BY and QUEUE_COALESCE, on the persistent queue in QUEUE_FILE when set
+func newForwardQueue() (eventQueue, error) {
+	workers, size := 4, 100
+	for envName, setting := range map[string]*int{"ASYNC_WORKERS": &workers, "ASYNC_QUEUE_SIZE": &size} {
+		if value := os.Getenv(envName); value != "" {
+			var err error
+			if *setting, err = strconv.Atoi(value); err != nil || *setting < 1 {
+				return nil, fmt.Errorf("%s must be a positive number, got %q", envName, value)
+			}
+		}
+	}
+	dropOldest := false
+	switch overflow := os.Getenv("ASYNC_OVERFLOW"); overflow {
+	case "", "reject":
+	case "drop_oldest":
+		dropOldest = true
+	default:
+		return nil, fmt.Errorf("ASYNC_OVERFLOW must be reject or drop_oldest, got %q", overflow)
+	}
+	orderBy := os.Getenv("ASYNC_ORDER_BY")
+	switch orderBy {
+	case "", orderByRepo, orderByRepoPackage:
+	default:
+		return nil, fmt.Errorf("ASYNC_ORDER_BY must be repo or repo_package, got %q", orderBy)
+	}
+	coalesce, err := lookupBool("QUEUE_COALESCE", false)
+	if err != nil {
+		return nil, err
+	}
+	if fileName := os.Getenv("QUEUE_FILE"); fileName != "" {
+		return newPersistentQueue(fileName, workers, size, dropOldest, orderBy, coalesce)
+	}
+	queue := &forwardQueue{shards: []chan forwardJob{make(chan forwardJob, size)}, orderBy: orderBy, dropOldest: dropOldest, coalesce: coalesce, latest: map[string]uint64{}}
+	if orderBy != "" {
+		// the shards share the queue size
+		queue.shards = make([]chan forwardJob, workers)
+		for index := range queue.shards {
+			queue.shards[index] = make(chan forwardJob, (size+workers-1)/workers)
+		}
+	}
+	queue.queuedAt = make([][]time.Time, len(queue.shards))
+	for index := range workers {
+		queue.workers.Add(1)
+		go queue.work(index % len(queue.shards))
+	}
+	return queue, nil
+}
+
+func (queue *forwardQueue) enqueue(job forwardJob) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return false
+	}
+	shard := queue.shardFor(orderKey(queue.orderBy, job.body))
+	jobs := queue.shards[shard]
+	if queue.coalesce {
+		queue.sequence++
+		job.coalesceKey, job.sequence = coalesceKey(job.request.Header, job.body), queue.sequence
+	}
+	for {
+		select {
+		case jobs <- job:
+			queue.queuedAt[shard] = append(queue.queuedAt[shard], time.Now())
+			if job.coalesceKey != "" {
+				queue.latest[job.coalesceKey] = job.sequence
+			}
+			return true
+		default:
+		}
+		if !queue.dropOldest {
+			return false
+		}
+		select {
+		case dropped := <-jobs:
+			queue.queuedAt[shard] = queue.queuedAt[shard][1:]
+			log.Printf("Forward queue full, dropped %s", dropped.summary)
+			if dropped.coalesceKey != "" && queue.latest[dropped.coalesceKey] == dropped.sequence {
+				delete(queue.latest, dropped.coalesceKey)
+			}
+			for _, destination := range dropped.destinations {
+				dropped.filters.deadLetters.add(dropped.request, destination, dropped.body, fmt.Errorf("dropped from full forward queue"))
+			}
+		default:
+		}
+	}
+}
+
+// shardFor returns the index of the shard queueing the events of the key. Callers hold the mutex
+func (queue *forwardQueue) shardFor(key string) int {
+	if len(queue.shards) == 1 {
+		return 0
+	}
+	if key == "" {
+		queue.next = (queue.next + 1) % len(queue.shards)
+		return queue.next
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(queue.shards)))
+}
+
+func (queue *forwardQueue) work(shard int) {
+	defer queue.workers.Done()
+	for job := range queue.shards[shard] {
+		queue.mutex.Lock()
+		if len(queue.queuedAt[shard]) > 0 {
+			queue.queuedAt[shard] = queue.queuedAt[shard][1:]
+		}
+		coalesced := false
+		if job.coalesceKey != "" {
+			if coalesced = queue.latest[job.coalesceKey] != job.sequence; !coalesced {
+				delete(queue.latest, job.coalesceKey)
+			}
+		}
+		queue.mutex.Unlock()
+		if coalesced {
+			log.Printf("Coalesced %s into a newer queued event of %s", job.summary, job.coalesceKey)
+			deliveryLog.replace(job.request.Header.Get("X-GitHub-Delivery"), deliveryCoalesced)
+			continue
+		}
+		forwarded := true
+		for _, destination := range job.destinations {
+			if _, err := job.filters.retry.send(job.request.Context(), job.request, destination, job.body); err != nil {
+				log.Printf("Failed to forward %s to %s from the queue: %v", job.summary, destination.url, err)
+				job.filters.deadLetters.add(job.request, destination, job.body, err)
+				forwarded = false
+				continue
+			}
+			log.Printf("Forwarded %s to %s from the queue", job.summary, destination.url)
+		}
+		deliveryLog.finish(job.request.Header.Get("X-GitHub-Delivery"), forwarded)
+	}
+}
+
+// drain waits until the workers forwarded every queued event
+func (queue *forwardQueue) drain() {
+	queue.mutex.Lock()
+	queue.closed = true
+	queued := 0
+	for _, jobs := range queue.shards {
+		close(jobs)
+		queued += len(jobs)
+	}
+	queue.mutex.Unlock()
+	log.Printf("Draining %d queued forwards", queued)
+	queue.workers.Wait()
+}
+
+func (queue *forwardQueue) depth() queueDepth {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	depth := queueDepth{}
+	for _, queuedAt := range queue.queuedAt {
+		depth.Depth += len(queuedAt)
+		if len(queuedAt) > 0 {
+			depth.OldestAgeSeconds = max(depth.OldestAgeSeconds, time.Since(queuedAt[0]).Seconds())
+		}
+	}
+	return depth
+}
+
+// forwardAsync queues the event for the worker pool, responding 202 or 503 when the queue is full
+func forwardAsync(responseWriter http.ResponseWriter, request *http.Request, filters *filterConfig, destinations []relayDestination, requestBody []byte, summary string) bool {
+	job := forwardJob{request: request.Clone(context.WithoutCancel(request.Context())), filters: filters, destinations: destinations, body: requestBody, summary: summary}
+	if !asyncForwards.enqueue(job) {
+		responseWriter.Header().Set("Retry-After", "1")
+		respondError(responseWriter, reasonQueueFull, fmt.Sprintf("%s was not queued, the forward queue is full", summary), http.StatusServiceUnavailable)
+		return false
+	}
+	responseWriter.Header().Set("X-Filter-Reason", reasonForwardAccepted)
+	responseWriter.WriteHeader(http.StatusAccepted)
+	responseWriter.Write([]byte(fmt.Sprintf("%s passed the filter on Github Webhook Filter server hosted at onrender.com. Queued for forwarding to relay.", summary)))
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderingRelay keeps the sequence numbers of the forwards of each repository in arrival order, and the most forwards
+// it handled at once, for all repositories and for a single one
+type orderingRelay struct {
+	*httptest.Server
+	mutex           sync.Mutex
+	sequences       map[string][]int
+	inFlight        map[string]int
+	maxInFlight     int
+	maxRepoInFlight int
+}
+
+func newOrderingRelay(t *testing.T, delay time.Duration) *orderingRelay {
+	relay := &orderingRelay{sequences: map[string][]int{}, inFlight: map[string]int{}}
+	relay.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload struct {
+			Sequence   int `json:"sequence"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		}
+		json.Unmarshal(body, &payload)
+		repo := payload.Repository.FullName
+		relay.mutex.Lock()
+		relay.sequences[repo] = append(relay.sequences[repo], payload.Sequence)
+		relay.inFlight[repo]++
+		total := 0
+		for _, count := range relay.inFlight {
+			total += count
+		}
+		relay.maxInFlight = max(relay.maxInFlight, total)
+		relay.maxRepoInFlight = max(relay.maxRepoInFlight, relay.inFlight[repo])
+		relay.mutex.Unlock()
+		time.Sleep(delay)
+		relay.mutex.Lock()
+		relay.inFlight[repo]--
+		relay.mutex.Unlock()
+	}))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// newOrderedQueue starts an in-memory forward queue with 4 workers ordering events by the key
+func newOrderedQueue(t *testing.T, orderBy string) *forwardQueue {
+	t.Setenv("ASYNC_WORKERS", "4")
+	t.Setenv("ASYNC_ORDER_BY", orderBy)
+	queue, err := newForwardQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue.(*forwardQueue)
+}
+
+// distinctShardRepos returns repositories whose events are queued on different shards
+func distinctShardRepos(queue *forwardQueue, count int) []string {
+	var repos []string
+	var shards []int
+	for index := 0; len(repos) < count; index++ {
+		repo := fmt.Sprintf("acme/repo-%d", index)
+		if shard := queue.shardFor(repo); !slices.Contains(shards, shard) {
+			repos, shards = append(repos, repo), append(shards, shard)
+		}
+	}
+	return repos
+}
+
+func enqueueOrdered(t *testing.T, queue *forwardQueue, filters *filterConfig, relayURL string, repo string, sequence int) {
+	t.Helper()
+	body := fmt.Sprintf(`{"sequence":%d,"repository":{"full_name":"%s"},"package":{"name":"app"}}`, sequence, repo)
+	job := forwardJob{request: newDelivery("package", body), filters: filters, destinations: newRelayDestinations([]string{relayURL}), body: []byte(body), summary: repo}
+	if !queue.enqueue(job) {
+		t.Fatalf("queue rejected %s #%d", repo, sequence)
+	}
+}
+
+func TestForwardQueueOrderWithinKey(t *testing.T) {
+	relay := newOrderingRelay(t, 5*time.Millisecond)
+	queue := newOrderedQueue(t, orderByRepo)
+	filters := loadTestFilters(t, nil)
+	repos := []string{"acme/api", "acme/web"}
+	for sequence := range 20 {
+		for _, repo := range repos {
+			enqueueOrdered(t, queue, filters, relay.URL, repo, sequence)
+		}
+	}
+	queue.drain()
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for _, repo := range repos {
+		if sequences := relay.sequences[repo]; len(sequences) != 20 || !slices.IsSorted(sequences) {
+			t.Errorf("%s forwarded in order %v, want 0 to 19", repo, sequences)
+		}
+	}
+	if relay.maxRepoInFlight != 1 {
+		t.Errorf("up to %d forwards of a repository at once, want 1", relay.maxRepoInFlight)
+	}
+}
+
+func TestForwardQueueConcurrencyAcrossKeys(t *testing.T) {
+	relay := newOrderingRelay(t, 100*time.Millisecond)
+	queue := newOrderedQueue(t, orderByRepo)
+	filters := loadTestFilters(t, nil)
+	repos := distinctShardRepos(queue, 4)
+	started := time.Now()
+	for _, repo := range repos {
+		enqueueOrdered(t, queue, filters, relay.URL, repo, 0)
+	}
+	queue.drain()
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if relay.maxInFlight != len(repos) {
+		t.Errorf("up to %d forwards at once, want the %d repositories in parallel", relay.maxInFlight, len(repos))
+	}
+	if elapsed := time.Since(started); elapsed > 300*time.Millisecond {
+		t.Errorf("forwarding %d repositories took %s, want about 100ms", len(repos), elapsed)
+	}
+}
+
+func TestOrderKey(t *testing.T) {
+	const body = `{"repository":{"full_name":"acme/app"},"package":{"name":"api"}}`
+	tests := []struct {
+		orderBy string
+		body    string
+		wantKey string
+	}{
+		{orderBy: "", body: body, wantKey: ""},
+		{orderBy: orderByRepo, body: body, wantKey: "acme/app"},
+		{orderBy: orderByRepoPackage, body: body, wantKey: "acme/app/api"},
+		{orderBy: orderByRepoPackage, body: `{"repository":{"full_name":"acme/app"}}`, wantKey: "acme/app/"},
+		{orderBy: orderByRepo, body: `{"package":{"name":"api"}}`, wantKey: ""},
+		{orderBy: orderByRepoPackage, body: `not json`, wantKey: ""},
+	}
+	for _, test := range tests {
+		if key := orderKey(test.orderBy, []byte(test.body)); key != test.wantKey {
+			t.Errorf("orderKey(%q, %s) = %q, want %q", test.orderBy, test.body, key, test.wantKey)
+		}
+	}
+}
+
+func TestNewForwardQueueInvalidOrderBy(t *testing.T) {
+	t.Setenv("ASYNC_ORDER_BY", "package")
+	if _, err := newForwardQueue(); err == nil {
+		t.Fatal("expected an error for an unknown order key")
+	}
+}
+
+func TestForwardQueueDepthPerKey(t *testing.T) {
+	// the relay holds the forwards of the blocked repository until released, the others answer at once
+	queue := newOrderedQueue(t, orderByRepo)
+	repos := distinctShardRepos(queue, 2)
+	blocked, flowing := repos[0], repos[1]
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	forwarded := make(chan string, 10)
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if repo := orderKey(orderByRepo, body); repo == blocked {
+			started <- struct{}{}
+			<-release
+		} else {
+			forwarded <- repo
+		}
+	}))
+	t.Cleanup(relay.Close)
+	filters := loadTestFilters(t, nil)
+
+	enqueueOrdered(t, queue, filters, relay.URL, blocked, 0)
+	<-started
+	enqueueOrdered(t, queue, filters, relay.URL, blocked, 1)
+	time.Sleep(50 * time.Millisecond)
+	// forwarded at once by its own worker, without taking the place of the blocked events
+	enqueueOrdered(t, queue, filters, relay.URL, flowing, 0)
+	<-forwarded
+
+	depth := queue.depth()
+	if depth.Depth != 1 {
+		t.Errorf("depth = %d, want the event queued behind the blocked forward", depth.Depth)
+	}
+	if depth.OldestAgeSeconds < 0.05 {
+		t.Errorf("oldest age = %.3fs, want the age of the blocked event, at least 50ms", depth.OldestAgeSeconds)
+	}
+	close(release)
+	queue.drain()
+	if depth := queue.depth(); depth.Depth != 0 || depth.OldestAgeSeconds != 0 {
+		t.Errorf("depth after draining = %+v, want empty", depth)
+	}
+}
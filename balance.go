@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Strategies picking the relay URL of a balanced forward
+const (
+	balanceWeighted   = "weighted"
+	balanceRoundRobin = "round_robin"
+	balanceRepository = "repository"
+)
+
+// balanceEndpoint is a relay URL of a balanced destination with its share of the forwards
+type balanceEndpoint struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// relayBalance spreads the forwards to a destination across several relay URLs, each forward going to a single one.
+// It is kept with the forwards in the forward queue and the dead-letter queue
+type relayBalance struct {
+	Strategy  string            `json:"strategy"`
+	Endpoints []balanceEndpoint `json:"endpoints"`
+}
+
+type relayBalancers struct {
+	mutex sync.Mutex
+	// next counts the round-robin forwards of each balanced destination, keyed by its relay URLs
+	next map[string]uint64
+	// picked counts the forwards each relay URL was picked for
+	picked map[string]int64
+}
+
+var balancers = &relayBalancers{next: map[string]uint64{}, picked: map[string]int64{}}
+
+// parseBalanceStrategy returns the strategy, weighted when empty
+func parseBalanceStrategy(strategy string) (string, error) {
+	switch strategy {
+	case "":
+		return balanceWeighted, nil
+	case balanceWeighted, balanceRoundRobin, balanceRepository:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("balance must be weighted, round_robin or repository, got %q", strategy)
+}
+
+// newRelayBalance balances the relay URLs with the strategy. The weights follow the order of the URLs, every URL
+// weighs 1 without weights
+func newRelayBalance(strategy string, relayURLs []string, weights []int) (*relayBalance, error) {
+	if len(weights) > 0 && len(weights) != len(relayURLs) {
+		return nil, fmt.Errorf("expected a weight for each of the %d balanced URLs, got %d", len(relayURLs), len(weights))
+	}
+	balance := &relayBalance{Strategy: strategy}
+	for index, relayURL := range relayURLs {
+		if isTemplatedRelayURL(relayURL) {
+			return nil, fmt.Errorf("balanced URL %s can't hold placeholders", relayURL)
+		}
+		endpoint := balanceEndpoint{URL: relayURL, Weight: 1}
+		if len(weights) > 0 {
+			if endpoint.Weight = weights[index]; endpoint.Weight < 1 {
+				return nil, fmt.Errorf("weight of %s must be a positive number, got %d", relayURL, endpoint.Weight)
+			}
+		}
+		balance.Endpoints = append(balance.Endpoints, endpoint)
+	}
+	return balance, nil
+}
+
+// balanceRelayURLs returns the destinations of the relay URLs as a single destination balanced across them with
+// RELAY_BALANCE, or as they are when the relay URLs aren't balanced
+func (filters *filterConfig) balanceRelayURLs(destinations []relayDestination) []relayDestination {
+	if filters.balanceStrategy == "" {
+		return destinations
+	}
+	// the Redis stream sink gets every forward besides the balanced relay URLs
+	var relayed, streams []relayDestination
+	for _, destination := range destinations {
+		if destination.sink == redisStreamSinkName {
+			streams = append(streams, destination)
+		} else {
+			relayed = append(relayed, destination)
+		}
+	}
+	if len(relayed) < 2 {
+		return destinations
+	}
+	relayURLs := make([]string, len(relayed))
+	for index, destination := range relayed {
+		relayURLs[index] = destination.url
+	}
+	balance, err := newRelayBalance(filters.balanceStrategy, relayURLs, filters.balanceWeights)
+	if err != nil {
+		// checked when the configuration is loaded
+		return destinations
+	}
+	balanced := relayed[0]
+	balanced.balance = balance
+	return append([]relayDestination{balanced}, streams...)
+}
+
+// pick returns the relay URL of a forward, among those whose circuit isn't open unless all of them are. Forwards of
+// the same repository go to the same relay URL with the repository strategy, and keep going to it while it is up
+func (balancers *relayBalancers) pick(balance *relayBalance, breaker breakerPolicy, header http.Header, body []byte) string {
+	var candidates []balanceEndpoint
+	for _, endpoint := range balance.Endpoints {
+		if !circuitBreakers.isOpen(endpoint.URL, breaker) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = balance.Endpoints
+	}
+	total := 0
+	for _, endpoint := range candidates {
+		total += endpoint.Weight
+	}
+	balancers.mutex.Lock()
+	defer balancers.mutex.Unlock()
+	var picked string
+	switch balance.Strategy {
+	case balanceRepository:
+		picked = rendezvous(candidates, repositoryKey(header, body))
+	case balanceRoundRobin:
+		key := balance.key()
+		picked = weightedAt(candidates, int(balancers.next[key]%uint64(total)))
+		balancers.next[key]++
+	default:
+		picked = weightedAt(candidates, rand.N(total))
+	}
+	balancers.picked[picked]++
+	return picked
+}
+
+// key identifies the balanced destination by its relay URLs
+func (balance *relayBalance) key() string {
+	relayURLs := make([]string, len(balance.Endpoints))
+	for index, endpoint := range balance.Endpoints {
+		relayURLs[index] = endpoint.URL
+	}
+	return strings.Join(relayURLs, ",")
+}
+
+// weightedAt returns the relay URL at the position among the endpoints, each taking as many positions as its weight
+func weightedAt(endpoints []balanceEndpoint, position int) string {
+	for _, endpoint := range endpoints {
+		if position < endpoint.Weight {
+			return endpoint.URL
+		}
+		position -= endpoint.Weight
+	}
+	return endpoints[len(endpoints)-1].URL
+}
+
+// rendezvous returns the relay URL with the highest weighted score for the key. Only the keys of a relay URL going
+// down or coming back move, to or from it
+func rendezvous(endpoints []balanceEndpoint, key string) string {
+	picked, best := "", math.Inf(-1)
+	for _, endpoint := range endpoints {
+		hash := fnv.New64a()
+		hash.Write([]byte(key + "\x00" + endpoint.URL))
+		unit := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -float64(endpoint.Weight) / math.Log(unit); score > best {
+			picked, best = endpoint.URL, score
+		}
+	}
+	return picked
+}
+
+// repositoryKey is the repository of the forwarded event, or its delivery ID for events without one
+func repositoryKey(header http.Header, body []byte) string {
+	template, _ := parseFieldTemplate("{repository}")
+	if repository, err := template.render(header, body, func(value string) string { return value }); err == nil && repository != "" {
+		return repository
+	}
+	return header.Get("X-GitHub-Delivery")
+}
+
+func (balancers *relayBalancers) counts() map[string]int64 {
+	balancers.mutex.Lock()
+	defer balancers.mutex.Unlock()
+	counts := map[string]int64{}
+	for relayURL, picked := range balancers.picked {
+		counts[redactURL(relayURL)] = picked
+	}
+	return counts
+}
+
+// sendBalanced forwards to one of the relay URLs of the destination, retrying on the picked URL. The reply names the
+// URL that served the forward
+func (policy retryPolicy) sendBalanced(ctx context.Context, request *http.Request, destination relayDestination, requestBody []byte) (relayReply, error) {
+	target := destination
+	target.balance = nil
+	target.url = balancers.pick(destination.balance, policy.breaker, request.Header, requestBody)
+	reply, err := policy.send(ctx, request, target, requestBody)
+	if err == nil && reply.servedBy == "" {
+		reply.servedBy = target.url
+	}
+	return reply, err
+}
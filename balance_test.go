@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+var testBreaker = breakerPolicy{threshold: 1, cooldown: time.Minute}
+
+// newTestBalance balances relay URLs only used by the test, one per weight, forgetting their circuits and counts at
+// the end of the test
+func newTestBalance(t *testing.T, strategy string, weights ...int) *relayBalance {
+	t.Helper()
+	relayURLs := make([]string, len(weights))
+	for index := range weights {
+		relayURLs[index] = fmt.Sprintf("https://relay-%d.example.com/%s", index, t.Name())
+	}
+	balance, err := newRelayBalance(strategy, relayURLs, weights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		circuitBreakers.mutex.Lock()
+		balancers.mutex.Lock()
+		defer circuitBreakers.mutex.Unlock()
+		defer balancers.mutex.Unlock()
+		for _, relayURL := range relayURLs {
+			delete(circuitBreakers.breakers, relayURL)
+			delete(balancers.picked, relayURL)
+		}
+		delete(balancers.next, balance.key())
+	})
+	return balance
+}
+
+// pickRepository picks the relay URL of an event of the repository
+func pickRepository(balance *relayBalance, repository string) string {
+	header := http.Header{"X-Github-Delivery": {"delivery-" + repository}}
+	return balancers.pick(balance, testBreaker, header, []byte(`{"repository":{"full_name":"`+repository+`"}}`))
+}
+
+// pickCounts counts the relay URLs of picks forwards
+func pickCounts(balance *relayBalance, picks int) map[string]int {
+	counts := map[string]int{}
+	for index := range picks {
+		counts[pickRepository(balance, fmt.Sprintf("octo-org/repo-%d", index))]++
+	}
+	return counts
+}
+
+func TestNewRelayBalance(t *testing.T) {
+	tests := []struct {
+		name      string
+		relayURLs []string
+		weights   []int
+		wantErr   string
+	}{
+		{name: "weights default to 1", relayURLs: []string{"https://a.example.com", "https://b.example.com"}},
+		{name: "weights", relayURLs: []string{"https://a.example.com", "https://b.example.com"}, weights: []int{1, 3}},
+		{name: "missing weight", relayURLs: []string{"https://a.example.com", "https://b.example.com"}, weights: []int{1}, wantErr: "expected a weight for each"},
+		{name: "zero weight", relayURLs: []string{"https://a.example.com", "https://b.example.com"}, weights: []int{1, 0}, wantErr: "must be a positive number"},
+		{name: "templated URL", relayURLs: []string{"https://a.example.com/{repository}", "https://b.example.com"}, wantErr: "can't hold placeholders"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			balance, err := newRelayBalance(balanceWeighted, test.relayURLs, test.weights)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for index, endpoint := range balance.Endpoints {
+				want := 1
+				if test.weights != nil {
+					want = test.weights[index]
+				}
+				if endpoint.URL != test.relayURLs[index] || endpoint.Weight != want {
+					t.Errorf("endpoint %d = %+v, want %s weighing %d", index, endpoint, test.relayURLs[index], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	balance := newTestBalance(t, balanceWeighted, 1, 3)
+	const picks = 10000
+	counts := pickCounts(balance, picks)
+	// the share of the heavier endpoint is 3/4, its standard deviation over the picks under 0.5%
+	if share := float64(counts[balance.Endpoints[1].URL]) / picks; share < 0.72 || share > 0.78 {
+		t.Errorf("expected about 75%% of the forwards to the endpoint weighing 3, got %.1f%%: %v", share*100, counts)
+	}
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	balance := newTestBalance(t, balanceRoundRobin, 1, 2)
+	first, second := balance.Endpoints[0].URL, balance.Endpoints[1].URL
+	want := []string{first, second, second, first, second, second}
+	for index, wantURL := range want {
+		if picked := pickRepository(balance, "octo-org/app"); picked != wantURL {
+			t.Errorf("pick %d = %s, want %s", index, picked, wantURL)
+		}
+	}
+}
+
+func TestBalanceRepositorySticky(t *testing.T) {
+	balance := newTestBalance(t, balanceRepository, 1, 1, 1)
+	picked := map[string]string{}
+	for index := range 50 {
+		repository := fmt.Sprintf("octo-org/repo-%d", index)
+		picked[repository] = pickRepository(balance, repository)
+		for range 3 {
+			if again := pickRepository(balance, repository); again != picked[repository] {
+				t.Fatalf("%s went to %s then %s", repository, picked[repository], again)
+			}
+		}
+	}
+	used := map[string]bool{}
+	for _, relayURL := range picked {
+		used[relayURL] = true
+	}
+	if len(used) != len(balance.Endpoints) {
+		t.Errorf("expected the repositories spread across the %d endpoints, got %d", len(balance.Endpoints), len(used))
+	}
+
+	// only the repositories of an endpoint going down move, and they come back with it
+	down := balance.Endpoints[0].URL
+	circuitBreakers.record(down, testBreaker, false)
+	for repository, relayURL := range picked {
+		moved := pickRepository(balance, repository)
+		if relayURL == down && moved == down {
+			t.Errorf("%s kept going to %s while its circuit is open", repository, down)
+		}
+		if relayURL != down && moved != relayURL {
+			t.Errorf("%s moved from %s to %s though its endpoint is up", repository, relayURL, moved)
+		}
+	}
+	circuitBreakers.record(down, testBreaker, true)
+	for repository, relayURL := range picked {
+		if back := pickRepository(balance, repository); back != relayURL {
+			t.Errorf("%s went to %s once %s was back, want %s", repository, back, down, relayURL)
+		}
+	}
+}
+
+func TestRepositoryKey(t *testing.T) {
+	header := http.Header{"X-Github-Delivery": {"delivery-1"}}
+	if key := repositoryKey(header, []byte(`{"repository":{"full_name":"octo-org/app"}}`)); key != "octo-org/app" {
+		t.Errorf("key = %q, want octo-org/app", key)
+	}
+	if key := repositoryKey(header, []byte(`{"zen":"Keep it logically awesome."}`)); key != "delivery-1" {
+		t.Errorf("key of an event without repository = %q, want its delivery ID", key)
+	}
+}
+
+func TestBalanceSkipsOpenCircuits(t *testing.T) {
+	for _, strategy := range []string{balanceWeighted, balanceRoundRobin, balanceRepository} {
+		t.Run(strategy, func(t *testing.T) {
+			balance := newTestBalance(t, strategy, 1, 1, 1)
+			synctest.Test(t, func(t *testing.T) {
+				down := balance.Endpoints[1].URL
+				circuitBreakers.record(down, testBreaker, false)
+				if counts := pickCounts(balance, 300); counts[down] != 0 {
+					t.Errorf("expected no forward to %s while its circuit is open, got %v", down, counts)
+				}
+
+				// half-open once the cooldown is over, the endpoint is picked again
+				time.Sleep(testBreaker.cooldown)
+				if counts := pickCounts(balance, 300); counts[down] == 0 {
+					t.Errorf("expected forwards to %s after the cooldown, got %v", down, counts)
+				}
+			})
+		})
+	}
+}
+
+func TestBalanceSkipsProbedCircuit(t *testing.T) {
+	balance := newTestBalance(t, balanceRoundRobin, 1, 1)
+	synctest.Test(t, func(t *testing.T) {
+		probed := balance.Endpoints[0].URL
+		circuitBreakers.record(probed, testBreaker, false)
+		time.Sleep(testBreaker.cooldown)
+		if !circuitBreakers.allow(probed, testBreaker) {
+			t.Fatal("expected a probe to be let through after the cooldown")
+		}
+		if counts := pickCounts(balance, 10); counts[probed] != 0 {
+			t.Errorf("expected no forward to %s while its probe is in flight, got %v", probed, counts)
+		}
+	})
+}
+
+func TestBalanceAllCircuitsOpen(t *testing.T) {
+	balance := newTestBalance(t, balanceRoundRobin, 1, 1)
+	for _, endpoint := range balance.Endpoints {
+		circuitBreakers.record(endpoint.URL, testBreaker, false)
+	}
+	counts := pickCounts(balance, 10)
+	for _, endpoint := range balance.Endpoints {
+		if counts[endpoint.URL] != 5 {
+			t.Errorf("expected every endpoint picked when all circuits are open, got %v", counts)
+		}
+	}
+}
+
+func TestHandlerBalance(t *testing.T) {
+	first, second := newTestRelay(t, http.StatusOK), newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"RELAY_BALANCE": balanceRoundRobin}, first.URL, second.URL)
+	for range 4 {
+		if response := deliver(newDelivery("package", testPackagePayload)); response.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", response.Code, http.StatusOK, response.Body)
+		}
+	}
+	if len(first.forwards()) != 2 || len(second.forwards()) != 2 {
+		t.Errorf("expected each relay to get 2 of the 4 forwards, got %d and %d", len(first.forwards()), len(second.forwards()))
+	}
+}
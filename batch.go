@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// batchEnvelope is one event of a batch forward. Batches are POSTed as a JSON array of envelopes, oldest first
+type batchEnvelope struct {
+	// Headers holds the inbound headers selected by FORWARD_HEADERS
+	Headers map[string]string `json:"headers"`
+	// Body is the forwarded payload, or the body template rendered for the destination, as a JSON string when it isn't
+	// valid JSON
+	Body json.RawMessage `json:"body"`
+}
+
+// eventBatch accumulates the events for one destination until it holds BATCH_SIZE events or BATCH_INTERVAL passed
+type eventBatch struct {
+	destination relayDestination
+	filters     *filterConfig
+	envelopes   []batchEnvelope
+	timer       *time.Timer
+}
+
+type eventBatches struct {
+	mutex   sync.Mutex
+	batches map[string]*eventBatch
+	// flushing counts the flushes in progress, waited for on shutdown
+	flushing sync.WaitGroup
+}
+
+var pendingBatches = &eventBatches{batches: map[string]*eventBatch{}}
+
+// forwardBatched adds the event to the batch of every destination and responds 202. The envelope holds the body
+// rendered for the destination when it has a body template, the batch itself is forwarded as it is
+func forwardBatched(responseWriter http.ResponseWriter, request *http.Request, filters *filterConfig, destinations []relayDestination, requestBody []byte, summary string) bool {
+	headers := map[string]string{}
+	selected := http.Header{}
+	copyForwardHeaders(selected, request.Header, filters.retry.headers)
+	for key := range selected {
+		headers[key] = selected.Get(key)
+	}
+	for _, destination := range destinations {
+		body := requestBody
+		if destination.body != nil {
+			body, destination.body = destination.body, nil
+		}
+		pendingBatches.add(destination, filters, newBatchEnvelope(headers, body))
+	}
+	responseWriter.Header().Set("X-Filter-Reason", reasonForwardAccepted)
+	responseWriter.WriteHeader(http.StatusAccepted)
+	responseWriter.Write([]byte(fmt.Sprintf("%s passed the filter on Github Webhook Filter server hosted at onrender.com. Batched for forwarding to relay.", summary)))
+	return true
+}
+
+// newBatchEnvelope wraps the body, as a JSON string when it isn't valid JSON
+func newBatchEnvelope(headers map[string]string, body []byte) batchEnvelope {
+	envelope := batchEnvelope{Headers: headers, Body: body}
+	if !json.Valid(body) {
+		envelope.Body, _ = json.Marshal(string(body))
+	}
+	return envelope
+}
+
+func (batches *eventBatches) add(destination relayDestination, filters *filterConfig, envelope batchEnvelope) {
+	batches.mutex.Lock()
+	defer batches.mutex.Unlock()
+	batch, found := batches.batches[destination.url]
+	if !found {
+		batch = &eventBatch{destination: destination}
+		batches.batches[destination.url] = batch
+		batch.timer = time.AfterFunc(filters.batchInterval, func() { batches.flush(destination.url) })
+	}
+	batch.filters = filters
+	batch.envelopes = append(batch.envelopes, envelope)
+	if len(batch.envelopes) >= filters.batchSize {
+		batch.timer.Stop()
+		delete(batches.batches, destination.url)
+		batches.flushing.Add(1)
+		go batches.send(batch)
+	}
+}
+
+// flush sends the batch of the relay URL when it still holds events
+func (batches *eventBatches) flush(relayURL string) {
+	batches.mutex.Lock()
+	batch, found := batches.batches[relayURL]
+	if found {
+		delete(batches.batches, relayURL)
+		batches.flushing.Add(1)
+	}
+	batches.mutex.Unlock()
+	if found {
+		batches.send(batch)
+	}
+}
+
+// flushAll sends every pending batch and waits for the flushes in progress, on shutdown
+func (batches *eventBatches) flushAll() {
+	batches.mutex.Lock()
+	var relayURLs []string
+	for relayURL, batch := range batches.batches {
+		batch.timer.Stop()
+		relayURLs = append(relayURLs, relayURL)
+	}
+	batches.mutex.Unlock()
+	for _, relayURL := range relayURLs {
+		batches.flush(relayURL)
+	}
+	batches.flushing.Wait()
+}
+
+func (batches *eventBatches) send(batch *eventBatch) {
+	defer batches.flushing.Done()
+	body, _ := json.Marshal(batch.envelopes)
+	request, _ := http.NewRequest("POST", "/", nil)
+	destination := batch.destination
+	destination.headers = maps.Clone(destination.headers)
+	if destination.headers == nil {
+		destination.headers = map[string]string{}
+	}
+	destination.headers["X-Filter-Batch-Size"] = strconv.Itoa(len(batch.envelopes))
+	_, err := batch.filters.retry.send(request.Context(), request, destination, body)
+	for _, envelope := range batch.envelopes {
+		deliveryLog.finish(envelope.Headers["X-Github-Delivery"], err == nil)
+	}
+	if err != nil {
+		log.Printf("Failed to forward batch of %d events to %s: %v", len(batch.envelopes), batch.destination.url, err)
+		batch.filters.deadLetters.add(request, destination, body, err)
+		return
+	}
+	log.Printf("Forwarded batch of %d events to %s", len(batch.envelopes), batch.destination.url)
+}
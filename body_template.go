@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// bodyTemplate is a text/template rendering the forwarded body from the payload, e.g.
+// {"image": {{ json .package.package_version.package_url }}, "source": "github"}
+type bodyTemplate struct {
+	source   string
+	template *template.Template
+}
+
+// parseBodyTemplate parses the template with the sprig functions, json to encode a value and header to read an
+// inbound header
+func parseBodyTemplate(source string) (*bodyTemplate, error) {
+	functions := sprig.TxtFuncMap()
+	functions["json"] = func(value any) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}
+	// header is replaced with the inbound headers when rendering
+	functions["header"] = func(string) string { return "" }
+	parsed, err := template.New("body").Funcs(functions).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return &bodyTemplate{source: source, template: parsed}, nil
+}
+
+// render executes the template on the decoded payload
+func (body *bodyTemplate) render(header http.Header, payload []byte) ([]byte, error) {
+	var data any
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("payload is not JSON: %w", err)
+	}
+	bound, err := body.template.Clone()
+	if err != nil {
+		return nil, err
+	}
+	bound.Funcs(template.FuncMap{"header": header.Get})
+	var rendered bytes.Buffer
+	if err := bound.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// renderBodies returns the destinations with their body rendered from the payload, with their own template or else
+// the fallback. Destinations without either forward the payload
+func renderBodies(destinations []relayDestination, fallback *bodyTemplate, header http.Header, payload []byte) ([]relayDestination, error) {
+	rendered := make([]relayDestination, len(destinations))
+	for index, destination := range destinations {
+		rendered[index] = destination
+		if destination.template == nil {
+			rendered[index].template = fallback
+		}
+		if rendered[index].template == nil {
+			continue
+		}
+		var err error
+		if rendered[index].body, err = rendered[index].template.render(header, payload); err != nil {
+			return nil, fmt.Errorf("body template of %s: %w", destination.url, err)
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// breakerPolicy opens the circuit of a relay URL after threshold consecutive failures for cooldown
+type breakerPolicy struct {
+	// threshold is 0 when the circuit breaker is disabled
+	threshold int
+	cooldown  time.Duration
+}
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+var errCircuitOpen = errors.New("Circuit open, relay failed too many times in a row")
+
+// circuitBreaker is the state of one relay URL. While open, forwards fail right away. Once the cooldown passed a single
+// probe is let through, closing the circuit when it succeeds and opening it again when it fails
+type circuitBreaker struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitzero"`
+	probing             bool
+}
+
+type relayBreakers struct {
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+var circuitBreakers = &relayBreakers{breakers: map[string]*circuitBreaker{}}
+
+func (breakers *relayBreakers) breaker(relayURL string) *circuitBreaker {
+	breaker, found := breakers.breakers[relayURL]
+	if !found {
+		breaker = &circuitBreaker{State: circuitClosed}
+		breakers.breakers[relayURL] = breaker
+	}
+	return breaker
+}
+
+// allow reports whether a forward to the relay URL may be sent
+func (breakers *relayBreakers) allow(relayURL string, policy breakerPolicy) bool {
+	if policy.threshold == 0 {
+		return true
+	}
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breaker := breakers.breaker(relayURL)
+	switch breaker.State {
+	case circuitOpen:
+		if time.Since(breaker.OpenedAt) < policy.cooldown {
+			return false
+		}
+		breaker.State = circuitHalfOpen
+		log.Printf("Circuit of %s half-open after %s, sending a probe", relayURL, policy.cooldown)
+		fallthrough
+	case circuitHalfOpen:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+	}
+	return true
+}
+
+// isOpen reports whether forwards to the relay URL fail right away, its circuit being open within the cooldown or
+// half-open with a probe in flight. Unlike allow, it never lets a probe through
+func (breakers *relayBreakers) isOpen(relayURL string, policy breakerPolicy) bool {
+	if policy.threshold == 0 {
+		return false
+	}
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breaker, found := breakers.breakers[relayURL]
+	if !found {
+		return false
+	}
+	return (breaker.State == circuitOpen && time.Since(breaker.OpenedAt) < policy.cooldown) || (breaker.State == circuitHalfOpen && breaker.probing)
+}
+
+// release lets another forward probe the half-open circuit of the relay URL, after allow let through a probe that was
+// never sent
+func (breakers *relayBreakers) release(relayURL string, policy breakerPolicy) {
+	if policy.threshold == 0 {
+		return
+	}
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breakers.breaker(relayURL).probing = false
+}
+
+// record counts the outcome of a forward to the relay URL, opening or closing its circuit
+func (breakers *relayBreakers) record(relayURL string, policy breakerPolicy, succeeded bool) {
+	if policy.threshold == 0 {
+		return
+	}
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	breaker := breakers.breaker(relayURL)
+	breaker.probing = false
+	if succeeded {
+		if breaker.State != circuitClosed {
+			log.Printf("Circuit of %s closed, probe succeeded", relayURL)
+		}
+		breaker.State, breaker.ConsecutiveFailures, breaker.OpenedAt = circuitClosed, 0, time.Time{}
+		return
+	}
+	breaker.ConsecutiveFailures++
+	if breaker.State == circuitHalfOpen || breaker.ConsecutiveFailures >= policy.threshold {
+		if breaker.State != circuitOpen {
+			log.Printf("Circuit of %s opened for %s after %d consecutive failures", relayURL, policy.cooldown, breaker.ConsecutiveFailures)
+		}
+		breaker.State, breaker.OpenedAt = circuitOpen, time.Now()
+	}
+}
+
+func (breakers *relayBreakers) states() map[string]circuitBreaker {
+	breakers.mutex.Lock()
+	defer breakers.mutex.Unlock()
+	states := map[string]circuitBreaker{}
+	for relayURL, breaker := range breakers.breakers {
+		states[relayURL] = *breaker
+	}
+	return states
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+)
+
+var checkConfig = flag.Bool("check-config", false, "Validate the configuration, print the effective filters and exit without starting the server")
+var testPayload = flag.String("test-payload", "", "With -check-config, JSON payload file run through the filters as a dry run")
+var testEvent = flag.String("event", "package", "With -test-payload, X-GitHub-Event type of the payload")
+
+// runConfigCheck loads the configuration, resolves the relay URLs and optionally runs a test payload through the filters.
+// Returns the process exit code
+func runConfigCheck() int {
+	config, err := loadServerConfig()
+	if err != nil {
+		fmt.Printf("Configuration invalid: %v\n", err)
+		return 1
+	}
+	for _, line := range config.describe() {
+		fmt.Println(line)
+	}
+	problems := 0
+	for _, relayURL := range config.relayURLs() {
+		if err := resolveRelayURL(relayURL); err != nil {
+			fmt.Printf("Relay URL %s: %v\n", relayURL, err)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return 1
+	}
+	if *testPayload != "" {
+		if err := runTestPayload(config.defaultRoute); err != nil {
+			fmt.Printf("Test payload %s: %v\n", *testPayload, err)
+			return 1
+		}
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+// relayURLs returns every relay URL the configuration forwards to, sorted and without duplicates
+func (config *serverConfig) relayURLs() []string {
+	set := stringSet{}
+	routes := []*route{config.defaultRoute}
+	for _, route := range config.routes {
+		routes = append(routes, route)
+	}
+	for _, route := range routes {
+		for _, relayURL := range route.relayURLs {
+			set[relayURL] = true
+		}
+		for _, relayURL := range route.filters.actionRelayURLs {
+			set[relayURL] = true
+		}
+		if route.filters.hedge != nil {
+			set[route.filters.hedge.url] = true
+		}
+		addDestination := func(destination relayDestination) {
+			set[destination.url] = true
+			if destination.hedge != nil {
+				set[destination.hedge.url] = true
+			}
+			if destination.balance != nil {
+				for _, endpoint := range destination.balance.Endpoints {
+					set[endpoint.URL] = true
+				}
+			}
+		}
+		if stream := route.filters.sinks[redisStreamSinkName]; stream != nil {
+			addDestination(*stream)
+		}
+		if route.filters.rules != nil {
+			for _, rule := range route.filters.rules.rules {
+				if rule.destination != nil {
+					addDestination(*rule.destination)
+				}
+			}
+		}
+		if route.filters.pipelines != nil {
+			for _, pipeline := range route.filters.pipelines.pipelines {
+				for _, destination := range pipeline.destinations {
+					addDestination(destination)
+				}
+			}
+		}
+	}
+	relayURLs := make([]string, 0, len(set))
+	for relayURL := range set {
+		relayURLs = append(relayURLs, relayURL)
+	}
+	sort.Strings(relayURLs)
+	return relayURLs
+}
+
+// resolveRelayURL checks that the URL is an absolute http(s) URL whose host resolves
+func resolveRelayURL(relayURL string) error {
+	parsed, err := url.Parse(relayURL)
+	if err != nil {
+		return err
+	}
+	if _, found := sinkOpeners[parsed.Scheme]; found {
+		_, err := sinkFor(relayURL)
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("must be an absolute http, https or sink URL")
+	}
+	if _, err := net.LookupHost(parsed.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runTestPayload sends the test payload through the request handling of the route as a dry run and prints the verdict
+func runTestPayload(checkedRoute *route) error {
+	body, err := os.ReadFile(*testPayload)
+	if err != nil {
+		return err
+	}
+	filters := *checkedRoute.filters
+	filters.dryRun = true
+	dryRunRoute := *checkedRoute
+	dryRunRoute.filters = &filters
+
+	mac := hmac.New(sha256.New, []byte(dryRunRoute.secret))
+	mac.Write(body)
+	request, err := http.NewRequest(http.MethodPost, dryRunRoute.path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-GitHub-Event", *testEvent)
+	request.Header.Set("X-GitHub-Delivery", "check-config")
+	request.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	recorder := newResponseCapture()
+	rule := handleRequest(recorder, request, &dryRunRoute)
+
+	verdict, reason := recorder.Header().Get("X-Filter-Verdict"), recorder.Header().Get("X-Filter-Reason")
+	fmt.Printf("Verdict: %s (reason %s)\n", verdict, reason)
+	if rule != "" {
+		fmt.Printf("Decided by: %s\n", rule)
+	}
+	fmt.Printf("Detail: %s", recorder.body.String())
+	if failureReasons[reason] {
+		return fmt.Errorf("the delivery would fail with reason %s", reason)
+	}
+	if verdict == "would-forward" && filters.bodyTemplate != nil {
+		destinations, err := renderBodies(filters.sinks.relayDestinations(dryRunRoute.relayURLs), filters.bodyTemplate, request.Header, projectFields(filters.forwardFields, body))
+		if err != nil {
+			return err
+		}
+		for _, destination := range destinations {
+			fmt.Printf("Body for %s:\n%s\n", destination.url, destination.body)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CloudEvents modes of OUTPUT_FORMAT=cloudevents, selected by CLOUDEVENTS_MODE
+const (
+	// cloudEventsStructured forwards the event as a JSON envelope with the payload in data
+	cloudEventsStructured = "structured"
+	// cloudEventsBinary forwards the payload unchanged with the event attributes in ce- headers
+	cloudEventsBinary = "binary"
+)
+
+// cloudEvent is a CloudEvents 1.0 event of a forwarded webhook
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// newCloudEvent describes the webhook: type com.github.<event>[.<action>], the repository as source, falling back to
+// the organization and github.com, the delivery ID as id and the package name as subject
+func newCloudEvent(header http.Header, body []byte) cloudEvent {
+	var payload struct {
+		Action     string `json:"action"`
+		Repository struct {
+			HTMLURL string `json:"html_url"`
+		} `json:"repository"`
+		Organization struct {
+			HTMLURL string `json:"html_url"`
+			Login   string `json:"login"`
+		} `json:"organization"`
+		Package struct {
+			Name string `json:"name"`
+		} `json:"package"`
+	}
+	json.Unmarshal(body, &payload)
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            "com.github." + header.Get("X-GitHub-Event"),
+		Source:          payload.Repository.HTMLURL,
+		ID:              header.Get("X-GitHub-Delivery"),
+		Subject:         payload.Package.Name,
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		DataContentType: "application/json",
+		Data:            body,
+	}
+	if payload.Action != "" {
+		event.Type += "." + payload.Action
+	}
+	if event.Source == "" && payload.Organization.Login != "" {
+		event.Source = "https://github.com/" + payload.Organization.Login
+	}
+	if event.Source == "" {
+		event.Source = "https://github.com"
+	}
+	if !json.Valid(body) {
+		event.Data, _ = json.Marshal(string(body))
+	}
+	return event
+}
+
+// structured encodes the event in the structured content mode, with application/cloudevents+json as content type
+func (event cloudEvent) structured() []byte {
+	encoded, _ := json.Marshal(event)
+	return encoded
+}
+
+// setBinaryHeaders sets the event attributes as the ce- headers of the binary content mode
+func (event cloudEvent) setBinaryHeaders(header http.Header) {
+	header.Set("Ce-Specversion", event.SpecVersion)
+	header.Set("Ce-Type", event.Type)
+	header.Set("Ce-Source", event.Source)
+	header.Set("Ce-Id", event.ID)
+	if event.Subject != "" {
+		header.Set("Ce-Subject", event.Subject)
+	}
+	header.Set("Ce-Time", event.Time)
+}
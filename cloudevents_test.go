@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCloudEventPayload = `{"action":"published","repository":{"full_name":"acme/app","html_url":"https://github.com/acme/app"},"package":{"name":"app","package_type":"CONTAINER"}}`
+
+// cloudEventAttributeName is the form of CloudEvents attribute names
+var cloudEventAttributeName = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// checkCloudEventAttributes checks the attributes of a received event against the CloudEvents 1.0 spec and the
+// webhook it was built from
+func checkCloudEventAttributes(t *testing.T, attributes map[string]string, deliveryID string) {
+	t.Helper()
+	for name := range attributes {
+		if !cloudEventAttributeName.MatchString(name) {
+			t.Errorf("invalid attribute name %q", name)
+		}
+	}
+	want := map[string]string{
+		"specversion": "1.0",
+		"type":        "com.github.package.published",
+		"source":      "https://github.com/acme/app",
+		"id":          deliveryID,
+		"subject":     "app",
+	}
+	for name, value := range want {
+		if attributes[name] != value {
+			t.Errorf("%s = %q, want %q", name, attributes[name], value)
+		}
+	}
+	if _, err := url.Parse(attributes["source"]); err != nil {
+		t.Errorf("source isn't a URI reference: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339, attributes["time"]); err != nil {
+		t.Errorf("time isn't RFC 3339: %v", err)
+	}
+}
+
+func TestCloudEventsStructured(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"OUTPUT_FORMAT": "cloudevents", "CLOUDEVENTS_MODE": "structured"}, relay.URL)
+	request := newDelivery("package", testCloudEventPayload)
+	if response := deliver(request); response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+	forward := relay.forwards()[0]
+	if contentType := forward.header.Get("Content-Type"); contentType != "application/cloudevents+json" {
+		t.Errorf("Content-Type = %q, want application/cloudevents+json", contentType)
+	}
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(forward.body), &envelope); err != nil {
+		t.Fatalf("body isn't a JSON envelope: %v", err)
+	}
+	attributes := map[string]string{}
+	for name, value := range envelope {
+		if name == "data" {
+			continue
+		}
+		var attribute string
+		if err := json.Unmarshal(value, &attribute); err != nil {
+			t.Errorf("attribute %s isn't a string: %s", name, value)
+		}
+		attributes[name] = attribute
+	}
+	checkCloudEventAttributes(t, attributes, request.Header.Get("X-GitHub-Delivery"))
+	if attributes["datacontenttype"] != "application/json" {
+		t.Errorf("datacontenttype = %q, want application/json", attributes["datacontenttype"])
+	}
+	var data bytes.Buffer
+	json.Compact(&data, envelope["data"])
+	if data.String() != testCloudEventPayload {
+		t.Errorf("data = %s, want the webhook payload", data.String())
+	}
+}
+
+func TestCloudEventsBinary(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"OUTPUT_FORMAT": "cloudevents", "CLOUDEVENTS_MODE": "binary"}, relay.URL)
+	request := newDelivery("package", testCloudEventPayload)
+	if response := deliver(request); response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+	forward := relay.forwards()[0]
+	attributes := map[string]string{}
+	for name, values := range forward.header {
+		if attribute, found := strings.CutPrefix(name, "Ce-"); found {
+			attributes[strings.ToLower(attribute)] = values[0]
+		}
+	}
+	checkCloudEventAttributes(t, attributes, request.Header.Get("X-GitHub-Delivery"))
+	if contentType := forward.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want the datacontenttype application/json", contentType)
+	}
+	if forward.body != testCloudEventPayload {
+		t.Errorf("body = %s, want the webhook payload", forward.body)
+	}
+}
+
+func TestCloudEventsRawByDefault(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, nil, relay.URL)
+	deliver(newDelivery("package", testCloudEventPayload))
+	forward := relay.forwards()[0]
+	if forward.body != testCloudEventPayload || forward.header.Get("Ce-Id") != "" {
+		t.Errorf("forward = %s with Ce-Id %q, want the raw payload", forward.body, forward.header.Get("Ce-Id"))
+	}
+}
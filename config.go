@@ -0,0 +1,849 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// filterConfig holds the filter settings that decide which webhook requests are forwarded to the relay
+type filterConfig struct {
+	events stringSet
+	// hookTargetTypes and hookTargetIDs are checked against the X-GitHub-Hook-Installation-Target-* headers
+	hookTargetTypes stringSet
+	hookTargetIDs   stringSet
+	hookIDs         stringSet
+	// eventActions is nil when EVENT_ACTIONS is unset
+	eventActions  eventActionMatrix
+	packageTypes  stringSet
+	repoAllowlist globList
+	repoDenylist  globList
+	orgs          stringSet
+	// repoVisibility is private, public or any
+	repoVisibility string
+	requiredTopics stringSet
+	anyTopics      stringSet
+	actions        stringSet
+	// actionRelayURLs maps the deleted and restored package actions to their own relay URL
+	actionRelayURLs map[string]string
+	tagRegex        *regexp.Regexp
+	packageNames    globList
+	// ownerTypes holds lowercase package owner types, empty for any
+	ownerTypes          stringSet
+	owners              stringSet
+	namespacePatterns   globList
+	imageURLRegex       *regexp.Regexp
+	namespaceFailClosed bool
+	// versionConstraint is nil when VERSION_CONSTRAINT is unset
+	versionConstraint *semver.Constraints
+	dropNonSemver     bool
+	// versionField is auto, version or tag
+	versionField string
+	rules        *ruleSet
+	// pipelines is nil when no pipelines file is given
+	pipelines *pipelineSet
+	// sinks is nil when no sinks file is given
+	sinks        sinkSet
+	expression   *filterExpression
+	jsonPaths    []jsonPathCondition
+	fieldFilters []fieldCondition
+	command      *filterCommand
+	// script is nil when FILTER_STARLARK is unset
+	script *filterScript
+	// schemas is nil when PAYLOAD_SCHEMA_DIR is unset
+	schemas payloadSchemas
+
+	excludePackageNames globList
+	excludeTagRegex     *regexp.Regexp
+	// artifactTags is nil when SKIP_ARTIFACT_TAGS is disabled
+	artifactTags        globList
+	blockSenders        stringSet
+	blockBotSenders     bool
+	pushBranches        globList
+	pushTags            globList
+	workflowNames       stringSet
+	workflowConclusions stringSet
+
+	releaseActions         stringSet
+	releaseAllowDraft      bool
+	releaseAllowPrerelease bool
+
+	pullRequestActions stringSet
+	pullRequestLabels  stringSet
+
+	dryRun bool
+	// allowSHA1 verifies deliveries without X-Hub-Signature-256 with their legacy SHA-1 X-Hub-Signature
+	allowSHA1 bool
+	// relayWait bounds forwarding to several relay URLs
+	relayWait       time.Duration
+	relayRequireAll bool
+	retry           retryPolicy
+	// bodyTemplate renders the body forwarded to the relay URLs when set
+	bodyTemplate *bodyTemplate
+	// hedge is nil when forwards to the relay URLs aren't hedged
+	hedge *relayHedge
+	// failoverURL is the relay URL forwarded to when a relay URL fails, empty when they don't fail over
+	failoverURL string
+	// balanceStrategy is empty when every forward goes to all the relay URLs, balanceWeights follow their order
+	balanceStrategy string
+	balanceWeights  []int
+	// retryInBackground answers 202 before forwarding and retries without the retry budget
+	retryInBackground bool
+	// relayPassthrough answers with the relay's response when forwarding to a single relay URL
+	relayPassthrough bool
+	// batchSize is 0 when events are forwarded one by one
+	batchSize     int
+	batchInterval time.Duration
+	// debounce holds events back until no newer event of their debounceKey arrived for that long, 0 when events aren't
+	// debounced
+	debounce    time.Duration
+	debounceKey *fieldTemplate
+	// asyncForward queues accepted events for the worker pool and answers 202 right away
+	asyncForward bool
+	// deadLetters is nil when failed forwards are only logged
+	deadLetters *deadLetterQueue
+	// maxForwardBytes is 0 when payloads of any size are forwarded
+	maxForwardBytes int
+	trimOversized   bool
+	// forwardFields are the dotted payload paths kept in forwards, all fields are forwarded when empty
+	forwardFields [][]string
+	// dedupeWindow is 0 when duplicate suppression is disabled
+	dedupeWindow time.Duration
+	// forwardWindow is nil when events are forwarded at any time
+	forwardWindow *forwardWindow
+	// repoRate is nil when forwards are not throttled
+	repoRate *forwardRate
+}
+
+var allowedEvents = flag.String("allowedEvents", "", "Comma-separated X-GitHub-Event types to forward (overrides ALLOWED_EVENTS). Empty forwards all event types")
+var rulesFile = flag.String("rules", "", "YAML rules file. When set, its rules replace the environment variable filters")
+var filterPackageTypes = flag.String("filterPackageTypes", "", "Comma-separated package types to forward (overrides FILTER_PACKAGE_TYPES). Empty forwards all package types")
+
+// loadFilterConfig reads the filter settings from flags and environment variables
+func loadFilterConfig() (*filterConfig, error) {
+	config := &filterConfig{}
+	events, found := lookupSetting("allowedEvents", "ALLOWED_EVENTS")
+	if !found {
+		events = "package"
+	}
+	config.events = newStringSet(parseList(events))
+	config.hookTargetTypes = newStringSet(parseList(strings.ToLower(os.Getenv("HOOK_TARGET_TYPES"))))
+	config.hookTargetIDs = newStringSet(parseList(os.Getenv("HOOK_TARGET_IDS")))
+	config.hookIDs = newStringSet(parseList(os.Getenv("ALLOWED_HOOK_IDS")))
+	preset, err := lookupPreset(os.Getenv("FILTER_PRESET"))
+	if err != nil {
+		return nil, fmt.Errorf("FILTER_PRESET: %w", err)
+	}
+	packageTypes, found := lookupSetting("filterPackageTypes", "FILTER_PACKAGE_TYPES")
+	if !found {
+		packageTypes = preset.packageTypes
+	}
+	config.packageTypes = newPackageTypeSet(packageTypes)
+	if config.eventActions, err = parseEventActionMatrix(os.Getenv("EVENT_ACTIONS")); err != nil {
+		return nil, fmt.Errorf("EVENT_ACTIONS: %w", err)
+	}
+	if config.repoAllowlist, err = newGlobList(os.Getenv("REPO_ALLOWLIST")); err != nil {
+		return nil, fmt.Errorf("REPO_ALLOWLIST: %w", err)
+	}
+	if config.repoDenylist, err = newGlobList(os.Getenv("REPO_DENYLIST") + "," + os.Getenv("EXCLUDE_REPOS")); err != nil {
+		return nil, fmt.Errorf("REPO_DENYLIST/EXCLUDE_REPOS: %w", err)
+	}
+	config.orgs = newStringSet(parseList(strings.ToLower(os.Getenv("ALLOWED_ORGS"))))
+	switch config.repoVisibility = strings.ToLower(os.Getenv("REPO_VISIBILITY")); config.repoVisibility {
+	case "":
+		config.repoVisibility = "any"
+	case "any", "private", "public":
+	default:
+		return nil, fmt.Errorf("REPO_VISIBILITY must be private, public or any, got %q", config.repoVisibility)
+	}
+	config.requiredTopics = newStringSet(parseList(strings.ToLower(os.Getenv("REQUIRED_TOPICS"))))
+	config.anyTopics = newStringSet(parseList(strings.ToLower(os.Getenv("ANY_TOPICS"))))
+	actions, found := os.LookupEnv("PACKAGE_ACTIONS")
+	if !found {
+		actions = "published,updated"
+	}
+	config.actions = newStringSet(parseList(actions))
+	config.actionRelayURLs = map[string]string{}
+	for action, envName := range map[string]string{"deleted": "PACKAGE_DELETED_RELAY_URL", "restored": "PACKAGE_RESTORED_RELAY_URL"} {
+		if relayURL := os.Getenv(envName); relayURL != "" {
+			config.actionRelayURLs[action] = relayURL
+		}
+	}
+	if tagRegex := os.Getenv("CONTAINER_TAG_REGEX"); tagRegex != "" {
+		if config.tagRegex, err = regexp.Compile(tagRegex); err != nil {
+			return nil, fmt.Errorf("CONTAINER_TAG_REGEX: %w", err)
+		}
+	}
+	if config.packageNames, err = newGlobList(os.Getenv("PACKAGE_NAME_PATTERNS")); err != nil {
+		return nil, fmt.Errorf("PACKAGE_NAME_PATTERNS: %w", err)
+	}
+	if config.namespacePatterns, err = newGlobList(os.Getenv("NAMESPACE_PATTERNS")); err != nil {
+		return nil, fmt.Errorf("NAMESPACE_PATTERNS: %w", err)
+	}
+	if imageURLRegex := os.Getenv("IMAGE_URL_REGEX"); imageURLRegex != "" {
+		if config.imageURLRegex, err = regexp.Compile(imageURLRegex); err != nil {
+			return nil, fmt.Errorf("IMAGE_URL_REGEX: %w", err)
+		}
+	}
+	if config.namespaceFailClosed, err = lookupBool("NAMESPACE_FAIL_CLOSED", false); err != nil {
+		return nil, err
+	}
+	if constraint := os.Getenv("VERSION_CONSTRAINT"); constraint != "" {
+		if config.versionConstraint, err = semver.NewConstraint(constraint); err != nil {
+			return nil, fmt.Errorf("VERSION_CONSTRAINT: %w", err)
+		}
+	}
+	switch config.versionField = strings.ToLower(os.Getenv("VERSION_FIELD")); config.versionField {
+	case "":
+		config.versionField = preset.versionField
+	case "auto", "version", "tag":
+	default:
+		return nil, fmt.Errorf("VERSION_FIELD must be auto, version or tag, got %q", config.versionField)
+	}
+	switch nonSemver := os.Getenv("VERSION_NONSEMVER"); nonSemver {
+	case "", "forward":
+	case "drop":
+		config.dropNonSemver = true
+	default:
+		return nil, fmt.Errorf("VERSION_NONSEMVER must be forward or drop, got %q", nonSemver)
+	}
+	switch ownerTypes := strings.ToLower(os.Getenv("PACKAGE_OWNER_TYPES")); ownerTypes {
+	case "", "any":
+		config.ownerTypes = stringSet{}
+	default:
+		config.ownerTypes = newStringSet(parseList(ownerTypes))
+		for ownerType := range config.ownerTypes {
+			if ownerType != "organization" && ownerType != "user" {
+				return nil, fmt.Errorf("PACKAGE_OWNER_TYPES must be any or a list of Organization and User, got %q", ownerTypes)
+			}
+		}
+	}
+	config.owners = newStringSet(parseList(strings.ToLower(os.Getenv("PACKAGE_OWNERS"))))
+	if config.excludePackageNames, err = newGlobList(os.Getenv("EXCLUDE_PACKAGE_NAME_PATTERNS")); err != nil {
+		return nil, fmt.Errorf("EXCLUDE_PACKAGE_NAME_PATTERNS: %w", err)
+	}
+	if tagRegex := os.Getenv("EXCLUDE_CONTAINER_TAG_REGEX"); tagRegex != "" {
+		if config.excludeTagRegex, err = regexp.Compile(tagRegex); err != nil {
+			return nil, fmt.Errorf("EXCLUDE_CONTAINER_TAG_REGEX: %w", err)
+		}
+	}
+	if skipArtifacts, err := lookupBool("SKIP_ARTIFACT_TAGS", preset.skipArtifactTags); err != nil {
+		return nil, err
+	} else if skipArtifacts {
+		artifactTags, found := os.LookupEnv("ARTIFACT_TAG_PATTERNS")
+		if !found {
+			artifactTags = preset.artifactTags
+		}
+		if config.artifactTags, err = newGlobList(artifactTags); err != nil {
+			return nil, fmt.Errorf("ARTIFACT_TAG_PATTERNS: %w", err)
+		}
+		if config.artifactTags == nil {
+			config.artifactTags = globList{}
+		}
+	}
+	config.blockSenders = newStringSet(parseList(strings.ToLower(os.Getenv("BLOCK_SENDERS"))))
+	if config.blockBotSenders, err = lookupBool("BLOCK_BOT_SENDERS", false); err != nil {
+		return nil, err
+	}
+	if config.pushBranches, err = newGlobList(os.Getenv("PUSH_BRANCHES")); err != nil {
+		return nil, fmt.Errorf("PUSH_BRANCHES: %w", err)
+	}
+	if config.pushTags, err = newGlobList(os.Getenv("PUSH_TAGS")); err != nil {
+		return nil, fmt.Errorf("PUSH_TAGS: %w", err)
+	}
+	config.workflowNames = newStringSet(parseList(os.Getenv("WORKFLOW_NAMES")))
+	config.workflowConclusions = newStringSet(parseList(os.Getenv("WORKFLOW_CONCLUSIONS")))
+	releaseActions, found := os.LookupEnv("RELEASE_ACTIONS")
+	if !found {
+		releaseActions = "published"
+	}
+	config.releaseActions = newStringSet(parseList(releaseActions))
+	if config.releaseAllowDraft, err = lookupBool("RELEASE_ALLOW_DRAFT", false); err != nil {
+		return nil, err
+	}
+	if config.releaseAllowPrerelease, err = lookupBool("RELEASE_ALLOW_PRERELEASE", false); err != nil {
+		return nil, err
+	}
+	config.pullRequestActions = newStringSet(parseList(os.Getenv("PR_ACTIONS")))
+	config.pullRequestLabels = newStringSet(parseList(os.Getenv("PR_LABELS")))
+	if config.dryRun, err = lookupBool("DRY_RUN", false); err != nil {
+		return nil, err
+	}
+	if config.allowSHA1, err = lookupBool("ALLOW_SHA1", false); err != nil {
+		return nil, err
+	}
+	if maxForwardBytes := os.Getenv("MAX_FORWARD_BYTES"); maxForwardBytes != "" {
+		if config.maxForwardBytes, err = strconv.Atoi(maxForwardBytes); err != nil {
+			return nil, fmt.Errorf("MAX_FORWARD_BYTES: %w", err)
+		}
+	}
+	for _, path := range parseList(os.Getenv("FORWARD_FIELDS")) {
+		keys := strings.Split(path, ".")
+		if slices.Contains(keys, "") {
+			return nil, fmt.Errorf("FORWARD_FIELDS: invalid path %q", path)
+		}
+		config.forwardFields = append(config.forwardFields, keys)
+	}
+	if config.trimOversized, err = lookupBool("TRIM_OVERSIZED", false); err != nil {
+		return nil, err
+	}
+	if dedupeWindow := os.Getenv("DEDUPE_WINDOW"); dedupeWindow != "" {
+		if config.dedupeWindow, err = time.ParseDuration(dedupeWindow); err != nil {
+			return nil, fmt.Errorf("DEDUPE_WINDOW: %w", err)
+		}
+	}
+	config.relayWait = 10 * time.Second
+	if relayWait := os.Getenv("RELAY_WAIT"); relayWait != "" {
+		if config.relayWait, err = time.ParseDuration(relayWait); err != nil {
+			return nil, fmt.Errorf("RELAY_WAIT: %w", err)
+		}
+	}
+	if config.relayRequireAll, err = lookupBool("RELAY_REQUIRE_ALL", false); err != nil {
+		return nil, err
+	}
+	config.retry = retryPolicy{maxAttempts: 1, backoff: 500 * time.Millisecond, budget: 8 * time.Second, timeout: 8 * time.Second, maxRetryAfter: time.Minute}
+	if attempts := os.Getenv("RELAY_MAX_ATTEMPTS"); attempts != "" {
+		if config.retry.maxAttempts, err = strconv.Atoi(attempts); err != nil || config.retry.maxAttempts < 1 {
+			return nil, fmt.Errorf("RELAY_MAX_ATTEMPTS must be a positive number, got %q", attempts)
+		}
+	}
+	for envName, setting := range map[string]*time.Duration{"RELAY_RETRY_BACKOFF": &config.retry.backoff, "RELAY_RETRY_BUDGET": &config.retry.budget, "RELAY_TIMEOUT": &config.retry.timeout, "RELAY_RETRY_AFTER_MAX": &config.retry.maxRetryAfter} {
+		if value := os.Getenv(envName); value != "" {
+			if *setting, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName, err)
+			}
+		}
+	}
+	if config.retryInBackground, err = lookupBool("RELAY_RETRY_BACKGROUND", false); err != nil {
+		return nil, err
+	}
+	forwardHeaders, found := os.LookupEnv("FORWARD_HEADERS")
+	if !found {
+		forwardHeaders = "X-GitHub-*,X-Hub-Signature-256"
+	}
+	if config.retry.headers, err = newGlobList(forwardHeaders); err != nil {
+		return nil, fmt.Errorf("FORWARD_HEADERS: %w", err)
+	}
+	if config.retry.relayHeaders, err = parseRelayHeaders(os.Getenv("RELAY_HEADERS")); err != nil {
+		return nil, fmt.Errorf("RELAY_HEADERS: %w", err)
+	}
+	if compress, err := lookupBool("RELAY_GZIP", false); err != nil {
+		return nil, err
+	} else if compress {
+		config.retry.gzipMinBytes = 1024
+		if value := os.Getenv("RELAY_GZIP_MIN_BYTES"); value != "" {
+			if config.retry.gzipMinBytes, err = strconv.Atoi(value); err != nil || config.retry.gzipMinBytes < 1 {
+				return nil, fmt.Errorf("RELAY_GZIP_MIN_BYTES must be a positive number, got %q", value)
+			}
+		}
+	}
+	config.retry.idempotencyHeader = "Idempotency-Key"
+	if value, found := os.LookupEnv("IDEMPOTENCY_HEADER"); found {
+		config.retry.idempotencyHeader = http.CanonicalHeaderKey(strings.TrimSpace(value))
+	}
+	config.retry.secret = os.Getenv("RELAY_SECRET")
+	config.retry.signatureHeader = http.CanonicalHeaderKey(os.Getenv("RELAY_SIGNATURE_HEADER"))
+	if config.retry.signatureHeader == "" {
+		config.retry.signatureHeader = "X-Hub-Signature-256"
+	}
+	switch format := strings.ToLower(os.Getenv("OUTPUT_FORMAT")); format {
+	case "", "raw":
+	case "cloudevents":
+		switch config.retry.cloudEventsMode = strings.ToLower(os.Getenv("CLOUDEVENTS_MODE")); config.retry.cloudEventsMode {
+		case "":
+			config.retry.cloudEventsMode = cloudEventsStructured
+		case cloudEventsStructured, cloudEventsBinary:
+		default:
+			return nil, fmt.Errorf("CLOUDEVENTS_MODE must be structured or binary, got %q", config.retry.cloudEventsMode)
+		}
+	default:
+		return nil, fmt.Errorf("OUTPUT_FORMAT must be raw or cloudevents, got %q", format)
+	}
+	if value := os.Getenv("RELAY_RATE"); value != "" {
+		if config.retry.rate, err = parseRelayRate(value); err != nil {
+			return nil, fmt.Errorf("RELAY_RATE: %w", err)
+		}
+		config.retry.rate.maxWait = 2 * time.Second
+		if maxWait := os.Getenv("RELAY_RATE_MAX_WAIT"); maxWait != "" {
+			if config.retry.rate.maxWait, err = time.ParseDuration(maxWait); err != nil {
+				return nil, fmt.Errorf("RELAY_RATE_MAX_WAIT: %w", err)
+			}
+		}
+	}
+	config.retry.breaker.cooldown = 30 * time.Second
+	if threshold := os.Getenv("BREAKER_THRESHOLD"); threshold != "" {
+		if config.retry.breaker.threshold, err = strconv.Atoi(threshold); err != nil || config.retry.breaker.threshold < 0 {
+			return nil, fmt.Errorf("BREAKER_THRESHOLD must be a number, got %q", threshold)
+		}
+	}
+	if cooldown := os.Getenv("BREAKER_COOLDOWN"); cooldown != "" {
+		if config.retry.breaker.cooldown, err = time.ParseDuration(cooldown); err != nil {
+			return nil, fmt.Errorf("BREAKER_COOLDOWN: %w", err)
+		}
+	}
+	if config.relayPassthrough, err = lookupBool("RELAY_RESPONSE_PASSTHROUGH", false); err != nil {
+		return nil, err
+	}
+	config.retry.responseBytes = 4096
+	if value := os.Getenv("RELAY_RESPONSE_MAX_BYTES"); value != "" {
+		if config.retry.responseBytes, err = strconv.Atoi(value); err != nil || config.retry.responseBytes < 0 {
+			return nil, fmt.Errorf("RELAY_RESPONSE_MAX_BYTES must be a number, got %q", value)
+		}
+	}
+	if value := os.Getenv("BATCH_SIZE"); value != "" {
+		if config.batchSize, err = strconv.Atoi(value); err != nil || config.batchSize < 0 {
+			return nil, fmt.Errorf("BATCH_SIZE must be a number, got %q", value)
+		}
+	}
+	config.batchInterval = 10 * time.Second
+	if value := os.Getenv("BATCH_INTERVAL"); value != "" {
+		if config.batchInterval, err = time.ParseDuration(value); err != nil || config.batchInterval <= 0 {
+			return nil, fmt.Errorf("BATCH_INTERVAL must be a positive duration, got %q", value)
+		}
+	}
+	if value := os.Getenv("DEBOUNCE"); value != "" {
+		if config.debounce, err = time.ParseDuration(value); err != nil || config.debounce < 0 {
+			return nil, fmt.Errorf("DEBOUNCE must be a positive duration, got %q", value)
+		}
+	}
+	debounceKey := os.Getenv("DEBOUNCE_KEY")
+	if debounceKey == "" {
+		debounceKey = "{repository}/{package}"
+	}
+	if config.debounceKey, err = parseFieldTemplate(debounceKey); err != nil {
+		return nil, fmt.Errorf("DEBOUNCE_KEY: %w", err)
+	}
+	if config.asyncForward, err = lookupBool("ASYNC_FORWARD", false); err != nil {
+		return nil, err
+	}
+	if dir := os.Getenv("DLQ_DIR"); dir != "" {
+		maxEntries, retention := 1000, 7*24*time.Hour
+		if value := os.Getenv("DLQ_MAX_ENTRIES"); value != "" {
+			if maxEntries, err = strconv.Atoi(value); err != nil || maxEntries < 0 {
+				return nil, fmt.Errorf("DLQ_MAX_ENTRIES must be a number, got %q", value)
+			}
+		}
+		if value := os.Getenv("DLQ_RETENTION"); value != "" {
+			if retention, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("DLQ_RETENTION: %w", err)
+			}
+		}
+		if config.deadLetters, err = newDeadLetterQueue(dir, maxEntries, retention); err != nil {
+			return nil, fmt.Errorf("DLQ_DIR: %w", err)
+		}
+	}
+	if window := os.Getenv("FORWARD_WINDOW"); window != "" {
+		if config.forwardWindow, err = parseForwardWindow(window); err != nil {
+			return nil, fmt.Errorf("FORWARD_WINDOW: %w", err)
+		}
+	}
+	if rate := os.Getenv("MAX_FORWARDS_PER_REPO"); rate != "" {
+		if config.repoRate, err = parseForwardRate(rate); err != nil {
+			return nil, fmt.Errorf("MAX_FORWARDS_PER_REPO: %w", err)
+		}
+	}
+	if hold, err := lookupBool("HOLD_OUTSIDE_WINDOW", false); err != nil {
+		return nil, err
+	} else if hold {
+		return nil, fmt.Errorf("HOLD_OUTSIDE_WINDOW: holding events until the window opens is not supported yet, events outside FORWARD_WINDOW are dropped")
+	}
+	if config.fieldFilters, err = parseFieldConditions(os.Getenv("FIELD_FILTERS")); err != nil {
+		return nil, fmt.Errorf("FIELD_FILTERS: %w", err)
+	}
+	if config.jsonPaths, err = parseJSONPathConditions(os.Getenv("FILTER_JSONPATH")); err != nil {
+		return nil, fmt.Errorf("FILTER_JSONPATH: %w", err)
+	}
+	if expression := os.Getenv("FILTER_EXPRESSION"); expression != "" {
+		if config.expression, err = newFilterExpression(expression); err != nil {
+			return nil, fmt.Errorf("FILTER_EXPRESSION: %w", err)
+		}
+	}
+	if command := strings.Fields(os.Getenv("FILTER_COMMAND")); len(command) > 0 {
+		config.command = &filterCommand{args: command, timeout: 5 * time.Second}
+		if timeout := os.Getenv("FILTER_COMMAND_TIMEOUT"); timeout != "" {
+			if config.command.timeout, err = time.ParseDuration(timeout); err != nil {
+				return nil, fmt.Errorf("FILTER_COMMAND_TIMEOUT: %w", err)
+			}
+		}
+	}
+	if file := os.Getenv("FILTER_STARLARK"); file != "" {
+		maxSteps := uint64(100000)
+		if steps := os.Getenv("FILTER_STARLARK_MAX_STEPS"); steps != "" {
+			if maxSteps, err = strconv.ParseUint(steps, 10, 64); err != nil || maxSteps == 0 {
+				return nil, fmt.Errorf("FILTER_STARLARK_MAX_STEPS must be a positive number, got %q", steps)
+			}
+		}
+		if config.script, err = loadFilterScript(file, maxSteps); err != nil {
+			return nil, fmt.Errorf("FILTER_STARLARK: %w", err)
+		}
+	}
+	if config.hedge, err = newRelayHedge(os.Getenv("RELAY_HEDGE_URL"), os.Getenv("RELAY_HEDGE_DELAY")); err != nil {
+		return nil, fmt.Errorf("RELAY_HEDGE_URL: %w", err)
+	}
+	config.failoverURL = os.Getenv("RELAY_FAILOVER_URL")
+	if err := validateFailoverURL(config.failoverURL, config.hedge); err != nil {
+		return nil, fmt.Errorf("RELAY_FAILOVER_URL: %w", err)
+	}
+	config.retry.failover = failoverPolicy{threshold: 3, cooldown: 5 * time.Minute}
+	if value := os.Getenv("RELAY_FAILOVER_THRESHOLD"); value != "" {
+		if config.retry.failover.threshold, err = strconv.Atoi(value); err != nil || config.retry.failover.threshold < 1 {
+			return nil, fmt.Errorf("RELAY_FAILOVER_THRESHOLD must be a positive number, got %q", value)
+		}
+	}
+	if value := os.Getenv("RELAY_FAILOVER_COOLDOWN"); value != "" {
+		if config.retry.failover.cooldown, err = time.ParseDuration(value); err != nil || config.retry.failover.cooldown < 0 {
+			return nil, fmt.Errorf("RELAY_FAILOVER_COOLDOWN must be a positive duration, got %q", value)
+		}
+	}
+	if value := os.Getenv("RELAY_BALANCE"); value != "" {
+		if config.balanceStrategy, err = parseBalanceStrategy(value); err != nil {
+			return nil, fmt.Errorf("RELAY_BALANCE: %w", err)
+		}
+	}
+	for _, value := range parseList(os.Getenv("RELAY_BALANCE_WEIGHTS")) {
+		if config.balanceStrategy == "" {
+			return nil, fmt.Errorf("RELAY_BALANCE_WEIGHTS needs RELAY_BALANCE")
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("RELAY_BALANCE_WEIGHTS must list positive numbers, got %q", value)
+		}
+		config.balanceWeights = append(config.balanceWeights, weight)
+	}
+	if source := os.Getenv("RELAY_BODY_TEMPLATE"); source != "" {
+		if config.bodyTemplate, err = parseBodyTemplate(source); err != nil {
+			return nil, fmt.Errorf("RELAY_BODY_TEMPLATE: %w", err)
+		}
+	}
+	if dir := os.Getenv("PAYLOAD_SCHEMA_DIR"); dir != "" {
+		if config.schemas, err = loadPayloadSchemas(dir); err != nil {
+			return nil, fmt.Errorf("PAYLOAD_SCHEMA_DIR: %w", err)
+		}
+	}
+	if *sinksFile != "" {
+		if config.sinks, err = loadSinks(*sinksFile); err != nil {
+			return nil, fmt.Errorf("sinks file %s: %w", *sinksFile, err)
+		}
+	}
+	if streamURL := redisStreamURL(); streamURL != "" {
+		if config.sinks, err = config.sinks.withRedisStream(streamURL); err != nil {
+			return nil, fmt.Errorf("REDIS_STREAM_URL: %w", err)
+		}
+	}
+	if *pipelinesFile != "" {
+		if config.pipelines, err = loadPipelines(*pipelinesFile, config.sinks); err != nil {
+			return nil, fmt.Errorf("pipelines file %s: %w", *pipelinesFile, err)
+		}
+	}
+	if *rulesFile != "" {
+		if config.rules, err = loadRules(*rulesFile, config.sinks); err != nil {
+			return nil, fmt.Errorf("rules file %s: %w", *rulesFile, err)
+		}
+	}
+	return config, nil
+}
+
+// describeFilterConfig summarizes the filter settings, one setting per line
+func describeFilterConfig(config *filterConfig) []string {
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	if config.schemas != nil {
+		add("Validating payloads against JSON Schemas for events: %s", config.schemas)
+	}
+	if config.dryRun {
+		add("Dry run enabled, nothing is forwarded to the relay")
+	}
+	if config.allowSHA1 {
+		add("WARNING: falling back to the legacy SHA-1 X-Hub-Signature when X-Hub-Signature-256 is absent")
+	}
+	for _, action := range []string{"deleted", "restored"} {
+		if relayURL := config.actionRelayURLs[action]; relayURL != "" {
+			add("Forwarding %s packages to %s", action, relayURL)
+		}
+	}
+	if config.eventActions != nil {
+		add("Forwarding event actions: %s", config.eventActions)
+	}
+	if len(config.hookIDs) > 0 {
+		add("Accepting hook IDs: %s", config.hookIDs)
+	}
+	if len(config.hookTargetTypes) > 0 || len(config.hookTargetIDs) > 0 {
+		add("Accepting hook installation target types: %s, IDs: %s", config.hookTargetTypes, config.hookTargetIDs)
+	}
+	if len(config.blockSenders) > 0 || config.blockBotSenders {
+		add("Blocking senders: %s, bots blocked: %t", config.blockSenders, config.blockBotSenders)
+	}
+	add("Forwarding pushes to branches: %s, tags: %s", config.pushBranches, config.pushTags)
+	add("Forwarding workflow runs: %s, conclusions: %s", config.workflowNames, config.workflowConclusions)
+	add("Forwarding release actions: %s, drafts: %t, prereleases: %t", config.releaseActions, config.releaseAllowDraft, config.releaseAllowPrerelease)
+	add("Forwarding pull request actions: %s, labels: %s", config.pullRequestActions, config.pullRequestLabels)
+	if len(config.forwardFields) > 0 {
+		var paths []string
+		for _, path := range config.forwardFields {
+			paths = append(paths, strings.Join(path, "."))
+		}
+		add("Forwarding payload fields: %s", strings.Join(paths, ", "))
+	}
+	if config.maxForwardBytes > 0 {
+		add("Forwarding payloads up to %d bytes, trimming oversized payloads: %t", config.maxForwardBytes, config.trimOversized)
+	}
+	add("Relay attempts time out after: %s", config.retry.timeout)
+	add("Forwarding inbound headers: %s", config.retry.headers)
+	if len(config.retry.relayHeaders) > 0 {
+		var names []string
+		for name := range config.retry.relayHeaders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		add("Setting relay headers: %s", strings.Join(names, ", "))
+	}
+	if config.retry.gzipMinBytes > 0 {
+		add("Compressing forwards from %d bytes", config.retry.gzipMinBytes)
+	}
+	if config.hedge != nil {
+		add("Hedging forwards to the relay URLs to %s after %s", config.hedge.url, config.hedge.delay)
+	}
+	if config.failoverURL != "" {
+		add("Failing over from the relay URLs to %s, preferring it for %s after %d failures in a row", redactURL(config.failoverURL), config.retry.failover.cooldown, config.retry.failover.threshold)
+	}
+	if config.balanceStrategy != "" {
+		add("Balancing forwards across the relay URLs: %s, weights: %v", config.balanceStrategy, config.balanceWeights)
+	}
+	if config.bodyTemplate != nil {
+		add("Rendering forwards to the relay URLs with the body template: %s", config.bodyTemplate.source)
+	}
+	if config.retry.idempotencyHeader != "" {
+		add("Sending idempotency keys in: %s", config.retry.idempotencyHeader)
+	}
+	if config.retry.secret != "" {
+		add("Signing forwards with the relay secret in: %s", config.retry.signatureHeader)
+	}
+	if config.retry.maxAttempts > 1 {
+		add("Retrying relay forwards up to %d attempts, backoff: %s, budget: %s, max Retry-After: %s, in background: %t", config.retry.maxAttempts, config.retry.backoff, config.retry.budget, config.retry.maxRetryAfter, config.retryInBackground)
+	}
+	if config.retry.rate != nil {
+		add("Limiting forwards to each relay URL to %s", config.retry.rate)
+	}
+	if config.retry.breaker.threshold > 0 {
+		add("Opening relay circuits after %d consecutive failures for %s", config.retry.breaker.threshold, config.retry.breaker.cooldown)
+	}
+	if config.relayPassthrough {
+		add("Answering with the relay response, up to %d bytes", config.retry.responseBytes)
+	}
+	if config.debounce > 0 {
+		add("Debouncing forwards for %s per key", config.debounce)
+	}
+	if config.batchSize > 0 {
+		add("Forwarding in batches of %d events, at least every %s", config.batchSize, config.batchInterval)
+	}
+	if config.asyncForward {
+		add("Forwarding asynchronously through the forward queue")
+	}
+	if config.deadLetters != nil {
+		add("Storing failed forwards in dead-letter queue: %s", config.deadLetters)
+	}
+	if config.forwardWindow != nil {
+		add("Forwarding only within: %s", config.forwardWindow)
+	}
+	if config.repoRate != nil {
+		add("Forwarding at most %s per repository", config.repoRate)
+	}
+	if config.dedupeWindow > 0 {
+		add("Suppressing duplicate package versions within %s", config.dedupeWindow)
+	}
+	for _, condition := range config.jsonPaths {
+		add("JSONPath condition: %s", condition.source)
+	}
+	for _, condition := range config.fieldFilters {
+		add("Field filter: %s", condition.source)
+	}
+	if config.expression != nil {
+		add("Filter expression: %s", config.expression)
+	}
+	if config.command != nil {
+		add("Filter command: %s, timeout: %s", config.command, config.command.timeout)
+	}
+	if config.script != nil {
+		add("Filter script: %s, execution budget: %d steps", config.script, config.script.maxSteps)
+	}
+	if *sinksFile != "" {
+		add("Declared sinks from %s: %s", *sinksFile, config.sinks)
+	}
+	if stream := config.sinks[redisStreamSinkName]; stream != nil {
+		add("Adding forwarded events to the Redis stream %s", redactURL(stream.url))
+	}
+	if config.pipelines != nil {
+		add("Dispatching to pipelines from %s: %s", *pipelinesFile, config.pipelines)
+		return lines
+	}
+	if config.rules != nil {
+		add("Loaded %d rules from %s, default verdict: %s", len(config.rules.rules), *rulesFile, verdictName(config.rules.defaultAllow))
+		return lines
+	}
+	add("Forwarding events: %s", config.events)
+	add("Forwarding package types: %s", config.packageTypes)
+	add("Forwarding package actions: %s", config.actions)
+	add("Repository allowlist: %s, denylist: %s", config.repoAllowlist, config.repoDenylist)
+	add("Forwarding organizations: %s", config.orgs)
+	add("Forwarding repository visibility: %s", config.repoVisibility)
+	add("Forwarding package names matching: %s, excluding: %s", config.packageNames, config.excludePackageNames)
+	if config.tagRegex != nil {
+		add("Forwarding container tags matching: %s", config.tagRegex)
+	}
+	if len(config.requiredTopics) > 0 || len(config.anyTopics) > 0 {
+		add("Forwarding repositories with all topics: %s, any topic: %s", config.requiredTopics, config.anyTopics)
+	}
+	if len(config.ownerTypes) > 0 || len(config.owners) > 0 {
+		add("Forwarding package owner types: %s, owners: %s", config.ownerTypes, config.owners)
+	}
+	if len(config.namespacePatterns) > 0 || config.imageURLRegex != nil {
+		add("Forwarding namespaces matching: %s, image URLs matching: %v, missing fields dropped: %t", config.namespacePatterns, config.imageURLRegex, config.namespaceFailClosed)
+	}
+	if config.versionConstraint != nil {
+		add("Forwarding package versions (%s) satisfying: %s, non-semver versions dropped: %t", config.versionField, config.versionConstraint, config.dropNonSemver)
+	}
+	if config.excludeTagRegex != nil {
+		add("Excluding container tags matching: %s", config.excludeTagRegex)
+	}
+	if config.artifactTags != nil {
+		add("Skipping signature and attestation artifacts, tags matching: %s", config.artifactTags)
+	}
+	return lines
+}
+
+// lookupSetting returns the value of the named flag when it was set on the command line, otherwise the environment variable
+func lookupSetting(flagName string, envName string) (string, bool) {
+	value, found := "", false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == flagName {
+			value, found = f.Value.String(), true
+		}
+	})
+	if found {
+		return value, true
+	}
+	return os.LookupEnv(envName)
+}
+
+// lookupBool parses a boolean environment variable, returning fallback when it is unset or empty
+func lookupBool(envName string, fallback bool) (bool, error) {
+	value := os.Getenv(envName)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", envName, err)
+	}
+	return parsed, nil
+}
+
+// parseRelayHeaders parses "Name: Value" pairs separated by semicolons or newlines. Values may reference environment
+// variables as ${NAME} so secrets stay out of the configuration
+func parseRelayHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, headerValue, found := strings.Cut(pair, ":")
+		if name = strings.TrimSpace(name); !found || name == "" {
+			return nil, fmt.Errorf("expected Name: Value, got %q", pair)
+		}
+		headers[http.CanonicalHeaderKey(name)] = os.ExpandEnv(strings.TrimSpace(headerValue))
+	}
+	return headers, nil
+}
+
+// parseList splits a comma-separated setting into its trimmed, non-empty entries
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type stringSet map[string]bool
+
+// normalizePackageType upper-cases package types, since GitHub sends both CONTAINER and container depending on the event source
+func normalizePackageType(packageType string) string {
+	return strings.ToUpper(strings.TrimSpace(packageType))
+}
+
+// newPackageTypeSet parses a comma-separated list of package types into a set of normalized package types
+func newPackageTypeSet(value string) stringSet {
+	return newStringSet(parseList(normalizePackageType(value)))
+}
+
+func newStringSet(items []string) stringSet {
+	set := stringSet{}
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// allows reports whether value is in the set. An empty set allows everything
+func (set stringSet) allows(value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+func (set stringSet) String() string {
+	if len(set) == 0 {
+		return "*"
+	}
+	items := make([]string, 0, len(set))
+	for item := range set {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// globList is a list of case-insensitive glob patterns, e.g. myorg/*
+type globList []string
+
+func newGlobList(value string) (globList, error) {
+	var patterns globList
+	for _, pattern := range parseList(value) {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// match returns the first pattern matching value
+func (patterns globList) match(value string) (string, bool) {
+	value = strings.ToLower(value)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func (patterns globList) String() string {
+	if len(patterns) == 0 {
+		return "(none)"
+	}
+	return strings.Join(patterns, ",")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debouncedEvent is the latest event of a debounce key, forwarded once no newer event arrived within DEBOUNCE
+type debouncedEvent struct {
+	request      *http.Request
+	filters      *filterConfig
+	destinations []relayDestination
+	body         []byte
+	summary      string
+	timer        *time.Timer
+}
+
+type debouncedEvents struct {
+	mutex   sync.Mutex
+	pending map[string]*debouncedEvent
+	// forwarding counts the forwards in progress, waited for on shutdown
+	forwarding sync.WaitGroup
+}
+
+var pendingDebounces = &debouncedEvents{pending: map[string]*debouncedEvent{}}
+
+// add holds the event back for the debounce window of its DEBOUNCE_KEY, replacing the pending event of the key and
+// restarting its window. Returns false when the event has no value for the key, so it is forwarded right away
+func (debounces *debouncedEvents) add(request *http.Request, filters *filterConfig, destinations []relayDestination, requestBody []byte, summary string) bool {
+	renderedKey, err := filters.debounceKey.render(request.Header, requestBody, func(value string) string { return value })
+	if err != nil {
+		log.Printf("Not debouncing %s, its debounce key has %v", summary, err)
+		return false
+	}
+	// routes debounce separately since they forward to different relay URLs
+	key := request.URL.Path + " " + renderedKey
+	event := &debouncedEvent{request: request.Clone(context.WithoutCancel(request.Context())), filters: filters, destinations: destinations, body: requestBody, summary: summary}
+	debounces.mutex.Lock()
+	defer debounces.mutex.Unlock()
+	if previous, found := debounces.pending[key]; found {
+		previous.timer.Stop()
+		log.Printf("Superseded %s by %s for debounce key %s", previous.summary, summary, renderedKey)
+		deliveryLog.replace(previous.request.Header.Get("X-GitHub-Delivery"), deliverySuperseded)
+	}
+	debounces.pending[key] = event
+	event.timer = time.AfterFunc(filters.debounce, func() { debounces.fire(key, event) })
+	return true
+}
+
+// fire forwards the event when it is still the pending one of its key
+func (debounces *debouncedEvents) fire(key string, event *debouncedEvent) {
+	debounces.mutex.Lock()
+	if debounces.pending[key] != event {
+		// superseded while the timer fired
+		debounces.mutex.Unlock()
+		return
+	}
+	delete(debounces.pending, key)
+	debounces.forwarding.Add(1)
+	debounces.mutex.Unlock()
+	debounces.forward(event)
+}
+
+func (debounces *debouncedEvents) forward(event *debouncedEvent) {
+	defer debounces.forwarding.Done()
+	for _, destination := range event.destinations {
+		if _, err := event.filters.retry.send(event.request.Context(), event.request, destination, event.body); err != nil {
+			log.Printf("Failed to forward debounced %s to %s: %v", event.summary, destination.url, err)
+			event.filters.deadLetters.add(event.request, destination, event.body, err)
+			deliveryLog.finish(event.request.Header.Get("X-GitHub-Delivery"), false)
+			continue
+		}
+		log.Printf("Forwarded debounced %s to %s", event.summary, destination.url)
+		deliveryLog.finish(event.request.Header.Get("X-GitHub-Delivery"), true)
+	}
+}
+
+// flushAll forwards every pending event without waiting for its window and waits for the forwards in progress, on
+// shutdown
+func (debounces *debouncedEvents) flushAll() {
+	debounces.mutex.Lock()
+	var flushed []*debouncedEvent
+	for key, event := range debounces.pending {
+		// a timer firing meanwhile finds its event gone and leaves it to the flush
+		event.timer.Stop()
+		delete(debounces.pending, key)
+		flushed = append(flushed, event)
+		debounces.forwarding.Add(1)
+	}
+	debounces.mutex.Unlock()
+	if len(flushed) > 0 {
+		log.Printf("Forwarding %d debounced events", len(flushed))
+	}
+	for _, event := range flushed {
+		go debounces.forward(event)
+	}
+	debounces.forwarding.Wait()
+}
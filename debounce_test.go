@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// memorySink records the delivery IDs of its forwards, so debounced forwards can be checked without a relay server
+// whose connections would leave the synctest bubble
+type memorySink struct {
+	mutex     sync.Mutex
+	delivered []string
+}
+
+func init() {
+	sinkOpeners["memory"] = func(*url.URL) (sink, error) { return &memorySink{}, nil }
+}
+
+func (memory *memorySink) send(_ context.Context, request *http.Request, _ []byte) (relayReply, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	memory.delivered = append(memory.delivered, request.Header.Get("X-GitHub-Delivery"))
+	return relayReply{status: http.StatusOK}, nil
+}
+
+func (memory *memorySink) deliveries() []string {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return slices.Clone(memory.delivered)
+}
+
+// newMemorySink returns the memory sink of a destination URL only used by the test
+func newMemorySink(t *testing.T) (relayDestination, *memorySink) {
+	t.Helper()
+	destinationURL := "memory://sink/" + t.Name()
+	opened, err := sinkFor(destinationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		openSinks.mutex.Lock()
+		delete(openSinks.sinks, destinationURL)
+		openSinks.mutex.Unlock()
+	})
+	return relayDestination{url: destinationURL}, opened.(*memorySink)
+}
+
+// packageDelivery is a package event of the package in the repository
+func packageDelivery(repository, name string) (*http.Request, []byte) {
+	body := []byte(`{"action":"published","repository":{"full_name":"` + repository + `"},` +
+		`"package":{"name":"` + name + `","package_type":"CONTAINER"}}`)
+	return newDelivery("package", string(body)), body
+}
+
+func newDebouncedEvents() *debouncedEvents {
+	return &debouncedEvents{pending: map[string]*debouncedEvent{}}
+}
+
+func TestDebounceForwardsLastEvent(t *testing.T) {
+	filters := loadTestFilters(t, map[string]string{"DEBOUNCE": "30s"})
+	destination, memory := newMemorySink(t)
+	synctest.Test(t, func(t *testing.T) {
+		debounces := newDebouncedEvents()
+		var last string
+		for range 3 {
+			request, body := packageDelivery("octo-org/app", "app")
+			if !debounces.add(request, filters, []relayDestination{destination}, body, "package") {
+				t.Fatal("expected the event to be debounced")
+			}
+			last = request.Header.Get("X-GitHub-Delivery")
+		}
+		time.Sleep(30 * time.Second)
+		synctest.Wait()
+		if delivered := memory.deliveries(); !slices.Equal(delivered, []string{last}) {
+			t.Errorf("expected only the last event %s to be forwarded, got %v", last, delivered)
+		}
+	})
+}
+
+func TestDebounceResetsWindow(t *testing.T) {
+	filters := loadTestFilters(t, map[string]string{"DEBOUNCE": "30s"})
+	destination, memory := newMemorySink(t)
+	synctest.Test(t, func(t *testing.T) {
+		debounces := newDebouncedEvents()
+		first, firstBody := packageDelivery("octo-org/app", "app")
+		debounces.add(first, filters, []relayDestination{destination}, firstBody, "package")
+		time.Sleep(20 * time.Second)
+		second, secondBody := packageDelivery("octo-org/app", "app")
+		debounces.add(second, filters, []relayDestination{destination}, secondBody, "package")
+
+		// past the window of the first event, within the window restarted by the second
+		time.Sleep(20 * time.Second)
+		synctest.Wait()
+		if delivered := memory.deliveries(); len(delivered) != 0 {
+			t.Fatalf("expected nothing forwarded before the restarted window ends, got %v", delivered)
+		}
+
+		time.Sleep(10 * time.Second)
+		synctest.Wait()
+		want := []string{second.Header.Get("X-GitHub-Delivery")}
+		if delivered := memory.deliveries(); !slices.Equal(delivered, want) {
+			t.Errorf("expected %v forwarded once the restarted window ended, got %v", want, delivered)
+		}
+	})
+}
+
+func TestDebounceKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		debounceKey string
+		// expected is the number of forwards of the app and cli packages of octo-org/app and the app package of
+		// octo-org/lib
+		expected int
+	}{
+		{"default key is the repository and package", "", 3},
+		{"repository key", "{repository}", 2},
+		{"package key", "{package}", 2},
+		{"constant key", "all", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"DEBOUNCE": "30s", "DEBOUNCE_KEY": test.debounceKey})
+			destination, memory := newMemorySink(t)
+			synctest.Test(t, func(t *testing.T) {
+				debounces := newDebouncedEvents()
+				for _, event := range [][2]string{{"octo-org/app", "app"}, {"octo-org/app", "cli"}, {"octo-org/lib", "app"}} {
+					request, body := packageDelivery(event[0], event[1])
+					if !debounces.add(request, filters, []relayDestination{destination}, body, "package") {
+						t.Fatal("expected the event to be debounced")
+					}
+				}
+				time.Sleep(30 * time.Second)
+				synctest.Wait()
+				if delivered := memory.deliveries(); len(delivered) != test.expected {
+					t.Errorf("expected %d forwards, got %v", test.expected, delivered)
+				}
+			})
+		})
+	}
+}
+
+func TestDebounceKeyMissing(t *testing.T) {
+	filters := loadTestFilters(t, map[string]string{"DEBOUNCE": "30s"})
+	debounces := newDebouncedEvents()
+	request := newDelivery("ping", `{"zen":"Keep it logically awesome."}`)
+	if debounces.add(request, filters, nil, []byte(`{"zen":"Keep it logically awesome."}`), "ping") {
+		t.Error("expected an event without a value for the debounce key not to be debounced")
+	}
+	if len(debounces.pending) != 0 {
+		t.Errorf("expected no pending event, got %d", len(debounces.pending))
+	}
+}
+
+func TestDebounceFlushAll(t *testing.T) {
+	filters := loadTestFilters(t, map[string]string{"DEBOUNCE": "30s"})
+	destination, memory := newMemorySink(t)
+	synctest.Test(t, func(t *testing.T) {
+		debounces := newDebouncedEvents()
+		var want []string
+		for _, repository := range []string{"octo-org/app", "octo-org/lib"} {
+			request, body := packageDelivery(repository, "app")
+			debounces.add(request, filters, []relayDestination{destination}, body, "package")
+			want = append(want, request.Header.Get("X-GitHub-Delivery"))
+		}
+		started := time.Now()
+		debounces.flushAll()
+		if waited := time.Since(started); waited != 0 {
+			t.Errorf("expected the flush not to wait for the window, waited %s", waited)
+		}
+		delivered := memory.deliveries()
+		slices.Sort(delivered)
+		slices.Sort(want)
+		if !slices.Equal(delivered, want) {
+			t.Errorf("expected %v forwarded, got %v", want, delivered)
+		}
+
+		// the stopped timers don't forward again
+		time.Sleep(time.Minute)
+		synctest.Wait()
+		if delivered := memory.deliveries(); len(delivered) != len(want) {
+			t.Errorf("expected no forward after the flush, got %v", delivered)
+		}
+	})
+}
+
+func TestHandlerDebounceAccepted(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"DEBOUNCE": "1h"}, relay.URL)
+	t.Cleanup(func() {
+		pendingDebounces.mutex.Lock()
+		defer pendingDebounces.mutex.Unlock()
+		for key, event := range pendingDebounces.pending {
+			event.timer.Stop()
+			delete(pendingDebounces.pending, key)
+		}
+	})
+	response := deliver(newDelivery("package", testPackagePayload))
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, response.Code, response.Body)
+	}
+	if reason := response.Header().Get("X-Filter-Reason"); reason != reasonForwardAccepted {
+		t.Errorf("X-Filter-Reason = %q, want %q", reason, reasonForwardAccepted)
+	}
+	if forwards := relay.forwards(); len(forwards) != 0 {
+		t.Errorf("expected the debounced event not to be forwarded yet, got %d forwards", len(forwards))
+	}
+}
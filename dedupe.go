@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupeCache remembers recently forwarded keys until their window expires
+type dedupeCache struct {
+	mutex   sync.Mutex
+	entries map[string]dedupeEntry
+}
+
+type dedupeEntry struct {
+	forwardedAt time.Time
+	expiresAt   time.Time
+}
+
+var recentForwards = &dedupeCache{entries: map[string]dedupeEntry{}}
+
+// seen reports whether key was forwarded within window, along with the time since. Unseen keys are recorded
+func (cache *dedupeCache) seen(key string, window time.Duration) (time.Duration, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if entry, found := cache.entries[key]; found && now.Before(entry.expiresAt) {
+		return now.Sub(entry.forwardedAt), true
+	}
+	cache.entries[key] = dedupeEntry{forwardedAt: now, expiresAt: now.Add(window)}
+	return 0, false
+}
+
+func (cache *dedupeCache) forget(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.entries, key)
+}
+
+// evictEvery periodically removes expired entries so the cache doesn't grow forever
+func (cache *dedupeCache) evictEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		cache.mutex.Lock()
+		now := time.Now()
+		for key, entry := range cache.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(cache.entries, key)
+			}
+		}
+		cache.mutex.Unlock()
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of delivery records
+const (
+	deliveryReceived  = "received"
+	deliveryFiltered  = "filtered"
+	deliveryRejected  = "rejected"
+	deliveryQueued    = "queued"
+	deliveryForwarded = "forwarded"
+	deliveryFailed    = "failed"
+	// deliverySuperseded events were debounced and replaced by a newer event of their key
+	deliverySuperseded = "superseded"
+	// deliveryCoalesced events were dropped from the forward queue for a newer event of their package version
+	deliveryCoalesced = "coalesced"
+)
+
+// deliveryRecord is the outcome of a delivery, listed by GET /deliveries
+type deliveryRecord struct {
+	DeliveryID string    `json:"delivery_id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Event      string    `json:"event"`
+	Path       string    `json:"path"`
+	// Verdict is the X-Filter-Reason of the response and Rule the rule or built-in filter that decided the event
+	Verdict string `json:"verdict"`
+	Rule    string `json:"rule,omitempty"`
+	Status  int    `json:"status"`
+	// State is the final state once queued forwards completed
+	State  string          `json:"state"`
+	Relays []deliveryRelay `json:"relays"`
+}
+
+// deliveryRelay is the outcome of forwarding a delivery to one relay URL. Status is 0 when the relay could not be
+// reached
+type deliveryRelay struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+// deliveryHistory keeps the records of the latest deliveries in a ring buffer. Its size is read at startup
+type deliveryHistory struct {
+	mutex   sync.Mutex
+	records []*deliveryRecord
+	// next is the ring buffer slot the next record is written to
+	next int
+	// latest indexes the most recent record of each delivery ID
+	latest map[string]*deliveryRecord
+	// store persists the records when DELIVERY_DB is set, nil otherwise
+	store *deliveryStore
+}
+
+// deliveryLog is nil when DELIVERY_LOG_SIZE is 0
+var deliveryLog *deliveryHistory
+
+// newDeliveryHistory returns the history of the last DELIVERY_LOG_SIZE deliveries, 1000 by default, or nil when it is
+// 0
+func newDeliveryHistory() (*deliveryHistory, error) {
+	size := 1000
+	if value := os.Getenv("DELIVERY_LOG_SIZE"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size < 0 {
+			return nil, fmt.Errorf("DELIVERY_LOG_SIZE must be a positive number, got %q", value)
+		}
+	}
+	if size == 0 {
+		if os.Getenv("DELIVERY_DB") != "" {
+			return nil, fmt.Errorf("DELIVERY_DB needs a DELIVERY_LOG_SIZE")
+		}
+		return nil, nil
+	}
+	history := &deliveryHistory{records: make([]*deliveryRecord, size), latest: map[string]*deliveryRecord{}}
+	var err error
+	if history.store, err = newDeliveryStore(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// keepsPayloads reports whether begin needs the payload of deliveries
+func (history *deliveryHistory) keepsPayloads() bool {
+	return history != nil && history.store != nil && history.store.payloads
+}
+
+// save writes the record to the store, if any. Callers hold the mutex
+func (history *deliveryHistory) save(record *deliveryRecord, payload []byte) {
+	if history.store != nil {
+		history.store.save(record, payload)
+	}
+}
+
+// close flushes the store, on shutdown
+func (history *deliveryHistory) close() {
+	if history != nil && history.store != nil {
+		history.store.close()
+	}
+}
+
+// begin starts the record of a received delivery, replacing the oldest record when the history is full. The payload is
+// only stored with DELIVERY_DB_PAYLOADS
+func (history *deliveryHistory) begin(request *http.Request, payload []byte) {
+	if history == nil {
+		return
+	}
+	record := &deliveryRecord{
+		DeliveryID: request.Header.Get("X-GitHub-Delivery"),
+		ReceivedAt: time.Now().UTC(),
+		Event:      request.Header.Get("X-GitHub-Event"),
+		Path:       request.URL.Path,
+		State:      deliveryReceived,
+		Relays:     []deliveryRelay{},
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if evicted := history.records[history.next]; evicted != nil && history.latest[evicted.DeliveryID] == evicted {
+		delete(history.latest, evicted.DeliveryID)
+	}
+	history.records[history.next] = record
+	history.next = (history.next + 1) % len(history.records)
+	history.latest[record.DeliveryID] = record
+	history.save(record, payload)
+}
+
+// respond records the response to the delivery. Queued forwards that completed already keep their final state
+func (history *deliveryHistory) respond(deliveryID string, status int, verdict string, rule string) {
+	if history == nil {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	record := history.latest[deliveryID]
+	if record == nil {
+		return
+	}
+	record.Status, record.Verdict, record.Rule = status, verdict, rule
+	defer history.save(record, nil)
+	if record.State != deliveryReceived {
+		return
+	}
+	switch {
+	case verdict == reasonForwarded:
+		record.State = deliveryForwarded
+	case verdict == reasonForwardAccepted:
+		record.State = deliveryQueued
+	case status >= 500:
+		record.State = deliveryFailed
+	case status >= 400:
+		record.State = deliveryRejected
+	default:
+		record.State = deliveryFiltered
+	}
+}
+
+// relayed records the last outcome of forwarding the delivery to the relay URL
+func (history *deliveryHistory) relayed(deliveryID string, relayURL string, attempts int, status int, failure error) {
+	if history == nil || deliveryID == "" {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	record := history.latest[deliveryID]
+	if record == nil {
+		return
+	}
+	defer history.save(record, nil)
+	relay := deliveryRelay{URL: relayURL, Status: status, Attempts: attempts}
+	if failure != nil {
+		relay.Error = failure.Error()
+	}
+	for index := range record.Relays {
+		if record.Relays[index].URL == relayURL {
+			relay.Attempts += record.Relays[index].Attempts
+			record.Relays[index] = relay
+			return
+		}
+	}
+	record.Relays = append(record.Relays, relay)
+}
+
+// finish records the final outcome of a queued forward of the delivery. One failed destination fails the delivery
+func (history *deliveryHistory) finish(deliveryID string, forwarded bool) {
+	if history == nil || deliveryID == "" {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	record := history.latest[deliveryID]
+	if record == nil {
+		return
+	}
+	if !forwarded {
+		record.State = deliveryFailed
+	} else if record.State == deliveryReceived || record.State == deliveryQueued {
+		record.State = deliveryForwarded
+	}
+	history.save(record, nil)
+}
+
+// replace records that the delivery was replaced by a newer event and won't be forwarded, in the superseded or
+// coalesced state
+func (history *deliveryHistory) replace(deliveryID string, state string) {
+	if history == nil || deliveryID == "" {
+		return
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if record := history.latest[deliveryID]; record != nil {
+		record.State = state
+		history.save(record, nil)
+	}
+}
+
+// handleDeliveries answers GET /deliveries/{id} with the latest record of the delivery, and GET /deliveries with the
+// ?limit= latest records received since ?since= in the ?state=, newest first. Records are read from DELIVERY_DB when
+// set. Requires ADMIN_TOKEN as bearer token
+func handleDeliveries(responseWriter http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(responseWriter, request) {
+		return
+	}
+	if deliveryLog == nil {
+		http.Error(responseWriter, "The delivery log is disabled, DELIVERY_LOG_SIZE is 0", http.StatusNotFound)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	deliveryID := request.PathValue("id")
+	if deliveryID != "" && deliveryLog.store != nil {
+		record, err := deliveryLog.store.find(deliveryID)
+		if err != nil {
+			http.Error(responseWriter, fmt.Sprintf("Failed to read the delivery database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if record == nil {
+			respondError(responseWriter, reasonBadRequest, fmt.Sprintf("No record of delivery %s", deliveryID), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(responseWriter).Encode(record)
+		return
+	}
+	if deliveryID != "" {
+		deliveryLog.mutex.Lock()
+		defer deliveryLog.mutex.Unlock()
+		record := deliveryLog.latest[deliveryID]
+		if record == nil {
+			respondError(responseWriter, reasonBadRequest, fmt.Sprintf("No record of delivery %s", deliveryID), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(responseWriter).Encode(record)
+		return
+	}
+	var since time.Time
+	if value := request.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			respondError(responseWriter, reasonBadRequest, fmt.Sprintf("since must be an RFC 3339 time, got %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 1000
+	if value := request.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			respondError(responseWriter, reasonBadRequest, fmt.Sprintf("limit must be a positive number, got %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	state := request.URL.Query().Get("state")
+	if deliveryLog.store != nil {
+		records, err := deliveryLog.store.list(since, state, limit)
+		if err != nil {
+			http.Error(responseWriter, fmt.Sprintf("Failed to read the delivery database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(responseWriter).Encode(records)
+		return
+	}
+	deliveryLog.mutex.Lock()
+	defer deliveryLog.mutex.Unlock()
+	records := []*deliveryRecord{}
+	for offset := 1; offset <= len(deliveryLog.records) && len(records) < limit; offset++ {
+		record := deliveryLog.records[(deliveryLog.next-offset+len(deliveryLog.records))%len(deliveryLog.records)]
+		if record == nil {
+			break
+		}
+		if record.ReceivedAt.Before(since) || (state != "" && record.State != state) {
+			continue
+		}
+		records = append(records, record)
+	}
+	json.NewEncoder(responseWriter).Encode(records)
+}
+
+// authorizeAdmin checks the ADMIN_TOKEN bearer token of admin endpoints, responding when it doesn't match
+func authorizeAdmin(responseWriter http.ResponseWriter, request *http.Request) bool {
+	config := currentConfig.Load()
+	if config.adminToken == "" {
+		http.Error(responseWriter, "Admin endpoints are disabled, set ADMIN_TOKEN", http.StatusNotFound)
+		return false
+	}
+	token, _ := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.adminToken)) != 1 {
+		log.Printf("Rejected admin request to %s with an invalid token", request.URL.Path)
+		http.Error(responseWriter, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
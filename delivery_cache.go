@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deliveryCache remembers the response to each delivery ID so GitHub's redeliveries of it are answered with the same
+// response instead of being forwarded again. Its settings are read at startup
+type deliveryCache struct {
+	ttl     time.Duration
+	maxSize int
+	mutex   sync.Mutex
+	// order lists the cached responses, oldest first, so the oldest are evicted when the cache is full
+	order     *list.List
+	responses map[string]*list.Element
+}
+
+// cachedResponse is the response to a delivery, replayed to its redeliveries
+type cachedResponse struct {
+	key string
+	// signature is the delivery's signature header, a redelivery is only answered from the cache when it matches
+	signature string
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// deliveryResponses is nil when DELIVERY_CACHE_TTL is not set
+var deliveryResponses *deliveryCache
+
+// newDeliveryCache returns the cache of DELIVERY_CACHE_TTL and DELIVERY_CACHE_SIZE, or nil when it is disabled
+func newDeliveryCache() (*deliveryCache, error) {
+	value := os.Getenv("DELIVERY_CACHE_TTL")
+	if value == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("DELIVERY_CACHE_TTL: %w", err)
+	}
+	if ttl <= 0 {
+		return nil, nil
+	}
+	cache := &deliveryCache{ttl: ttl, maxSize: 10000, order: list.New(), responses: map[string]*list.Element{}}
+	if value := os.Getenv("DELIVERY_CACHE_SIZE"); value != "" {
+		if cache.maxSize, err = strconv.Atoi(value); err != nil || cache.maxSize < 1 {
+			return nil, fmt.Errorf("DELIVERY_CACHE_SIZE must be a positive number, got %q", value)
+		}
+	}
+	log.Printf("Caching the responses to up to %d deliveries for %s", cache.maxSize, ttl)
+	return cache, nil
+}
+
+// deliveryKey identifies a delivery, per route since a delivery ID is only unique to a webhook
+func deliveryKey(request *http.Request) string {
+	return request.URL.Path + " " + request.Header.Get("X-GitHub-Delivery")
+}
+
+// lookup returns the cached response to the delivery, when its signature matches the one of the first delivery
+func (cache *deliveryCache) lookup(request *http.Request) (*cachedResponse, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, found := cache.responses[deliveryKey(request)]
+	if !found {
+		return nil, false
+	}
+	response := element.Value.(*cachedResponse)
+	if !time.Now().Before(response.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.responses, response.key)
+		return nil, false
+	}
+	return response, response.signature == request.Header.Get("X-Hub-Signature-256")
+}
+
+// store caches the response to the delivery, evicting expired responses and the oldest ones beyond maxSize
+func (cache *deliveryCache) store(request *http.Request, status int, header http.Header, body []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	response := &cachedResponse{key: deliveryKey(request), signature: request.Header.Get("X-Hub-Signature-256"), status: status, header: header, body: body, expiresAt: now.Add(cache.ttl)}
+	if element, found := cache.responses[response.key]; found {
+		cache.order.Remove(element)
+	}
+	cache.responses[response.key] = cache.order.PushBack(response)
+	// every response has the same TTL so the oldest expires first
+	for oldest := cache.order.Front(); oldest != nil; oldest = cache.order.Front() {
+		cached := oldest.Value.(*cachedResponse)
+		if cache.order.Len() <= cache.maxSize && now.Before(cached.expiresAt) {
+			break
+		}
+		cache.order.Remove(oldest)
+		delete(cache.responses, cached.key)
+	}
+}
+
+// reprocessRequested reports whether the delivery asks to be processed again even though its response is cached, with
+// X-Filter-Reprocess: true or ?reprocess=true
+func reprocessRequested(request *http.Request) bool {
+	for _, value := range []string{request.Header.Get("X-Filter-Reprocess"), request.URL.Query().Get("reprocess")} {
+		if reprocess, err := strconv.ParseBool(value); err == nil && reprocess {
+			return true
+		}
+	}
+	return false
+}
+
+// replay answers a redelivery with the cached response and X-Duplicate-Delivery: true
+func (response *cachedResponse) replay(responseWriter http.ResponseWriter) {
+	for name, values := range response.header {
+		responseWriter.Header()[name] = values
+	}
+	responseWriter.Header().Set("X-Duplicate-Delivery", "true")
+	responseWriter.WriteHeader(response.status)
+	responseWriter.Write(response.body)
+}
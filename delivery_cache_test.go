@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useDeliveryCache caches the responses of the handler in a cache of the TTL and size until the end of the test
+func useDeliveryCache(t *testing.T, ttl string, size string) *deliveryCache {
+	t.Helper()
+	t.Setenv("DELIVERY_CACHE_TTL", ttl)
+	t.Setenv("DELIVERY_CACHE_SIZE", size)
+	cache, err := newDeliveryCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := deliveryResponses
+	deliveryResponses = cache
+	t.Cleanup(func() { deliveryResponses = previous })
+	return cache
+}
+
+func cachedDelivery(id string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	request.Header.Set("X-GitHub-Delivery", id)
+	request.Header.Set("X-Hub-Signature-256", "sha256="+id)
+	return request
+}
+
+func TestDeliveryCacheEvictsOldest(t *testing.T) {
+	cache := useDeliveryCache(t, "1h", "2")
+	for _, id := range []string{"first", "second", "third"} {
+		cache.store(cachedDelivery(id), http.StatusOK, http.Header{}, []byte(id))
+	}
+	for id, wantCached := range map[string]bool{"first": false, "second": true, "third": true} {
+		if _, cached := cache.lookup(cachedDelivery(id)); cached != wantCached {
+			t.Errorf("%s cached = %v, want %v", id, cached, wantCached)
+		}
+	}
+}
+
+func TestDeliveryCacheStoreAgainRefreshes(t *testing.T) {
+	cache := useDeliveryCache(t, "1h", "2")
+	cache.store(cachedDelivery("first"), http.StatusOK, http.Header{}, nil)
+	cache.store(cachedDelivery("second"), http.StatusOK, http.Header{}, nil)
+	cache.store(cachedDelivery("first"), http.StatusAccepted, http.Header{}, nil)
+	cache.store(cachedDelivery("third"), http.StatusOK, http.Header{}, nil)
+	if _, cached := cache.lookup(cachedDelivery("second")); cached {
+		t.Error("second is still cached, want it evicted as the oldest")
+	}
+	if response, cached := cache.lookup(cachedDelivery("first")); !cached || response.status != http.StatusAccepted {
+		t.Errorf("first = %v %v, want its latest response cached", response, cached)
+	}
+	if cache.order.Len() != 2 || len(cache.responses) != 2 {
+		t.Errorf("cache holds %d responses indexed by %d keys, want 2", cache.order.Len(), len(cache.responses))
+	}
+}
+
+func TestDeliveryCacheExpires(t *testing.T) {
+	cache := useDeliveryCache(t, "50ms", "10")
+	cache.store(cachedDelivery("expiring"), http.StatusOK, http.Header{}, nil)
+	if _, cached := cache.lookup(cachedDelivery("expiring")); !cached {
+		t.Fatal("response not cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, cached := cache.lookup(cachedDelivery("expiring")); cached {
+		t.Error("response still cached after its TTL")
+	}
+	if cache.order.Len() != 0 || len(cache.responses) != 0 {
+		t.Errorf("expired response still held by the cache")
+	}
+}
+
+func TestDeliveryCacheStoreEvictsExpired(t *testing.T) {
+	cache := useDeliveryCache(t, "50ms", "10")
+	cache.store(cachedDelivery("expiring"), http.StatusOK, http.Header{}, nil)
+	time.Sleep(60 * time.Millisecond)
+	cache.store(cachedDelivery("fresh"), http.StatusOK, http.Header{}, nil)
+	if _, held := cache.responses[deliveryKey(cachedDelivery("expiring"))]; held || cache.order.Len() != 1 {
+		t.Errorf("storing a response kept the expired one")
+	}
+}
+
+func TestDeliveryCacheSignatureMismatch(t *testing.T) {
+	cache := useDeliveryCache(t, "1h", "10")
+	cache.store(cachedDelivery("signed"), http.StatusOK, http.Header{}, nil)
+	forged := cachedDelivery("signed")
+	forged.Header.Set("X-Hub-Signature-256", "sha256=forged")
+	if _, cached := cache.lookup(forged); cached {
+		t.Error("a delivery with another signature was answered from the cache")
+	}
+}
+
+func TestHandlerReplaysDuplicateDeliveries(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, nil, relay.URL)
+	useDeliveryCache(t, "1h", "10")
+	first := newDelivery("package", testPackagePayload)
+	redelivery := func() *http.Request {
+		request := newDelivery("package", testPackagePayload)
+		request.Header.Set("X-GitHub-Delivery", first.Header.Get("X-GitHub-Delivery"))
+		return request
+	}
+	if response := deliver(first); response.Code != http.StatusOK || response.Header().Get("X-Duplicate-Delivery") != "" {
+		t.Fatalf("first delivery = %d %v", response.Code, response.Header())
+	}
+	response := deliver(redelivery())
+	if response.Code != http.StatusOK || response.Header().Get("X-Duplicate-Delivery") != "true" || response.Header().Get("X-Filter-Reason") != reasonForwarded {
+		t.Errorf("redelivery = %d %v, want the cached response with X-Duplicate-Delivery", response.Code, response.Header())
+	}
+	if forwards := relay.forwards(); len(forwards) != 1 {
+		t.Errorf("relay received %d forwards, want the first delivery only", len(forwards))
+	}
+	reprocess := redelivery()
+	reprocess.Header.Set("X-Filter-Reprocess", "true")
+	if response := deliver(reprocess); response.Header().Get("X-Duplicate-Delivery") != "" {
+		t.Error("reprocessed redelivery was answered from the cache")
+	}
+	if forwards := relay.forwards(); len(forwards) != 2 {
+		t.Errorf("relay received %d forwards, want the reprocessed redelivery forwarded", len(forwards))
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// deliveryMigrations are applied in order to bring the database to its schema version, kept in PRAGMA user_version.
+// Migrations are only ever appended
+var deliveryMigrations = []string{
+	`CREATE TABLE deliveries (
+		delivery_id TEXT NOT NULL,
+		received_at INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		path TEXT NOT NULL,
+		verdict TEXT NOT NULL,
+		rule TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		state TEXT NOT NULL,
+		relays TEXT NOT NULL,
+		payload BLOB,
+		PRIMARY KEY (delivery_id, received_at)
+	);
+	CREATE INDEX deliveries_received_at ON deliveries (received_at);`,
+}
+
+// deliveryStore persists the delivery records in a SQLite database from a background writer, so requests never wait
+// on the disk. Its settings are read at startup
+type deliveryStore struct {
+	db *sql.DB
+	// payloads also stores the payload of every delivery
+	payloads bool
+	// retention is the age from which records are deleted, 0 to keep them
+	retention time.Duration
+	// maxRows is the number of records kept, the oldest are deleted first, 0 for no limit
+	maxRows int
+	records chan storedDelivery
+	// dropped counts the writes lost because the writer fell behind
+	dropped atomic.Int64
+	done    sync.WaitGroup
+}
+
+// storedDelivery is a snapshot of a delivery record to write, with the payload of its first write
+type storedDelivery struct {
+	record  deliveryRecord
+	payload []byte
+}
+
+// newDeliveryStore opens DELIVERY_DB, migrating its schema, and starts its writer with DELIVERY_DB_PAYLOADS,
+// DELIVERY_DB_RETENTION and DELIVERY_DB_MAX_ROWS. Returns nil when DELIVERY_DB is not set
+func newDeliveryStore() (*deliveryStore, error) {
+	path := os.Getenv("DELIVERY_DB")
+	if path == "" {
+		return nil, nil
+	}
+	store := &deliveryStore{retention: 30 * 24 * time.Hour, maxRows: 100000, records: make(chan storedDelivery, 1024)}
+	var err error
+	if store.payloads, err = lookupBool("DELIVERY_DB_PAYLOADS", false); err != nil {
+		return nil, err
+	}
+	if value := os.Getenv("DELIVERY_DB_RETENTION"); value != "" {
+		if store.retention, err = time.ParseDuration(value); err != nil || store.retention < 0 {
+			return nil, fmt.Errorf("DELIVERY_DB_RETENTION must be a positive duration, got %q", value)
+		}
+	}
+	if value := os.Getenv("DELIVERY_DB_MAX_ROWS"); value != "" {
+		if store.maxRows, err = strconv.Atoi(value); err != nil || store.maxRows < 0 {
+			return nil, fmt.Errorf("DELIVERY_DB_MAX_ROWS must be a positive number, got %q", value)
+		}
+	}
+	if store.db, err = sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"); err != nil {
+		return nil, fmt.Errorf("DELIVERY_DB: %w", err)
+	}
+	if err := store.migrate(); err != nil {
+		store.db.Close()
+		return nil, fmt.Errorf("DELIVERY_DB: %w", err)
+	}
+	log.Printf("Storing delivery records in %s, payloads: %t, retention: %s, max rows: %d", path, store.payloads, store.retention, store.maxRows)
+	store.done.Add(1)
+	go store.write()
+	return store, nil
+}
+
+// migrate applies the migrations the database doesn't have yet
+func (store *deliveryStore) migrate() error {
+	var version int
+	if err := store.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for index := version; index < len(deliveryMigrations); index++ {
+		transaction, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := transaction.Exec(deliveryMigrations[index]); err != nil {
+			transaction.Rollback()
+			return fmt.Errorf("migration %d: %w", index+1, err)
+		}
+		if _, err := transaction.Exec(fmt.Sprintf("PRAGMA user_version = %d", index+1)); err != nil {
+			transaction.Rollback()
+			return fmt.Errorf("migration %d: %w", index+1, err)
+		}
+		if err := transaction.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", index+1, err)
+		}
+		log.Printf("Migrated delivery database to version %d", index+1)
+	}
+	return nil
+}
+
+// save queues a snapshot of the record for writing, or drops it when the writer fell behind. Callers hold the
+// history mutex
+func (store *deliveryStore) save(record *deliveryRecord, payload []byte) {
+	snapshot := storedDelivery{record: *record}
+	snapshot.record.Relays = slices.Clone(record.Relays)
+	if store.payloads {
+		snapshot.payload = payload
+	}
+	select {
+	case store.records <- snapshot:
+	default:
+		if store.dropped.Add(1) == 1 {
+			log.Printf("Delivery database writer fell behind, dropping records")
+		}
+	}
+}
+
+// write upserts the queued snapshots and applies the retention every minute
+func (store *deliveryStore) write() {
+	defer store.done.Done()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	store.prune()
+	for {
+		select {
+		case snapshot, open := <-store.records:
+			if !open {
+				store.db.Close()
+				return
+			}
+			record := snapshot.record
+			relays, _ := json.Marshal(record.Relays)
+			_, err := store.db.Exec(`INSERT INTO deliveries (delivery_id, received_at, event, path, verdict, rule, status, state, relays, payload)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (delivery_id, received_at) DO UPDATE SET verdict = excluded.verdict, rule = excluded.rule,
+				status = excluded.status, state = excluded.state, relays = excluded.relays`,
+				record.DeliveryID, record.ReceivedAt.UnixNano(), record.Event, record.Path, record.Verdict, record.Rule, record.Status, record.State, string(relays), snapshot.payload)
+			if err != nil {
+				log.Printf("Error storing delivery %s: %v", record.DeliveryID, err)
+			}
+		case <-ticker.C:
+			store.prune()
+			if dropped := store.dropped.Swap(0); dropped > 0 {
+				log.Printf("Dropped %d delivery records, the database writer fell behind", dropped)
+			}
+		}
+	}
+}
+
+// prune deletes the records older than the retention and the oldest ones beyond maxRows
+func (store *deliveryStore) prune() {
+	if store.retention > 0 {
+		if _, err := store.db.Exec("DELETE FROM deliveries WHERE received_at < ?", time.Now().Add(-store.retention).UnixNano()); err != nil {
+			log.Printf("Error deleting expired delivery records: %v", err)
+		}
+	}
+	if store.maxRows > 0 {
+		if _, err := store.db.Exec("DELETE FROM deliveries WHERE received_at < (SELECT received_at FROM deliveries ORDER BY received_at DESC LIMIT 1 OFFSET ?)", store.maxRows-1); err != nil {
+			log.Printf("Error deleting old delivery records: %v", err)
+		}
+	}
+}
+
+// find returns the latest record of the delivery ID, or nil
+func (store *deliveryStore) find(deliveryID string) (*storedRecord, error) {
+	records, err := store.query("WHERE delivery_id = ? ORDER BY received_at DESC LIMIT 1", deliveryID)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+// list returns the records received from since in the state, any when empty, newest first
+func (store *deliveryStore) list(since time.Time, state string, limit int) ([]storedRecord, error) {
+	var sinceNanos int64
+	if !since.IsZero() {
+		sinceNanos = since.UnixNano()
+	}
+	return store.query("WHERE received_at >= ? AND (? = '' OR state = ?) ORDER BY received_at DESC LIMIT ?", sinceNanos, state, state, limit)
+}
+
+// storedRecord is a delivery record read from the database, with its payload when stored
+type storedRecord struct {
+	deliveryRecord
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (store *deliveryStore) query(condition string, arguments ...any) ([]storedRecord, error) {
+	rows, err := store.db.Query("SELECT delivery_id, received_at, event, path, verdict, rule, status, state, relays, payload FROM deliveries "+condition, arguments...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []storedRecord{}
+	for rows.Next() {
+		var record storedRecord
+		var receivedAt int64
+		var relays string
+		var payload []byte
+		if err := rows.Scan(&record.DeliveryID, &receivedAt, &record.Event, &record.Path, &record.Verdict, &record.Rule, &record.Status, &record.State, &relays, &payload); err != nil {
+			return nil, err
+		}
+		record.ReceivedAt = time.Unix(0, receivedAt).UTC()
+		json.Unmarshal([]byte(relays), &record.Relays)
+		if len(payload) > 0 {
+			record.Payload = payload
+			if !json.Valid(payload) {
+				record.Payload, _ = json.Marshal(string(payload))
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// close writes the queued records and closes the database, on shutdown
+func (store *deliveryStore) close() {
+	close(store.records)
+	store.done.Wait()
+}
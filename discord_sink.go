@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discordSink posts an embed rendered from the event to a Discord webhook
+type discordSink struct {
+	webhookURL  string
+	title       *fieldTemplate
+	description *fieldTemplate
+	// bestEffort posts in the background and only logs failures, so Discord never delays or fails the relay forward
+	bestEffort bool
+	// dryRun logs the rendered embed instead of posting it
+	dryRun bool
+	// rateLimit holds back posts while Discord's rate limit bucket is exhausted
+	rateLimit retryAfterPause
+	// background tracks the best effort posts still running, waited for on shutdown
+	background sync.WaitGroup
+}
+
+// discordFields are the embed fields shown when the event has a value for them
+var discordFields = []struct{ name, template string }{
+	{"Repository", "{repository}"}, {"Package", "{package}"}, {"Tag", "{tag}"}, {"Sender", "{sender}"},
+}
+
+// discordLinks are the templates of the embed link, the first the event has a value for is used
+var discordLinks = []string{"{package.package_version.html_url}", "{package.html_url}", "{repository.html_url}"}
+
+// discordBackgroundTimeout bounds a best effort post, rate limit waits included
+const discordBackgroundTimeout = 30 * time.Second
+
+func init() {
+	sinkOpeners["discord"] = openDiscordSink
+}
+
+// openDiscordSink opens discord://discord.com/api/webhooks/<id>/<token>, posting to the https webhook URL.
+// ?title= and ?description= are the embed templates, ?best_effort=false makes Discord failures fail the forward and
+// ?dry_run=true logs the embeds instead of posting them
+func openDiscordSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	if destinationURL.Host == "" || strings.Trim(destinationURL.Path, "/") == "" {
+		return nil, fmt.Errorf("expected discord://<webhook host>/<webhook path>")
+	}
+	notifier := &discordSink{bestEffort: true}
+	title := query.Get("title")
+	if title == "" {
+		title = "{event}"
+	}
+	var err error
+	if notifier.title, err = parseFieldTemplate(title); err != nil {
+		return nil, err
+	}
+	if description := query.Get("description"); description != "" {
+		if notifier.description, err = parseFieldTemplate(description); err != nil {
+			return nil, err
+		}
+	}
+	for name, setting := range map[string]*bool{"best_effort": &notifier.bestEffort, "dry_run": &notifier.dryRun} {
+		if value := query.Get(name); value != "" {
+			if *setting, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	webhookURL := url.URL{Scheme: "https", Host: destinationURL.Host, Path: destinationURL.Path}
+	notifier.webhookURL = webhookURL.String()
+	return notifier, nil
+}
+
+func (notifier *discordSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	message, err := notifier.render(request.Header, body)
+	if err != nil {
+		if notifier.bestEffort {
+			log.Printf("Discord notification of %s failed, continuing: %v", request.Header.Get("X-GitHub-Delivery"), err)
+			return relayReply{status: http.StatusOK}, nil
+		}
+		return relayReply{status: http.StatusUnprocessableEntity}, err
+	}
+	if notifier.dryRun {
+		log.Printf("Dry run, not posting Discord notification of %s: %s", request.Header.Get("X-GitHub-Delivery"), message)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	if !notifier.bestEffort {
+		return notifier.post(ctx, request.Header.Get("X-GitHub-Delivery"), message)
+	}
+	delivery := request.Header.Get("X-GitHub-Delivery")
+	notifier.background.Add(1)
+	go func() {
+		defer notifier.background.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), discordBackgroundTimeout)
+		defer cancel()
+		if _, err := notifier.post(ctx, delivery, message); err != nil {
+			log.Printf("Discord notification of %s failed, continuing: %v", delivery, err)
+		}
+	}()
+	return relayReply{status: http.StatusAccepted}, nil
+}
+
+// render builds the webhook message with a single embed
+func (notifier *discordSink) render(header http.Header, body []byte) ([]byte, error) {
+	title, err := notifier.title.render(header, body, strings.TrimSpace)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering Discord title: %v", err)
+	}
+	embed := map[string]any{"title": title, "timestamp": time.Now().UTC().Format(time.RFC3339)}
+	if notifier.description != nil {
+		if embed["description"], err = notifier.description.render(header, body, strings.TrimSpace); err != nil {
+			return nil, fmt.Errorf("Error rendering Discord description: %v", err)
+		}
+	}
+	var fields []map[string]any
+	for _, field := range discordFields {
+		template, _ := parseFieldTemplate(field.template)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			fields = append(fields, map[string]any{"name": field.name, "value": value, "inline": true})
+		}
+	}
+	if len(fields) > 0 {
+		embed["fields"] = fields
+	}
+	for _, link := range discordLinks {
+		template, _ := parseFieldTemplate(link)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			embed["url"] = value
+			break
+		}
+	}
+	return json.Marshal(map[string]any{"embeds": []any{embed}})
+}
+
+// post sends the message, pausing while Discord's rate limit bucket is exhausted and retrying 429 responses after
+// their reset as long as the context allows
+func (notifier *discordSink) post(ctx context.Context, delivery string, message []byte) (relayReply, error) {
+	for {
+		if err := notifier.rateLimit.wait(ctx); err != nil {
+			return relayReply{status: http.StatusTooManyRequests}, fmt.Errorf("Discord rate limit: %v", err)
+		}
+		newRequest, _ := http.NewRequestWithContext(ctx, "POST", notifier.webhookURL, bytes.NewReader(message))
+		newRequest.Header.Set("User-Agent", relayUserAgent)
+		newRequest.Header.Set("Content-Type", "application/json")
+		httpResponse, err := relayClient.Do(newRequest)
+		if err != nil {
+			return relayReply{}, fmt.Errorf("Error posting to Discord: %v", err)
+		}
+		reply := relayReply{status: httpResponse.StatusCode, contentType: httpResponse.Header.Get("Content-Type")}
+		reply.body, _ = io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+		httpResponse.Body.Close()
+		resetAfter := discordResetAfter(httpResponse.Header)
+		if httpResponse.StatusCode == http.StatusTooManyRequests {
+			log.Printf("Discord rate limited, retrying after %s", resetAfter)
+			notifier.rateLimit.pause(resetAfter)
+			continue
+		}
+		if httpResponse.Header.Get("X-RateLimit-Remaining") == "0" {
+			notifier.rateLimit.pause(resetAfter)
+		}
+		if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+			return reply, fmt.Errorf("Error - Discord returned status %d: %s", httpResponse.StatusCode, reply.body)
+		}
+		log.Printf("Posted Discord notification of %s", delivery)
+		return reply, nil
+	}
+}
+
+// discordResetAfter reads when the rate limit bucket resets from X-RateLimit-Reset-After, or Retry-After, and
+// defaults to a second
+func discordResetAfter(header http.Header) time.Duration {
+	for _, name := range []string{"X-RateLimit-Reset-After", "Retry-After"} {
+		if seconds, err := strconv.ParseFloat(header.Get(name), 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return time.Second
+}
+
+func (notifier *discordSink) close() {
+	notifier.background.Wait()
+}
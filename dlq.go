@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetterQueue persists the forwards that failed after all retries as one JSON file per entry in a directory
+type deadLetterQueue struct {
+	dir        string
+	maxEntries int
+	retention  time.Duration
+}
+
+// deadLetter is a failed forward with everything needed to redeliver it
+type deadLetter struct {
+	ID                 string            `json:"id"`
+	FailedAt           time.Time         `json:"failed_at"`
+	Destination        string            `json:"destination"`
+	DestinationHeaders map[string]string `json:"destination_headers,omitempty"`
+	Sink               string            `json:"sink,omitempty"`
+	FailoverURL        string            `json:"failover_url,omitempty"`
+	Balance            *relayBalance     `json:"balance,omitempty"`
+	Error              string            `json:"error"`
+	Headers            http.Header       `json:"headers,omitempty"`
+	Body               []byte            `json:"body,omitempty"`
+	// Attempts counts the automatic redeliveries of DLQ_RETRY_INTERVAL, the next one is due at NextAttempt
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	// PermanentlyFailed is set once the entry is older than DLQ_RETRY_MAX_AGE, it is only redelivered manually then
+	PermanentlyFailed bool `json:"permanently_failed,omitempty"`
+}
+
+var deadLetterMutex sync.Mutex
+
+var deadLetterIDPattern = regexp.MustCompile(`^[0-9]+-[0-9a-f]+$`)
+
+func newDeadLetterQueue(dir string, maxEntries int, retention time.Duration) (*deadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &deadLetterQueue{dir: dir, maxEntries: maxEntries, retention: retention}, nil
+}
+
+// add writes a failed forward to the queue when it is enabled, then drops expired entries and the oldest entries over maxEntries
+func (queue *deadLetterQueue) add(request *http.Request, destination relayDestination, requestBody []byte, failure error) {
+	if queue == nil {
+		return
+	}
+	random := make([]byte, 4)
+	rand.Read(random)
+	entry := deadLetter{
+		ID:                 fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(random)),
+		FailedAt:           time.Now().UTC(),
+		Destination:        destination.url,
+		DestinationHeaders: destination.headers,
+		Sink:               destination.sink,
+		FailoverURL:        destination.failover,
+		Balance:            destination.balance,
+		Error:              failure.Error(),
+		Headers:            request.Header,
+		Body:               requestBody,
+	}
+	if destination.body != nil {
+		entry.Body = destination.body
+	}
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	if err := queue.write(&entry); err != nil {
+		log.Printf("Failed to write dead letter for %s: %v", destination.url, err)
+		return
+	}
+	log.Printf("Stored failed forward to %s as dead letter %s", destination.url, entry.ID)
+	queue.prune()
+	queue.alert()
+}
+
+// prune removes expired entries and the oldest entries over maxEntries. Callers hold deadLetterMutex
+func (queue *deadLetterQueue) prune() {
+	ids, err := queue.ids()
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		return
+	}
+	for index, id := range ids {
+		expired := false
+		if queue.retention > 0 {
+			if info, err := os.Stat(queue.path(id)); err == nil && time.Since(info.ModTime()) > queue.retention {
+				expired = true
+			}
+		}
+		if expired || (queue.maxEntries > 0 && len(ids)-index > queue.maxEntries) {
+			os.Remove(queue.path(id))
+		}
+	}
+}
+
+// alert reports the number of entries to PagerDuty, which alerts on a growing queue. Callers hold deadLetterMutex
+func (queue *deadLetterQueue) alert() {
+	if ids, err := queue.ids(); err == nil {
+		pagerDuty.deadLetters(len(ids))
+	}
+}
+
+// ids returns the entry IDs, oldest first
+func (queue *deadLetterQueue) ids() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(queue.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if id := strings.TrimSuffix(filepath.Base(file), ".json"); deadLetterIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	// IDs start with the failure time in nanoseconds, all of the same length for the foreseeable future
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (queue *deadLetterQueue) path(id string) string {
+	return filepath.Join(queue.dir, id+".json")
+}
+
+// write stores the entry, replacing it when it exists. Callers hold deadLetterMutex
+func (queue *deadLetterQueue) write(entry *deadLetter) error {
+	content, _ := json.Marshal(entry)
+	return os.WriteFile(queue.path(entry.ID), content, 0o600)
+}
+
+func (queue *deadLetterQueue) read(id string) (*deadLetter, error) {
+	if !deadLetterIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	content, err := os.ReadFile(queue.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var entry deadLetter
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// handleDeadLetters lists the entries of the dead-letter queue, without their headers and bodies. Requires ADMIN_TOKEN
+// as bearer token
+func handleDeadLetters(responseWriter http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(responseWriter, request) {
+		return
+	}
+	queue := currentConfig.Load().defaultRoute.filters.deadLetters
+	if queue == nil {
+		http.Error(responseWriter, "Dead-letter queue is disabled, set DLQ_DIR", http.StatusNotFound)
+		return
+	}
+	deadLetterMutex.Lock()
+	ids, err := queue.ids()
+	deadLetterMutex.Unlock()
+	if err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Failed to list dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+	entries := []deadLetter{}
+	for _, id := range ids {
+		if entry, err := queue.read(id); err == nil {
+			entry.Headers, entry.Body = nil, nil
+			entries = append(entries, *entry)
+		}
+	}
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(entries)
+}
+
+// handleRedeliver forwards a dead letter to its destination again and removes it when that succeeds. Requires
+// ADMIN_TOKEN as bearer token
+func handleRedeliver(responseWriter http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(responseWriter, request) {
+		return
+	}
+	filters := currentConfig.Load().defaultRoute.filters
+	if filters.deadLetters == nil {
+		http.Error(responseWriter, "Dead-letter queue is disabled, set DLQ_DIR", http.StatusNotFound)
+		return
+	}
+	id := request.PathValue("id")
+	entry, err := filters.deadLetters.read(id)
+	if err != nil {
+		http.NotFound(responseWriter, request)
+		return
+	}
+	original := request.Clone(request.Context())
+	original.Header = entry.Headers
+	destination := filters.sinks.restore(relayDestination{url: entry.Destination, headers: entry.DestinationHeaders, failover: entry.FailoverURL, balance: entry.Balance}, entry.Sink)
+	if _, err := filters.retry.send(request.Context(), original, destination, entry.Body); err != nil {
+		respondError(responseWriter, reasonRelayError, fmt.Sprintf("Redelivery of dead letter %s to %s failed: %v", id, entry.Destination, err), http.StatusBadGateway)
+		return
+	}
+	deadLetterMutex.Lock()
+	os.Remove(filters.deadLetters.path(id))
+	filters.deadLetters.alert()
+	deadLetterMutex.Unlock()
+	log.Printf("Redelivered dead letter %s to %s", id, entry.Destination)
+	responseWriter.Header().Set("X-Filter-Reason", reasonForwarded)
+	responseWriter.Write([]byte(fmt.Sprintf("Dead letter %s redelivered to %s.", id, entry.Destination)))
+}
+
+func (queue *deadLetterQueue) String() string {
+	return fmt.Sprintf("%s (max %d entries, retention %s)", queue.dir, queue.maxEntries, queue.retention)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadLetterRetrier redelivers the dead letters in the background, every entry with exponential backoff until it is
+// older than maxAge, when it is marked permanently failed and left for manual redelivery. Its settings are read at
+// startup
+type deadLetterRetrier struct {
+	// interval is how often the queue is scanned for entries due
+	interval time.Duration
+	// parallel bounds the redeliveries running at once
+	parallel int
+	maxAge   time.Duration
+	// backoff is the delay before the first redelivery, doubling after every failed one
+	backoff time.Duration
+	// cancel stops the scans and the redeliveries in flight, done is closed once they returned
+	cancel context.CancelFunc
+	done   chan struct{}
+	// retried, succeeded, failed and expired count the redeliveries for /stats/filters
+	retried   atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+	expired   atomic.Int64
+}
+
+// deadLetterRetries is nil when DLQ_RETRY_INTERVAL is not set
+var deadLetterRetries *deadLetterRetrier
+
+// newDeadLetterRetrier reads DLQ_RETRY_INTERVAL, DLQ_RETRY_PARALLEL, DLQ_RETRY_MAX_AGE and DLQ_RETRY_BACKOFF. Returns
+// nil when DLQ_RETRY_INTERVAL is not set
+func newDeadLetterRetrier() (*deadLetterRetrier, error) {
+	value := os.Getenv("DLQ_RETRY_INTERVAL")
+	if value == "" {
+		return nil, nil
+	}
+	retrier := &deadLetterRetrier{parallel: 2, maxAge: 24 * time.Hour, backoff: time.Minute}
+	var err error
+	if retrier.interval, err = time.ParseDuration(value); err != nil || retrier.interval <= 0 {
+		return nil, fmt.Errorf("DLQ_RETRY_INTERVAL must be a positive duration, got %q", value)
+	}
+	for envName, setting := range map[string]*time.Duration{"DLQ_RETRY_MAX_AGE": &retrier.maxAge, "DLQ_RETRY_BACKOFF": &retrier.backoff} {
+		if value := os.Getenv(envName); value != "" {
+			if *setting, err = time.ParseDuration(value); err != nil || *setting <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration, got %q", envName, value)
+			}
+		}
+	}
+	if value := os.Getenv("DLQ_RETRY_PARALLEL"); value != "" {
+		if retrier.parallel, err = strconv.Atoi(value); err != nil || retrier.parallel < 1 {
+			return nil, fmt.Errorf("DLQ_RETRY_PARALLEL must be a positive number, got %q", value)
+		}
+	}
+	if os.Getenv("DLQ_DIR") == "" {
+		log.Printf("WARNING: DLQ_RETRY_INTERVAL is set without DLQ_DIR, there are no dead letters to retry")
+	}
+	log.Printf("Retrying dead letters every %s, %d at once, backoff: %s, max age: %s", retrier.interval, retrier.parallel, retrier.backoff, retrier.maxAge)
+	return retrier, nil
+}
+
+// start scans the queue every interval until close
+func (retrier *deadLetterRetrier) start() {
+	if retrier == nil {
+		return
+	}
+	var ctx context.Context
+	ctx, retrier.cancel = context.WithCancel(context.Background())
+	retrier.done = make(chan struct{})
+	go func() {
+		defer close(retrier.done)
+		ticker := time.NewTicker(retrier.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				retrier.scan(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// scan redelivers the entries due, skipping those whose relay circuit is open, and marks the entries over maxAge
+// permanently failed
+func (retrier *deadLetterRetrier) scan(ctx context.Context) {
+	filters := currentConfig.Load().defaultRoute.filters
+	queue := filters.deadLetters
+	if queue == nil {
+		return
+	}
+	deadLetterMutex.Lock()
+	ids, err := queue.ids()
+	deadLetterMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to list dead letters: %v", err)
+		return
+	}
+	slots := make(chan struct{}, retrier.parallel)
+	var running sync.WaitGroup
+	for _, id := range ids {
+		entry, err := queue.read(id)
+		if err != nil || entry.PermanentlyFailed {
+			continue
+		}
+		if time.Since(entry.FailedAt) > retrier.maxAge {
+			entry.PermanentlyFailed = true
+			deadLetterMutex.Lock()
+			err := queue.write(entry)
+			deadLetterMutex.Unlock()
+			if err == nil {
+				retrier.expired.Add(1)
+				log.Printf("Dead letter %s to %s is older than %s after %d redeliveries, giving up", id, entry.Destination, retrier.maxAge, entry.Attempts)
+			}
+			continue
+		}
+		if entry.NextAttempt.IsZero() {
+			entry.NextAttempt = entry.FailedAt.Add(retrier.backoff)
+		}
+		if time.Now().Before(entry.NextAttempt) || circuitBreakers.isOpen(entry.Destination, filters.retry.breaker) {
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer func() { <-slots }()
+			retrier.redeliver(ctx, filters, entry)
+		}()
+	}
+	running.Wait()
+}
+
+// redeliver forwards the entry to its destination again, removing it when that succeeds and scheduling the next
+// redelivery otherwise. Redeliveries cut short by close or by an open circuit are left as they were
+func (retrier *deadLetterRetrier) redeliver(ctx context.Context, filters *filterConfig, entry *deadLetter) {
+	request, _ := http.NewRequestWithContext(ctx, "POST", "/", nil)
+	request.Header = entry.Headers
+	destination := filters.sinks.restore(relayDestination{url: entry.Destination, headers: entry.DestinationHeaders, failover: entry.FailoverURL, balance: entry.Balance}, entry.Sink)
+	_, err := filters.retry.send(ctx, request, destination, entry.Body)
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errCircuitOpen)) {
+		// another redelivery is probing the relay, this one waits for the next scan
+		return
+	}
+	retrier.retried.Add(1)
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	if _, statErr := os.Stat(filters.deadLetters.path(entry.ID)); statErr != nil {
+		// redelivered manually or pruned meanwhile
+		return
+	}
+	if err == nil {
+		retrier.succeeded.Add(1)
+		os.Remove(filters.deadLetters.path(entry.ID))
+		filters.deadLetters.alert()
+		log.Printf("Redelivered dead letter %s to %s after %d failed redeliveries", entry.ID, entry.Destination, entry.Attempts)
+		return
+	}
+	retrier.failed.Add(1)
+	entry.Attempts++
+	entry.Error = err.Error()
+	entry.NextAttempt = time.Now().Add(retrier.backoff << min(entry.Attempts, 20))
+	if writeErr := filters.deadLetters.write(entry); writeErr != nil {
+		log.Printf("Failed to update dead letter %s: %v", entry.ID, writeErr)
+		return
+	}
+	log.Printf("Redelivery %d of dead letter %s to %s failed, next at %s: %v", entry.Attempts, entry.ID, entry.Destination, entry.NextAttempt.Format(time.RFC3339), err)
+}
+
+// close stops the scans and cancels the redeliveries in flight, on shutdown
+func (retrier *deadLetterRetrier) close() {
+	if retrier == nil || retrier.cancel == nil {
+		return
+	}
+	retrier.cancel()
+	<-retrier.done
+}
+
+// counts returns the redeliveries attempted, succeeded and failed, and the entries given up, nil when disabled
+func (retrier *deadLetterRetrier) counts() map[string]int64 {
+	if retrier == nil {
+		return nil
+	}
+	return map[string]int64{"retried": retrier.retried.Load(), "succeeded": retrier.succeeded.Load(), "failed": retrier.failed.Load(), "expired": retrier.expired.Load()}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// emailTimeout bounds sending an email, from connecting to the server to its acceptance
+const emailTimeout = 30 * time.Second
+
+// emailSink emails a message rendered from the event through an SMTP server. Emails are best effort: they are sent in
+// the background so the forward never waits for them, and failures are only logged and counted
+type emailSink struct {
+	address string
+	host    string
+	// implicitTLS connects with TLS, startTLS upgrades the connection and neither sends in plain text
+	implicitTLS bool
+	startTLS    bool
+	tlsConfig   *tls.Config
+	auth        smtp.Auth
+	from        *mail.Address
+	to          []string
+	// body is nil for the default body listing the repository, package, tag, sender and link the event has
+	subject *fieldTemplate
+	body    *fieldTemplate
+	// key and interval limit emails to one per rendered key and interval, 0 sending every email
+	key      *fieldTemplate
+	interval time.Duration
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+	// sent, failed and limited count the emails for /stats/filters
+	sent       atomic.Int64
+	failed     atomic.Int64
+	limited    atomic.Int64
+	background sync.WaitGroup
+}
+
+func init() {
+	sinkOpeners["smtp"] = openEmailSink
+	sinkOpeners["smtps"] = openEmailSink
+}
+
+// openEmailSink opens smtp://[user:password@]<host>[:port]?from=<address>&to=<address>&to=..., or smtps:// for implicit
+// TLS. ?subject= and ?body= are templates, ?tls=none sends without STARTTLS, and ?interval= and ?key= limit the emails
+func openEmailSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	if destinationURL.Hostname() == "" || query.Get("from") == "" || query.Get("to") == "" {
+		return nil, fmt.Errorf("expected smtp://<host>[:port]?from=<address>&to=<address>")
+	}
+	mailer := &emailSink{host: destinationURL.Hostname(), implicitTLS: destinationURL.Scheme == "smtps", startTLS: destinationURL.Scheme == "smtp", interval: 10 * time.Minute, lastSent: map[string]time.Time{}}
+	port := destinationURL.Port()
+	if port == "" {
+		port = "587"
+		if mailer.implicitTLS {
+			port = "465"
+		}
+	}
+	mailer.address = net.JoinHostPort(mailer.host, port)
+	switch mode := query.Get("tls"); mode {
+	case "", "starttls":
+	case "none":
+		if mailer.implicitTLS {
+			return nil, fmt.Errorf("tls=none doesn't apply to smtps")
+		}
+		mailer.startTLS = false
+	default:
+		return nil, fmt.Errorf("tls must be starttls or none, got %q", mode)
+	}
+	mailer.tlsConfig = relayClient.Transport.(*http.Transport).TLSClientConfig.Clone()
+	mailer.tlsConfig.ServerName = mailer.host
+	if destinationURL.User != nil {
+		password, _ := destinationURL.User.Password()
+		// net/smtp refuses to send the password without TLS, except to localhost
+		mailer.auth = smtp.PlainAuth("", destinationURL.User.Username(), password, mailer.host)
+	}
+	var err error
+	if mailer.from, err = mail.ParseAddress(query.Get("from")); err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	// ?to= is repeated for several recipients, since RELAY_URLS separates URLs with commas
+	for _, value := range query["to"] {
+		recipients, err := mail.ParseAddressList(value)
+		if err != nil {
+			return nil, fmt.Errorf("to: %w", err)
+		}
+		for _, recipient := range recipients {
+			mailer.to = append(mailer.to, recipient.Address)
+		}
+	}
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "GitHub {event} event of {repository}"
+	}
+	if mailer.subject, err = parseFieldTemplate(subject); err != nil {
+		return nil, fmt.Errorf("subject: %w", err)
+	}
+	if body := query.Get("body"); body != "" {
+		if mailer.body, err = parseFieldTemplate(body); err != nil {
+			return nil, fmt.Errorf("body: %w", err)
+		}
+	}
+	key := query.Get("key")
+	if key == "" {
+		key = "{repository}/{package}"
+	}
+	if mailer.key, err = parseFieldTemplate(key); err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	if value := query.Get("interval"); value != "" {
+		if mailer.interval, err = time.ParseDuration(value); err != nil || mailer.interval < 0 {
+			return nil, fmt.Errorf("interval must be a positive duration, got %q", value)
+		}
+	}
+	return mailer, nil
+}
+
+func (mailer *emailSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	delivery := request.Header.Get("X-GitHub-Delivery")
+	message, err := mailer.render(request.Header, body)
+	if err != nil {
+		mailer.failed.Add(1)
+		log.Printf("Email notification of %s failed, continuing: %v", delivery, err)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	if !mailer.allow(request.Header, body) {
+		mailer.limited.Add(1)
+		log.Printf("Not emailing %s, an email of its key was sent within %s", delivery, mailer.interval)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	mailer.background.Add(1)
+	go func() {
+		defer mailer.background.Done()
+		if err := mailer.deliver(message); err != nil {
+			mailer.failed.Add(1)
+			log.Printf("Email notification of %s failed, continuing: %v", delivery, err)
+			return
+		}
+		mailer.sent.Add(1)
+		log.Printf("Emailed notification of %s to %s", delivery, strings.Join(mailer.to, ", "))
+	}()
+	return relayReply{status: http.StatusAccepted}, nil
+}
+
+// allow reports whether no email of the event's key was sent within the interval, recording the email when allowed.
+// Events without a value for the key share the key of their event type
+func (mailer *emailSink) allow(header http.Header, body []byte) bool {
+	if mailer.interval == 0 {
+		return true
+	}
+	key, err := mailer.key.render(header, body, func(value string) string { return value })
+	if err != nil {
+		key = header.Get("X-GitHub-Event")
+	}
+	now := time.Now()
+	mailer.mutex.Lock()
+	defer mailer.mutex.Unlock()
+	if sent, found := mailer.lastSent[key]; found && now.Sub(sent) < mailer.interval {
+		return false
+	}
+	mailer.lastSent[key] = now
+	if len(mailer.lastSent) > 1000 {
+		for key, sent := range mailer.lastSent {
+			if now.Sub(sent) >= mailer.interval {
+				delete(mailer.lastSent, key)
+			}
+		}
+	}
+	return true
+}
+
+// render builds the plain text email, quoted-printable encoded
+func (mailer *emailSink) render(header http.Header, body []byte) ([]byte, error) {
+	subject, err := mailer.subject.render(header, body, strings.TrimSpace)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering email subject: %v", err)
+	}
+	var text string
+	if mailer.body != nil {
+		if text, err = mailer.body.render(header, body, func(value string) string { return value }); err != nil {
+			return nil, fmt.Errorf("Error rendering email body: %v", err)
+		}
+	} else {
+		text = defaultEmailBody(header, body)
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", mailer.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(mailer.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+	encoder := quotedprintable.NewWriter(&message)
+	encoder.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	encoder.Close()
+	return message.Bytes(), nil
+}
+
+// defaultEmailBody lists the event type and action, the repository, package, tag and sender the event has, the link to
+// its package version, package or repository page and the delivery ID
+func defaultEmailBody(header http.Header, body []byte) string {
+	var lines []string
+	eventTemplate, _ := parseFieldTemplate("{event} {action}")
+	if value, err := eventTemplate.render(header, body, strings.TrimSpace); err == nil {
+		lines = append(lines, "Event: "+value)
+	} else {
+		lines = append(lines, "Event: "+header.Get("X-GitHub-Event"))
+	}
+	for _, field := range discordFields {
+		template, _ := parseFieldTemplate(field.template)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			lines = append(lines, field.name+": "+value)
+		}
+	}
+	for _, link := range discordLinks {
+		template, _ := parseFieldTemplate(link)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			lines = append(lines, "Link: "+value)
+			break
+		}
+	}
+	lines = append(lines, "Delivery: "+header.Get("X-GitHub-Delivery"))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// deliver sends the message through the SMTP server
+func (mailer *emailSink) deliver(message []byte) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var connection net.Conn
+	var err error
+	if mailer.implicitTLS {
+		connection, err = tls.DialWithDialer(dialer, "tcp", mailer.address, mailer.tlsConfig)
+	} else {
+		connection, err = dialer.Dial("tcp", mailer.address)
+	}
+	if err != nil {
+		return err
+	}
+	connection.SetDeadline(time.Now().Add(emailTimeout))
+	client, err := smtp.NewClient(connection, mailer.host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	defer client.Close()
+	if mailer.startTLS {
+		if supported, _ := client.Extension("STARTTLS"); !supported {
+			return fmt.Errorf("%s doesn't support STARTTLS, set ?tls=none to send without TLS", mailer.address)
+		}
+		if err := client.StartTLS(mailer.tlsConfig); err != nil {
+			return err
+		}
+	}
+	if mailer.auth != nil {
+		if err := client.Auth(mailer.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(mailer.from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range mailer.to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// close waits for the emails still being sent, on shutdown
+func (mailer *emailSink) close() {
+	mailer.background.Wait()
+}
+
+// emailCounts returns the emails sent, failed and rate limited by the open email sinks, by destination URL without
+// password
+func emailCounts() map[string]map[string]int64 {
+	openSinks.mutex.Lock()
+	defer openSinks.mutex.Unlock()
+	counts := map[string]map[string]int64{}
+	for destinationURL, opened := range openSinks.sinks {
+		if mailer, ok := opened.(*emailSink); ok {
+			counts[redactURL(destinationURL)] = map[string]int64{"sent": mailer.sent.Load(), "failed": mailer.failed.Load(), "rate_limited": mailer.limited.Load()}
+		}
+	}
+	return counts
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// eventActionMatrix maps an event type to the actions forwarded for it. An empty action set stands for the * wildcard
+type eventActionMatrix map[string]stringSet
+
+// parseEventActionMatrix parses a comma-separated list of event:action pairs, e.g. package:published, workflow_run:*
+func parseEventActionMatrix(value string) (eventActionMatrix, error) {
+	matrix := eventActionMatrix{}
+	for _, pair := range parseList(value) {
+		eventType, action, found := strings.Cut(pair, ":")
+		eventType, action = strings.TrimSpace(eventType), strings.TrimSpace(action)
+		if !found || eventType == "" || action == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected event:action", pair)
+		}
+		if eventType == "*" || strings.Contains(action, ":") {
+			return nil, fmt.Errorf("invalid pair %q, only the action can be the * wildcard", pair)
+		}
+		eventType = canonicalEventType(eventType)
+		actions, listed := matrix[eventType]
+		switch {
+		case action == "*":
+			matrix[eventType] = stringSet{}
+		case !listed:
+			matrix[eventType] = stringSet{action: true}
+		case len(actions) > 0:
+			actions[action] = true
+		}
+	}
+	if len(matrix) == 0 {
+		return nil, nil
+	}
+	return matrix, nil
+}
+
+// filter drops events whose event type and action pair is not in the matrix
+func (matrix eventActionMatrix) filter(eventType string, action string) *filterReason {
+	if actions, listed := matrix[eventType]; listed && actions.allows(action) {
+		return nil
+	}
+	return filtered(reasonEventActionFiltered, "Filtered out %s event with action %s! Allowed event actions: %s. No forward to relay", eventType, action, matrix)
+}
+
+func (matrix eventActionMatrix) String() string {
+	pairs := make([]string, 0, len(matrix))
+	for eventType, actions := range matrix {
+		if len(actions) == 0 {
+			pairs = append(pairs, eventType+":*")
+		}
+		for action := range actions {
+			pairs = append(pairs, eventType+":"+action)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
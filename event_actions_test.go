@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestParseEventActionMatrix(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantMatrix string
+		wantErr    bool
+	}{
+		{value: "package:published, release:released, workflow_run:completed", wantMatrix: "package:published,release:released,workflow_run:completed"},
+		{value: "package:published,package:updated", wantMatrix: "package:published,package:updated"},
+		{value: "package:*", wantMatrix: "package:*"},
+		{value: "package:published,package:*", wantMatrix: "package:*"},
+		{value: "package:*,package:published", wantMatrix: "package:*"},
+		{value: "registry_package:published", wantMatrix: "package:published"},
+		{value: " package : published ", wantMatrix: "package:published"},
+		{value: "", wantMatrix: ""},
+		{value: "package", wantErr: true},
+		{value: "package:", wantErr: true},
+		{value: ":published", wantErr: true},
+		{value: "*:published", wantErr: true},
+		{value: "package:published:extra", wantErr: true},
+		{value: "package:published,release", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			matrix, err := parseEventActionMatrix(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if matrix.String() != test.wantMatrix {
+				t.Errorf("matrix = %s, want %s", matrix, test.wantMatrix)
+			}
+		})
+	}
+}
+
+func TestEventActionMatrixFilter(t *testing.T) {
+	matrix, err := parseEventActionMatrix("package:published,release:released,workflow_run:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		eventType   string
+		action      string
+		wantAllowed bool
+	}{
+		{eventType: "package", action: "published", wantAllowed: true},
+		{eventType: "package", action: "updated", wantAllowed: false},
+		{eventType: "release", action: "released", wantAllowed: true},
+		{eventType: "release", action: "published", wantAllowed: false},
+		{eventType: "workflow_run", action: "requested", wantAllowed: true},
+		{eventType: "workflow_run", action: "", wantAllowed: true},
+		{eventType: "push", action: "", wantAllowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.eventType+":"+test.action, func(t *testing.T) {
+			reason := matrix.filter(test.eventType, test.action)
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v", allowed, test.wantAllowed)
+			}
+			if reason != nil && reason.Code != reasonEventActionFiltered {
+				t.Errorf("reason = %q, want %q", reason.Code, reasonEventActionFiltered)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// eventGridMaxBatchBytes is the Event Grid limit of a publish request, and so of a single event
+const eventGridMaxBatchBytes = 1024 * 1024
+
+// eventGridScope is the token scope of managed identity authentication
+const eventGridScope = "https://eventgrid.azure.net/.default"
+
+// eventGridSink publishes forwards to an Azure Event Grid topic, in the Event Grid or CloudEvents schema. Concurrent
+// forwards are published together in batches of up to the Event Grid request size limit
+type eventGridSink struct {
+	endpoint    string
+	cloudEvents bool
+	eventType   *fieldTemplate
+	// defaultEventType falls back to GitHub.<Event> for events without an action
+	defaultEventType bool
+	// pascalCase converts the eventType values to PascalCase, e.g. workflow_run to WorkflowRun
+	pascalCase bool
+	subject    *fieldTemplate
+	// key is the topic access key, empty when credential authenticates with a managed identity token
+	key        string
+	credential azcore.TokenCredential
+	// batchWait is how long a batch waits for more events after its first one, 0 to only batch the events already
+	// waiting while the previous batch is published
+	batchWait time.Duration
+	publishes chan *eventGridPublish
+}
+
+// eventGridPublish is an event waiting to be published, with the channel its result is sent to
+type eventGridPublish struct {
+	ctx    context.Context
+	event  []byte
+	result chan eventGridResult
+}
+
+type eventGridResult struct {
+	reply relayReply
+	err   error
+}
+
+// eventGridEvent is an event of the Event Grid schema
+type eventGridEvent struct {
+	ID          string          `json:"id"`
+	EventType   string          `json:"eventType"`
+	Subject     string          `json:"subject"`
+	EventTime   string          `json:"eventTime"`
+	Data        json.RawMessage `json:"data"`
+	DataVersion string          `json:"dataVersion"`
+}
+
+func init() {
+	sinkOpeners["eventgrid"] = openEventGridSink
+}
+
+// openEventGridSink opens eventgrid://<topic host>[/<path>], publishing to the https topic endpoint, /api/events by
+// default. ?key_env= names the environment variable holding the topic key, or ?auth=managed_identity authenticates
+// with the managed identity, user-assigned with ?client_id=. ?schema=cloudevents publishes CloudEvents, ?event_type=
+// and ?subject= are templates and ?batch_wait= holds batches back for more events
+func openEventGridSink(destinationURL *url.URL) (sink, error) {
+	if destinationURL.Host == "" {
+		return nil, fmt.Errorf("expected eventgrid://<topic host>[/<path>]")
+	}
+	query := destinationURL.Query()
+	endpoint := url.URL{Scheme: "https", Host: destinationURL.Host, Path: destinationURL.Path}
+	if strings.Trim(endpoint.Path, "/") == "" {
+		endpoint.Path = "/api/events"
+	}
+	grid := &eventGridSink{endpoint: endpoint.String(), pascalCase: true, publishes: make(chan *eventGridPublish)}
+	switch schema := query.Get("schema"); schema {
+	case "", "eventgrid":
+	case "cloudevents":
+		grid.cloudEvents = true
+	default:
+		return nil, fmt.Errorf("schema must be eventgrid or cloudevents, got %q", schema)
+	}
+	eventType := query.Get("event_type")
+	if eventType == "" {
+		eventType, grid.defaultEventType = "GitHub.{event}.{action}", true
+	}
+	subject := query.Get("subject")
+	if subject == "" {
+		subject = "{repository}"
+	}
+	var err error
+	if grid.eventType, err = parseFieldTemplate(eventType); err != nil {
+		return nil, fmt.Errorf("event_type: %w", err)
+	}
+	if grid.subject, err = parseFieldTemplate(subject); err != nil {
+		return nil, fmt.Errorf("subject: %w", err)
+	}
+	switch typeCase := query.Get("type_case"); typeCase {
+	case "", "pascal":
+	case "none":
+		grid.pascalCase = false
+	default:
+		return nil, fmt.Errorf("type_case must be pascal or none, got %q", typeCase)
+	}
+	if value := query.Get("batch_wait"); value != "" {
+		if grid.batchWait, err = time.ParseDuration(value); err != nil || grid.batchWait < 0 {
+			return nil, fmt.Errorf("batch_wait must be a positive duration, got %q", value)
+		}
+	}
+	switch auth := query.Get("auth"); auth {
+	case "", "key":
+		keyEnv := query.Get("key_env")
+		if keyEnv == "" {
+			return nil, fmt.Errorf("expected ?key_env=<variable holding the topic key> or ?auth=managed_identity")
+		}
+		if grid.key = os.Getenv(keyEnv); grid.key == "" {
+			return nil, fmt.Errorf("key_env: %s is not set", keyEnv)
+		}
+	case "managed_identity":
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		if clientID := query.Get("client_id"); clientID != "" {
+			options.ID = azidentity.ClientID(clientID)
+		}
+		if grid.credential, err = azidentity.NewManagedIdentityCredential(options); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("auth must be key or managed_identity, got %q", auth)
+	}
+	go grid.publish()
+	return grid, nil
+}
+
+// send queues the event for the next batch and waits for the batch to be published
+func (grid *eventGridSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	event, err := grid.encode(request.Header, body)
+	if err != nil {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error rendering Event Grid event: %v", err)
+	}
+	if len(event)+2 > eventGridMaxBatchBytes {
+		return relayReply{status: http.StatusRequestEntityTooLarge}, fmt.Errorf("Event Grid event of %d bytes exceeds the 1 MB limit", len(event))
+	}
+	publish := &eventGridPublish{ctx: ctx, event: event, result: make(chan eventGridResult, 1)}
+	select {
+	case grid.publishes <- publish:
+	case <-ctx.Done():
+		return relayReply{}, ctx.Err()
+	}
+	select {
+	case result := <-publish.result:
+		return result.reply, result.err
+	case <-ctx.Done():
+		return relayReply{}, ctx.Err()
+	}
+}
+
+// encode wraps the payload in an event of the schema
+func (grid *eventGridSink) encode(header http.Header, body []byte) ([]byte, error) {
+	escape := func(value string) string { return value }
+	if grid.pascalCase {
+		escape = pascalCase
+	}
+	eventType, err := grid.eventType.render(header, body, escape)
+	if err != nil && grid.defaultEventType {
+		eventType, err = "GitHub."+escape(header.Get("X-GitHub-Event")), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	subject, err := grid.subject.render(header, body, func(value string) string { return value })
+	if err != nil {
+		// Event Grid requires a subject
+		subject = header.Get("X-GitHub-Event")
+	}
+	if grid.cloudEvents {
+		event := newCloudEvent(header, body)
+		event.Type, event.Subject = eventType, subject
+		if event.ID == "" {
+			event.ID = eventGridID(body)
+		}
+		return json.Marshal(event)
+	}
+	event := eventGridEvent{
+		ID:          header.Get("X-GitHub-Delivery"),
+		EventType:   eventType,
+		Subject:     subject,
+		EventTime:   time.Now().UTC().Format(time.RFC3339),
+		Data:        body,
+		DataVersion: "1.0",
+	}
+	if event.ID == "" {
+		event.ID = eventGridID(body)
+	}
+	if !json.Valid(body) {
+		event.Data, _ = json.Marshal(string(body))
+	}
+	return json.Marshal(event)
+}
+
+// eventGridID identifies events without a delivery ID by their payload, since Event Grid requires an id
+func eventGridID(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:16])
+}
+
+// pascalCase converts a value such as workflow_run to WorkflowRun, for Event Grid event types
+func pascalCase(value string) string {
+	words := strings.FieldsFunc(value, func(r rune) bool { return r == '_' || r == '-' || r == ' ' })
+	for index, word := range words {
+		words[index] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, "")
+}
+
+// publish collects the queued events into batches up to the size limit and publishes them one batch at a time
+func (grid *eventGridSink) publish() {
+	var carried *eventGridPublish
+	for {
+		first := carried
+		if first == nil {
+			first = <-grid.publishes
+		}
+		carried = nil
+		batch, size := []*eventGridPublish{first}, len(first.event)+2
+		var wait <-chan time.Time
+		if grid.batchWait > 0 {
+			wait = time.After(grid.batchWait)
+		}
+	collect:
+		for {
+			var next *eventGridPublish
+			if wait == nil {
+				select {
+				case next = <-grid.publishes:
+				default:
+					break collect
+				}
+			} else {
+				select {
+				case next = <-grid.publishes:
+				case <-wait:
+					break collect
+				}
+			}
+			if size+len(next.event)+1 > eventGridMaxBatchBytes {
+				carried = next
+				break collect
+			}
+			batch, size = append(batch, next), size+len(next.event)+1
+		}
+		grid.publishBatch(batch)
+	}
+}
+
+// publishBatch posts the batch and sends the result to every event. A batch Event Grid rejects as invalid is published
+// again one event at a time, so a single invalid event doesn't fail the others
+func (grid *eventGridSink) publishBatch(batch []*eventGridPublish) {
+	reply, err := grid.post(batch)
+	if err != nil && len(batch) > 1 && (reply.status == http.StatusBadRequest || reply.status == http.StatusRequestEntityTooLarge) {
+		log.Printf("Event Grid topic %s rejected a batch of %d events, publishing them one at a time: %v", grid.endpoint, len(batch), err)
+		for _, publish := range batch {
+			grid.publishBatch([]*eventGridPublish{publish})
+		}
+		return
+	}
+	if err == nil {
+		log.Printf("Event Grid topic %s accepted %d events", grid.endpoint, len(batch))
+	}
+	for _, publish := range batch {
+		publish.result <- eventGridResult{reply: reply, err: err}
+	}
+}
+
+// post sends the batch as a JSON array, until the latest deadline of its events
+func (grid *eventGridSink) post(batch []*eventGridPublish) (relayReply, error) {
+	ctx, deadline := context.Background(), time.Time{}
+	for _, publish := range batch {
+		eventDeadline, found := publish.ctx.Deadline()
+		if !found {
+			deadline = time.Time{}
+			break
+		}
+		if eventDeadline.After(deadline) {
+			deadline = eventDeadline
+		}
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	var encoded bytes.Buffer
+	encoded.WriteByte('[')
+	for index, publish := range batch {
+		if index > 0 {
+			encoded.WriteByte(',')
+		}
+		encoded.Write(publish.event)
+	}
+	encoded.WriteByte(']')
+	newRequest, _ := http.NewRequestWithContext(ctx, "POST", grid.endpoint, &encoded)
+	newRequest.Header.Set("User-Agent", relayUserAgent)
+	newRequest.Header.Set("Content-Type", "application/json")
+	if grid.cloudEvents {
+		newRequest.Header.Set("Content-Type", "application/cloudevents-batch+json; charset=utf-8")
+	}
+	if grid.credential != nil {
+		token, err := grid.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{eventGridScope}})
+		if err != nil {
+			return relayReply{}, fmt.Errorf("Error getting a managed identity token for Event Grid: %v", err)
+		}
+		newRequest.Header.Set("Authorization", "Bearer "+token.Token)
+	} else {
+		newRequest.Header.Set("aeg-sas-key", grid.key)
+	}
+	httpResponse, err := relayClient.Do(newRequest)
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to Event Grid topic %s: %v", grid.endpoint, err)
+	}
+	defer httpResponse.Body.Close()
+	reply := relayReply{status: httpResponse.StatusCode, contentType: httpResponse.Header.Get("Content-Type")}
+	reply.body, _ = io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+	if httpResponse.StatusCode == http.StatusTooManyRequests || httpResponse.StatusCode == http.StatusServiceUnavailable {
+		reply.retryAfter, _ = parseRetryAfter(httpResponse.Header.Get("Retry-After"))
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		return reply, fmt.Errorf("Error - Event Grid topic %s returned status %d: %s", grid.endpoint, httpResponse.StatusCode, reply.body)
+	}
+	return reply, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// WebhookEvent holds the fields shared by every GitHub webhook payload
+type WebhookEvent struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName   string `json:"full_name"`
+		Private    *bool  `json:"private"`
+		Visibility string `json:"visibility"`
+		// Topics is missing from some older payloads, which counts as no topics
+		Topics []string `json:"topics"`
+		Owner  struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Organization *struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+	Sender struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"sender"`
+}
+
+// ownerLogin returns the organization that owns the event, falling back to the repository owner for user-owned repos
+func (event *WebhookEvent) ownerLogin() string {
+	if event.Organization != nil && event.Organization.Login != "" {
+		return event.Organization.Login
+	}
+	return event.Repository.Owner.Login
+}
+
+// repositoryVisibility returns private or public, or an empty string when the payload has no repository visibility.
+// Internal repositories are reported as private
+func (event *WebhookEvent) repositoryVisibility() string {
+	switch event.Repository.Visibility {
+	case "public":
+		return "public"
+	case "private", "internal":
+		return "private"
+	}
+	if event.Repository.Private != nil {
+		if *event.Repository.Private {
+			return "private"
+		}
+		return "public"
+	}
+	return ""
+}
+
+// typedEvent is implemented by the payloads of event types that have their own filters
+type typedEvent interface {
+	// exclude returns the reason when the event matches an exclusion
+	exclude(config *filterConfig) *filterReason
+	// filter returns the reason when the event does not pass the allow filters
+	filter(config *filterConfig) *filterReason
+	// summary describes the event in log lines and responses
+	summary() string
+}
+
+// eventTypes maps X-GitHub-Event values to their typed payloads
+var eventTypes = map[string]func() typedEvent{
+	"package":      func() typedEvent { return &PackageEvent{} },
+	"pull_request": func() typedEvent { return &PullRequestEvent{} },
+	"push":         func() typedEvent { return &PushEvent{} },
+	"release":      func() typedEvent { return &ReleaseEvent{} },
+	"workflow_run": func() typedEvent { return &WorkflowRunEvent{} },
+}
+
+// canonicalEventType maps legacy X-GitHub-Event names onto the event type they are filtered as
+func canonicalEventType(eventType string) string {
+	if eventType == "registry_package" {
+		return "package"
+	}
+	return eventType
+}
+
+type PackageEvent struct {
+	WebhookEvent
+	Package packagePayload `json:"package"`
+	// RegistryPackage holds the package of legacy registry_package events, copied into Package when decoding
+	RegistryPackage *packagePayload `json:"registry_package"`
+	// variant is the payload key the package was read from, package or registry_package
+	variant string
+}
+
+type packagePayload struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"owner"`
+	PackageVersion struct {
+		Version           string `json:"version"`
+		PackageURL        string `json:"package_url"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name string `json:"name"`
+			} `json:"tag"`
+			Manifest struct {
+				MediaType string `json:"media_type"`
+				Config    struct {
+					MediaType string `json:"media_type"`
+				} `json:"config"`
+				Layers []struct {
+					MediaType string `json:"media_type"`
+				} `json:"layers"`
+			} `json:"manifest"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+// UnmarshalJSON decodes both the package and the legacy registry_package payload shapes into Package
+func (event *PackageEvent) UnmarshalJSON(data []byte) error {
+	type plainPackageEvent PackageEvent
+	if err := json.Unmarshal(data, (*plainPackageEvent)(event)); err != nil {
+		return err
+	}
+	event.variant = "package"
+	if event.RegistryPackage != nil {
+		event.Package = *event.RegistryPackage
+		event.variant = "registry_package"
+	}
+	return nil
+}
+
+func (event *PackageEvent) containerTag() string {
+	return event.Package.PackageVersion.ContainerMetadata.Tag.Name
+}
+
+// versionOf returns the package version (version), the container tag (tag) or the version falling back to the tag (auto)
+func (event *PackageEvent) versionOf(field string) string {
+	switch field {
+	case "version":
+		return event.Package.PackageVersion.Version
+	case "tag":
+		return event.containerTag()
+	}
+	return event.version()
+}
+
+// manifestMediaTypes returns the media types of the container manifest, its config and its layers present in the payload
+func (event *PackageEvent) manifestMediaTypes() []string {
+	manifest := event.Package.PackageVersion.ContainerMetadata.Manifest
+	var mediaTypes []string
+	for _, mediaType := range []string{manifest.MediaType, manifest.Config.MediaType} {
+		if mediaType != "" {
+			mediaTypes = append(mediaTypes, mediaType)
+		}
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != "" {
+			mediaTypes = append(mediaTypes, layer.MediaType)
+		}
+	}
+	return mediaTypes
+}
+
+// version returns the package version, falling back to the container tag
+func (event *PackageEvent) version() string {
+	if version := event.Package.PackageVersion.Version; version != "" {
+		return version
+	}
+	return event.containerTag()
+}
+
+// dedupeKey identifies a published package version across repeated deliveries
+func (event *PackageEvent) dedupeKey() string {
+	key := fmt.Sprintf("%s/%s:%s", event.Repository.FullName, event.Package.Name, event.version())
+	if event.Action == "deleted" || event.Action == "restored" {
+		// a delete or restore is never a duplicate of the publish of the same version
+		key += " " + event.Action
+	}
+	return key
+}
+
+func (event *PackageEvent) summary() string {
+	if event.Action == "deleted" || event.Action == "restored" {
+		return fmt.Sprintf("package_type:%s (%s, %s)", event.Package.PackageType, event.variant, event.Action)
+	}
+	return fmt.Sprintf("package_type:%s (%s)", event.Package.PackageType, event.variant)
+}
+
+type PushEvent struct {
+	WebhookEvent
+	Ref string `json:"ref"`
+}
+
+func (event *PushEvent) summary() string {
+	return "ref:" + event.Ref
+}
+
+type WorkflowRunEvent struct {
+	WebhookEvent
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		Conclusion string `json:"conclusion"`
+	} `json:"workflow_run"`
+}
+
+func (event *WorkflowRunEvent) summary() string {
+	return fmt.Sprintf("workflow_run:%s(%s)", event.WorkflowRun.Name, event.WorkflowRun.Conclusion)
+}
+
+type ReleaseEvent struct {
+	WebhookEvent
+	Release struct {
+		TagName    string `json:"tag_name"`
+		Draft      bool   `json:"draft"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+}
+
+func (event *ReleaseEvent) summary() string {
+	return "release:" + event.Release.TagName
+}
+
+type PullRequestEvent struct {
+	WebhookEvent
+	PullRequest struct {
+		Number int `json:"number"`
+		Labels []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+	} `json:"pull_request"`
+}
+
+func (event *PullRequestEvent) summary() string {
+	return fmt.Sprintf("pull_request:#%d", event.PullRequest.Number)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPackageEventShapes(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		wantVariant string
+	}{
+		{fixture: "package_published.json", wantVariant: "package"},
+		{fixture: "registry_package_published.json", wantVariant: "registry_package"},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			var event PackageEvent
+			if err := json.Unmarshal([]byte(readTestdata(t, test.fixture)), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Package.Name != "app" || normalizePackageType(event.Package.PackageType) != "CONTAINER" || event.containerTag() != "v1.2.0" {
+				t.Errorf("package = %+v, want app CONTAINER v1.2.0", event.Package)
+			}
+			if event.variant != test.wantVariant || !strings.Contains(event.summary(), test.wantVariant) {
+				t.Errorf("variant = %s, summary = %s, want %s", event.variant, event.summary(), test.wantVariant)
+			}
+		})
+	}
+}
+
+func TestHandlerRegistryPackage(t *testing.T) {
+	tests := []struct {
+		name         string
+		packageTypes string
+		wantReason   string
+	}{
+		{name: "allowed package type", packageTypes: "container", wantReason: reasonForwarded},
+		{name: "other package type", packageTypes: "npm", wantReason: reasonPackageTypeFiltered},
+	}
+	for _, test := range tests {
+		for _, delivery := range []struct{ eventType, fixture string }{{"package", "package_published.json"}, {"registry_package", "registry_package_published.json"}} {
+			t.Run(test.name+" "+delivery.eventType, func(t *testing.T) {
+				relay := newTestRelay(t, http.StatusOK)
+				serveTestConfig(t, map[string]string{"FILTER_PACKAGE_TYPES": test.packageTypes}, relay.URL)
+				response := deliver(newDelivery(delivery.eventType, readTestdata(t, delivery.fixture)))
+				if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+					t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execSink runs a local command for each forward with the payload on stdin, one invocation at a time
+type execSink struct {
+	args    []string
+	timeout time.Duration
+	// dropBusy drops forwards arriving while the command runs instead of queueing them
+	dropBusy bool
+	// maxOutput caps the stdout and stderr bytes kept and logged
+	maxOutput int
+	// running holds a token while the command runs
+	running chan struct{}
+}
+
+// execEnvironment are the variables set for the command besides the inherited environment, with the template filling
+// them. Variables the event has no value for are left empty
+var execEnvironment = map[string]string{
+	"GWF_EVENT":    "{event}",
+	"GWF_DELIVERY": "{delivery}",
+	"GWF_ACTION":   "{action}",
+	"GWF_REPO":     "{repository}",
+	"GWF_PACKAGE":  "{package}",
+	"GWF_TAG":      "{tag}",
+}
+
+func init() {
+	sinkOpeners["exec"] = openExecSink
+}
+
+// openExecSink opens exec:///<command path>?arg=<argument>&arg=..., e.g. exec:///usr/local/bin/deploy.sh. ?timeout=
+// bounds each run, 5m by default, ?overflow=drop drops forwards while the command runs instead of queueing them and
+// ?max_output= caps the logged output, 4096 bytes by default
+func openExecSink(destinationURL *url.URL) (sink, error) {
+	if destinationURL.Host != "" || destinationURL.Path == "" {
+		return nil, fmt.Errorf("expected exec:///<command path>")
+	}
+	query := destinationURL.Query()
+	command := &execSink{args: append([]string{destinationURL.Path}, query["arg"]...), timeout: 5 * time.Minute, maxOutput: 4096, running: make(chan struct{}, 1)}
+	if timeout := query.Get("timeout"); timeout != "" {
+		var err error
+		if command.timeout, err = time.ParseDuration(timeout); err != nil || command.timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be a positive duration, got %q", timeout)
+		}
+	}
+	switch overflow := query.Get("overflow"); overflow {
+	case "", "queue":
+	case "drop":
+		command.dropBusy = true
+	default:
+		return nil, fmt.Errorf("overflow must be queue or drop, got %q", overflow)
+	}
+	if maxOutput := query.Get("max_output"); maxOutput != "" {
+		var err error
+		if command.maxOutput, err = strconv.Atoi(maxOutput); err != nil || command.maxOutput < 0 {
+			return nil, fmt.Errorf("max_output must be a positive number, got %q", maxOutput)
+		}
+	}
+	return command, nil
+}
+
+// send runs the command once the previous run finished, or skips it when busy with ?overflow=drop. A non-zero exit
+// fails like a 5xx relay response so it is retried
+func (command *execSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	if command.dropBusy {
+		select {
+		case command.running <- struct{}{}:
+		default:
+			log.Printf("Command %s is already running, dropped %s", command, request.Header.Get("X-GitHub-Delivery"))
+			return relayReply{status: http.StatusOK}, nil
+		}
+	} else {
+		select {
+		case command.running <- struct{}{}:
+		case <-ctx.Done():
+			return relayReply{}, fmt.Errorf("Error waiting for command %s to finish its previous run: %v", command, ctx.Err())
+		}
+	}
+	defer func() { <-command.running }()
+
+	ctx, cancel := context.WithTimeout(ctx, command.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command.args[0], command.args[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = os.Environ()
+	for name, field := range execEnvironment {
+		template, _ := parseFieldTemplate(field)
+		value, _ := template.render(request.Header, body, strings.TrimSpace)
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	stdout, stderr := &cappedBuffer{limit: command.maxOutput}, &cappedBuffer{limit: command.maxOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	started := time.Now()
+	err := cmd.Run()
+	if stdout.Len() > 0 {
+		log.Printf("Command %s stdout: %s", command, stdout)
+	}
+	if stderr.Len() > 0 {
+		log.Printf("Command %s stderr: %s", command, stderr)
+	}
+	reply := relayReply{status: http.StatusOK, contentType: "text/plain", body: stdout.Bytes()}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return relayReply{}, fmt.Errorf("%w: command %s ran longer than %s", errRelayTimeout, command, command.timeout)
+	}
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		reply.status = http.StatusInternalServerError
+		return reply, fmt.Errorf("Error - Command %s exited with code %d", command, exitError.ExitCode())
+	}
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error running command %s: %v", command, err)
+	}
+	log.Printf("Command %s completed in %s", command, time.Since(started).Round(time.Millisecond))
+	return reply, nil
+}
+
+func (command *execSink) String() string {
+	return strings.Join(command.args, " ")
+}
+
+// cappedBuffer keeps the first limit bytes written to it and counts the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	discarded int
+}
+
+func (buffer *cappedBuffer) Write(content []byte) (int, error) {
+	kept := min(len(content), max(buffer.limit-buffer.Len(), 0))
+	buffer.Buffer.Write(content[:kept])
+	buffer.discarded += len(content) - kept
+	return len(content), nil
+}
+
+func (buffer *cappedBuffer) String() string {
+	output := strings.TrimSpace(buffer.Buffer.String())
+	if buffer.discarded > 0 {
+		output += fmt.Sprintf(" ... (%d more bytes)", buffer.discarded)
+	}
+	return output
+}
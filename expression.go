@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// filterExpression is a compiled CEL expression evaluated against the decoded payload (payload) and the X-GitHub-Event value (event)
+type filterExpression struct {
+	source  string
+	program cel.Program
+}
+
+func newFilterExpression(source string) (*filterExpression, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("payload", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("event", cel.StringType),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("expression must evaluate to a bool, got %s", ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &filterExpression{source: source, program: program}, nil
+}
+
+// evaluate returns true when the event should be forwarded
+func (expression *filterExpression) evaluate(eventType string, payload map[string]any) (bool, error) {
+	result, _, err := expression.program.Eval(map[string]any{"payload": payload, "event": eventType})
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := result.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %v instead of a bool", result.Value())
+	}
+	return allowed, nil
+}
+
+func (expression *filterExpression) String() string {
+	return expression.source
+}
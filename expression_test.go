@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testReleasePayload = `{"action":"published","release":{"tag_name":"v1.2.0","draft":false},"repository":{"full_name":"octo-org/app","private":true},"sender":{"login":"octocat","type":"User"}}`
+
+func TestFilterExpressionEvaluate(t *testing.T) {
+	tests := []struct {
+		name        string
+		expression  string
+		wantAllowed bool
+		wantErr     bool
+	}{
+		{name: "nested field", expression: `payload.release.tag_name.startsWith("v")`, wantAllowed: true},
+		{name: "nested fields combined", expression: `payload.release.tag_name.startsWith("v") && payload.repository.private && payload.sender.type != "Bot"`, wantAllowed: true},
+		{name: "nested field not matching", expression: `payload.sender.type == "Bot"`, wantAllowed: false},
+		{name: "event type", expression: `event == "release"`, wantAllowed: true},
+		{name: "missing field checked with has", expression: `has(payload.release.prerelease) && payload.release.prerelease`, wantAllowed: false},
+		{name: "missing top-level field checked with has", expression: `!has(payload.pull_request)`, wantAllowed: true},
+		{name: "missing field", expression: `payload.release.prerelease == false`, wantErr: true},
+		{name: "missing parent field", expression: `payload.pull_request.merged`, wantErr: true},
+		{name: "non-bool result", expression: `payload.release.tag_name`, wantErr: true},
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(testReleasePayload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := newFilterExpression(test.expression)
+			if err != nil {
+				t.Fatalf("compiling %s: %v", test.expression, err)
+			}
+			allowed, err := expression.evaluate("release", payload)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if allowed != test.wantAllowed {
+				t.Errorf("allowed = %v, want %v", allowed, test.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestFilterExpressionCompile(t *testing.T) {
+	for _, source := range []string{`payload.release.tag_name.startsWith(`, `1 + 1`, `unknown == "release"`} {
+		if _, err := newFilterExpression(source); err == nil {
+			t.Errorf("expected %s not to compile", source)
+		}
+	}
+}
+
+func TestHandlerFilterExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		wantStatus int
+		wantReason string
+	}{
+		{name: "true forwards", expression: `payload.release.tag_name.startsWith("v")`, wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "false filters", expression: `payload.release.draft`, wantStatus: http.StatusOK, wantReason: reasonExpressionFiltered},
+		{name: "evaluation error fails the delivery", expression: `payload.release.missing == "x"`, wantStatus: http.StatusInternalServerError, wantReason: reasonExpressionError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, map[string]string{"ALLOWED_EVENTS": "release", "RELEASE_ACTIONS": "published", "FILTER_EXPRESSION": test.expression}, relay.URL)
+			response := deliver(newDelivery("release", testReleasePayload))
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+		})
+	}
+}
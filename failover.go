@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// failoverPolicy tries the failover URL of a destination first for cooldown once its primary URL failed threshold
+// times in a row
+type failoverPolicy struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+// relayEndpointHealth is the health of the primary or failover URL of a destination
+type relayEndpointHealth struct {
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Served              int64     `json:"served"`
+	Failed              int64     `json:"failed"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastFailure         time.Time `json:"last_failure,omitzero"`
+}
+
+// relayFailover is the health of a primary URL and its failover URL. PreferFailoverUntil is set while the primary is
+// unhealthy, until which the failover URL is tried first
+type relayFailover struct {
+	FailoverURL         string              `json:"failover_url"`
+	Primary             relayEndpointHealth `json:"primary"`
+	Failover            relayEndpointHealth `json:"failover"`
+	PreferFailoverUntil time.Time           `json:"prefer_failover_until,omitzero"`
+}
+
+type relayFailovers struct {
+	mutex     sync.Mutex
+	failovers map[string]*relayFailover
+}
+
+var failoverHealth = &relayFailovers{failovers: map[string]*relayFailover{}}
+
+// validateFailoverURL checks the failover URL of a destination, which can't be hedged as well
+func validateFailoverURL(failoverURL string, hedge *relayHedge) error {
+	if failoverURL == "" {
+		return nil
+	}
+	if hedge != nil {
+		return fmt.Errorf("a destination can't be hedged and fail over, set either the hedge or the failover URL")
+	}
+	if isTemplatedRelayURL(failoverURL) {
+		return fmt.Errorf("failover URL %s can't hold placeholders", failoverURL)
+	}
+	return nil
+}
+
+func (failovers *relayFailovers) failover(primaryURL string, failoverURL string) *relayFailover {
+	failover, found := failovers.failovers[primaryURL]
+	if !found || failover.FailoverURL != failoverURL {
+		failover = &relayFailover{FailoverURL: failoverURL}
+		failovers.failovers[primaryURL] = failover
+	}
+	return failover
+}
+
+// preferFailover reports whether the primary URL is unhealthy, so its failover URL is tried first
+func (failovers *relayFailovers) preferFailover(primaryURL string, failoverURL string) bool {
+	failovers.mutex.Lock()
+	defer failovers.mutex.Unlock()
+	return time.Now().Before(failovers.failover(primaryURL, failoverURL).PreferFailoverUntil)
+}
+
+// record counts the outcome of a forward to the primary or failover URL, preferring the failover URL for the cooldown
+// once the primary failed threshold times in a row and going back to the primary once it succeeds
+func (failovers *relayFailovers) record(primaryURL string, failoverURL string, servingURL string, policy failoverPolicy, succeeded bool) {
+	failovers.mutex.Lock()
+	defer failovers.mutex.Unlock()
+	failover := failovers.failover(primaryURL, failoverURL)
+	health := &failover.Primary
+	if servingURL == failoverURL {
+		health = &failover.Failover
+	}
+	if succeeded {
+		health.ConsecutiveFailures, health.LastSuccess = 0, time.Now()
+		health.Served++
+		if servingURL == primaryURL && !failover.PreferFailoverUntil.IsZero() {
+			log.Printf("Relay %s is healthy again, no longer preferring %s", primaryURL, failoverURL)
+			failover.PreferFailoverUntil = time.Time{}
+		}
+		return
+	}
+	health.ConsecutiveFailures++
+	health.Failed++
+	health.LastFailure = time.Now()
+	if servingURL == primaryURL && health.ConsecutiveFailures >= policy.threshold && time.Now().After(failover.PreferFailoverUntil) {
+		failover.PreferFailoverUntil = time.Now().Add(policy.cooldown)
+		log.Printf("Relay %s failed %d times in a row, preferring %s for %s", primaryURL, health.ConsecutiveFailures, failoverURL, policy.cooldown)
+	}
+}
+
+func (failovers *relayFailovers) states() map[string]relayFailover {
+	failovers.mutex.Lock()
+	defer failovers.mutex.Unlock()
+	states := map[string]relayFailover{}
+	for primaryURL, failover := range failovers.failovers {
+		state := *failover
+		state.FailoverURL = redactURL(state.FailoverURL)
+		states[redactURL(primaryURL)] = state
+	}
+	return states
+}
+
+// failoverStatus reports whether a forward that failed with the status fails over: network errors, timeouts and 5xx
+func failoverStatus(status int) bool {
+	return status == 0 || status >= 500
+}
+
+// sendFailover forwards to the primary URL of the destination with a single attempt, then to its failover URL with the
+// retry policy when the primary failed with a network error, a timeout or a 5xx. The failover URL is tried first while
+// the primary is unhealthy. The reply names the URL that served the forward
+func (policy retryPolicy) sendFailover(ctx context.Context, request *http.Request, destination relayDestination, requestBody []byte) (relayReply, error) {
+	primary, failover := destination, destination
+	// the destination's retry policy already applies to policy
+	primary.failover, failover.failover = "", ""
+	primary.retry, failover.retry = nil, nil
+	failover.url = destination.failover
+	order := []relayDestination{primary, failover}
+	if failoverHealth.preferFailover(primary.url, failover.url) {
+		log.Printf("Relay %s is unhealthy, forwarding to %s first", primary.url, failover.url)
+		order[0], order[1] = failover, primary
+	}
+	var reply relayReply
+	var err error
+	for index, target := range order {
+		attemptPolicy := policy
+		if index == 0 {
+			attemptPolicy.maxAttempts = 1
+		}
+		reply, err = attemptPolicy.send(ctx, request, target, requestBody)
+		failoverHealth.record(primary.url, failover.url, target.url, policy.failover, err == nil || !failoverStatus(reply.status))
+		if err == nil {
+			if index > 0 {
+				log.Printf("Failed over from %s to %s", order[0].url, target.url)
+			}
+			reply.servedBy = target.url
+			return reply, nil
+		}
+		if !failoverStatus(reply.status) || ctx.Err() != nil {
+			return reply, err
+		}
+		if index == 0 {
+			log.Printf("Relay %s failed, failing over to %s: %v", target.url, order[1].url, err)
+		}
+	}
+	return reply, err
+}
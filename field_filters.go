@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// fieldCondition matches a dotted path of the payload, e.g. package.package_version.author.login=ci-bot. A ! prefix
+// negates the condition
+type fieldCondition struct {
+	source string
+	path   []any
+	negate bool
+	value  string
+	// regex is nil for = conditions
+	regex *regexp.Regexp
+}
+
+// parseFieldConditions parses ; separated conditions using = for exact matches and ~ for regular expressions
+func parseFieldConditions(value string) ([]fieldCondition, error) {
+	var conditions []fieldCondition
+	for _, source := range strings.Split(value, ";") {
+		if source = strings.TrimSpace(source); source == "" {
+			continue
+		}
+		condition, err := newFieldCondition(source)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %w", source, err)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func newFieldCondition(source string) (fieldCondition, error) {
+	condition := fieldCondition{source: source}
+	expression := source
+	if rest, found := strings.CutPrefix(expression, "!"); found {
+		condition.negate, expression = true, rest
+	}
+	index := strings.IndexAny(expression, "=~")
+	if index < 0 {
+		return condition, fmt.Errorf("missing operator, expected = or ~")
+	}
+	path := strings.TrimSpace(expression[:index])
+	if path == "" {
+		return condition, fmt.Errorf("missing path")
+	}
+	var err error
+	if condition.path, err = parseJSONPath("$." + path); err != nil {
+		return condition, err
+	}
+	condition.value = strings.TrimSpace(expression[index+1:])
+	if expression[index] == '~' {
+		if condition.regex, err = regexp.Compile(condition.value); err != nil {
+			return condition, err
+		}
+	}
+	return condition, nil
+}
+
+// matches reports whether the payload satisfies the condition. A missing path doesn't match, so it passes negated
+// conditions
+func (condition *fieldCondition) matches(payload map[string]any) bool {
+	value, found := lookupPath(payload, condition.path)
+	matched := false
+	if found {
+		if actual := formatValue(value); condition.regex != nil {
+			matched = condition.regex.MatchString(actual)
+		} else {
+			matched = actual == condition.value
+		}
+	}
+	return matched != condition.negate
+}
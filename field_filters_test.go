@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldConditions(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantPaths [][]any
+		wantOps   []string
+		wantErr   bool
+	}{
+		{value: "package.package_version.author.login=ci-bot", wantPaths: [][]any{{"package", "package_version", "author", "login"}}, wantOps: []string{"="}},
+		{value: "repository.default_branch~^main|master$", wantPaths: [][]any{{"repository", "default_branch"}}, wantOps: []string{"~"}},
+		{value: "!sender.login=dependabot[bot]", wantPaths: [][]any{{"sender", "login"}}, wantOps: []string{"!="}},
+		{value: "!sender.login~bot", wantPaths: [][]any{{"sender", "login"}}, wantOps: []string{"!~"}},
+		{value: "a=1; b~2 ;", wantPaths: [][]any{{"a"}, {"b"}}, wantOps: []string{"=", "~"}},
+		{value: "commits[0].author.name=octocat", wantPaths: [][]any{{"commits", 0, "author", "name"}}, wantOps: []string{"="}},
+		{value: "", wantPaths: nil},
+		{value: "package.name", wantErr: true},
+		{value: "=ci-bot", wantErr: true},
+		{value: "!=ci-bot", wantErr: true},
+		{value: "package..name=app", wantErr: true},
+		{value: "commits[x]=1", wantErr: true},
+		{value: "commits[0=1", wantErr: true},
+		{value: "tag~[", wantErr: true},
+		{value: "a=1;b", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			conditions, err := parseFieldConditions(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			var paths [][]any
+			var ops []string
+			for _, condition := range conditions {
+				paths = append(paths, condition.path)
+				op := "="
+				if condition.regex != nil {
+					op = "~"
+				}
+				if condition.negate {
+					op = "!" + op
+				}
+				ops = append(ops, op)
+			}
+			if !test.wantErr && (!reflect.DeepEqual(paths, test.wantPaths) || !reflect.DeepEqual(ops, test.wantOps)) {
+				t.Errorf("parsed %v %v, want %v %v", paths, ops, test.wantPaths, test.wantOps)
+			}
+		})
+	}
+}
+
+func TestParseFieldConditionValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantValue string
+	}{
+		{value: "a=b=c", wantValue: "b=c"},
+		{value: "a = spaced ", wantValue: "spaced"},
+		{value: "a=", wantValue: ""},
+		{value: "a~x=y", wantValue: "x=y"},
+	}
+	for _, test := range tests {
+		conditions, err := parseFieldConditions(test.value)
+		if err != nil {
+			t.Fatalf("%s: %v", test.value, err)
+		}
+		if conditions[0].value != test.wantValue {
+			t.Errorf("%s: value = %q, want %q", test.value, conditions[0].value, test.wantValue)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(`{"a":{"b":{"c":"deep"}},"list":[{"name":"first"},{"name":"second"}],"scalar":"text","null":null}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		path      []any
+		wantValue any
+		wantFound bool
+	}{
+		{name: "nested objects", path: []any{"a", "b", "c"}, wantValue: "deep", wantFound: true},
+		{name: "intermediate object", path: []any{"a", "b"}, wantValue: map[string]any{"c": "deep"}, wantFound: true},
+		{name: "array element", path: []any{"list", 1, "name"}, wantValue: "second", wantFound: true},
+		{name: "null value", path: []any{"null"}, wantValue: nil, wantFound: true},
+		{name: "missing key", path: []any{"a", "x"}},
+		{name: "missing parent", path: []any{"x", "b", "c"}},
+		{name: "key on a scalar", path: []any{"scalar", "b"}},
+		{name: "key on null", path: []any{"null", "b"}},
+		{name: "index on an object", path: []any{"a", 0}},
+		{name: "key on an array", path: []any{"list", "name"}},
+		{name: "index out of range", path: []any{"list", 2}},
+		{name: "negative index", path: []any{"list", -1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, found := lookupPath(payload, test.path)
+			if found != test.wantFound || !reflect.DeepEqual(value, test.wantValue) {
+				t.Errorf("lookupPath = %v %v, want %v %v", value, found, test.wantValue, test.wantFound)
+			}
+		})
+	}
+}
+
+func TestFieldConditionMatches(t *testing.T) {
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(`{"package":{"package_version":{"author":{"login":"ci-bot"}}},"repository":{"default_branch":"master","fork":false,"size":1024}}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		condition string
+		wantMatch bool
+	}{
+		{condition: "package.package_version.author.login=ci-bot", wantMatch: true},
+		{condition: "package.package_version.author.login=octocat", wantMatch: false},
+		{condition: "repository.default_branch~^main|master$", wantMatch: true},
+		{condition: "repository.default_branch~^main$", wantMatch: false},
+		{condition: "!package.package_version.author.login=ci-bot", wantMatch: false},
+		{condition: "!repository.default_branch~^main$", wantMatch: true},
+		{condition: "repository.fork=false", wantMatch: true},
+		{condition: "repository.size=1024", wantMatch: true},
+		{condition: "repository.topics=deploy", wantMatch: false},
+		{condition: "repository.topics~.*", wantMatch: false},
+		{condition: "!repository.topics=deploy", wantMatch: true},
+	}
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			conditions, err := parseFieldConditions(test.condition)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := conditions[0].matches(payload); match != test.wantMatch {
+				t.Errorf("matches = %v, want %v", match, test.wantMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+var suppressedActionsMutex sync.Mutex
+var suppressedActions = map[string]int{}
+
+// filterEvent runs the filters configured through environment variables. Exclusions are evaluated first so a deny always
+// wins over an allow, and an event matching no exclusion and all allow filters is forwarded. Event types registered in
+// eventTypes are decoded into their own struct and get their specific filters applied as well. Returns the typed
+// event (nil for other event types), the reason when the event is filtered out and any error decoding the typed event
+func filterEvent(config *filterConfig, eventType string, requestBody []byte, event *WebhookEvent) (typedEvent, *filterReason, error) {
+	var typed typedEvent
+	if newTypedEvent, found := eventTypes[eventType]; found {
+		typed = newTypedEvent()
+		if err := json.Unmarshal(requestBody, typed); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if reason := filterExclusions(config, event); reason != nil {
+		return typed, reason, nil
+	}
+	if typed != nil {
+		if reason := typed.exclude(config); reason != nil {
+			return typed, reason, nil
+		}
+	}
+	if reason := filterRepository(config, event); reason != nil {
+		return typed, reason, nil
+	}
+	if reason := filterOrganization(config, event); reason != nil {
+		return typed, reason, nil
+	}
+	if reason := filterVisibility(config, event); reason != nil {
+		return typed, reason, nil
+	}
+	if reason := filterTopics(config, event); reason != nil {
+		return typed, reason, nil
+	}
+	if typed == nil {
+		return nil, nil, nil
+	}
+	return typed, typed.filter(config), nil
+}
+
+// filterHook checks the X-GitHub-Hook-ID header against ALLOWED_HOOK_IDS and the X-GitHub-Hook-Installation-Target-Type
+// and -ID headers against HOOK_TARGET_TYPES and HOOK_TARGET_IDS. Only headers are read so it can run before the body is
+// read and the signature verified
+func filterHook(config *filterConfig, headers http.Header) *filterReason {
+	if hookID := headers.Get("X-GitHub-Hook-ID"); !config.hookIDs.allows(hookID) {
+		return filtered(reasonHookFiltered, "Filtered out delivery from hook %s! Allowed hook IDs: %s. No forward to relay", hookID, config.hookIDs)
+	}
+	targetType := headers.Get("X-GitHub-Hook-Installation-Target-Type")
+	if !config.hookTargetTypes.allows(strings.ToLower(targetType)) {
+		return filtered(reasonHookTargetFiltered, "Filtered out hook installation target type %s! Allowed target types: %s. No forward to relay", targetType, config.hookTargetTypes)
+	}
+	if targetID := headers.Get("X-GitHub-Hook-Installation-Target-ID"); !config.hookTargetIDs.allows(targetID) {
+		return filtered(reasonHookTargetFiltered, "Filtered out hook installation target %s %s! Allowed target IDs: %s. No forward to relay", targetType, targetID, config.hookTargetIDs)
+	}
+	return nil
+}
+
+// filterExclusions checks the denylist and blocked sender settings shared by all events
+func filterExclusions(config *filterConfig, event *WebhookEvent) *filterReason {
+	fullName := event.Repository.FullName
+	if rule, matched := config.repoDenylist.match(fullName); matched {
+		return filtered(reasonRepoFiltered, "Filtered out repository %s! Matched exclusion rule %s. No forward to relay", fullName, rule)
+	}
+	if sender := event.Sender; sender.Login != "" {
+		if config.blockSenders[strings.ToLower(sender.Login)] {
+			return filtered(reasonSenderFiltered, "Filtered out sender %s! Sender is blocked. No forward to relay", sender.Login)
+		}
+		if config.blockBotSenders && sender.Type == "Bot" {
+			return filtered(reasonSenderFiltered, "Filtered out sender %s! Bot senders are blocked. No forward to relay", sender.Login)
+		}
+	}
+	return nil
+}
+
+// filterRepository checks the repository against the allowlist. Returns the reason when the event is filtered out
+func filterRepository(config *filterConfig, event *WebhookEvent) *filterReason {
+	fullName := event.Repository.FullName
+	if len(config.repoAllowlist) == 0 {
+		return nil
+	}
+	rule, matched := config.repoAllowlist.match(fullName)
+	if !matched {
+		return filtered(reasonRepoFiltered, "Filtered out repository %s! No allowlist rule matched (%s). No forward to relay", fullName, config.repoAllowlist)
+	}
+	log.Printf("Repository %s matched allowlist rule %s", fullName, rule)
+	return nil
+}
+
+// filterOrganization checks the owning organization against ALLOWED_ORGS
+func filterOrganization(config *filterConfig, event *WebhookEvent) *filterReason {
+	org := event.ownerLogin()
+	if !config.orgs.allows(strings.ToLower(org)) {
+		return filtered(reasonOrgFiltered, "Filtered out organization %s! Allowed organizations: %s. No forward to relay", org, config.orgs)
+	}
+	return nil
+}
+
+// filterVisibility checks the repository visibility against REPO_VISIBILITY. Payloads without a visibility always pass
+func filterVisibility(config *filterConfig, event *WebhookEvent) *filterReason {
+	visibility := event.repositoryVisibility()
+	if config.repoVisibility == "any" || visibility == "" || visibility == config.repoVisibility {
+		return nil
+	}
+	return filtered(reasonVisibilityFiltered, "Filtered out %s repository %s! Only %s repositories are forwarded. No forward to relay", visibility, event.Repository.FullName, config.repoVisibility)
+}
+
+// filterTopics checks repository.topics against REQUIRED_TOPICS, all of which must be present, and ANY_TOPICS, one of
+// which must be present
+func filterTopics(config *filterConfig, event *WebhookEvent) *filterReason {
+	topics := newStringSet(event.Repository.Topics)
+	for topic := range config.requiredTopics {
+		if !topics[topic] {
+			return filtered(reasonTopicFiltered, "Filtered out repository %s! Missing required topic %s. No forward to relay", event.Repository.FullName, topic)
+		}
+	}
+	if len(config.anyTopics) == 0 {
+		return nil
+	}
+	for topic := range topics {
+		if config.anyTopics[topic] {
+			return nil
+		}
+	}
+	return filtered(reasonTopicFiltered, "Filtered out repository %s! None of the topics %s. No forward to relay", event.Repository.FullName, config.anyTopics)
+}
+
+// exclude checks the EXCLUDE_* package settings
+func (event *PackageEvent) exclude(config *filterConfig) *filterReason {
+	if rule, matched := config.excludePackageNames.match(event.Package.Name); matched {
+		return filtered(reasonPackageNameFiltered, "Filtered out package %s! Matched exclusion rule %s. No forward to relay", event.Package.Name, rule)
+	}
+	if tag := event.containerTag(); config.excludeTagRegex != nil && config.excludeTagRegex.MatchString(tag) {
+		return filtered(reasonTagFiltered, "Filtered out container tag %s! Matched exclusion rule %s. No forward to relay", tag, config.excludeTagRegex)
+	}
+	if config.artifactTags != nil {
+		return filterArtifact(config, event)
+	}
+	return nil
+}
+
+// artifactMediaTypes are the manifest media types used by cosign signatures and in-toto attestations
+var artifactMediaTypes = []string{
+	"application/vnd.dev.cosign.artifact.sig.v1+json",
+	"application/vnd.dev.cosign.simplesigning.v1+json",
+	"application/vnd.dev.sigstore.bundle.v0.3+json",
+	"application/vnd.dsse.envelope.v1+json",
+	"application/vnd.in-toto+json",
+}
+
+// filterArtifact drops signature and attestation artifacts pushed alongside an image, recognized by their tag or, when
+// the payload has them, their manifest media types
+func filterArtifact(config *filterConfig, event *PackageEvent) *filterReason {
+	tag := event.containerTag()
+	if rule, matched := config.artifactTags.match(tag); matched {
+		log.Printf("Container tag %s classified as an artifact by pattern %s", tag, rule)
+		return filtered(reasonArtifactFiltered, "Filtered out artifact tag %s! Matched artifact pattern %s. No forward to relay", tag, rule)
+	}
+	for _, mediaType := range event.manifestMediaTypes() {
+		if slices.Contains(artifactMediaTypes, mediaType) {
+			log.Printf("Container tag %s classified as an artifact by media type %s", tag, mediaType)
+			return filtered(reasonArtifactFiltered, "Filtered out artifact tag %s! Manifest media type %s. No forward to relay", tag, mediaType)
+		}
+	}
+	return nil
+}
+
+// filter applies the package_type, action, name and tag filters to a package event
+func (event *PackageEvent) filter(config *filterConfig) *filterReason {
+	packageType := normalizePackageType(event.Package.PackageType)
+	if !config.packageTypes.allows(packageType) {
+		return filtered(reasonPackageTypeFiltered, "Filtered out package_type %s (received as %s)! Allowed package types: %s. No forward to relay", packageType, event.Package.PackageType, config.packageTypes)
+	}
+	if action := event.Action; config.actionRelayURLs[action] == "" && !config.actions.allows(action) {
+		countSuppressedAction(action)
+		if action == "deleted" {
+			return filtered(reasonPackageDeleted, "Filtered out deletion of package %s version %s! Deletes are dropped unless PACKAGE_DELETED_RELAY_URL is set. No forward to relay", event.Package.Name, event.version())
+		}
+		return filtered(reasonActionFiltered, "Filtered out package action %s! Allowed actions: %s. No forward to relay", action, config.actions)
+	}
+	if len(config.packageNames) > 0 {
+		if _, matched := config.packageNames.match(event.Package.Name); !matched {
+			return filtered(reasonPackageNameFiltered, "Filtered out package %s! Name does not match %s. No forward to relay", event.Package.Name, config.packageNames)
+		}
+	}
+	if reason := filterOwner(config, event); reason != nil {
+		return reason
+	}
+	if config.tagRegex != nil && packageType == "CONTAINER" {
+		if tag := event.containerTag(); !config.tagRegex.MatchString(tag) {
+			return filtered(reasonTagFiltered, "Filtered out container tag %s! Tag does not match %s. No forward to relay", tag, config.tagRegex)
+		}
+	}
+	if reason := filterNamespace(config, event); reason != nil {
+		return reason
+	}
+	if config.versionConstraint != nil {
+		if reason := filterVersion(config, event.versionOf(config.versionField)); reason != nil {
+			return reason
+		}
+	}
+	log.Printf("package_type %s with action %s passed filter!", packageType, event.Action)
+	return nil
+}
+
+// filterOwner checks package.owner against PACKAGE_OWNER_TYPES and PACKAGE_OWNERS
+func filterOwner(config *filterConfig, event *PackageEvent) *filterReason {
+	owner := event.Package.Owner
+	if !config.ownerTypes.allows(strings.ToLower(owner.Type)) {
+		return filtered(reasonOwnerFiltered, "Filtered out package %s owned by %s %s! Allowed owner types: %s. No forward to relay", event.Package.Name, owner.Type, owner.Login, config.ownerTypes)
+	}
+	if !config.owners.allows(strings.ToLower(owner.Login)) {
+		return filtered(reasonOwnerFiltered, "Filtered out package %s owned by %s! Allowed owners: %s. No forward to relay", event.Package.Name, owner.Login, config.owners)
+	}
+	return nil
+}
+
+// filterNamespace checks the package namespace against NAMESPACE_PATTERNS and the package URL against IMAGE_URL_REGEX.
+// Payloads missing these fields pass unless NAMESPACE_FAIL_CLOSED is enabled
+func filterNamespace(config *filterConfig, event *PackageEvent) *filterReason {
+	if len(config.namespacePatterns) > 0 {
+		namespace := event.Package.Namespace
+		if namespace == "" {
+			if config.namespaceFailClosed {
+				return filtered(reasonNamespaceFiltered, "Filtered out package %s! Payload has no namespace. No forward to relay", event.Package.Name)
+			}
+		} else if _, matched := config.namespacePatterns.match(namespace); !matched {
+			return filtered(reasonNamespaceFiltered, "Filtered out namespace %s! Namespace does not match %s. No forward to relay", namespace, config.namespacePatterns)
+		}
+	}
+	if config.imageURLRegex != nil {
+		packageURL := event.Package.PackageVersion.PackageURL
+		if packageURL == "" {
+			if config.namespaceFailClosed {
+				return filtered(reasonNamespaceFiltered, "Filtered out package %s! Payload has no package URL. No forward to relay", event.Package.Name)
+			}
+		} else if !config.imageURLRegex.MatchString(packageURL) {
+			return filtered(reasonNamespaceFiltered, "Filtered out image %s! URL does not match %s. No forward to relay", packageURL, config.imageURLRegex)
+		}
+	}
+	return nil
+}
+
+// filterVersion checks the package version against VERSION_CONSTRAINT. Versions that are not semver are handled per VERSION_NONSEMVER
+func filterVersion(config *filterConfig, version string) *filterReason {
+	parsed, err := semver.NewVersion(version)
+	if err != nil {
+		if config.dropNonSemver {
+			return filtered(reasonVersionFiltered, "Filtered out package version %s! Not a semver version. No forward to relay", version)
+		}
+		log.Printf("Package version %s is not a semver version, forwarding", version)
+		return nil
+	}
+	if !config.versionConstraint.Check(parsed) {
+		return filtered(reasonVersionFiltered, "Filtered out package version %s! Version does not satisfy %s. No forward to relay", version, config.versionConstraint)
+	}
+	return nil
+}
+
+func (event *PushEvent) exclude(config *filterConfig) *filterReason {
+	return nil
+}
+
+// filter checks the pushed ref against PUSH_BRANCHES or PUSH_TAGS
+func (event *PushEvent) filter(config *filterConfig) *filterReason {
+	var patterns globList
+	var name string
+	if branch, found := strings.CutPrefix(event.Ref, "refs/heads/"); found {
+		patterns, name = config.pushBranches, branch
+	} else if tag, found := strings.CutPrefix(event.Ref, "refs/tags/"); found {
+		patterns, name = config.pushTags, tag
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	if _, matched := patterns.match(name); !matched {
+		return filtered(reasonRefFiltered, "Filtered out push to %s! Ref does not match %s. No forward to relay", event.Ref, patterns)
+	}
+	return nil
+}
+
+func (event *WorkflowRunEvent) exclude(config *filterConfig) *filterReason {
+	return nil
+}
+
+// filter checks the workflow run against WORKFLOW_NAMES and WORKFLOW_CONCLUSIONS
+func (event *WorkflowRunEvent) filter(config *filterConfig) *filterReason {
+	run := event.WorkflowRun
+	if !config.workflowNames.allows(run.Name) {
+		return filtered(reasonWorkflowFiltered, "Filtered out workflow %s! Allowed workflows: %s. No forward to relay", run.Name, config.workflowNames)
+	}
+	if !config.workflowConclusions.allows(run.Conclusion) {
+		return filtered(reasonWorkflowFiltered, "Filtered out workflow %s with conclusion %s! Allowed conclusions: %s. No forward to relay", run.Name, run.Conclusion, config.workflowConclusions)
+	}
+	return nil
+}
+
+func (event *ReleaseEvent) exclude(config *filterConfig) *filterReason {
+	return nil
+}
+
+// filter checks the release action and drops drafts and prereleases unless they are allowed
+func (event *ReleaseEvent) filter(config *filterConfig) *filterReason {
+	release := event.Release
+	if !config.releaseActions.allows(event.Action) {
+		return filtered(reasonReleaseFiltered, "Filtered out release %s with action %s! Allowed actions: %s. No forward to relay", release.TagName, event.Action, config.releaseActions)
+	}
+	if release.Draft && !config.releaseAllowDraft {
+		return filtered(reasonReleaseFiltered, "Filtered out draft release %s! No forward to relay", release.TagName)
+	}
+	if release.Prerelease && !config.releaseAllowPrerelease {
+		return filtered(reasonReleaseFiltered, "Filtered out prerelease %s! No forward to relay", release.TagName)
+	}
+	return nil
+}
+
+func (event *PullRequestEvent) exclude(config *filterConfig) *filterReason {
+	return nil
+}
+
+// filter checks the pull request action against PR_ACTIONS and requires one of PR_LABELS
+func (event *PullRequestEvent) filter(config *filterConfig) *filterReason {
+	number := event.PullRequest.Number
+	if !config.pullRequestActions.allows(event.Action) {
+		return filtered(reasonPullRequestFiltered, "Filtered out pull request #%d with action %s! Allowed actions: %s. No forward to relay", number, event.Action, config.pullRequestActions)
+	}
+	if len(config.pullRequestLabels) == 0 {
+		return nil
+	}
+	for _, label := range event.PullRequest.Labels {
+		if config.pullRequestLabels[label.Name] {
+			return nil
+		}
+	}
+	return filtered(reasonPullRequestFiltered, "Filtered out pull request #%d! Missing label %s. No forward to relay", number, config.pullRequestLabels)
+}
+
+func countSuppressedAction(action string) {
+	suppressedActionsMutex.Lock()
+	defer suppressedActionsMutex.Unlock()
+	suppressedActions[action]++
+}
+
+// logSuppressedActions periodically logs and resets the number of package events dropped per action
+func logSuppressedActions(interval time.Duration) {
+	for range time.Tick(interval) {
+		suppressedActionsMutex.Lock()
+		counts := suppressedActions
+		suppressedActions = map[string]int{}
+		suppressedActionsMutex.Unlock()
+
+		actions := make([]string, 0, len(counts))
+		for action := range counts {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		for _, action := range actions {
+			log.Printf("Suppressed %d package events with action %s in the last %s", counts[action], action, interval)
+		}
+	}
+}
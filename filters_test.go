@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFilterOrganization(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowedOrgs string
+		payload     string
+		wantAllowed bool
+	}{
+		{name: "organization allowed", allowedOrgs: "acme-prod", payload: `{"organization":{"login":"acme-prod"},"repository":{"owner":{"login":"acme-prod"}}}`, wantAllowed: true},
+		{name: "organization not allowed", allowedOrgs: "acme-prod", payload: `{"organization":{"login":"acme-dev"},"repository":{"owner":{"login":"acme-dev"}}}`, wantAllowed: false},
+		{name: "organization matched case-insensitively", allowedOrgs: "Acme-Prod", payload: `{"organization":{"login":"ACME-PROD"}}`, wantAllowed: true},
+		{name: "organization wins over the repository owner", allowedOrgs: "acme-prod", payload: `{"organization":{"login":"acme-dev"},"repository":{"owner":{"login":"acme-prod"}}}`, wantAllowed: false},
+		{name: "user-owned repository falls back to the owner", allowedOrgs: "octocat", payload: `{"repository":{"owner":{"login":"octocat"}}}`, wantAllowed: true},
+		{name: "user-owned repository of another owner", allowedOrgs: "acme-prod", payload: `{"repository":{"owner":{"login":"octocat"}}}`, wantAllowed: false},
+		{name: "no owner at all", allowedOrgs: "acme-prod", payload: `{}`, wantAllowed: false},
+		{name: "unset allows every organization", allowedOrgs: "", payload: `{"organization":{"login":"acme-dev"}}`, wantAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"ALLOWED_ORGS": test.allowedOrgs})
+			reason := filterOrganization(filters, decodeEvent(t, test.payload))
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && reason.Code != reasonOrgFiltered {
+				t.Errorf("reason = %q, want %q", reason.Code, reasonOrgFiltered)
+			}
+		})
+	}
+}
+
+// decodePackageEvent decodes a package payload as filterEvent does
+func decodePackageEvent(t *testing.T, payload string) *PackageEvent {
+	t.Helper()
+	var event PackageEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		t.Fatalf("decoding %s: %v", payload, err)
+	}
+	return &event
+}
+
+func TestPackageNamePatterns(t *testing.T) {
+	tests := []struct {
+		name        string
+		patterns    string
+		packageName string
+		wantAllowed bool
+	}{
+		{name: "exact name", patterns: "api-*,web-frontend", packageName: "web-frontend", wantAllowed: true},
+		{name: "prefix glob", patterns: "api-*,web-frontend", packageName: "api-gateway", wantAllowed: true},
+		{name: "no pattern matches", patterns: "api-*,web-frontend", packageName: "worker", wantAllowed: false},
+		{name: "exact pattern is not a prefix", patterns: "web-frontend", packageName: "web-frontend-legacy", wantAllowed: false},
+		{name: "case-insensitive name", patterns: "api-*", packageName: "API-Gateway", wantAllowed: true},
+		{name: "case-insensitive pattern", patterns: "API-*", packageName: "api-gateway", wantAllowed: true},
+		{name: "single character wildcard", patterns: "api-v?", packageName: "api-v2", wantAllowed: true},
+		{name: "star matches every name", patterns: "*", packageName: "anything", wantAllowed: true},
+		{name: "star matches the empty name", patterns: "*", packageName: "", wantAllowed: true},
+		{name: "empty list allows every name", patterns: "", packageName: "anything", wantAllowed: true},
+		{name: "list of blanks allows every name", patterns: " , ", packageName: "anything", wantAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"PACKAGE_NAME_PATTERNS": test.patterns})
+			event := decodePackageEvent(t, `{"action":"published","package":{"name":"`+test.packageName+`","package_type":"CONTAINER"}}`)
+			reason := event.filter(filters)
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && reason.Code != reasonPackageNameFiltered {
+				t.Errorf("reason = %q, want %q", reason.Code, reasonPackageNameFiltered)
+			}
+		})
+	}
+}
+
+func TestPackageNamePatternsInvalid(t *testing.T) {
+	t.Setenv("PACKAGE_NAME_PATTERNS", "api-[")
+	if _, err := loadFilterConfig(); err == nil {
+		t.Fatal("expected an error for a malformed pattern")
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		payload    string
+		wantReason string
+		wantDetail string
+	}{
+		{name: "default forwards", env: map[string]string{}, payload: `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"app","package_type":"CONTAINER"}}`},
+		{name: "allow forwards", env: map[string]string{"REPO_ALLOWLIST": "acme/*", "PACKAGE_NAME_PATTERNS": "app"},
+			payload: `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"app","package_type":"CONTAINER"}}`},
+		{name: "missing allow filters", env: map[string]string{"PACKAGE_NAME_PATTERNS": "api-*"},
+			payload:    `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"app","package_type":"CONTAINER"}}`,
+			wantReason: reasonPackageNameFiltered, wantDetail: "does not match"},
+		{name: "repository deny wins over allow", env: map[string]string{"REPO_ALLOWLIST": "acme/*", "EXCLUDE_REPOS": "acme/legacy-*"},
+			payload:    `{"action":"published","repository":{"full_name":"acme/legacy-app"},"package":{"name":"app","package_type":"CONTAINER"}}`,
+			wantReason: reasonRepoFiltered, wantDetail: "exclusion rule acme/legacy-*"},
+		{name: "package name deny wins over allow", env: map[string]string{"PACKAGE_NAME_PATTERNS": "*", "EXCLUDE_PACKAGE_NAME_PATTERNS": "test-*"},
+			payload:    `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"test-app","package_type":"CONTAINER"}}`,
+			wantReason: reasonPackageNameFiltered, wantDetail: "exclusion rule test-*"},
+		{name: "tag deny wins over allow", env: map[string]string{"CONTAINER_TAG_REGEX": ".*", "EXCLUDE_CONTAINER_TAG_REGEX": "^dev$"},
+			payload:    `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"app","package_type":"CONTAINER","package_version":{"container_metadata":{"tag":{"name":"dev"}}}}}`,
+			wantReason: reasonTagFiltered, wantDetail: "exclusion rule ^dev$"},
+		{name: "deny wins over a failing allow", env: map[string]string{"PACKAGE_NAME_PATTERNS": "api-*", "EXCLUDE_PACKAGE_NAME_PATTERNS": "test-*"},
+			payload:    `{"action":"published","repository":{"full_name":"acme/app"},"package":{"name":"test-app","package_type":"CONTAINER"}}`,
+			wantReason: reasonPackageNameFiltered, wantDetail: "exclusion rule test-*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, test.env)
+			_, reason, err := filterEvent(filters, "package", []byte(test.payload), decodeEvent(t, test.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantReason == "" {
+				if reason != nil {
+					t.Fatalf("filtered out: %v", reason)
+				}
+				return
+			}
+			if reason == nil {
+				t.Fatalf("forwarded, want %s", test.wantReason)
+			}
+			if reason.Code != test.wantReason || !strings.Contains(reason.Detail, test.wantDetail) {
+				t.Errorf("reason = %s (%s), want %s mentioning %q", reason.Code, reason.Detail, test.wantReason, test.wantDetail)
+			}
+		})
+	}
+}
+
+func TestReleaseFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		fixture     string
+		env         map[string]string
+		wantAllowed bool
+	}{
+		{name: "published release", fixture: "release_published.json", wantAllowed: true},
+		{name: "published prerelease", fixture: "release_prerelease.json", wantAllowed: false},
+		{name: "published prerelease allowed", fixture: "release_prerelease.json", env: map[string]string{"RELEASE_ALLOW_PRERELEASE": "true"}, wantAllowed: true},
+		{name: "draft action not allowed", fixture: "release_draft.json", wantAllowed: false},
+		{name: "draft filtered when its action is allowed", fixture: "release_draft.json", env: map[string]string{"RELEASE_ACTIONS": "created,published"}, wantAllowed: false},
+		{name: "draft allowed", fixture: "release_draft.json", env: map[string]string{"RELEASE_ACTIONS": "created", "RELEASE_ALLOW_DRAFT": "true"}, wantAllowed: true},
+		{name: "allowing prereleases keeps drafts out", fixture: "release_draft_prerelease.json", env: map[string]string{"RELEASE_ACTIONS": "created", "RELEASE_ALLOW_PRERELEASE": "true"}, wantAllowed: false},
+		{name: "allowing drafts keeps prereleases out", fixture: "release_draft_prerelease.json", env: map[string]string{"RELEASE_ACTIONS": "created", "RELEASE_ALLOW_DRAFT": "true"}, wantAllowed: false},
+		{name: "draft prerelease allowed", fixture: "release_draft_prerelease.json", env: map[string]string{"RELEASE_ACTIONS": "created", "RELEASE_ALLOW_DRAFT": "true", "RELEASE_ALLOW_PRERELEASE": "true"}, wantAllowed: true},
+		{name: "published release with another action allowed", fixture: "release_published.json", env: map[string]string{"RELEASE_ACTIONS": "released"}, wantAllowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, test.env)
+			payload := readTestdata(t, test.fixture)
+			_, reason, err := filterEvent(filters, "release", []byte(payload), decodeEvent(t, payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && reason.Code != reasonReleaseFiltered {
+				t.Errorf("reason = %q, want %q", reason.Code, reasonReleaseFiltered)
+			}
+		})
+	}
+}
+
+func TestFilterVisibility(t *testing.T) {
+	tests := []struct {
+		name        string
+		visibility  string
+		payload     string
+		wantAllowed bool
+	}{
+		{name: "private repository, private wanted", visibility: "private", payload: `{"repository":{"private":true}}`, wantAllowed: true},
+		{name: "public repository, private wanted", visibility: "private", payload: `{"repository":{"private":false}}`, wantAllowed: false},
+		{name: "public repository, public wanted", visibility: "public", payload: `{"repository":{"private":false}}`, wantAllowed: true},
+		{name: "private repository, public wanted", visibility: "public", payload: `{"repository":{"private":true}}`, wantAllowed: false},
+		{name: "visibility field, private wanted", visibility: "private", payload: `{"repository":{"visibility":"private"}}`, wantAllowed: true},
+		{name: "visibility field wins over private", visibility: "public", payload: `{"repository":{"private":true,"visibility":"public"}}`, wantAllowed: true},
+		{name: "internal repository counts as private", visibility: "private", payload: `{"repository":{"visibility":"internal","private":true}}`, wantAllowed: true},
+		{name: "internal repository, public wanted", visibility: "public", payload: `{"repository":{"visibility":"internal"}}`, wantAllowed: false},
+		{name: "any allows public", visibility: "any", payload: `{"repository":{"private":false}}`, wantAllowed: true},
+		{name: "default allows private", visibility: "", payload: `{"repository":{"private":true}}`, wantAllowed: true},
+		{name: "case-insensitive setting", visibility: "PRIVATE", payload: `{"repository":{"private":true}}`, wantAllowed: true},
+		{name: "missing repository block", visibility: "private", payload: `{}`, wantAllowed: true},
+		{name: "repository without visibility", visibility: "public", payload: `{"repository":{"full_name":"acme/app"}}`, wantAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"REPO_VISIBILITY": test.visibility})
+			reason := filterVisibility(filters, decodeEvent(t, test.payload))
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && (reason.Code != reasonVisibilityFiltered || !strings.Contains(reason.Detail, filters.repoVisibility)) {
+				t.Errorf("reason = %s (%s), want %s naming the visibility", reason.Code, reason.Detail, reasonVisibilityFiltered)
+			}
+		})
+	}
+}
+
+func TestFilterVisibilityInvalid(t *testing.T) {
+	t.Setenv("REPO_VISIBILITY", "secret")
+	if _, err := loadFilterConfig(); err == nil {
+		t.Fatal("expected an error for an unknown visibility")
+	}
+}
+
+func TestPackageTypeCase(t *testing.T) {
+	tests := []struct {
+		name         string
+		packageTypes string
+		packageType  string
+		wantAllowed  bool
+	}{
+		{name: "upper-case payload, lower-case setting", packageTypes: "container", packageType: "CONTAINER", wantAllowed: true},
+		{name: "lower-case payload, upper-case setting", packageTypes: "CONTAINER", packageType: "container", wantAllowed: true},
+		{name: "mixed-case payload and setting", packageTypes: "Container", packageType: "conTAINER", wantAllowed: true},
+		{name: "payload with spaces", packageTypes: "container", packageType: " container ", wantAllowed: true},
+		{name: "mixed-case list", packageTypes: "NPM, Container", packageType: "container", wantAllowed: true},
+		{name: "mixed-case other type", packageTypes: "container", packageType: "Npm", wantAllowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"FILTER_PACKAGE_TYPES": test.packageTypes})
+			event := decodePackageEvent(t, `{"action":"published","package":{"name":"app","package_type":"`+test.packageType+`"}}`)
+			reason := event.filter(filters)
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && !strings.Contains(reason.Detail, "received as "+test.packageType) {
+				t.Errorf("detail %q doesn't name the received package type %q", reason.Detail, test.packageType)
+			}
+		})
+	}
+}
+
+func TestPackageTypeCaseInRules(t *testing.T) {
+	condition := parseTestCondition(t, "package_type: Container")
+	for _, packageType := range []string{"CONTAINER", "container", "Container"} {
+		event := decodePackageEvent(t, `{"package":{"package_type":"`+packageType+`"}}`)
+		var matched []string
+		if !condition.matches("package", event, &matched) {
+			t.Errorf("package_type %s doesn't match package_type: Container", packageType)
+		}
+	}
+}
+
+func TestFilterTopics(t *testing.T) {
+	tests := []struct {
+		name        string
+		required    string
+		any         string
+		payload     string
+		wantAllowed bool
+	}{
+		{name: "all required topics present", required: "auto-deploy,prod", payload: `{"repository":{"topics":["prod","auto-deploy","go"]}}`, wantAllowed: true},
+		{name: "one required topic missing", required: "auto-deploy,prod", payload: `{"repository":{"topics":["auto-deploy"]}}`, wantAllowed: false},
+		{name: "one of the topics present", any: "auto-deploy,canary", payload: `{"repository":{"topics":["canary"]}}`, wantAllowed: true},
+		{name: "none of the topics present", any: "auto-deploy,canary", payload: `{"repository":{"topics":["go"]}}`, wantAllowed: false},
+		{name: "required and any both satisfied", required: "prod", any: "auto-deploy,canary", payload: `{"repository":{"topics":["prod","canary"]}}`, wantAllowed: true},
+		{name: "required satisfied, any not", required: "prod", any: "auto-deploy", payload: `{"repository":{"topics":["prod"]}}`, wantAllowed: false},
+		{name: "case-insensitive settings", required: "Auto-Deploy", payload: `{"repository":{"topics":["auto-deploy"]}}`, wantAllowed: true},
+		{name: "empty topics with required topics", required: "auto-deploy", payload: `{"repository":{"topics":[]}}`, wantAllowed: false},
+		{name: "missing topics with required topics", required: "auto-deploy", payload: `{"repository":{"full_name":"acme/app"}}`, wantAllowed: false},
+		{name: "missing topics with any topics", any: "auto-deploy", payload: `{"repository":{"full_name":"acme/app"}}`, wantAllowed: false},
+		{name: "null topics", required: "auto-deploy", payload: `{"repository":{"topics":null}}`, wantAllowed: false},
+		{name: "missing topics without topic settings", payload: `{"repository":{"full_name":"acme/app"}}`, wantAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"REQUIRED_TOPICS": test.required, "ANY_TOPICS": test.any})
+			reason := filterTopics(filters, decodeEvent(t, test.payload))
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && reason.Code != reasonTopicFiltered {
+				t.Errorf("reason = %q, want %q", reason.Code, reasonTopicFiltered)
+			}
+		})
+	}
+}
+
+func TestPackageActionRouting(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		// deletedURL and restoredURL set PACKAGE_DELETED_RELAY_URL and PACKAGE_RESTORED_RELAY_URL to their relays
+		deletedURL, restoredURL bool
+		packageActions          *string
+		// wantRelay is the relay forwarded to, empty when the event is dropped
+		wantRelay  string
+		wantReason string
+		wantDetail string
+	}{
+		{name: "published forwarded to the relay URL", action: "published", wantRelay: "main", wantReason: reasonForwarded},
+		{name: "published with action relay URLs", action: "published", deletedURL: true, restoredURL: true, wantRelay: "main", wantReason: reasonForwarded},
+		{name: "deleted dropped by default", action: "deleted", wantReason: reasonPackageDeleted, wantDetail: "deletion of package app"},
+		{name: "deleted routed to PACKAGE_DELETED_RELAY_URL", action: "deleted", deletedURL: true, wantRelay: "deleted", wantReason: reasonForwarded},
+		{name: "deleted listed in PACKAGE_ACTIONS", action: "deleted", packageActions: ptr("published,deleted"), wantRelay: "main", wantReason: reasonForwarded},
+		{name: "restored dropped by default", action: "restored", wantReason: reasonActionFiltered, wantDetail: "action restored"},
+		{name: "restored routed to PACKAGE_RESTORED_RELAY_URL", action: "restored", restoredURL: true, wantRelay: "restored", wantReason: reasonForwarded},
+		{name: "restored not routed to PACKAGE_DELETED_RELAY_URL", action: "restored", deletedURL: true, wantReason: reasonActionFiltered},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relays := map[string]*testRelay{"main": newTestRelay(t, http.StatusOK), "deleted": newTestRelay(t, http.StatusOK), "restored": newTestRelay(t, http.StatusOK)}
+			env := map[string]string{}
+			if test.deletedURL {
+				env["PACKAGE_DELETED_RELAY_URL"] = relays["deleted"].URL
+			}
+			if test.restoredURL {
+				env["PACKAGE_RESTORED_RELAY_URL"] = relays["restored"].URL
+			}
+			if test.packageActions != nil {
+				env["PACKAGE_ACTIONS"] = *test.packageActions
+			}
+			serveTestConfig(t, env, relays["main"].URL)
+			response := deliver(newDelivery("package", strings.Replace(testPackagePayload, `"published"`, `"`+test.action+`"`, 1)))
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+			for name, relay := range relays {
+				if forwarded := len(relay.forwards()) == 1; forwarded != (name == test.wantRelay) {
+					t.Errorf("%s relay received %d forwards", name, len(relay.forwards()))
+				}
+			}
+			if test.wantDetail != "" {
+				var body filterReason
+				if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || !strings.Contains(body.Detail, test.wantDetail) {
+					t.Errorf("body %q doesn't mention %q", response.Body, test.wantDetail)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterNamespace(t *testing.T) {
+	const (
+		platform = "ghcr_platform_published.json"
+		other    = "ghcr_other_namespace_published.json"
+		// missing has neither package.namespace nor package_version.package_url and container_metadata
+		missing = "ghcr_missing_metadata.json"
+	)
+	tests := []struct {
+		name        string
+		fixture     string
+		env         map[string]string
+		wantAllowed bool
+		wantDetail  string
+	}{
+		{name: "no namespace settings", fixture: missing, wantAllowed: true},
+		{name: "namespace matches", fixture: platform, env: map[string]string{"NAMESPACE_PATTERNS": "acme"}, wantAllowed: true},
+		{name: "namespace doesn't match", fixture: other, env: map[string]string{"NAMESPACE_PATTERNS": "acme"}, wantDetail: "namespace octo-labs"},
+		{name: "namespace glob", fixture: other, env: map[string]string{"NAMESPACE_PATTERNS": "acme,octo-*"}, wantAllowed: true},
+		{name: "namespace case-insensitive", fixture: platform, env: map[string]string{"NAMESPACE_PATTERNS": "ACME"}, wantAllowed: true},
+		{name: "image URL matches", fixture: platform, env: map[string]string{"IMAGE_URL_REGEX": `^ghcr\.io/acme/platform-`}, wantAllowed: true},
+		{name: "image URL doesn't match", fixture: other, env: map[string]string{"IMAGE_URL_REGEX": `^ghcr\.io/acme/platform-`}, wantDetail: "ghcr.io/octo-labs/cli:2.0.0"},
+		{name: "namespace matches, image URL doesn't", fixture: platform, env: map[string]string{"NAMESPACE_PATTERNS": "acme", "IMAGE_URL_REGEX": `/platform-web:`}, wantDetail: "platform-api"},
+		{name: "missing namespace fails open", fixture: missing, env: map[string]string{"NAMESPACE_PATTERNS": "acme"}, wantAllowed: true},
+		{name: "missing namespace fails closed", fixture: missing, env: map[string]string{"NAMESPACE_PATTERNS": "acme", "NAMESPACE_FAIL_CLOSED": "true"}, wantDetail: "no namespace"},
+		{name: "missing package URL fails open", fixture: missing, env: map[string]string{"IMAGE_URL_REGEX": `^ghcr\.io/acme/`}, wantAllowed: true},
+		{name: "missing package URL fails closed", fixture: missing, env: map[string]string{"IMAGE_URL_REGEX": `^ghcr\.io/acme/`, "NAMESPACE_FAIL_CLOSED": "true"}, wantDetail: "no package URL"},
+		{name: "fail closed with the fields present", fixture: platform, env: map[string]string{"NAMESPACE_PATTERNS": "acme", "IMAGE_URL_REGEX": `^ghcr\.io/acme/`, "NAMESPACE_FAIL_CLOSED": "true"}, wantAllowed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, test.env)
+			reason := filterNamespace(filters, decodePackageEvent(t, readTestdata(t, test.fixture)))
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && (reason.Code != reasonNamespaceFiltered || !strings.Contains(reason.Detail, test.wantDetail)) {
+				t.Errorf("reason = %s (%s), want %s mentioning %q", reason.Code, reason.Detail, reasonNamespaceFiltered, test.wantDetail)
+			}
+		})
+	}
+}
+
+func TestGhcrFixtureNesting(t *testing.T) {
+	event := decodePackageEvent(t, readTestdata(t, "ghcr_platform_published.json"))
+	if event.Package.Namespace != "acme" || event.Package.PackageVersion.PackageURL != "ghcr.io/acme/platform-api:v1.4.0" || event.Package.PackageVersion.ContainerMetadata.Tag.Name != "v1.4.0" {
+		t.Errorf("decoded namespace %q, package URL %q and tag %q", event.Package.Namespace, event.Package.PackageVersion.PackageURL, event.Package.PackageVersion.ContainerMetadata.Tag.Name)
+	}
+	missing := decodePackageEvent(t, readTestdata(t, "ghcr_missing_metadata.json"))
+	if missing.Package.Namespace != "" || missing.Package.PackageVersion.PackageURL != "" || missing.Package.PackageVersion.ContainerMetadata.Tag.Name != "" {
+		t.Errorf("expected no namespace, package URL and tag, got %+v", missing.Package)
+	}
+}
+
+func TestHandlerNamespaceFilter(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"NAMESPACE_PATTERNS": "acme", "IMAGE_URL_REGEX": `^ghcr\.io/acme/platform-`}, relay.URL)
+	for fixture, wantReason := range map[string]string{"ghcr_platform_published.json": reasonForwarded, "ghcr_other_namespace_published.json": reasonNamespaceFiltered} {
+		response := deliver(newDelivery("package", readTestdata(t, fixture)))
+		if reason := response.Header().Get("X-Filter-Reason"); reason != wantReason {
+			t.Errorf("%s: X-Filter-Reason = %q, want %q", fixture, reason, wantReason)
+		}
+	}
+	if forwards := relay.forwards(); len(forwards) != 1 {
+		t.Errorf("relay received %d forwards, want 1", len(forwards))
+	}
+}
+
+func TestFilterOwner(t *testing.T) {
+	const (
+		organization = "package_owner_organization.json"
+		user         = "package_owner_user.json"
+	)
+	tests := []struct {
+		name        string
+		fixture     string
+		ownerTypes  string
+		owners      string
+		missingType bool
+		wantAllowed bool
+		wantDetail  string
+	}{
+		{name: "any owner type by default, organization", fixture: organization, wantAllowed: true},
+		{name: "any owner type by default, user", fixture: user, wantAllowed: true},
+		{name: "any owner type explicitly", fixture: user, ownerTypes: "any", wantAllowed: true},
+		{name: "organization allowed", fixture: organization, ownerTypes: "Organization", wantAllowed: true},
+		{name: "user denied", fixture: user, ownerTypes: "Organization", wantDetail: "owned by User octocat"},
+		{name: "user allowed", fixture: user, ownerTypes: "User", wantAllowed: true},
+		{name: "organization denied", fixture: organization, ownerTypes: "User", wantDetail: "owned by Organization acme"},
+		{name: "both owner types", fixture: user, ownerTypes: "Organization,User", wantAllowed: true},
+		{name: "owner types case-insensitive", fixture: organization, ownerTypes: "organization", wantAllowed: true},
+		{name: "missing type with any owner type", fixture: organization, missingType: true, wantAllowed: true},
+		{name: "missing type with owner types", fixture: organization, ownerTypes: "Organization", missingType: true, wantDetail: "Allowed owner types"},
+		{name: "owner login allowed", fixture: organization, owners: "acme,globex", wantAllowed: true},
+		{name: "owner login denied", fixture: user, owners: "acme", wantDetail: "owned by octocat"},
+		{name: "owner login case-insensitive", fixture: user, owners: "OctoCat", wantAllowed: true},
+		{name: "owner type allowed, login denied", fixture: organization, ownerTypes: "Organization", owners: "globex", wantDetail: "Allowed owners"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, map[string]string{"PACKAGE_OWNER_TYPES": test.ownerTypes, "PACKAGE_OWNERS": test.owners})
+			event := decodePackageEvent(t, readTestdata(t, test.fixture))
+			if test.missingType {
+				event.Package.Owner.Type = ""
+			}
+			reason := filterOwner(filters, event)
+			if allowed := reason == nil; allowed != test.wantAllowed {
+				t.Fatalf("allowed = %v, want %v (%v)", allowed, test.wantAllowed, reason)
+			}
+			if reason != nil && (reason.Code != reasonOwnerFiltered || !strings.Contains(reason.Detail, test.wantDetail)) {
+				t.Errorf("reason = %s (%s), want %s mentioning %q", reason.Code, reason.Detail, reasonOwnerFiltered, test.wantDetail)
+			}
+		})
+	}
+}
+
+func TestFilterOwnerTypesInvalid(t *testing.T) {
+	t.Setenv("PACKAGE_OWNER_TYPES", "Organization,Bot")
+	if _, err := loadFilterConfig(); err == nil || !strings.Contains(err.Error(), "PACKAGE_OWNER_TYPES") {
+		t.Errorf("expected a PACKAGE_OWNER_TYPES error, got %v", err)
+	}
+}
+
+func TestHandlerOwnerFilter(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"PACKAGE_OWNER_TYPES": "Organization"}, relay.URL)
+	response := deliver(newDelivery("package", readTestdata(t, "package_owner_user.json")))
+	if response.Code != http.StatusOK || response.Header().Get("X-Filter-Reason") != reasonOwnerFiltered {
+		t.Errorf("status %d with reason %q, want %d with %q", response.Code, response.Header().Get("X-Filter-Reason"), http.StatusOK, reasonOwnerFiltered)
+	}
+	if !strings.Contains(response.Body.String(), "octocat") {
+		t.Errorf("body %q doesn't name the owner", response.Body)
+	}
+	if forwards := relay.forwards(); len(forwards) != 0 {
+		t.Errorf("relay received %d forwards, want none", len(forwards))
+	}
+}
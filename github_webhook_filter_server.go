@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -11,66 +14,203 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
-type PackageEvent struct {
-	Package struct {
-		PackageType string `json:"package_type"`
-	} `json:"package"`
-}
-
-var webhookSecret string
-var relayURL string
 var loadEnvFile = flag.Bool("loadEnvFile", true, "Load environment variables from .env file")
 
-func init() {
+// setup parses the flags, loads the configuration and opens the queues, caches and stores the server relies on. It runs
+// from main rather than init so the tests don't parse the server flags nor need a configured environment
+func setup() {
 	flag.Parse()
 	if *loadEnvFile {
 		if err := godotenv.Load("variables.env"); err != nil {
 			log.Printf("Error when loading environment variables: %v\n", err)
 		}
 	}
-	webhookSecret = os.Getenv("GITHUB_WEBHOOK_SECRET")
-	relayURL = os.Getenv("WEBHOOKRELAY_URL")
-	if webhookSecret == "" || relayURL == "" {
-		log.Fatal("Missing required environment variables")
+	if *checkConfig {
+		os.Exit(runConfigCheck())
+	}
+	config, err := loadServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.defaultRoute.secret != "" {
+		log.Printf("Webhook shared secret loaded")
+	}
+	for _, line := range config.describe() {
+		log.Printf("%s\n", line)
+	}
+	currentConfig.Store(config)
+	if relayClient, err = newRelayClient(config.defaultRoute.relayURLs); err != nil {
+		log.Fatal(err)
+	}
+	if *migrateSchema {
+		if err := migratePostgresDestinations(config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if asyncForwards, err = newForwardQueue(); err != nil {
+		log.Fatal(err)
+	}
+	if eventArchiver, err = newEventArchive(); err != nil {
+		log.Fatal(err)
+	}
+	if deliveryResponses, err = newDeliveryCache(); err != nil {
+		log.Fatal(err)
+	}
+	if deliveryLog, err = newDeliveryHistory(); err != nil {
+		log.Fatal(err)
+	}
+	if pagerDuty, err = newPagerDutyAlerter(); err != nil {
+		log.Fatal(err)
+	}
+	if deadLetterRetries, err = newDeadLetterRetrier(); err != nil {
+		log.Fatal(err)
 	}
-	log.Printf("Webhook shared secret loaded")
-	log.Printf("URL: %s\n", relayURL)
 }
 
 func main() {
+	setup()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		depth := asyncForwards.depth()
+		w.Header().Set("X-Queue-Depth", strconv.Itoa(depth.Depth))
+		w.Header().Set("X-Queue-Oldest-Age", strconv.FormatFloat(depth.OldestAgeSeconds, 'f', 0, 64))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	mux.HandleFunc("/ready", handleReady)
+	mux.HandleFunc("/stats/filters", handleFilterStats)
+	mux.HandleFunc("GET /dlq", handleDeadLetters)
+	mux.HandleFunc("POST /dlq/{id}/redeliver", handleRedeliver)
+	mux.HandleFunc("POST /admin/redeliver", handleAdminRedeliver)
+	mux.HandleFunc("GET /deliveries", handleDeliveries)
+	mux.HandleFunc("GET /deliveries/{id}", handleDeliveries)
 	mux.HandleFunc("/", handler)
+	go logSuppressedActions(time.Hour)
+	go reloadOnSignal()
+	go recentForwards.evictEvery(time.Minute)
+	go forwardThrottle.evictIdle(time.Hour, 24*time.Hour)
+	deadLetterRetries.start()
 	log.Printf("Starting github webhooks filter server, listening on 8080")
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, stopped)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// shutdownOnSignal stops the server on SIGTERM or SIGINT once in-flight requests completed, dead-letter retries
+// stopped, debounced events and pending batches were sent, the forward queue drained and sinks, the archive and the
+// delivery database were flushed
+func shutdownOnSignal(server *http.Server, stopped chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+	log.Printf("Received %s, shutting down", received)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error when shutting down: %v", err)
+	}
+	deadLetterRetries.close()
+	pendingDebounces.flushAll()
+	pendingBatches.flushAll()
+	asyncForwards.drain()
+	closeSinks()
+	pagerDuty.close()
+	if eventArchiver != nil {
+		eventArchiver.close()
+	}
+	deliveryLog.close()
+	log.Printf("Shutdown complete")
+	close(stopped)
 }
 
 func handler(responseWriter http.ResponseWriter, request *http.Request) {
 	log.Printf("********************")
-	log.Printf("Received %s request from %s", request.Method, request.RemoteAddr)
+	hookID := request.Header.Get("X-GitHub-Hook-ID")
+	log.Printf("Received %s request from %s (hook %s)", request.Method, request.RemoteAddr, hookID)
 
 	defer func() {
-		log.Printf("Finished processing request")
+		log.Printf("Finished processing request (hook %s)", hookID)
 		log.Printf("********************")
 	}()
 
+	route := currentConfig.Load().lookupRoute(request.URL.Path)
+	if route == nil {
+		log.Printf("No route configured for path %s", request.URL.Path)
+		http.NotFound(responseWriter, request)
+		return
+	}
 	if request.Method == "HEAD" || request.Method == "GET" {
 		handleHeadAndGet(responseWriter, request)
 		return
 	}
+	var body []byte
+	if eventArchiver != nil || deliveryLog.keepsPayloads() {
+		// the body is read up front so events rejected before filtering are archived and stored with their payload
+		body = readRequest(request.Body)
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if eventArchiver != nil {
+		recorder := &responseCapture{ResponseWriter: responseWriter}
+		responseWriter = recorder
+		defer func() {
+			eventArchiver.record(request, body, recorder.status, recorder.Header().Get("X-Filter-Reason"))
+		}()
+	}
 	if err := logRequest(request.Header); err != "" {
-		respondError(responseWriter, string(err), http.StatusBadRequest)
+		respondFailed(responseWriter, route.filters, reasonBadRequest, err, http.StatusBadRequest)
 		return
 	}
-	handleRequest(responseWriter, request)
+	if deliveryResponses != nil {
+		if cached, found := deliveryResponses.lookup(request); found && !reprocessRequested(request) {
+			log.Printf("Delivery %s was already processed, replaying its %d response", request.Header.Get("X-GitHub-Delivery"), cached.status)
+			cached.replay(responseWriter)
+			return
+		}
+		capture := &responseCapture{ResponseWriter: responseWriter}
+		responseWriter = capture
+		defer func() {
+			// failures aren't cached so that redeliveries retry them
+			if capture.status >= 200 && capture.status < 300 {
+				deliveryResponses.store(request, capture.status, capture.header, capture.body.Bytes())
+			}
+		}()
+	}
+	// rule is the rule or built-in filter that decided the event
+	var rule string
+	if deliveryLog != nil {
+		deliveryLog.begin(request, body)
+		recorder := &responseCapture{ResponseWriter: responseWriter}
+		responseWriter = recorder
+		defer func() {
+			deliveryLog.respond(request.Header.Get("X-GitHub-Delivery"), recorder.status, recorder.Header().Get("X-Filter-Reason"), rule)
+		}()
+	}
+	if reason := filterHook(route.filters, request.Header); reason != nil {
+		respondFiltered(responseWriter, route.filters, reason)
+		filterStatistics.record(canonicalEventType(request.Header.Get("X-GitHub-Event")), reason.Code, false)
+		return
+	}
+	if eventType := canonicalEventType(request.Header.Get("X-GitHub-Event")); route.filters.rules == nil && route.filters.pipelines == nil && !route.filters.events.allows(eventType) {
+		respondFiltered(responseWriter, route.filters, filtered(reasonEventNotAllowed, "Filtered out event %s! Allowed events: %s. No forward to relay", eventType, route.filters.events))
+		filterStatistics.record(eventType, reasonEventNotAllowed, false)
+		return
+	}
+	if rule = handleRequest(responseWriter, request, route); rule != "" {
+		forwarded := responseWriter.Header().Get("X-Filter-Reason") == reasonForwarded
+		filterStatistics.record(canonicalEventType(request.Header.Get("X-GitHub-Event")), rule, forwarded)
+	}
 }
 
 func handleHeadAndGet(responseWriter http.ResponseWriter, request *http.Request) {
@@ -89,64 +229,220 @@ func logRequest(headers http.Header) string {
 		errorLine := fmt.Sprintf("Either missing requestId: (%s) or eventType: (%s) and will not process request further", requestId, eventType)
 		return errorLine
 	}
-	log.Printf("Processing request with id: (%s) and event type: (%s)\n", requestId, eventType)
+	log.Printf("Processing request with id: (%s), event type: (%s), hook: (%s), hook installation target: (%s %s)\n", requestId, eventType,
+		headers.Get("X-GitHub-Hook-ID"), headers.Get("X-GitHub-Hook-Installation-Target-Type"), headers.Get("X-GitHub-Hook-Installation-Target-ID"))
 	return ""
 }
 
-func respondError(responseWriter http.ResponseWriter, msg string, code int) {
-	log.Printf("%s", msg)
-	http.Error(responseWriter, msg, code)
-}
-
-func handleRequest(responseWriter http.ResponseWriter, request *http.Request) {
+// handleRequest filters and forwards a webhook delivery. Returns the name of the rule or built-in filter that decided the
+// event, or an empty string when the request was rejected before filtering
+func handleRequest(responseWriter http.ResponseWriter, request *http.Request, route *route) string {
+	filters := route.filters
 	requestBody := readRequest(request.Body)
-	headerSignature := request.Header.Get("X-Hub-Signature-256")
-	if !verifySignature(headerSignature, requestBody) {
-		respondError(responseWriter, "Invalid Signature", http.StatusUnauthorized)
-		return
+	algorithm, headerSignature, valid := verifyDelivery(route.secret, request.Header, requestBody, filters.allowSHA1)
+	if !valid {
+		respondFailed(responseWriter, filters, reasonSignatureInvalid, "Invalid Signature", http.StatusUnauthorized)
+		return ""
 	}
-	log.Printf("Signature Match! %s\n", headerSignature)
+	log.Printf("Signature Match (%s)! %s\n", algorithm, headerSignature)
 
-	var event PackageEvent
+	eventType := canonicalEventType(request.Header.Get("X-GitHub-Event"))
+	if receivedType := request.Header.Get("X-GitHub-Event"); receivedType != eventType {
+		log.Printf("Received legacy %s event, filtering it as a %s event", receivedType, eventType)
+	}
+	var event WebhookEvent
 	if err := json.Unmarshal(requestBody, &event); err != nil {
 		logLine := fmt.Sprintf("Failed to parse JSON: %v", err)
-		respondError(responseWriter, logLine, http.StatusBadRequest)
-		return
+		respondFailed(responseWriter, filters, reasonInvalidPayload, logLine, http.StatusBadRequest)
+		return ""
+	}
+	if err := filters.schemas.validate(eventType, requestBody); err != nil {
+		respondFailed(responseWriter, filters, reasonSchemaInvalid, fmt.Sprintf("Payload does not match the %s schema: %v", eventType, err), http.StatusBadRequest)
+		return ""
+	}
+	if filters.pipelines != nil {
+		var packageEvent PackageEvent
+		json.Unmarshal(requestBody, &packageEvent)
+		dispatchPipelines(responseWriter, request, filters, route.relayURLs, eventType, &packageEvent, requestBody)
+		return ""
+	}
+	var payload map[string]any
+	json.Unmarshal(requestBody, &payload)
+	if filters.rules == nil && filters.eventActions != nil {
+		if reason := filters.eventActions.filter(eventType, event.Action); reason != nil {
+			respondFiltered(responseWriter, filters, reason)
+			return reason.Code
+		}
 	}
 
-	if packageType := event.Package.PackageType; packageType != "CONTAINER" {
-		logLine := fmt.Sprintf("Filtered out package_type %s! No forward to relay", packageType)
-		log.Printf("%s", logLine)
-		responseWriter.Header().Add("Message", logLine)
-		responseWriter.WriteHeader(http.StatusNoContent)
-		return
+	summary := "event:" + eventType
+	// rule names the rule or built-in filter that decided the event, for the filter statistics
+	rule := builtinFiltersPassed
+	var typed typedEvent
+	// ruleDestination is set when the matching rule forwards to its own destination
+	var ruleDestination *relayDestination
+	if filters.rules != nil {
+		var packageEvent PackageEvent
+		json.Unmarshal(requestBody, &packageEvent)
+		if eventType == "package" {
+			typed = &packageEvent
+		}
+		var allowed bool
+		var notify string
+		rule, allowed, ruleDestination, notify = filters.rules.evaluate(eventType, &packageEvent)
+		if notify != "" && filters.dryRun {
+			log.Printf("Dry run, not sending the PagerDuty event of rule %s", rule)
+		} else if notify != "" {
+			pagerDuty.notifyRule(rule, notify, request.Header, requestBody, verdictName(allowed))
+		}
+		if !allowed {
+			respondFiltered(responseWriter, filters, filtered(reasonRuleFiltered, "Filtered out by rule %s! No forward to relay", rule))
+			return rule
+		}
+		summary = "rule:" + rule
+	} else {
+		var reason *filterReason
+		var err error
+		typed, reason, err = filterEvent(filters, eventType, requestBody, &event)
+		if err != nil {
+			respondFailed(responseWriter, filters, reasonInvalidPayload, fmt.Sprintf("Failed to parse %s event: %v", eventType, err), http.StatusBadRequest)
+			return ""
+		}
+		if reason != nil {
+			respondFiltered(responseWriter, filters, reason)
+			return reason.Code
+		}
+		if typed != nil {
+			summary = typed.summary()
+		}
+	}
+
+	for _, condition := range filters.fieldFilters {
+		if !condition.matches(payload) {
+			respondFiltered(responseWriter, filters, filtered(reasonFieldFiltered, "Filtered out by field filter %s! No forward to relay", condition.source))
+			return rule
+		}
+	}
+	for _, condition := range filters.jsonPaths {
+		if !condition.matches(payload) {
+			respondFiltered(responseWriter, filters, filtered(reasonJSONPathFiltered, "Filtered out by JSONPath condition %s! No forward to relay", condition.source))
+			return rule
+		}
+	}
+	if filters.expression != nil {
+		allowed, err := filters.expression.evaluate(eventType, payload)
+		if err != nil {
+			respondFailed(responseWriter, filters, reasonExpressionError, fmt.Sprintf("Failed to evaluate filter expression (%s): %v", filters.expression, err), http.StatusInternalServerError)
+			return rule
+		}
+		if !allowed {
+			respondFiltered(responseWriter, filters, filtered(reasonExpressionFiltered, "Filtered out by expression %s! No forward to relay", filters.expression))
+			return rule
+		}
 	}
 
-	log.Printf("package_type CONTAINER passed filter! Sending to relay")
+	if filters.command != nil {
+		allowed, err := filters.command.run(request.Context(), eventType, requestBody)
+		if err != nil {
+			respondFailed(responseWriter, filters, reasonCommandError, fmt.Sprintf("Failed to run filter command (%s): %v", filters.command, err), http.StatusInternalServerError)
+			return rule
+		}
+		if !allowed {
+			respondFiltered(responseWriter, filters, filtered(reasonCommandFiltered, "Filtered out by filter command %s! No forward to relay", filters.command))
+			return rule
+		}
+	}
 
-	newRequest, _ := http.NewRequestWithContext(request.Context(), "POST", relayURL, strings.NewReader(string(requestBody)))
-	for key, valuesArray := range request.Header {
-		for _, value := range valuesArray {
-			newRequest.Header.Set(key, value)
+	scriptRelayURL := ""
+	if filters.script != nil {
+		verdict, err := filters.script.run(eventType, request.Header, requestBody)
+		if err != nil {
+			respondFailed(responseWriter, filters, reasonScriptError, fmt.Sprintf("Failed to run filter script (%s): %v", filters.script, err), http.StatusInternalServerError)
+			return rule
+		}
+		if !verdict.forward {
+			detail := verdict.reason
+			if detail == "" {
+				detail = "no reason given"
+			}
+			respondFiltered(responseWriter, filters, filtered(reasonScriptFiltered, "Filtered out by filter script %s (%s)! No forward to relay", filters.script, detail))
+			return rule
+		}
+		scriptRelayURL = verdict.relayURL
+	}
+
+	forwardBody, reason := limitPayloadSize(filters, projectFields(filters.forwardFields, requestBody))
+	if reason != nil {
+		respondFiltered(responseWriter, filters, reason)
+		return rule
+	}
+
+	if filters.forwardWindow != nil && !filters.forwardWindow.contains(time.Now()) {
+		respondFiltered(responseWriter, filters, filtered(reasonOutsideWindow, "Filtered out %s! Delivered outside the forward window %s. No forward to relay", summary, filters.forwardWindow))
+		return rule
+	}
+
+	destinations := filters.sinks.relayDestinations(route.relayURLs)
+	for index := range destinations {
+		if destinations[index].hedge == nil && destinations[index].failover == "" {
+			destinations[index].hedge, destinations[index].failover = filters.hedge, filters.failoverURL
 		}
 	}
-	newRequest.Header.Set("User-Agent", "Go WebHook Filter")
-	newRequest.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	httpResponse, err := client.Do(newRequest)
+	destinations = filters.balanceRelayURLs(destinations)
+	if ruleDestination != nil {
+		destinations = []relayDestination{*ruleDestination}
+		log.Printf("Rule %s routed %s to %s", rule, summary, ruleDestination.url)
+	}
+	if packageEvent, ok := typed.(*PackageEvent); ok && filters.actionRelayURLs[packageEvent.Action] != "" {
+		destinations = newRelayDestinations([]string{filters.actionRelayURLs[packageEvent.Action]})
+		log.Printf("Routing %s package to %s", packageEvent.Action, destinations[0].url)
+	}
+	if scriptRelayURL != "" {
+		destinations = newRelayDestinations([]string{scriptRelayURL})
+		log.Printf("Filter script routed %s to %s", summary, scriptRelayURL)
+	}
+	destinations, err := expandRelayURLs(destinations, request.Header, requestBody)
 	if err != nil {
-		logLine := fmt.Sprintf("Error sending request: %v\n", err)
-		respondError(responseWriter, logLine, http.StatusBadGateway)
+		respondFailed(responseWriter, filters, reasonTemplateError, fmt.Sprintf("Failed to build the relay URL of %s: %v", summary, err), http.StatusInternalServerError)
+		return rule
+	}
+	if destinations, err = renderBodies(destinations, filters.bodyTemplate, request.Header, forwardBody); err != nil {
+		respondFailed(responseWriter, filters, reasonTemplateError, fmt.Sprintf("Failed to render %s: %v", summary, err), http.StatusInternalServerError)
+		return rule
 	}
-	defer httpResponse.Body.Close()
 
-	log.Printf("Downstream relay responded with code: %d", httpResponse.StatusCode)
+	dedupeKey := ""
+	if packageEvent, ok := typed.(*PackageEvent); ok && filters.dedupeWindow > 0 {
+		dedupeKey = packageEvent.dedupeKey()
+		if since, duplicate := recentForwards.seen(dedupeKey, filters.dedupeWindow); duplicate {
+			respondFiltered(responseWriter, filters, filtered(reasonDuplicateSuppressed, "Suppressed duplicate of %s forwarded %s ago. No forward to relay", dedupeKey, since.Round(time.Second)))
+			return rule
+		}
+	}
 
-	if statusCode := httpResponse.StatusCode; statusCode < 200 || statusCode >= 300 {
-		http.Error(responseWriter, fmt.Sprintf("Error - Relay returned status: %d", statusCode), http.StatusBadGateway)
+	if filters.repoRate != nil && !filters.dryRun {
+		if repo := event.Repository.FullName; !forwardThrottle.allow(repo, filters.repoRate) {
+			if dedupeKey != "" {
+				recentForwards.forget(dedupeKey)
+			}
+			respondFiltered(responseWriter, filters, filtered(reasonRateLimited, "Filtered out %s from %s! Repository exceeded %s. No forward to relay", summary, repo, filters.repoRate))
+			return rule
+		}
 	}
-	responseWriter.Write([]byte("package_type:CONTAINER passed the filter on Github Webhook Filter server hosted at onrender.com. Forwarded to relay."))
-	responseWriter.WriteHeader(http.StatusOK)
+
+	if filters.dryRun {
+		if dedupeKey != "" {
+			// only forwards count, a real delivery of the event after the dry run goes through
+			recentForwards.forget(dedupeKey)
+		}
+		respondDryRun(responseWriter, "would-forward", filtered(reasonForwarded, "%s passed the filter", summary))
+		return rule
+	}
+	if !forwardToRelay(responseWriter, request, filters, destinations, forwardBody, summary) && dedupeKey != "" {
+		// let GitHub's redelivery of a failed forward through
+		recentForwards.forget(dedupeKey)
+	}
+	return rule
 }
 
 func readRequest(reader io.ReadCloser) []byte {
@@ -157,9 +453,26 @@ func readRequest(reader io.ReadCloser) []byte {
 	return requestBody
 }
 
-func verifySignature(headerSignature string, requestBodyToHash []byte) bool {
+// verifyDelivery checks the X-Hub-Signature-256 signature of the delivery, or with allowSHA1 the legacy SHA-1
+// X-Hub-Signature of deliveries without one. Returns the algorithm and the signature checked
+func verifyDelivery(webhookSecret string, header http.Header, requestBody []byte, allowSHA1 bool) (string, string, bool) {
+	if headerSignature := header.Get("X-Hub-Signature-256"); headerSignature != "" || !allowSHA1 {
+		return "SHA-256", headerSignature, verifySignature(webhookSecret, headerSignature, requestBody)
+	}
+	headerSignature := header.Get("X-Hub-Signature")
+	return "SHA-1", headerSignature, verifySHA1Signature(webhookSecret, headerSignature, requestBody)
+}
+
+func verifySignature(webhookSecret string, headerSignature string, requestBodyToHash []byte) bool {
 	mac := hmac.New(sha256.New, []byte(webhookSecret))
 	mac.Write(requestBodyToHash)
 	calculated := "sha256=" + hex.EncodeToString(mac.Sum(nil))
 	return hmac.Equal([]byte(calculated), []byte(headerSignature))
 }
+
+func verifySHA1Signature(webhookSecret string, headerSignature string, requestBodyToHash []byte) bool {
+	mac := hmac.New(sha1.New, []byte(webhookSecret))
+	mac.Write(requestBodyToHash)
+	calculated := "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(calculated), []byte(headerSignature))
+}
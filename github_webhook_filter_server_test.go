@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSecret is the webhook secret the test deliveries are signed with
+const testSecret = "test-secret"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// the configuration comes from the environment variables set by each test, not from the shell running the tests
+	kept := map[string]string{}
+	for _, name := range []string{"PATH", "HOME", "TMPDIR", "GOCOVERDIR"} {
+		if value, found := os.LookupEnv(name); found {
+			kept[name] = value
+		}
+	}
+	os.Clearenv()
+	for name, value := range kept {
+		os.Setenv(name, value)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	var err error
+	if relayClient, err = newRelayClient(nil); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// serveTestConfig loads the configuration from the environment variables, forwarding to the relay URLs, and serves it
+// until the end of the test
+func serveTestConfig(t *testing.T, env map[string]string, relayURLs ...string) *serverConfig {
+	t.Helper()
+	t.Setenv("GITHUB_WEBHOOK_SECRET", testSecret)
+	t.Setenv("RELAY_URLS", strings.Join(relayURLs, ","))
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	config, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("loading the configuration: %v", err)
+	}
+	previous := currentConfig.Swap(config)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return config
+}
+
+// loadTestFilters loads the filter configuration from the environment variables
+func loadTestFilters(t *testing.T, env map[string]string) *filterConfig {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	filters, err := loadFilterConfig()
+	if err != nil {
+		t.Fatalf("loading the filter configuration: %v", err)
+	}
+	return filters
+}
+
+// decodeEvent decodes the fields shared by every webhook payload
+func decodeEvent(t *testing.T, payload string) *WebhookEvent {
+	t.Helper()
+	var event WebhookEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		t.Fatalf("decoding %s: %v", payload, err)
+	}
+	return &event
+}
+
+// readTestdata returns the content of the file of the testdata directory
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+var deliveryIDs atomic.Int64
+
+// newDelivery builds a delivery of the event with a fresh delivery ID, signed with testSecret
+func newDelivery(eventType string, payload string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(payload))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-GitHub-Event", eventType)
+	request.Header.Set("X-GitHub-Delivery", "delivery-"+strconv.FormatInt(deliveryIDs.Add(1), 10))
+	request.Header.Set("X-GitHub-Hook-ID", "1")
+	request.Header.Set("X-Hub-Signature-256", signSHA256(testSecret, payload))
+	return request
+}
+
+func signSHA256(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func signSHA1(secret string, payload string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver runs the delivery through the handler
+func deliver(request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+// testRelay is a relay answering every forward with its status and keeping the forwards it received
+type testRelay struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	received []relayedForward
+}
+
+type relayedForward struct {
+	header http.Header
+	body   string
+}
+
+func newTestRelay(t *testing.T, status int) *testRelay {
+	relay := &testRelay{}
+	relay.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		relay.mutex.Lock()
+		relay.received = append(relay.received, relayedForward{header: r.Header.Clone(), body: string(body)})
+		relay.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+func (relay *testRelay) forwards() []relayedForward {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return append([]relayedForward(nil), relay.received...)
+}
+
+const testPackagePayload = `{"action":"published","repository":{"full_name":"octo-org/app"},"package":{"name":"app","package_type":"CONTAINER","package_version":{"version":"1.0.0"}}}`
+
+func TestHandlerEventTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowedEvents *string
+		eventType     string
+		payload       string
+		wantStatus    int
+		wantReason    string
+	}{
+		{name: "package event allowed by default", eventType: "package", payload: testPackagePayload, wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "other event dropped by default", eventType: "issues", payload: `{"action":"opened"}`, wantStatus: http.StatusOK, wantReason: reasonEventNotAllowed},
+		{name: "legacy registry_package filtered as package", eventType: "registry_package", payload: `{"action":"published","registry_package":{"name":"app","package_type":"CONTAINER"}}`, wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "listed event allowed", allowedEvents: ptr("push,issues"), eventType: "issues", payload: `{"action":"opened"}`, wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "unlisted event dropped", allowedEvents: ptr("push,issues"), eventType: "package", payload: testPackagePayload, wantStatus: http.StatusOK, wantReason: reasonEventNotAllowed},
+		{name: "empty list allows every event", allowedEvents: ptr(""), eventType: "star", payload: `{"action":"created"}`, wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "package event filtered by its package type", eventType: "package", payload: `{"action":"published","package":{"name":"app","package_type":"npm"}}`, wantStatus: http.StatusOK, wantReason: reasonPackageTypeFiltered},
+		{name: "invalid payload", allowedEvents: ptr(""), eventType: "issues", payload: `{"action":`, wantStatus: http.StatusBadRequest, wantReason: reasonInvalidPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			env := map[string]string{"FILTER_PACKAGE_TYPES": "container"}
+			if test.allowedEvents != nil {
+				env["ALLOWED_EVENTS"] = *test.allowedEvents
+			}
+			serveTestConfig(t, env, relay.URL)
+			response := deliver(newDelivery(test.eventType, test.payload))
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+			if forwarded := len(relay.forwards()) == 1; forwarded != (test.wantReason == reasonForwarded) {
+				t.Errorf("relay received %d forwards", len(relay.forwards()))
+			}
+		})
+	}
+}
+
+func TestHandlerRejectsDeliveries(t *testing.T) {
+	tests := []struct {
+		name       string
+		prepare    func(request *http.Request)
+		wantStatus int
+		wantReason string
+	}{
+		{name: "missing event type", prepare: func(request *http.Request) { request.Header.Del("X-GitHub-Event") }, wantStatus: http.StatusBadRequest, wantReason: reasonBadRequest},
+		{name: "missing delivery ID", prepare: func(request *http.Request) { request.Header.Del("X-GitHub-Delivery") }, wantStatus: http.StatusBadRequest, wantReason: reasonBadRequest},
+		{name: "missing signature", prepare: func(request *http.Request) { request.Header.Del("X-Hub-Signature-256") }, wantStatus: http.StatusUnauthorized, wantReason: reasonSignatureInvalid},
+		{name: "wrong secret", prepare: func(request *http.Request) {
+			request.Header.Set("X-Hub-Signature-256", signSHA256("other-secret", testPackagePayload))
+		}, wantStatus: http.StatusUnauthorized, wantReason: reasonSignatureInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, nil, relay.URL)
+			request := newDelivery("package", testPackagePayload)
+			test.prepare(request)
+			response := deliver(request)
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+			if forwards := relay.forwards(); len(forwards) != 0 {
+				t.Errorf("relay received %d forwards, want none", len(forwards))
+			}
+		})
+	}
+}
+
+func TestVerifyDelivery(t *testing.T) {
+	validSHA256, validSHA1 := signSHA256(testSecret, testPackagePayload), signSHA1(testSecret, testPackagePayload)
+	invalidSHA256, invalidSHA1 := signSHA256("other-secret", testPackagePayload), signSHA1("other-secret", testPackagePayload)
+	tests := []struct {
+		name          string
+		sha256        string
+		sha1          string
+		allowSHA1     bool
+		wantAlgorithm string
+		wantValid     bool
+	}{
+		{name: "SHA-256 only", sha256: validSHA256, wantAlgorithm: "SHA-256", wantValid: true},
+		{name: "invalid SHA-256 only", sha256: invalidSHA256, wantAlgorithm: "SHA-256", wantValid: false},
+		{name: "SHA-256 only with SHA-1 allowed", sha256: validSHA256, allowSHA1: true, wantAlgorithm: "SHA-256", wantValid: true},
+		{name: "SHA-1 only", sha1: validSHA1, wantAlgorithm: "SHA-256", wantValid: false},
+		{name: "SHA-1 only with SHA-1 allowed", sha1: validSHA1, allowSHA1: true, wantAlgorithm: "SHA-1", wantValid: true},
+		{name: "invalid SHA-1 only with SHA-1 allowed", sha1: invalidSHA1, allowSHA1: true, wantAlgorithm: "SHA-1", wantValid: false},
+		{name: "no signature with SHA-1 allowed", allowSHA1: true, wantAlgorithm: "SHA-1", wantValid: false},
+		{name: "both valid", sha256: validSHA256, sha1: validSHA1, allowSHA1: true, wantAlgorithm: "SHA-256", wantValid: true},
+		{name: "valid SHA-256 and invalid SHA-1", sha256: validSHA256, sha1: invalidSHA1, allowSHA1: true, wantAlgorithm: "SHA-256", wantValid: true},
+		{name: "invalid SHA-256 and valid SHA-1", sha256: invalidSHA256, sha1: validSHA1, allowSHA1: true, wantAlgorithm: "SHA-256", wantValid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.sha256 != "" {
+				header.Set("X-Hub-Signature-256", test.sha256)
+			}
+			if test.sha1 != "" {
+				header.Set("X-Hub-Signature", test.sha1)
+			}
+			algorithm, _, valid := verifyDelivery(testSecret, header, []byte(testPackagePayload), test.allowSHA1)
+			if algorithm != test.wantAlgorithm || valid != test.wantValid {
+				t.Errorf("verified %s valid = %v, want %s valid = %v", algorithm, valid, test.wantAlgorithm, test.wantValid)
+			}
+		})
+	}
+}
+
+func TestHandlerSHA1Fallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowSHA1  string
+		wantStatus int
+		wantLog    string
+	}{
+		{name: "SHA-1 allowed", allowSHA1: "true", wantStatus: http.StatusOK, wantLog: "Signature Match (SHA-1)!"},
+		{name: "SHA-1 not allowed by default", wantStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, map[string]string{"ALLOW_SHA1": test.allowSHA1}, relay.URL)
+			request := newDelivery("package", testPackagePayload)
+			request.Header.Del("X-Hub-Signature-256")
+			request.Header.Set("X-Hub-Signature", signSHA1(testSecret, testPackagePayload))
+			var logged strings.Builder
+			previous := log.Writer()
+			log.SetOutput(io.MultiWriter(&logged, previous))
+			t.Cleanup(func() { log.SetOutput(previous) })
+			response := deliver(request)
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if test.wantLog != "" && !strings.Contains(logged.String(), test.wantLog) {
+				t.Errorf("expected the log to state %q, got:\n%s", test.wantLog, logged.String())
+			}
+		})
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+func TestHandlerDryRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		eventType string
+		payload   string
+		sign      func(request *http.Request)
+		// before runs before the delivery
+		before      func(t *testing.T)
+		wantVerdict string
+		wantReason  string
+	}{
+		{name: "passing event", eventType: "package", payload: testPackagePayload, wantVerdict: "would-forward", wantReason: reasonForwarded},
+		{name: "event type not allowed", eventType: "issues", payload: `{"action":"opened"}`, wantVerdict: "would-drop", wantReason: reasonEventNotAllowed},
+		{name: "filtered event", eventType: "package", payload: `{"action":"published","package":{"name":"app","package_type":"npm"}}`, wantVerdict: "would-drop", wantReason: reasonPackageTypeFiltered},
+		{name: "invalid signature still checked", eventType: "package", payload: testPackagePayload, sign: func(request *http.Request) {
+			request.Header.Set("X-Hub-Signature-256", signSHA256("other-secret", testPackagePayload))
+		}, wantVerdict: "would-drop", wantReason: reasonSignatureInvalid},
+		{name: "missing delivery ID", eventType: "package", payload: testPackagePayload, sign: func(request *http.Request) {
+			request.Header.Del("X-GitHub-Delivery")
+		}, wantVerdict: "would-drop", wantReason: reasonBadRequest},
+		{name: "invalid payload", eventType: "package", payload: `{"action":`, wantVerdict: "would-drop", wantReason: reasonInvalidPayload},
+		{name: "expression error", env: map[string]string{"FILTER_EXPRESSION": `payload.missing == "x"`}, eventType: "package", payload: testPackagePayload, wantVerdict: "would-drop", wantReason: reasonExpressionError},
+		{name: "template error", env: map[string]string{"RELAY_BODY_TEMPLATE": `{{ fail "boom" }}`}, eventType: "package", payload: testPackagePayload, wantVerdict: "would-drop", wantReason: reasonTemplateError},
+		{name: "duplicate of a forward", env: map[string]string{"DEDUPE_WINDOW": "1h"}, eventType: "package", payload: testPackagePayload, before: func(t *testing.T) {
+			key := decodePackageEvent(t, testPackagePayload).dedupeKey()
+			recentForwards.seen(key, time.Hour)
+			t.Cleanup(func() { recentForwards.forget(key) })
+		}, wantVerdict: "would-drop", wantReason: reasonDuplicateSuppressed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"DRY_RUN": "true", "FILTER_PACKAGE_TYPES": "container"}
+			maps.Copy(env, test.env)
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, env, relay.URL)
+			if test.before != nil {
+				test.before(t)
+			}
+			request := newDelivery(test.eventType, test.payload)
+			if test.sign != nil {
+				test.sign(request)
+			}
+			response := deliver(request)
+			if response.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", response.Code, http.StatusOK)
+			}
+			if verdict := response.Header().Get("X-Filter-Verdict"); verdict != test.wantVerdict {
+				t.Errorf("X-Filter-Verdict = %q, want %q", verdict, test.wantVerdict)
+			}
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+			var body filterReason
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Code != test.wantReason || body.Detail == "" {
+				t.Errorf("body %q isn't the JSON reason %s with a detail", response.Body, test.wantReason)
+			}
+			if forwards := relay.forwards(); len(forwards) != 0 {
+				t.Errorf("relay received %d forwards in a dry run", len(forwards))
+			}
+		})
+	}
+}
+
+func TestHandlerReasonCodes(t *testing.T) {
+	const packageEvent = `{"action":"published","repository":{"full_name":"acme/app","private":true,"topics":["deploy"],"owner":{"login":"acme"}},"sender":{"login":"octocat","type":"User"},"package":{"name":"app","package_type":"CONTAINER","package_version":{"version":"1.0.0","container_metadata":{"tag":{"name":"v1.0.0"}}}}}`
+	tests := []struct {
+		name        string
+		env         map[string]string
+		relayStatus int
+		eventType   string
+		payload     string
+		prepare     func(request *http.Request)
+		// deliveries is the number of times the event is delivered, 1 when 0, the last response being checked
+		deliveries int
+		wantStatus int
+		wantReason string
+	}{
+		{name: "forwarded", wantStatus: http.StatusOK, wantReason: reasonForwarded},
+		{name: "relay error", relayStatus: http.StatusInternalServerError, wantStatus: http.StatusBadGateway, wantReason: reasonRelayError},
+		{name: "signature invalid", prepare: func(request *http.Request) { request.Header.Set("X-Hub-Signature-256", "sha256=00") }, wantStatus: http.StatusUnauthorized, wantReason: reasonSignatureInvalid},
+		{name: "bad request", prepare: func(request *http.Request) { request.Header.Del("X-GitHub-Delivery") }, wantStatus: http.StatusBadRequest, wantReason: reasonBadRequest},
+		{name: "invalid payload", payload: `{"action":`, wantStatus: http.StatusBadRequest, wantReason: reasonInvalidPayload},
+		{name: "event not allowed", eventType: "issues", wantStatus: http.StatusOK, wantReason: reasonEventNotAllowed},
+		{name: "event action filtered", env: map[string]string{"EVENT_ACTIONS": "package:updated"}, wantStatus: http.StatusOK, wantReason: reasonEventActionFiltered},
+		{name: "hook filtered", env: map[string]string{"ALLOWED_HOOK_IDS": "2"}, wantStatus: http.StatusOK, wantReason: reasonHookFiltered},
+		{name: "hook target filtered", env: map[string]string{"HOOK_TARGET_TYPES": "repository"}, prepare: func(request *http.Request) {
+			request.Header.Set("X-GitHub-Hook-Installation-Target-Type", "organization")
+		}, wantStatus: http.StatusOK, wantReason: reasonHookTargetFiltered},
+		{name: "repository filtered", env: map[string]string{"REPO_ALLOWLIST": "other/*"}, wantStatus: http.StatusOK, wantReason: reasonRepoFiltered},
+		{name: "organization filtered", env: map[string]string{"ALLOWED_ORGS": "other"}, wantStatus: http.StatusOK, wantReason: reasonOrgFiltered},
+		{name: "visibility filtered", env: map[string]string{"REPO_VISIBILITY": "public"}, wantStatus: http.StatusOK, wantReason: reasonVisibilityFiltered},
+		{name: "topic filtered", env: map[string]string{"REQUIRED_TOPICS": "release"}, wantStatus: http.StatusOK, wantReason: reasonTopicFiltered},
+		{name: "sender filtered", env: map[string]string{"BLOCK_SENDERS": "octocat"}, wantStatus: http.StatusOK, wantReason: reasonSenderFiltered},
+		{name: "package type filtered", env: map[string]string{"FILTER_PACKAGE_TYPES": "npm"}, wantStatus: http.StatusOK, wantReason: reasonPackageTypeFiltered},
+		{name: "package name filtered", env: map[string]string{"PACKAGE_NAME_PATTERNS": "api-*"}, wantStatus: http.StatusOK, wantReason: reasonPackageNameFiltered},
+		{name: "action filtered", env: map[string]string{"PACKAGE_ACTIONS": "updated"}, wantStatus: http.StatusOK, wantReason: reasonActionFiltered},
+		{name: "package deleted", payload: strings.Replace(packageEvent, `"published"`, `"deleted"`, 1), wantStatus: http.StatusOK, wantReason: reasonPackageDeleted},
+		{name: "tag filtered", env: map[string]string{"CONTAINER_TAG_REGEX": "^release-"}, wantStatus: http.StatusOK, wantReason: reasonTagFiltered},
+		{name: "field filtered", env: map[string]string{"FIELD_FILTERS": "package.name=api"}, wantStatus: http.StatusOK, wantReason: reasonFieldFiltered},
+		{name: "expression filtered", env: map[string]string{"FILTER_EXPRESSION": `payload.action == "updated"`}, wantStatus: http.StatusOK, wantReason: reasonExpressionFiltered},
+		{name: "expression error", env: map[string]string{"FILTER_EXPRESSION": `payload.missing == "x"`}, wantStatus: http.StatusInternalServerError, wantReason: reasonExpressionError},
+		{name: "payload too large", env: map[string]string{"MAX_FORWARD_BYTES": "10"}, wantStatus: http.StatusOK, wantReason: reasonPayloadTooLarge},
+		{name: "outside window", env: map[string]string{"FORWARD_WINDOW": time.Now().UTC().Add(48*time.Hour).Format("Mon") + " 00:00-23:59"}, wantStatus: http.StatusOK, wantReason: reasonOutsideWindow},
+		{name: "duplicate suppressed", env: map[string]string{"DEDUPE_WINDOW": "1h"}, deliveries: 2, wantStatus: http.StatusOK, wantReason: reasonDuplicateSuppressed},
+		{name: "rate limited", env: map[string]string{"MAX_FORWARDS_PER_REPO": "1/h"}, deliveries: 2, wantStatus: http.StatusOK, wantReason: reasonRateLimited},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relayStatus, eventType, payload := test.relayStatus, test.eventType, test.payload
+			if relayStatus == 0 {
+				relayStatus = http.StatusOK
+			}
+			if eventType == "" {
+				eventType = "package"
+			}
+			if payload == "" {
+				payload = packageEvent
+			}
+			relay := newTestRelay(t, relayStatus)
+			serveTestConfig(t, test.env, relay.URL)
+			var response *httptest.ResponseRecorder
+			for range max(test.deliveries, 1) {
+				request := newDelivery(eventType, payload)
+				if test.prepare != nil {
+					test.prepare(request)
+				}
+				response = deliver(request)
+			}
+			if response.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.Code, test.wantStatus)
+			}
+			if reason := response.Header().Get("X-Filter-Reason"); reason != test.wantReason {
+				t.Errorf("X-Filter-Reason = %q, want %q", reason, test.wantReason)
+			}
+			if test.wantReason == reasonForwarded {
+				return
+			}
+			if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+			if message := response.Header().Get("Message"); message != "" {
+				t.Errorf("unexpected Message header %q", message)
+			}
+			var body filterReason
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q isn't a JSON reason: %v", response.Body, err)
+			}
+			if body.Code != test.wantReason || body.Detail == "" {
+				t.Errorf("body = %+v, want reason %s with a detail", body, test.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// filterCommand is an external filter hook. The payload is written to its stdin and the exit code decides the verdict
+type filterCommand struct {
+	args    []string
+	timeout time.Duration
+}
+
+// run returns true when the event should be forwarded (exit code 0) and false when it should be dropped (exit code 1).
+// Any other exit code, a timeout or a failure to start the command is an error
+func (command *filterCommand) run(ctx context.Context, eventType string, requestBody []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, command.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command.args[0], command.args[1:]...)
+	cmd.Stdin = bytes.NewReader(requestBody)
+	cmd.Env = append(os.Environ(), "GWF_EVENT="+eventType)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		log.Printf("Filter command stderr: %s", strings.TrimSpace(stderr.String()))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("timed out after %s", command.timeout)
+	}
+	var exitError *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitError) && exitError.ExitCode() == 1:
+		return false, nil
+	}
+	return false, err
+}
+
+func (command *filterCommand) String() string {
+	return strings.Join(command.args, " ")
+}
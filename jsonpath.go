@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jsonPathCondition compares the value found at a JSONPath-like location in the payload, e.g. $.package.name == "api"
+type jsonPathCondition struct {
+	source   string
+	path     []any
+	operator string
+	value    string
+	regex    *regexp.Regexp
+}
+
+var jsonPathOperators = []string{"==", "!=", "=~"}
+
+// parseJSONPathConditions parses ; separated conditions
+func parseJSONPathConditions(value string) ([]jsonPathCondition, error) {
+	var conditions []jsonPathCondition
+	for _, source := range strings.Split(value, ";") {
+		if source = strings.TrimSpace(source); source == "" {
+			continue
+		}
+		condition, err := newJSONPathCondition(source)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %w", source, err)
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func newJSONPathCondition(source string) (jsonPathCondition, error) {
+	condition := jsonPathCondition{source: source}
+	index := -1
+	for _, operator := range jsonPathOperators {
+		if i := strings.Index(source, operator); i >= 0 && (index < 0 || i < index) {
+			index, condition.operator = i, operator
+		}
+	}
+	if index < 0 {
+		return condition, fmt.Errorf("missing operator, expected one of %s", strings.Join(jsonPathOperators, ", "))
+	}
+	var err error
+	if condition.path, err = parseJSONPath(strings.TrimSpace(source[:index])); err != nil {
+		return condition, err
+	}
+	condition.value = strings.TrimSpace(source[index+len(condition.operator):])
+	if strings.HasPrefix(condition.value, `"`) {
+		if condition.value, err = strconv.Unquote(condition.value); err != nil {
+			return condition, fmt.Errorf("invalid quoted value: %w", err)
+		}
+	}
+	if condition.operator == "=~" {
+		if condition.regex, err = regexp.Compile(condition.value); err != nil {
+			return condition, err
+		}
+	}
+	return condition, nil
+}
+
+// parseJSONPath parses $.a.b[0].c into its keys (string) and array indexes (int)
+func parseJSONPath(path string) ([]any, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path %q must start with $", path)
+	}
+	var segments []any
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("path %q has an empty key", path)
+			}
+			segments = append(segments, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed [", path)
+			}
+			arrayIndex, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("path %q has an invalid array index %q", path, rest[1:end])
+			}
+			segments = append(segments, arrayIndex)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q has an unexpected character %q", path, rest[0])
+		}
+	}
+	return segments, nil
+}
+
+// lookupPath walks the decoded payload. Returns false when any segment is missing
+func lookupPath(payload any, path []any) (any, bool) {
+	current := payload
+	for _, segment := range path {
+		switch key := segment.(type) {
+		case string:
+			object, ok := current.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[key]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := current.([]any)
+			if !ok || key < 0 || key >= len(array) {
+				return nil, false
+			}
+			current = array[key]
+		}
+	}
+	return current, true
+}
+
+// formatValue renders a decoded JSON scalar the way it would be written in a condition
+func formatValue(value any) string {
+	switch typed := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return typed
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(typed)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// matches reports whether the payload satisfies the condition. Missing paths never match
+func (condition *jsonPathCondition) matches(payload map[string]any) bool {
+	value, found := lookupPath(payload, condition.path)
+	if !found {
+		return false
+	}
+	actual := formatValue(value)
+	switch condition.operator {
+	case "==":
+		return actual == condition.value
+	case "!=":
+		return actual != condition.value
+	default:
+		return condition.regex.MatchString(actual)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// kafkaSink produces forwards to a Kafka topic. Records are keyed by repository full name so the events of a
+// repository stay in order
+type kafkaSink struct {
+	client *kgo.Client
+	topic  string
+}
+
+func init() {
+	sinkOpeners["kafka"] = openKafkaSink
+}
+
+// openKafkaSink opens kafka://[user:password@]<broker>[,<broker>...]/<topic>. ?tls=true connects with the relay TLS
+// settings and ?sasl=plain, scram-sha-256 or scram-sha-512 authenticates with the user and password
+func openKafkaSink(destinationURL *url.URL) (sink, error) {
+	topic := strings.TrimPrefix(destinationURL.Path, "/")
+	if destinationURL.Host == "" || topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("expected kafka://<broker>[,<broker>...]/<topic>")
+	}
+	options := []kgo.Opt{kgo.SeedBrokers(strings.Split(destinationURL.Host, ",")...), kgo.DefaultProduceTopic(topic), kgo.ProducerLinger(0)}
+	query := destinationURL.Query()
+	if useTLS, _ := strconv.ParseBool(query.Get("tls")); useTLS {
+		options = append(options, kgo.DialTLSConfig(relayClient.Transport.(*http.Transport).TLSClientConfig.Clone()))
+	}
+	user := destinationURL.User.Username()
+	password, _ := destinationURL.User.Password()
+	switch mechanism := query.Get("sasl"); mechanism {
+	case "":
+	case "plain":
+		options = append(options, kgo.SASL(plain.Auth{User: user, Pass: password}.AsMechanism()))
+	case "scram-sha-256":
+		options = append(options, kgo.SASL(scram.Auth{User: user, Pass: password}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		options = append(options, kgo.SASL(scram.Auth{User: user, Pass: password}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("sasl must be plain, scram-sha-256 or scram-sha-512, got %q", mechanism)
+	}
+	client, err := kgo.NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{client: client, topic: topic}, nil
+}
+
+func (producer *kafkaSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	var event struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	json.Unmarshal(body, &event)
+	record := &kgo.Record{Value: body, Headers: []kgo.RecordHeader{
+		{Key: "event_type", Value: []byte(request.Header.Get("X-GitHub-Event"))},
+		{Key: "delivery_id", Value: []byte(request.Header.Get("X-GitHub-Delivery"))},
+	}}
+	if event.Repository.FullName != "" {
+		record.Key = []byte(event.Repository.FullName)
+	}
+	produced, err := producer.client.ProduceSync(ctx, record).First()
+	if err != nil {
+		reply := relayReply{}
+		if errors.Is(err, kerr.MessageTooLarge) {
+			reply.status = http.StatusRequestEntityTooLarge
+		}
+		return reply, fmt.Errorf("Error producing to Kafka topic %s: %v", producer.topic, err)
+	}
+	log.Printf("Kafka topic %s accepted record at partition %d offset %d", producer.topic, produced.Partition, produced.Offset)
+	return relayReply{status: http.StatusOK, contentType: "application/json", body: fmt.Appendf(nil, `{"partition":%d,"offset":%d}`, produced.Partition, produced.Offset)}, nil
+}
+
+func (producer *kafkaSink) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := producer.client.Flush(ctx); err != nil {
+		log.Printf("Failed to flush Kafka topic %s: %v", producer.topic, err)
+	}
+	producer.client.Close()
+}
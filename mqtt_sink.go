@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttEscaper keeps field values from splitting or wildcarding the levels of MQTT topics
+var mqttEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttSink publishes forwards to an MQTT topic rendered from the event. The client reconnects on its own and keeps its
+// session, so messages in flight at QoS 1 and 2 are resent once reconnected
+type mqttSink struct {
+	client mqtt.Client
+	server string
+	topic  *fieldTemplate
+	qos    byte
+	retain bool
+}
+
+func init() {
+	sinkOpeners["mqtt"] = openMQTTSink
+	sinkOpeners["mqtts"] = openMQTTSink
+}
+
+// openMQTTSink opens mqtt://[user:password@]<broker>/<topic template>, e.g. mqtt://broker.lan:1883/github/{repo}/{event},
+// or mqtts:// for TLS with the relay TLS settings. ?qos= is 0, 1 or 2, ?retain=true publishes retained messages and
+// ?client_id= sets the client ID of the session
+func openMQTTSink(destinationURL *url.URL) (sink, error) {
+	topic, err := parseFieldTemplate(strings.TrimPrefix(destinationURL.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if destinationURL.Host == "" || len(topic.literals[0]) == 0 && len(topic.fields) == 0 {
+		return nil, fmt.Errorf("expected mqtt://<broker>/<topic template>")
+	}
+	query := destinationURL.Query()
+	publisher := &mqttSink{server: destinationURL.Host, topic: topic, qos: 1}
+	if value := query.Get("qos"); value != "" {
+		qos, err := strconv.Atoi(value)
+		if err != nil || qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("qos must be 0, 1 or 2, got %q", value)
+		}
+		publisher.qos = byte(qos)
+	}
+	if value := query.Get("retain"); value != "" {
+		if publisher.retain, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("retain: %w", err)
+		}
+	}
+	clientID := query.Get("client_id")
+	if clientID == "" {
+		// the session is only resumed by a client with the same ID
+		hostname, _ := os.Hostname()
+		clientID = "github_webhook_filter-" + hostname
+	}
+	broker := url.URL{Scheme: "tcp", Host: destinationURL.Host}
+	options := mqtt.NewClientOptions().
+		SetClientID(clientID).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(2 * time.Second).
+		SetConnectTimeout(5 * time.Second).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetOrderMatters(false).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Disconnected from MQTT broker %s: %v", destinationURL.Host, err)
+		}).
+		SetOnConnectHandler(func(_ mqtt.Client) {
+			log.Printf("Connected to MQTT broker %s", destinationURL.Host)
+		})
+	if destinationURL.Scheme == "mqtts" {
+		broker.Scheme = "ssl"
+		options.SetTLSConfig(relayClient.Transport.(*http.Transport).TLSClientConfig.Clone())
+	}
+	options.AddBroker(broker.String())
+	if destinationURL.User != nil {
+		password, _ := destinationURL.User.Password()
+		options.SetUsername(destinationURL.User.Username()).SetPassword(password)
+	}
+	publisher.client = mqtt.NewClient(options)
+	// with SetConnectRetry the client keeps connecting in the background, sends fail until it is connected
+	publisher.client.Connect()
+	return publisher, nil
+}
+
+func (publisher *mqttSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	topic, err := publisher.topic.render(request.Header, body, mqttEscaper.Replace)
+	if err != nil {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error rendering MQTT topic: %v", err)
+	}
+	// events are never buffered while disconnected, the forward retries publish them once reconnected
+	if err := publisher.ready(); err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to MQTT topic %s: %v", topic, err)
+	}
+	token := publisher.client.Publish(topic, publisher.qos, publisher.retain, body)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return relayReply{}, fmt.Errorf("Error publishing to MQTT topic %s: %v", topic, ctx.Err())
+	}
+	if err := token.Error(); err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to MQTT topic %s: %v", topic, err)
+	}
+	log.Printf("Published to MQTT topic %s at QoS %d", topic, publisher.qos)
+	return relayReply{status: http.StatusOK}, nil
+}
+
+func (publisher *mqttSink) ready() error {
+	if !publisher.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker %s", publisher.server)
+	}
+	return nil
+}
+
+// close waits up to a second for the messages in flight and disconnects, on shutdown
+func (publisher *mqttSink) close() {
+	publisher.client.Disconnect(1000)
+}
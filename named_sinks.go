@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSinkName names the relay URLs of the route. The default sink declared in the sinks file, if any, sets how
+// they are forwarded to
+const defaultSinkName = "default"
+
+// sinkSet maps the names of the sinks declared in the sinks file to their destination
+type sinkSet map[string]*relayDestination
+
+// sinkRetry overrides the retry policy for the forwards to a declared sink. Zero attempts or backoff, and a nil budget,
+// keep the policy's
+type sinkRetry struct {
+	maxAttempts int
+	backoff     time.Duration
+	budget      *time.Duration
+}
+
+// statusRange is an inclusive range of HTTP statuses
+type statusRange struct{ from, to int }
+
+// statusSet lists the relay statuses counting as a success
+type statusSet []statusRange
+
+var sinksFile = flag.String("sinks", "", "YAML sinks file declaring named destinations that rules and pipelines reference by name")
+
+type sinksFileContent struct {
+	Sinks []sinksFileSink `yaml:"sinks"`
+}
+
+type sinksFileSink struct {
+	Name               string          `yaml:"name"`
+	URL                string          `yaml:"url"`
+	Method             string          `yaml:"method"`
+	SuccessStatus      []string        `yaml:"success_status"`
+	Retry              *sinksFileRetry `yaml:"retry"`
+	destinationOptions `yaml:",inline"`
+}
+
+type sinksFileRetry struct {
+	MaxAttempts int    `yaml:"max_attempts"`
+	Backoff     string `yaml:"backoff"`
+	Budget      string `yaml:"budget"`
+}
+
+func loadSinks(fileName string) (sinkSet, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file sinksFileContent
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	set := sinkSet{}
+	for index, fileSink := range file.Sinks {
+		destination, err := newNamedSink(fileSink)
+		if err != nil {
+			return nil, fmt.Errorf("sink #%d (%s): %w", index+1, fileSink.Name, err)
+		}
+		if set[fileSink.Name] != nil {
+			return nil, fmt.Errorf("sink #%d: duplicate name %s", index+1, fileSink.Name)
+		}
+		set[fileSink.Name] = destination
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no sinks declared")
+	}
+	return set, nil
+}
+
+// newNamedSink builds the destination of a declared sink. The default sink has no URL, it applies to the relay URLs
+func newNamedSink(fileSink sinksFileSink) (*relayDestination, error) {
+	if fileSink.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	url := fileSink.URL
+	if fileSink.Name == defaultSinkName {
+		if url != "" {
+			return nil, fmt.Errorf("the default sink forwards to the relay URLs and takes no url")
+		}
+		if len(fileSink.BalanceURLs) > 0 {
+			return nil, fmt.Errorf("the default sink takes no balance_urls, RELAY_BALANCE balances the relay URLs")
+		}
+		// a placeholder URL so the destination options are accepted, replaced by each relay URL
+		url = "https://relay"
+	} else if url == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+	destination, err := newRuleDestination(url, fileSink.destinationOptions)
+	if err != nil {
+		return nil, err
+	}
+	destination.sink = fileSink.Name
+	isHTTP := strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+	if isTemplatedRelayURL(url) {
+		if _, err := expandRelayURL(url, nil, nil); err != nil {
+			return nil, fmt.Errorf("url: %w", err)
+		}
+	}
+	if fileSink.Method != "" || len(fileSink.SuccessStatus) > 0 {
+		if !isHTTP {
+			return nil, fmt.Errorf("method and success_status only apply to http(s) URLs")
+		}
+	}
+	switch destination.method = strings.ToUpper(fileSink.Method); destination.method {
+	case "", "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return nil, fmt.Errorf("method must be POST, PUT, PATCH or DELETE, got %q", fileSink.Method)
+	}
+	if len(fileSink.SuccessStatus) > 0 {
+		if destination.successStatus, err = parseStatusSet(fileSink.SuccessStatus); err != nil {
+			return nil, fmt.Errorf("success_status: %w", err)
+		}
+	}
+	if fileSink.Retry != nil {
+		if destination.retry, err = newSinkRetry(*fileSink.Retry); err != nil {
+			return nil, fmt.Errorf("retry: %w", err)
+		}
+	}
+	return destination, nil
+}
+
+func newSinkRetry(fileRetry sinksFileRetry) (*sinkRetry, error) {
+	retry := &sinkRetry{maxAttempts: fileRetry.MaxAttempts}
+	if retry.maxAttempts < 0 {
+		return nil, fmt.Errorf("max_attempts must be a positive number, got %d", fileRetry.MaxAttempts)
+	}
+	var err error
+	if fileRetry.Backoff != "" {
+		if retry.backoff, err = time.ParseDuration(fileRetry.Backoff); err != nil || retry.backoff <= 0 {
+			return nil, fmt.Errorf("backoff must be a positive duration, got %q", fileRetry.Backoff)
+		}
+	}
+	if fileRetry.Budget != "" {
+		budget, err := time.ParseDuration(fileRetry.Budget)
+		if err != nil || budget < 0 {
+			return nil, fmt.Errorf("budget must be a positive duration, got %q", fileRetry.Budget)
+		}
+		retry.budget = &budget
+	}
+	return retry, nil
+}
+
+// apply returns the policy with the sink's attempts, backoff and budget
+func (retry *sinkRetry) apply(policy retryPolicy) retryPolicy {
+	if retry.maxAttempts > 0 {
+		policy.maxAttempts = retry.maxAttempts
+	}
+	if retry.backoff > 0 {
+		policy.backoff = retry.backoff
+	}
+	if retry.budget != nil {
+		policy.budget = *retry.budget
+	}
+	return policy
+}
+
+// parseStatusSet parses statuses such as 200, ranges such as 200-299 and classes such as 2xx
+func parseStatusSet(values []string) (statusSet, error) {
+	var set statusSet
+	for _, value := range values {
+		for _, item := range parseList(value) {
+			var status statusRange
+			var err error
+			lower := strings.ToLower(item)
+			if from, to, found := strings.Cut(lower, "-"); found {
+				status.from, err = strconv.Atoi(from)
+				if err == nil {
+					status.to, err = strconv.Atoi(to)
+				}
+			} else if class, found := strings.CutSuffix(lower, "xx"); found && len(class) == 1 {
+				status.from, err = strconv.Atoi(class)
+				status.from *= 100
+				status.to = status.from + 99
+			} else {
+				status.from, err = strconv.Atoi(lower)
+				status.to = status.from
+			}
+			if err != nil || status.from < 100 || status.to > 599 || status.from > status.to {
+				return nil, fmt.Errorf("expected a status, a range such as 200-204 or a class such as 2xx, got %q", item)
+			}
+			set = append(set, status)
+		}
+	}
+	return set, nil
+}
+
+func (set statusSet) contains(status int) bool {
+	for _, statuses := range set {
+		if status >= statuses.from && status <= statuses.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (set statusSet) String() string {
+	var items []string
+	for _, statuses := range set {
+		if statuses.from == statuses.to {
+			items = append(items, strconv.Itoa(statuses.from))
+		} else {
+			items = append(items, fmt.Sprintf("%d-%d", statuses.from, statuses.to))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// destination returns the destination of the named sink, or nil for the default sink, which forwards to the relay
+// URLs. Fails on sinks that aren't declared
+func (set sinkSet) destination(name string) (*relayDestination, error) {
+	if name == defaultSinkName {
+		return nil, nil
+	}
+	declared := set[name]
+	if declared == nil {
+		return nil, fmt.Errorf("undefined sink %q", name)
+	}
+	destination := *declared
+	return &destination, nil
+}
+
+// relayDestinations returns the destinations of the relay URLs, with the settings of the declared default sink, and
+// the Redis stream sink when declared
+func (set sinkSet) relayDestinations(relayURLs []string) []relayDestination {
+	destinations := newRelayDestinations(relayURLs)
+	if declared := set[defaultSinkName]; declared != nil {
+		for index, destination := range destinations {
+			destinations[index] = *declared
+			destinations[index].url = destination.url
+		}
+	}
+	if stream := set[redisStreamSinkName]; stream != nil {
+		destinations = append(destinations, *stream)
+	}
+	return destinations
+}
+
+// restore sets the method, success statuses and retry policy of the named sink back on a destination read from the
+// forward queue or the dead-letter queue, which only keep its URL, headers, timeout and rendered body
+func (set sinkSet) restore(destination relayDestination, name string) relayDestination {
+	if declared := set[name]; declared != nil {
+		destination.sink, destination.method, destination.successStatus, destination.retry = name, declared.method, declared.successStatus, declared.retry
+	}
+	return destination
+}
+
+func (set sinkSet) String() string {
+	var names []string
+	for name, destination := range set {
+		if name == defaultSinkName {
+			names = append(names, name+" -> relay URLs")
+		} else {
+			names = append(names, fmt.Sprintf("%s -> %s", name, redactURL(destination.url)))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, "; ")
+}
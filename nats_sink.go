@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsSink publishes forwards to a NATS subject rendered from the event, through JetStream when enabled
+type natsSink struct {
+	connection *nats.Conn
+	// stream is nil when publishing with core NATS
+	stream  jetstream.JetStream
+	subject *fieldTemplate
+}
+
+func init() {
+	sinkOpeners["nats"] = openNATSSink
+}
+
+// openNATSSink opens nats://[user:password@]<server>/<subject template>, e.g.
+// nats://nats.internal:4222/github.{event}.{action}.{org}.{repo}. ?creds= names a credentials file, ?tls=true connects
+// with the relay TLS settings and ?jetstream=true publishes with JetStream and waits for its ack
+func openNATSSink(destinationURL *url.URL) (sink, error) {
+	subject, err := parseFieldTemplate(strings.TrimPrefix(destinationURL.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if destinationURL.Host == "" || len(subject.literals[0]) == 0 && len(subject.fields) == 0 {
+		return nil, fmt.Errorf("expected nats://<server>/<subject template>")
+	}
+	server := &url.URL{Scheme: "nats", Host: destinationURL.Host, User: destinationURL.User}
+	query := destinationURL.Query()
+	options := []nats.Option{
+		nats.Name("github_webhook_filter"),
+		// connection loss is retried by the forward retries, events are never buffered while disconnected
+		nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1), nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Disconnected from NATS server %s: %v", destinationURL.Host, err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Printf("Reconnected to NATS server %s", destinationURL.Host)
+		}),
+	}
+	if creds := query.Get("creds"); creds != "" {
+		options = append(options, nats.UserCredentials(creds))
+	}
+	if useTLS, _ := strconv.ParseBool(query.Get("tls")); useTLS {
+		options = append(options, nats.Secure(relayClient.Transport.(*http.Transport).TLSClientConfig.Clone()))
+	}
+	connection, err := nats.Connect(server.String(), options...)
+	if err != nil {
+		return nil, err
+	}
+	publisher := &natsSink{connection: connection, subject: subject}
+	if useJetStream, _ := strconv.ParseBool(query.Get("jetstream")); useJetStream {
+		if publisher.stream, err = jetstream.New(connection); err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	return publisher, nil
+}
+
+func (publisher *natsSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	subject, err := publisher.subject.render(request.Header, body, topicEscaper.Replace)
+	if err != nil {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error rendering NATS subject: %v", err)
+	}
+	if err := publisher.ready(); err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to NATS subject %s: %v", subject, err)
+	}
+	message := nats.NewMsg(subject)
+	message.Data = body
+	for _, header := range []string{"X-GitHub-Event", "X-GitHub-Delivery", "X-GitHub-Hook-ID"} {
+		if value := request.Header.Get(header); value != "" {
+			message.Header.Set(header, value)
+		}
+	}
+	if publisher.stream == nil {
+		if err := publisher.connection.PublishMsg(message); err != nil {
+			return relayReply{}, fmt.Errorf("Error publishing to NATS subject %s: %v", subject, err)
+		}
+		// the round trip confirms the server received the message
+		if err := publisher.connection.FlushWithContext(ctx); err != nil {
+			return relayReply{}, fmt.Errorf("Error publishing to NATS subject %s: %v", subject, err)
+		}
+		log.Printf("Published to NATS subject %s", subject)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	// JetStream drops redeliveries of the same delivery within its duplicate window
+	if delivery := request.Header.Get("X-GitHub-Delivery"); delivery != "" {
+		message.Header.Set(jetstream.MsgIDHeader, delivery)
+	}
+	ack, err := publisher.stream.PublishMsg(ctx, message)
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error publishing to JetStream subject %s: %v", subject, err)
+	}
+	log.Printf("JetStream stream %s acknowledged %s at sequence %d", ack.Stream, subject, ack.Sequence)
+	return relayReply{status: http.StatusOK, contentType: "application/json", body: fmt.Appendf(nil, `{"stream":%q,"sequence":%d}`, ack.Stream, ack.Sequence)}, nil
+}
+
+func (publisher *natsSink) ready() error {
+	if !publisher.connection.IsConnected() {
+		return fmt.Errorf("not connected to NATS, %s", publisher.connection.Status())
+	}
+	return nil
+}
+
+func (publisher *natsSink) close() {
+	if err := publisher.connection.Drain(); err != nil {
+		publisher.connection.Close()
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pagerDutyTimeout bounds sending an event to PagerDuty
+const pagerDutyTimeout = 10 * time.Second
+
+// PagerDuty severities, of the failing relay and dead-letter queue incidents and of notify: pagerduty rules
+const (
+	pagerDutyCritical = "critical"
+	pagerDutyError    = "error"
+	pagerDutyWarning  = "warning"
+	pagerDutyInfo     = "info"
+)
+
+// pagerDutyAlerter sends PagerDuty Events API v2 events: incidents of relay URLs failing for longer than failingAfter
+// and of a dead-letter queue reaching dlqThreshold entries, resolved once they recover, and events of the rules with
+// notify: pagerduty. Its settings are read at startup
+type pagerDutyAlerter struct {
+	eventsURL  string
+	routingKey string
+	// failingAfter is how long a relay URL fails before its incident is triggered, 0 when relay failures don't alert
+	failingAfter time.Duration
+	// dlqThreshold is the number of dead letters triggering the dead-letter queue incident, 0 when it doesn't alert
+	dlqThreshold int
+	mutex        sync.Mutex
+	// failing holds when each failing relay URL started failing and whether its incident was triggered
+	failing      map[string]*failingRelay
+	dlqTriggered bool
+	background   sync.WaitGroup
+}
+
+type failingRelay struct {
+	since     time.Time
+	triggered bool
+}
+
+// pagerDuty is nil when PAGERDUTY_ROUTING_KEY is not set
+var pagerDuty *pagerDutyAlerter
+
+// newPagerDutyAlerter reads PAGERDUTY_ROUTING_KEY, PAGERDUTY_URL, PAGERDUTY_FAILING_AFTER and PAGERDUTY_DLQ_THRESHOLD.
+// Returns nil when PAGERDUTY_ROUTING_KEY is not set
+func newPagerDutyAlerter() (*pagerDutyAlerter, error) {
+	routingKey := os.Getenv("PAGERDUTY_ROUTING_KEY")
+	if routingKey == "" {
+		return nil, nil
+	}
+	alerter := &pagerDutyAlerter{eventsURL: "https://events.pagerduty.com/v2/enqueue", routingKey: routingKey, failingAfter: 5 * time.Minute, failing: map[string]*failingRelay{}}
+	if value := os.Getenv("PAGERDUTY_URL"); value != "" {
+		alerter.eventsURL = value
+	}
+	if value := os.Getenv("PAGERDUTY_FAILING_AFTER"); value != "" {
+		var err error
+		if alerter.failingAfter, err = time.ParseDuration(value); err != nil || alerter.failingAfter < 0 {
+			return nil, fmt.Errorf("PAGERDUTY_FAILING_AFTER must be a positive duration, got %q", value)
+		}
+	}
+	if value := os.Getenv("PAGERDUTY_DLQ_THRESHOLD"); value != "" {
+		var err error
+		if alerter.dlqThreshold, err = strconv.Atoi(value); err != nil || alerter.dlqThreshold < 0 {
+			return nil, fmt.Errorf("PAGERDUTY_DLQ_THRESHOLD must be a positive number, got %q", value)
+		}
+	}
+	log.Printf("Sending PagerDuty events to %s, relays failing after: %s, dead letters threshold: %d", alerter.eventsURL, alerter.failingAfter, alerter.dlqThreshold)
+	return alerter, nil
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2. Payload is only set on trigger events
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Component     string            `json:"component,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// relayOutcome records the final outcome of a forward to the relay URL, triggering its incident once it failed for
+// longer than failingAfter and resolving it on the next success. Forwards the relay rejected with a 4xx other than
+// 429 don't count, the relay is up
+func (alerter *pagerDutyAlerter) relayOutcome(relayURL string, status int, failure error) {
+	if alerter == nil || alerter.failingAfter == 0 || (failure != nil && !retryableStatus(status)) {
+		return
+	}
+	alerter.mutex.Lock()
+	defer alerter.mutex.Unlock()
+	relay := alerter.failing[relayURL]
+	dedupKey := "github_webhook_filter/relay/" + redactURL(relayURL)
+	if failure == nil {
+		if relay != nil && relay.triggered {
+			log.Printf("Relay %s recovered, resolving its PagerDuty incident", redactURL(relayURL))
+			alerter.sendInBackground(pagerDutyEvent{EventAction: "resolve", DedupKey: dedupKey})
+		}
+		delete(alerter.failing, relayURL)
+		return
+	}
+	if relay == nil {
+		relay = &failingRelay{since: time.Now()}
+		alerter.failing[relayURL] = relay
+	}
+	if relay.triggered || time.Since(relay.since) < alerter.failingAfter {
+		return
+	}
+	relay.triggered = true
+	log.Printf("Relay %s failing since %s, triggering a PagerDuty incident", redactURL(relayURL), relay.since.Format(time.RFC3339))
+	alerter.sendInBackground(pagerDutyEvent{EventAction: "trigger", DedupKey: dedupKey, Payload: &pagerDutyPayload{
+		Summary:       fmt.Sprintf("Relay %s failing for %s", redactURL(relayURL), time.Since(relay.since).Round(time.Second)),
+		Source:        "github_webhook_filter",
+		Severity:      pagerDutyCritical,
+		Component:     redactURL(relayURL),
+		CustomDetails: map[string]string{"failing_since": relay.since.UTC().Format(time.RFC3339), "last_error": failure.Error()},
+	}})
+}
+
+// deadLetters records the number of dead letters, triggering the dead-letter queue incident when it reaches
+// dlqThreshold and resolving it once the queue is back under it
+func (alerter *pagerDutyAlerter) deadLetters(count int) {
+	if alerter == nil || alerter.dlqThreshold == 0 {
+		return
+	}
+	alerter.mutex.Lock()
+	defer alerter.mutex.Unlock()
+	dedupKey := "github_webhook_filter/dlq"
+	if count < alerter.dlqThreshold {
+		if alerter.dlqTriggered {
+			log.Printf("Dead-letter queue back to %d entries, resolving its PagerDuty incident", count)
+			alerter.sendInBackground(pagerDutyEvent{EventAction: "resolve", DedupKey: dedupKey})
+			alerter.dlqTriggered = false
+		}
+		return
+	}
+	if alerter.dlqTriggered {
+		return
+	}
+	alerter.dlqTriggered = true
+	log.Printf("Dead-letter queue reached %d entries, triggering a PagerDuty incident", count)
+	alerter.sendInBackground(pagerDutyEvent{EventAction: "trigger", DedupKey: dedupKey, Payload: &pagerDutyPayload{
+		Summary:  fmt.Sprintf("Dead-letter queue reached %d failed forwards", count),
+		Source:   "github_webhook_filter",
+		Severity: pagerDutyError,
+	}})
+}
+
+// notifyRule sends an event of the delivery matching a rule with notify: pagerduty. Repeated deliveries of the same
+// GitHub delivery update one alert
+func (alerter *pagerDutyAlerter) notifyRule(rule string, severity string, header http.Header, body []byte, verdict string) {
+	if alerter == nil {
+		return
+	}
+	details := map[string]string{"rule": rule, "verdict": verdict, "delivery": header.Get("X-GitHub-Delivery"), "event": header.Get("X-GitHub-Event")}
+	for _, field := range []string{"action", "repository", "package", "tag", "sender"} {
+		template, _ := parseFieldTemplate("{" + field + "}")
+		if value, err := template.render(header, body, func(value string) string { return value }); err == nil {
+			details[field] = value
+		}
+	}
+	summary := fmt.Sprintf("Rule %s matched %s event", rule, details["event"])
+	if details["action"] != "" {
+		summary += " " + details["action"]
+	}
+	if details["repository"] != "" {
+		summary += " of " + details["repository"]
+	}
+	if details["package"] != "" {
+		summary += ", package " + details["package"]
+	}
+	if details["tag"] != "" {
+		summary += ":" + details["tag"]
+	}
+	event := pagerDutyEvent{EventAction: "trigger", DedupKey: "github_webhook_filter/delivery/" + details["delivery"], Payload: &pagerDutyPayload{
+		Summary:       summary,
+		Source:        "github_webhook_filter",
+		Severity:      severity,
+		Component:     details["repository"],
+		CustomDetails: details,
+	}}
+	for _, link := range teamsLinks {
+		template, _ := parseFieldTemplate(link.template)
+		if value, err := template.render(header, body, func(value string) string { return value }); err == nil {
+			event.Links = append(event.Links, pagerDutyLink{Href: value, Text: link.title})
+			break
+		}
+	}
+	alerter.sendInBackground(event)
+}
+
+// sendInBackground sends the event without waiting for PagerDuty, logging failures
+func (alerter *pagerDutyAlerter) sendInBackground(event pagerDutyEvent) {
+	event.RoutingKey = alerter.routingKey
+	alerter.background.Add(1)
+	go func() {
+		defer alerter.background.Done()
+		if err := alerter.send(event); err != nil {
+			log.Printf("Failed to send PagerDuty %s event %s: %v", event.EventAction, event.DedupKey, err)
+		}
+	}()
+}
+
+func (alerter *pagerDutyAlerter) send(event pagerDutyEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pagerDutyTimeout)
+	defer cancel()
+	encoded, _ := json.Marshal(event)
+	newRequest, _ := http.NewRequestWithContext(ctx, "POST", alerter.eventsURL, bytes.NewReader(encoded))
+	newRequest.Header.Set("User-Agent", relayUserAgent)
+	newRequest.Header.Set("Content-Type", "application/json")
+	httpResponse, err := relayClient.Do(newRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+		return fmt.Errorf("PagerDuty returned status %d: %s", httpResponse.StatusCode, body)
+	}
+	log.Printf("Sent PagerDuty %s event %s", event.EventAction, event.DedupKey)
+	return nil
+}
+
+// close waits for the events being sent, on shutdown
+func (alerter *pagerDutyAlerter) close() {
+	if alerter != nil {
+		alerter.background.Wait()
+	}
+}
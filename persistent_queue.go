@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var queueBucket = []byte("queue")
+
+// persistentQueue is the eventQueue stored in a bbolt file. Events are written before the 202 response and deleted once
+// forwarded, so a restart resumes the queue. Failed forwards stay queued and are retried with backoff until
+// QUEUE_MAX_ATTEMPTS, then go to the dead-letter queue
+type persistentQueue struct {
+	db          *bolt.DB
+	maxItems    int
+	dropOldest  bool
+	maxAttempts int
+	// orderBy keeps the events of a key in order, an event is only claimed once the earlier ones of its key are gone
+	orderBy string
+	// coalesce deletes the queued events of a package version when a newer one is queued
+	coalesce bool
+	workers  sync.WaitGroup
+	// wake signals the workers that an event was queued
+	wake chan struct{}
+	stop chan struct{}
+	// mutex guards claimed and closed
+	mutex   sync.Mutex
+	claimed map[uint64]bool
+	closed  bool
+}
+
+// queuedEvent is an event in the persistent queue. Destinations only lists those not forwarded yet
+type queuedEvent struct {
+	Headers      http.Header         `json:"headers"`
+	Destinations []queuedDestination `json:"destinations"`
+	Body         []byte              `json:"body"`
+	Summary      string              `json:"summary"`
+	QueuedAt     time.Time           `json:"queued_at"`
+	Attempts     int                 `json:"attempts"`
+	NextAttempt  time.Time           `json:"next_attempt"`
+	LastError    string              `json:"last_error,omitempty"`
+	// Key is the ASYNC_ORDER_BY key of the event, empty when it isn't ordered
+	Key string `json:"key,omitempty"`
+	// CoalesceKey is the QUEUE_COALESCE key of the event, empty when it isn't coalesced
+	CoalesceKey string `json:"coalesce_key,omitempty"`
+	// Path is the path of the route that accepted the event, whose configuration forwards it
+	Path string `json:"path,omitempty"`
+}
+
+type queuedDestination struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Timeout time.Duration     `json:"timeout,omitempty"`
+	// Body is the rendered body template, forwarded instead of the event body when set
+	Body []byte `json:"body,omitempty"`
+	// Sink names the declared sink whose method, success statuses and retry policy apply
+	Sink string `json:"sink,omitempty"`
+	// FailoverURL is forwarded to when URL fails
+	FailoverURL string `json:"failover_url,omitempty"`
+	// HedgeURL is forwarded to as well when URL hasn't succeeded within HedgeDelay
+	HedgeURL   string        `json:"hedge_url,omitempty"`
+	HedgeDelay time.Duration `json:"hedge_delay,omitempty"`
+	// Balance spreads the forwards across several relay URLs, URL being the first of them
+	Balance *relayBalance `json:"balance,omitempty"`
+}
+
+// destination restores the destination of the queued forward, with the settings of its sink
+func (queued queuedDestination) destination(sinks sinkSet) relayDestination {
+	destination := relayDestination{url: queued.URL, headers: queued.Headers, timeout: queued.Timeout, body: queued.Body, failover: queued.FailoverURL, balance: queued.Balance}
+	if queued.HedgeURL != "" {
+		destination.hedge = &relayHedge{url: queued.HedgeURL, delay: queued.HedgeDelay}
+	}
+	return sinks.restore(destination, queued.Sink)
+}
+
+func newPersistentQueue(fileName string, workers int, maxItems int, dropOldest bool, orderBy string, coalesce bool) (*persistentQueue, error) {
+	maxAttempts := 10
+	if value := os.Getenv("QUEUE_MAX_ATTEMPTS"); value != "" {
+		var err error
+		if maxAttempts, err = strconv.Atoi(value); err != nil || maxAttempts < 1 {
+			return nil, fmt.Errorf("QUEUE_MAX_ATTEMPTS must be a positive number, got %q", value)
+		}
+	}
+	db, err := bolt.Open(fileName, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("QUEUE_FILE: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(queueBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("QUEUE_FILE: %w", err)
+	}
+	queue := &persistentQueue{db: db, maxItems: maxItems, dropOldest: dropOldest, maxAttempts: maxAttempts, orderBy: orderBy, coalesce: coalesce, wake: make(chan struct{}, 1), stop: make(chan struct{}), claimed: map[uint64]bool{}}
+	if depth := queue.depth(); depth.Depth > 0 {
+		log.Printf("Resuming %d queued forwards from %s", depth.Depth, fileName)
+	}
+	for range workers {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+	return queue, nil
+}
+
+func (queue *persistentQueue) enqueue(job forwardJob) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return false
+	}
+	event := queuedEvent{Headers: job.request.Header, Body: job.body, Summary: job.summary, QueuedAt: time.Now(), NextAttempt: time.Now(), Key: orderKey(queue.orderBy, job.body), Path: job.request.URL.Path}
+	if queue.coalesce {
+		event.CoalesceKey = coalesceKey(job.request.Header, job.body)
+	}
+	for _, destination := range job.destinations {
+		queued := queuedDestination{URL: destination.url, Headers: destination.headers, Timeout: destination.timeout, Body: destination.body, Sink: destination.sink, FailoverURL: destination.failover, Balance: destination.balance}
+		if destination.hedge != nil {
+			queued.HedgeURL, queued.HedgeDelay = destination.hedge.url, destination.hedge.delay
+		}
+		event.Destinations = append(event.Destinations, queued)
+	}
+	content, _ := json.Marshal(event)
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		coalesced := 0
+		if event.CoalesceKey != "" {
+			var err error
+			if coalesced, err = queue.coalesceOlder(bucket, event.CoalesceKey, job.summary); err != nil {
+				return err
+			}
+		}
+		if bucket.Stats().KeyN-coalesced >= queue.maxItems {
+			if !queue.dropOldest {
+				return errQueueFull
+			}
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				if !queue.claimed[binary.BigEndian.Uint64(key)] {
+					queue.deadLetter(value, fmt.Errorf("dropped from full forward queue"))
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+		id, _ := bucket.NextSequence()
+		return bucket.Put(queueKey(id), content)
+	})
+	if err != nil {
+		if err != errQueueFull {
+			log.Printf("Failed to queue %s: %v", job.summary, err)
+		}
+		return false
+	}
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+var errQueueFull = fmt.Errorf("queue full")
+
+// coalesceOlder deletes the queued events of the coalesce key that aren't being forwarded, superseded by the event
+// being queued, and returns how many. Callers hold the mutex
+func (queue *persistentQueue) coalesceOlder(bucket *bolt.Bucket, key string, summary string) (int, error) {
+	coalesced := 0
+	cursor := bucket.Cursor()
+	for id, value := cursor.First(); id != nil; id, value = cursor.Next() {
+		var event queuedEvent
+		if json.Unmarshal(value, &event) != nil || event.CoalesceKey != key || queue.claimed[binary.BigEndian.Uint64(id)] {
+			continue
+		}
+		log.Printf("Coalesced queued %s into the newer %s of %s", event.Summary, summary, key)
+		deliveryLog.replace(event.Headers.Get("X-GitHub-Delivery"), deliveryCoalesced)
+		if err := cursor.Delete(); err != nil {
+			return coalesced, err
+		}
+		coalesced++
+	}
+	return coalesced, nil
+}
+
+func (queue *persistentQueue) work() {
+	defer queue.workers.Done()
+	for {
+		select {
+		case <-queue.stop:
+			return
+		default:
+		}
+		id, event, found := queue.claim()
+		if !found {
+			select {
+			case <-queue.stop:
+				return
+			case <-queue.wake:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		queue.forward(id, event)
+	}
+}
+
+// claim returns the oldest event that is due and not being forwarded by another worker, and whose order key has no
+// earlier event still queued
+func (queue *persistentQueue) claim() (uint64, *queuedEvent, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	var claimedID uint64
+	var claimed *queuedEvent
+	// blocked holds the order keys of the events skipped so far
+	blocked := stringSet{}
+	queue.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(queueBucket).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			id := binary.BigEndian.Uint64(key)
+			var event queuedEvent
+			if err := json.Unmarshal(value, &event); err != nil {
+				continue
+			}
+			if queue.claimed[id] || event.NextAttempt.After(time.Now()) || blocked[event.Key] {
+				if event.Key != "" {
+					blocked[event.Key] = true
+				}
+				continue
+			}
+			claimedID, claimed = id, &event
+			return nil
+		}
+		return nil
+	})
+	if claimed == nil {
+		return 0, nil, false
+	}
+	queue.claimed[claimedID] = true
+	return claimedID, claimed, true
+}
+
+// forward sends the event to its remaining destinations with the retry and dead-letter settings of the current
+// configuration of its route, then deletes it or schedules the next attempt
+func (queue *persistentQueue) forward(id uint64, event *queuedEvent) {
+	filters := event.filters()
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header = event.Headers
+	event.Attempts++
+	var remaining []queuedDestination
+	// retryAfter is the longest Retry-After of the destinations left
+	var retryAfter time.Duration
+	for _, queued := range event.Destinations {
+		destination := queued.destination(filters.sinks)
+		reply, err := filters.retry.send(request.Context(), request, destination, event.Body)
+		if err == nil {
+			log.Printf("Forwarded %s to %s from the queue", event.Summary, destination.url)
+			continue
+		}
+		event.LastError = err.Error()
+		if !retryableStatus(reply.status) || event.Attempts >= queue.maxAttempts {
+			log.Printf("Failed to forward %s to %s from the queue after %d attempts, giving up: %v", event.Summary, destination.url, event.Attempts, err)
+			filters.deadLetters.add(request, destination, event.Body, err)
+			deliveryLog.finish(request.Header.Get("X-GitHub-Delivery"), false)
+			continue
+		}
+		log.Printf("Failed to forward %s to %s from the queue, attempt %d/%d: %v", event.Summary, destination.url, event.Attempts, queue.maxAttempts, err)
+		remaining = append(remaining, queued)
+		if reply.retryAfter > 0 {
+			retryAfter = max(retryAfter, filters.retry.retryAfterDelay(reply))
+		}
+	}
+
+	if len(remaining) == 0 {
+		deliveryLog.finish(request.Header.Get("X-GitHub-Delivery"), true)
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.claimed, id)
+	err := queue.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		if len(remaining) == 0 {
+			return bucket.Delete(queueKey(id))
+		}
+		event.Destinations = remaining
+		delay := min(filters.retry.backoff<<min(event.Attempts, 20), 5*time.Minute)
+		if retryAfter > 0 {
+			log.Printf("Relay asked to retry %s after %s, backing off", event.Summary, retryAfter)
+			delay = retryAfter
+		}
+		event.NextAttempt = time.Now().Add(delay)
+		content, _ := json.Marshal(event)
+		return bucket.Put(queueKey(id), content)
+	})
+	if err != nil {
+		log.Printf("Failed to update queued %s: %v", event.Summary, err)
+	}
+}
+
+// deadLetter stores a queued event that won't be forwarded in the dead-letter queue of the current configuration of its
+// route
+func (queue *persistentQueue) deadLetter(content []byte, failure error) {
+	var event queuedEvent
+	if err := json.Unmarshal(content, &event); err != nil {
+		return
+	}
+	log.Printf("Forward queue full, dropped %s", event.Summary)
+	deliveryLog.finish(event.Headers.Get("X-GitHub-Delivery"), false)
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header = event.Headers
+	filters := event.filters()
+	for _, queued := range event.Destinations {
+		destination := queued.destination(filters.sinks)
+		filters.deadLetters.add(request, destination, event.Body, failure)
+	}
+}
+
+// filters returns the current configuration of the route that accepted the event, or of the default route when the
+// route is gone since
+func (event *queuedEvent) filters() *filterConfig {
+	config := currentConfig.Load()
+	if route := config.lookupRoute(event.Path); route != nil {
+		return route.filters
+	}
+	log.Printf("Route %s of queued %s is gone, forwarding with the default configuration", event.Path, event.Summary)
+	return config.defaultRoute.filters
+}
+
+// drain waits for the events being forwarded. Queued events stay in the file for the next start
+func (queue *persistentQueue) drain() {
+	queue.mutex.Lock()
+	queue.closed = true
+	queue.mutex.Unlock()
+	close(queue.stop)
+	queue.workers.Wait()
+	log.Printf("Keeping %d queued forwards for the next start", queue.depth().Depth)
+	queue.db.Close()
+}
+
+func (queue *persistentQueue) depth() queueDepth {
+	var depth queueDepth
+	queue.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(queueBucket)
+		depth.Depth = bucket.Stats().KeyN
+		if _, value := bucket.Cursor().First(); value != nil {
+			var event queuedEvent
+			if json.Unmarshal(value, &event) == nil {
+				depth.OldestAgeSeconds = time.Since(event.QueuedAt).Seconds()
+			}
+		}
+		return nil
+	})
+	return depth
+}
+
+func queueKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineSet is the list of pipelines loaded from the pipelines file. An event is offered to every pipeline, or
+// only to the first matching one when firstMatch is set
+type pipelineSet struct {
+	pipelines  []pipeline
+	firstMatch bool
+}
+
+// pipeline forwards the events matching its condition to all of its destinations
+type pipeline struct {
+	name         string
+	condition    ruleCondition
+	destinations []relayDestination
+	// toRelayURLs forwards to the route's relay URLs as well, for pipelines listing the default sink
+	toRelayURLs bool
+}
+
+var pipelinesFile = flag.String("pipelines", "", "YAML pipelines file. When set, events are dispatched to the matching pipelines instead of the relay URL")
+
+type pipelinesFileContent struct {
+	Mode      string                  `yaml:"mode"`
+	Pipelines []pipelinesFilePipeline `yaml:"pipelines"`
+}
+
+type pipelinesFilePipeline struct {
+	Name               string    `yaml:"name"`
+	Match              yaml.Node `yaml:"match"`
+	Destinations       []string  `yaml:"destinations"`
+	Sinks              []string  `yaml:"sinks"`
+	destinationOptions `yaml:",inline"`
+}
+
+func loadPipelines(fileName string, sinks sinkSet) (*pipelineSet, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file pipelinesFileContent
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	set := &pipelineSet{}
+	switch file.Mode {
+	case "", "all":
+	case "first":
+		set.firstMatch = true
+	default:
+		return nil, fmt.Errorf("mode must be all or first, got %q", file.Mode)
+	}
+	names := map[string]bool{}
+	for index, filePipeline := range file.Pipelines {
+		pipeline, err := newPipeline(filePipeline, sinks)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline #%d (%s): %w", index+1, filePipeline.Name, err)
+		}
+		if names[pipeline.name] {
+			return nil, fmt.Errorf("pipeline #%d: duplicate name %s", index+1, pipeline.name)
+		}
+		names[pipeline.name] = true
+		set.pipelines = append(set.pipelines, pipeline)
+	}
+	if len(set.pipelines) == 0 {
+		return nil, fmt.Errorf("no pipelines declared")
+	}
+	return set, nil
+}
+
+func newPipeline(filePipeline pipelinesFilePipeline, sinks sinkSet) (pipeline, error) {
+	pipeline := pipeline{name: filePipeline.Name}
+	if pipeline.name == "" {
+		return pipeline, fmt.Errorf("missing name")
+	}
+	if len(filePipeline.Destinations) == 0 && len(filePipeline.Sinks) == 0 {
+		return pipeline, fmt.Errorf("missing destinations or sinks")
+	}
+	for _, url := range filePipeline.Destinations {
+		destination, err := newRuleDestination(url, filePipeline.destinationOptions)
+		if err != nil {
+			return pipeline, err
+		}
+		pipeline.destinations = append(pipeline.destinations, *destination)
+	}
+	for _, name := range filePipeline.Sinks {
+		destination, err := sinks.destination(name)
+		if err != nil {
+			return pipeline, err
+		}
+		if destination == nil {
+			pipeline.toRelayURLs = true
+		} else {
+			pipeline.destinations = append(pipeline.destinations, *destination)
+		}
+	}
+	if filePipeline.Match.Kind == 0 {
+		pipeline.condition = allCondition{}
+		return pipeline, nil
+	}
+	var err error
+	pipeline.condition, err = parseRuleCondition(&filePipeline.Match)
+	return pipeline, err
+}
+
+// dispatchPipelines offers the event to the pipelines and forwards it to the destinations of every matching one. The
+// response lists the pipelines that forwarded the event in the X-Filter-Pipelines header
+func dispatchPipelines(responseWriter http.ResponseWriter, request *http.Request, filters *filterConfig, relayURLs []string, eventType string, event *PackageEvent, requestBody []byte) {
+	var forwarded []string
+	var failures []string
+	// templateFailed is set when a relay URL or body template failed to render, which responds 500 instead of 502
+	templateFailed := false
+	for _, pipeline := range filters.pipelines.pipelines {
+		var matched []string
+		if !pipeline.condition.matches(eventType, event, &matched) {
+			continue
+		}
+		log.Printf("Pipeline %s matched on [%s]", pipeline.name, strings.Join(matched, ", "))
+		failed := false
+		destinations := pipeline.destinations
+		if pipeline.toRelayURLs {
+			destinations = append(filters.balanceRelayURLs(filters.sinks.relayDestinations(relayURLs)), destinations...)
+		}
+		destinations, err := expandRelayURLs(destinations, request.Header, requestBody)
+		if err == nil {
+			destinations, err = renderBodies(destinations, filters.bodyTemplate, request.Header, requestBody)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", pipeline.name, err))
+			templateFailed, failed = true, true
+		} else if !filters.dryRun {
+			for _, destination := range destinations {
+				if _, err := filters.retry.send(request.Context(), request, destination, requestBody); err != nil {
+					failures = append(failures, fmt.Sprintf("%s: %v", pipeline.name, err))
+					filters.deadLetters.add(request, destination, requestBody, err)
+					failed = true
+				}
+			}
+		}
+		filterStatistics.recordPipeline(pipeline.name, !failed)
+		if !failed {
+			forwarded = append(forwarded, pipeline.name)
+		}
+		if filters.pipelines.firstMatch {
+			break
+		}
+	}
+
+	filterStatistics.recordEvent(eventType, len(forwarded) > 0)
+	responseWriter.Header().Set("X-Filter-Pipelines", strings.Join(forwarded, ","))
+	switch {
+	case templateFailed:
+		respondFailed(responseWriter, filters, reasonTemplateError, fmt.Sprintf("Pipeline templates failed: %s. Forwarded by: [%s]", strings.Join(failures, "; "), strings.Join(forwarded, ", ")), http.StatusInternalServerError)
+	case len(failures) > 0:
+		respondError(responseWriter, reasonRelayError, fmt.Sprintf("Pipeline destinations failed: %s. Forwarded by: [%s]", strings.Join(failures, "; "), strings.Join(forwarded, ", ")), http.StatusBadGateway)
+	case len(forwarded) == 0:
+		respondFiltered(responseWriter, filters, filtered(reasonPipelineFiltered, "Filtered out event %s! No pipeline matched. No forward to relay", eventType))
+	case filters.dryRun:
+		respondDryRun(responseWriter, "would-forward", filtered(reasonForwarded, "Pipelines [%s] would forward the event", strings.Join(forwarded, ", ")))
+	default:
+		log.Printf("Forwarded by pipelines [%s]", strings.Join(forwarded, ", "))
+		responseWriter.Header().Set("X-Filter-Reason", reasonForwarded)
+		responseWriter.Write([]byte(fmt.Sprintf("event:%s passed the filter on Github Webhook Filter server hosted at onrender.com. Forwarded by pipelines: %s.", eventType, strings.Join(forwarded, ", "))))
+	}
+}
+
+func (set *pipelineSet) String() string {
+	var names []string
+	for _, pipeline := range set.pipelines {
+		var urls []string
+		if pipeline.toRelayURLs {
+			urls = append(urls, defaultSinkName)
+		}
+		for _, destination := range pipeline.destinations {
+			urls = append(urls, destination.url)
+		}
+		names = append(names, fmt.Sprintf("%s -> %s", pipeline.name, strings.Join(urls, ",")))
+	}
+	mode := "all"
+	if set.firstMatch {
+		mode = "first"
+	}
+	return fmt.Sprintf("%s (mode %s)", strings.Join(names, "; "), mode)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var migrateSchema = flag.Bool("migrate", false, "Create the tables of postgres destinations when missing, at startup")
+
+// postgresSink inserts forwards as rows of a PostgreSQL table through a connection pool, with the insert prepared on
+// every connection
+type postgresSink struct {
+	pool  *pgxpool.Pool
+	table string
+}
+
+func init() {
+	sinkOpeners["postgres"] = openPostgresSink
+	sinkOpeners["postgresql"] = openPostgresSink
+}
+
+// openPostgresSink opens postgres://[user:password@]<host>[:port]/<database>?table=<table>&on_conflict=ignore|update,
+// the other parameters being those of the pgx connection string, e.g. sslmode or pool_max_conns
+func openPostgresSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	table := query.Get("table")
+	if table == "" {
+		table = "deliveries"
+	}
+	conflict := "DO NOTHING"
+	switch onConflict := query.Get("on_conflict"); onConflict {
+	case "", "ignore":
+	case "update":
+		conflict = "DO UPDATE SET received_at = excluded.received_at, event = excluded.event, repo = excluded.repo, package = excluded.package, tag = excluded.tag, payload = excluded.payload"
+	default:
+		return nil, fmt.Errorf("on_conflict must be ignore or update, got %q", onConflict)
+	}
+	query.Del("table")
+	query.Del("on_conflict")
+	connectionURL := *destinationURL
+	connectionURL.RawQuery = query.Encode()
+	config, err := pgxpool.ParseConfig(connectionURL.String())
+	if err != nil {
+		return nil, err
+	}
+	inserter := &postgresSink{table: pgx.Identifier(strings.Split(table, ".")).Sanitize()}
+	insert := fmt.Sprintf(`INSERT INTO %s (id, received_at, event, repo, package, tag, payload) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) %s`, inserter.table, conflict)
+	config.AfterConnect = func(ctx context.Context, connection *pgx.Conn) error {
+		_, err := connection.Prepare(ctx, "insert_delivery", insert)
+		return err
+	}
+	if inserter.pool, err = pgxpool.NewWithConfig(context.Background(), config); err != nil {
+		return nil, err
+	}
+	if *migrateSchema {
+		if err := inserter.migrate(); err != nil {
+			inserter.pool.Close()
+			return nil, err
+		}
+	}
+	return inserter, nil
+}
+
+// migrate creates the table when missing. It runs before the first connection prepares the insert, which needs it
+func (inserter *postgresSink) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connection, err := pgx.ConnectConfig(ctx, inserter.pool.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer connection.Close(ctx)
+	_, err = connection.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id TEXT PRIMARY KEY,
+		received_at TIMESTAMPTZ NOT NULL,
+		event TEXT NOT NULL,
+		repo TEXT,
+		package TEXT,
+		tag TEXT,
+		payload JSONB NOT NULL
+	)`, inserter.table))
+	if err != nil {
+		return fmt.Errorf("creating table %s: %w", inserter.table, err)
+	}
+	log.Printf("PostgreSQL table %s is ready", inserter.table)
+	return nil
+}
+
+// migratePostgresDestinations opens the postgres destinations of the configuration, creating their tables, so -migrate
+// fails the startup instead of the first forward
+func migratePostgresDestinations(config *serverConfig) error {
+	for _, destinationURL := range config.relayURLs() {
+		if parsed, err := url.Parse(destinationURL); err != nil || (parsed.Scheme != "postgres" && parsed.Scheme != "postgresql") {
+			continue
+		}
+		if _, err := sinkFor(destinationURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inserter *postgresSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	deliveryID := request.Header.Get("X-GitHub-Delivery")
+	if deliveryID == "" {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error inserting into PostgreSQL table %s: no X-GitHub-Delivery ID", inserter.table)
+	}
+	var event PackageEvent
+	json.Unmarshal(body, &event)
+	tag := event.containerTag()
+	if tag == "" {
+		tag = event.version()
+	}
+	payload := body
+	if !json.Valid(body) {
+		payload, _ = json.Marshal(string(body))
+	}
+	_, err := inserter.pool.Exec(ctx, "insert_delivery", deliveryID, time.Now().UTC(), request.Header.Get("X-GitHub-Event"),
+		nullable(event.Repository.FullName), nullable(event.Package.Name), nullable(tag), string(payload))
+	if err != nil {
+		return relayReply{status: postgresStatus(err)}, fmt.Errorf("Error inserting into PostgreSQL table %s: %v", inserter.table, err)
+	}
+	log.Printf("Inserted %s into PostgreSQL table %s", deliveryID, inserter.table)
+	return relayReply{status: http.StatusOK}, nil
+}
+
+// nullable stores empty values as NULL
+func nullable(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// postgresStatus maps the SQLSTATE of an insert error to the HTTP status deciding whether it is retried. Invalid data,
+// failed authentication and missing tables or privileges aren't retried, connection failures map to 0 like network
+// errors
+func postgresStatus(err error) int {
+	var serverError *pgconn.PgError
+	if !errors.As(err, &serverError) {
+		return 0
+	}
+	switch {
+	case serverError.Code == "42501":
+		return http.StatusForbidden
+	case strings.HasPrefix(serverError.Code, "28"):
+		return http.StatusUnauthorized
+	case strings.HasPrefix(serverError.Code, "22"), strings.HasPrefix(serverError.Code, "23"):
+		return http.StatusUnprocessableEntity
+	case strings.HasPrefix(serverError.Code, "42"):
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+func (inserter *postgresSink) ready() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return inserter.pool.Ping(ctx)
+}
+
+func (inserter *postgresSink) close() {
+	inserter.pool.Close()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// filterPreset holds the defaults of the package settings for one package ecosystem. Explicit environment variables
+// and flags override them
+type filterPreset struct {
+	// packageTypes is the default of FILTER_PACKAGE_TYPES
+	packageTypes string
+	// versionField is the default of VERSION_FIELD
+	versionField string
+	// skipArtifactTags and artifactTags are the defaults of SKIP_ARTIFACT_TAGS and ARTIFACT_TAG_PATTERNS
+	skipArtifactTags bool
+	artifactTags     string
+}
+
+// defaultPreset applies when FILTER_PRESET is unset
+var defaultPreset = filterPreset{packageTypes: "CONTAINER", versionField: "auto", skipArtifactTags: true, artifactTags: "*.sig,*.att"}
+
+// filterPresets are selected through FILTER_PRESET
+var filterPresets = map[string]filterPreset{
+	"container": {packageTypes: "CONTAINER", versionField: "tag", skipArtifactTags: true, artifactTags: "*.sig,*.att,*.sbom"},
+	"npm":       {packageTypes: "NPM", versionField: "version"},
+	"maven":     {packageTypes: "MAVEN", versionField: "version"},
+	"nuget":     {packageTypes: "NUGET", versionField: "version"},
+	"rubygems":  {packageTypes: "RUBYGEMS", versionField: "version"},
+}
+
+// lookupPreset returns the named preset, or the default preset when name is empty
+func lookupPreset(name string) (filterPreset, error) {
+	if name == "" {
+		return defaultPreset, nil
+	}
+	preset, found := filterPresets[strings.ToLower(name)]
+	if !found {
+		names := make([]string, 0, len(filterPresets))
+		for presetName := range filterPresets {
+			names = append(names, presetName)
+		}
+		sort.Strings(names)
+		return preset, fmt.Errorf("unknown preset %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return preset, nil
+}
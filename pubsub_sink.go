@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/pubsub/v2"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pubsubAttributes maps the message attributes set on every message to the inbound header they come from
+var pubsubAttributes = map[string]string{"delivery_id": "X-GitHub-Delivery", "event_type": "X-GitHub-Event", "hook_id": "X-GitHub-Hook-ID"}
+
+// pubsubSink publishes forwards to a Google Cloud Pub/Sub topic, with the payload as message data. Credentials are the
+// application default credentials unless a key file is given, and PUBSUB_EMULATOR_HOST points it at the emulator
+type pubsubSink struct {
+	client    *pubsub.Client
+	publisher *pubsub.Publisher
+	topic     string
+	// orderByRepo sets the repository full name as ordering key
+	orderByRepo bool
+}
+
+func init() {
+	sinkOpeners["pubsub"] = openPubSubSink
+}
+
+// openPubSubSink opens pubsub://<project>/<topic>, e.g. pubsub://my-project/github-events. ?credentials_file= names a
+// service account key file and ?ordering_key=repo orders the messages of each repository
+func openPubSubSink(destinationURL *url.URL) (sink, error) {
+	topic := strings.TrimPrefix(destinationURL.Path, "/")
+	if destinationURL.Host == "" || topic == "" || strings.Contains(topic, "/") {
+		return nil, fmt.Errorf("expected pubsub://<project>/<topic>")
+	}
+	query := destinationURL.Query()
+	var options []option.ClientOption
+	if credentialsFile := query.Get("credentials_file"); credentialsFile != "" {
+		options = append(options, option.WithAuthCredentialsFile(option.ServiceAccount, credentialsFile))
+	}
+	orderByRepo := false
+	switch orderingKey := query.Get("ordering_key"); orderingKey {
+	case "":
+	case "repo":
+		orderByRepo = true
+	default:
+		return nil, fmt.Errorf("ordering_key must be repo, got %q", orderingKey)
+	}
+	client, err := pubsub.NewClient(context.Background(), destinationURL.Host, options...)
+	if err != nil {
+		return nil, err
+	}
+	publisher := client.Publisher(topic)
+	publisher.EnableMessageOrdering = orderByRepo
+	return &pubsubSink{client: client, publisher: publisher, topic: destinationURL.Host + "/" + topic, orderByRepo: orderByRepo}, nil
+}
+
+// send publishes the message and waits for Pub/Sub to accept it
+func (topic *pubsubSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	message := &pubsub.Message{Data: body, Attributes: map[string]string{}}
+	for attribute, header := range pubsubAttributes {
+		if value := request.Header.Get(header); value != "" {
+			message.Attributes[attribute] = value
+		}
+	}
+	if topic.orderByRepo {
+		var event struct {
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		}
+		json.Unmarshal(body, &event)
+		message.OrderingKey = event.Repository.FullName
+	}
+	messageID, err := topic.publisher.Publish(ctx, message).Get(ctx)
+	if err != nil {
+		if message.OrderingKey != "" {
+			// a failed publish pauses its ordering key until resumed
+			topic.publisher.ResumePublish(message.OrderingKey)
+		}
+		return relayReply{status: pubsubStatus(err)}, fmt.Errorf("Error publishing to Pub/Sub topic %s: %v", topic.topic, err)
+	}
+	log.Printf("Pub/Sub topic %s accepted message %s", topic.topic, messageID)
+	return relayReply{status: http.StatusOK, contentType: "application/json", body: fmt.Appendf(nil, `{"message_id":%q}`, messageID)}, nil
+}
+
+// pubsubStatus maps the gRPC code of a publish error to the HTTP status deciding whether it is retried. Transient
+// failures map to 0 like network errors
+func pubsubStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// close publishes the pending messages and stops the publisher, on shutdown
+func (topic *pubsubSink) close() {
+	topic.publisher.Stop()
+	if err := topic.client.Close(); err != nil {
+		log.Printf("Failed to close Pub/Sub client of %s: %v", topic.topic, err)
+	}
+}
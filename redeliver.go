@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// redeliveryRequest is the body of POST /admin/redeliver. Either DeliveryID or a Since and Until time range selects
+// the archived deliveries
+type redeliveryRequest struct {
+	DeliveryID string    `json:"delivery_id"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+	// IncludeFiltered also redelivers archived deliveries that were filtered out
+	IncludeFiltered bool `json:"include_filtered"`
+	// SkipFilters forwards to the route's relay URLs without running the filters again
+	SkipFilters bool `json:"skip_filters"`
+}
+
+// redeliveryOutcome is the result of redelivering one archived delivery
+type redeliveryOutcome struct {
+	DeliveryID string `json:"delivery_id"`
+	Event      string `json:"event"`
+	Status     int    `json:"status"`
+	Reason     string `json:"reason"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// handleAdminRedeliver re-runs archived deliveries through the filters and forwarding of their route, one at a time,
+// and lists the outcome of each. Requires ADMIN_TOKEN as bearer token
+func handleAdminRedeliver(responseWriter http.ResponseWriter, request *http.Request) {
+	if !authorizeAdmin(responseWriter, request) {
+		return
+	}
+	config := currentConfig.Load()
+	if eventArchiver == nil {
+		http.Error(responseWriter, "Redelivery needs the archive, set ARCHIVE_PATH", http.StatusNotFound)
+		return
+	}
+	var selection redeliveryRequest
+	if err := json.NewDecoder(request.Body).Decode(&selection); err != nil {
+		respondError(responseWriter, reasonBadRequest, fmt.Sprintf("Invalid redelivery request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if (selection.DeliveryID == "") == (selection.Since.IsZero() && selection.Until.IsZero()) {
+		respondError(responseWriter, reasonBadRequest, "Redelivery needs either delivery_id or since and until", http.StatusBadRequest)
+		return
+	}
+	entries, err := eventArchiver.find(selection)
+	if err != nil {
+		http.Error(responseWriter, fmt.Sprintf("Failed to read the archive: %v", err), http.StatusInternalServerError)
+		return
+	}
+	outcomes := []redeliveryOutcome{}
+	for _, entry := range entries {
+		outcomes = append(outcomes, redeliver(request, config, entry, selection.SkipFilters))
+	}
+	log.Printf("Redelivered %d archived deliveries", len(outcomes))
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(outcomes)
+}
+
+// redeliver replays the archived delivery as a signed request to its route, marked with X-Filter-Redelivery
+func redeliver(adminRequest *http.Request, config *serverConfig, entry archiveEntry, skipFilters bool) redeliveryOutcome {
+	outcome := redeliveryOutcome{DeliveryID: entry.DeliveryID, Event: entry.Event}
+	route := config.lookupRoute(entry.Path)
+	if route == nil {
+		outcome.Status, outcome.Reason, outcome.Detail = http.StatusNotFound, reasonBadRequest, fmt.Sprintf("No route configured for path %s", entry.Path)
+		return outcome
+	}
+	body := []byte(entry.Payload)
+	mac := hmac.New(sha256.New, []byte(route.secret))
+	mac.Write(body)
+	request, err := http.NewRequestWithContext(adminRequest.Context(), http.MethodPost, entry.Path, bytes.NewReader(body))
+	if err != nil {
+		outcome.Status, outcome.Reason, outcome.Detail = http.StatusBadRequest, reasonBadRequest, fmt.Sprintf("Invalid archived path %s: %v", entry.Path, err)
+		return outcome
+	}
+	request.Header.Set("X-GitHub-Event", entry.Event)
+	request.Header.Set("X-GitHub-Delivery", entry.DeliveryID)
+	if entry.HookID != "" {
+		request.Header.Set("X-GitHub-Hook-ID", entry.HookID)
+	}
+	request.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	request.Header.Set("X-Filter-Redelivery", "true")
+	log.Printf("Redelivering archived delivery %s (%s) from %s", entry.DeliveryID, entry.Event, entry.Time)
+	recorder := newResponseCapture()
+	if skipFilters {
+		destinations, err := expandRelayURLs(route.filters.balanceRelayURLs(route.filters.sinks.relayDestinations(route.relayURLs)), request.Header, body)
+		if err == nil {
+			destinations, err = renderBodies(destinations, route.filters.bodyTemplate, request.Header, body)
+		}
+		if err != nil {
+			respondError(recorder, reasonTemplateError, fmt.Sprintf("Failed to render redelivery of %s: %v", entry.DeliveryID, err), http.StatusInternalServerError)
+		} else {
+			forwardToRelay(recorder, request, route.filters, destinations, body, "redelivery:"+entry.DeliveryID)
+		}
+	} else {
+		handleRequest(recorder, request, route)
+	}
+	outcome.Status, outcome.Reason = recorder.status, recorder.Header().Get("X-Filter-Reason")
+	var reason filterReason
+	if json.Unmarshal(recorder.body.Bytes(), &reason) == nil && reason.Detail != "" {
+		outcome.Detail = reason.Detail
+	} else {
+		outcome.Detail = strings.TrimSpace(recorder.body.String())
+	}
+	log.Printf("Redelivery of %s: %d %s", entry.DeliveryID, outcome.Status, outcome.Reason)
+	return outcome
+}
+
+// find reads the archive files, oldest first, and returns the selected entries. A delivery archived several times is
+// only returned once, with its latest payload
+func (archive *eventArchive) find(selection redeliveryRequest) ([]archiveEntry, error) {
+	files, err := filepath.Glob(archive.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// the rotated files sort by their timestamp suffix
+	slices.Sort(files)
+	files = append(files, archive.path)
+	var entries []archiveEntry
+	indexes := map[string]int{}
+	for _, fileName := range files {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			var entry archiveEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if !selection.matches(entry) {
+				continue
+			}
+			if index, found := indexes[entry.DeliveryID]; found {
+				entries[index] = entry
+				continue
+			}
+			indexes[entry.DeliveryID] = len(entries)
+			entries = append(entries, entry)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+	}
+	return entries, nil
+}
+
+func (selection redeliveryRequest) matches(entry archiveEntry) bool {
+	if entry.Verdict == archiveFiltered && !selection.IncludeFiltered {
+		return false
+	}
+	if selection.DeliveryID != "" {
+		return entry.DeliveryID == selection.DeliveryID
+	}
+	archivedAt, err := time.Parse(time.RFC3339Nano, entry.Time)
+	if err != nil {
+		return false
+	}
+	return !archivedAt.Before(selection.Since) && (selection.Until.IsZero() || archivedAt.Before(selection.Until))
+}
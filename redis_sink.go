@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSink appends forwards to a Redis stream
+type redisSink struct {
+	client *redis.Client
+	stream string
+	// maxLength trims the stream to about that many entries, 0 for no trimming
+	maxLength int64
+	// entries counts the entries written, for the filter statistics
+	entries atomic.Int64
+}
+
+func init() {
+	sinkOpeners["redis"] = openRedisSink
+	sinkOpeners["rediss"] = openRedisSink
+}
+
+// redisStreamSinkName names the Redis stream of REDIS_STREAM_URL or REDIS_URL among the declared sinks. Every event
+// forwarded to the relay URLs is also added to it
+const redisStreamSinkName = "redis_stream"
+
+// redisStreamURL returns REDIS_STREAM_URL, or REDIS_URL when it is unset
+func redisStreamURL() string {
+	if streamURL := os.Getenv("REDIS_STREAM_URL"); streamURL != "" {
+		return streamURL
+	}
+	return os.Getenv("REDIS_URL")
+}
+
+// withRedisStream declares the Redis stream sink of the URL in the set, creating the set when nil
+func (set sinkSet) withRedisStream(streamURL string) (sinkSet, error) {
+	if parsed, err := url.Parse(streamURL); err != nil || (parsed.Scheme != "redis" && parsed.Scheme != "rediss") {
+		return nil, fmt.Errorf("expected a redis:// or rediss:// URL, got %s", redactURL(streamURL))
+	}
+	if set[redisStreamSinkName] != nil {
+		return nil, fmt.Errorf("the sinks file can't declare the %s sink", redisStreamSinkName)
+	}
+	if set == nil {
+		set = sinkSet{}
+	}
+	set[redisStreamSinkName] = &relayDestination{url: streamURL, sink: redisStreamSinkName}
+	return set, nil
+}
+
+// openRedisSink opens redis://[user:password@]<host>[/<db>] or rediss:// for TLS with the relay TLS settings.
+// ?stream= names the stream, github_webhooks by default, and ?maxlen= trims it
+func openRedisSink(destinationURL *url.URL) (sink, error) {
+	stream := &redisSink{stream: "github_webhooks"}
+	query := destinationURL.Query()
+	if name := query.Get("stream"); name != "" {
+		stream.stream = name
+	}
+	if maxLength := query.Get("maxlen"); maxLength != "" {
+		var err error
+		if stream.maxLength, err = strconv.ParseInt(maxLength, 10, 64); err != nil || stream.maxLength < 0 {
+			return nil, fmt.Errorf("maxlen must be a positive number, got %q", maxLength)
+		}
+	}
+	query.Del("stream")
+	query.Del("maxlen")
+	connectionURL := *destinationURL
+	connectionURL.RawQuery = query.Encode()
+	options, err := redis.ParseURL(connectionURL.String())
+	if err != nil {
+		return nil, err
+	}
+	if options.TLSConfig != nil {
+		options.TLSConfig = relayClient.Transport.(*http.Transport).TLSClientConfig.Clone()
+		options.TLSConfig.ServerName = destinationURL.Hostname()
+	}
+	stream.client = redis.NewClient(options)
+	return stream, nil
+}
+
+func (stream *redisSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	var event struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	json.Unmarshal(body, &event)
+	id, err := stream.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream.stream,
+		MaxLen: stream.maxLength,
+		Approx: true,
+		Values: []any{
+			"delivery_id", request.Header.Get("X-GitHub-Delivery"),
+			"event_type", request.Header.Get("X-GitHub-Event"),
+			"repo", event.Repository.FullName,
+			"body", body,
+		},
+	}).Result()
+	if err != nil {
+		return relayReply{}, fmt.Errorf("Error adding to Redis stream %s: %v", stream.stream, err)
+	}
+	stream.entries.Add(1)
+	log.Printf("Redis stream %s added entry %s", stream.stream, id)
+	return relayReply{status: http.StatusOK, contentType: "application/json", body: fmt.Appendf(nil, `{"id":%q}`, id)}, nil
+}
+
+func (stream *redisSink) ready() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return stream.client.Ping(ctx).Err()
+}
+
+func (stream *redisSink) close() {
+	stream.client.Close()
+}
+
+// redisEntries returns the entries written by the open Redis sinks, by destination URL without password
+func redisEntries() map[string]int64 {
+	openSinks.mutex.Lock()
+	defer openSinks.mutex.Unlock()
+	entries := map[string]int64{}
+	for destinationURL, opened := range openSinks.sinks {
+		if stream, ok := opened.(*redisSink); ok {
+			entries[redactURL(destinationURL)] = stream.entries.Load()
+		}
+	}
+	return entries
+}
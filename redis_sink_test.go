@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisStreamDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantURL string
+	}{
+		{name: "REDIS_URL", env: map[string]string{"REDIS_URL": "redis://cache.internal:6379/0"}, wantURL: "redis://cache.internal:6379/0"},
+		{name: "REDIS_STREAM_URL", env: map[string]string{"REDIS_STREAM_URL": "rediss://stream.internal:6380"}, wantURL: "rediss://stream.internal:6380"},
+		{name: "REDIS_STREAM_URL over REDIS_URL", env: map[string]string{"REDIS_URL": "redis://cache.internal:6379/0", "REDIS_STREAM_URL": "rediss://stream.internal:6380"}, wantURL: "rediss://stream.internal:6380"},
+		{name: "unset"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filters := loadTestFilters(t, test.env)
+			destinations := filters.sinks.relayDestinations([]string{"https://relay.example.com"})
+			if destinations[0].url != "https://relay.example.com" {
+				t.Errorf("first destination = %s, want the relay URL", destinations[0].url)
+			}
+			if test.wantURL == "" {
+				if len(destinations) != 1 {
+					t.Errorf("expected only the relay URL, got %d destinations", len(destinations))
+				}
+				return
+			}
+			if len(destinations) != 2 || destinations[1].url != test.wantURL || destinations[1].sink != redisStreamSinkName {
+				t.Errorf("expected the relay URL and the %s sink of %s, got %+v", redisStreamSinkName, test.wantURL, destinations)
+			}
+		})
+	}
+}
+
+func TestRedisStreamInvalid(t *testing.T) {
+	t.Setenv("REDIS_URL", "https://cache.internal")
+	if _, err := loadFilterConfig(); err == nil || !strings.Contains(err.Error(), "REDIS_STREAM_URL") {
+		t.Errorf("expected a REDIS_STREAM_URL error, got %v", err)
+	}
+}
+
+func TestRedisStreamNotBalanced(t *testing.T) {
+	filters := loadTestFilters(t, map[string]string{"REDIS_URL": "redis://cache.internal:6379/0", "RELAY_BALANCE": balanceRoundRobin})
+	destinations := filters.balanceRelayURLs(filters.sinks.relayDestinations([]string{"https://a.example.com", "https://b.example.com"}))
+	if len(destinations) != 2 || destinations[0].balance == nil || len(destinations[0].balance.Endpoints) != 2 {
+		t.Fatalf("expected the balanced relay URLs and the stream, got %+v", destinations)
+	}
+	if destinations[1].sink != redisStreamSinkName || destinations[1].balance != nil {
+		t.Errorf("expected the stream forwarded to besides the balanced relay URLs, got %+v", destinations[1])
+	}
+}
+
+func TestServerConfigRedisStreamOnly(t *testing.T) {
+	config := serveTestConfig(t, map[string]string{"REDIS_URL": "redis://cache.internal:6379/0"})
+	if len(config.defaultRoute.relayURLs) != 0 {
+		t.Errorf("expected no relay URL, got %v", config.defaultRoute.relayURLs)
+	}
+	if relayURLs := config.relayURLs(); len(relayURLs) != 1 || relayURLs[0] != "redis://cache.internal:6379/0" {
+		t.Errorf("expected the stream among the checked destinations, got %v", relayURLs)
+	}
+}
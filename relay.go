@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// forwardToRelay sends the event to every relay URL. With a single relay URL the relay's failure is the response, or
+// the relay's response whatever it is with RELAY_RESPONSE_PASSTHROUGH.
+// With several, they are sent to concurrently within RELAY_WAIT and the response lists each destination's outcome.
+// Returns whether the event counts as forwarded
+func forwardToRelay(responseWriter http.ResponseWriter, request *http.Request, filters *filterConfig, destinations []relayDestination, requestBody []byte, summary string) bool {
+	log.Printf("Sending %s from hook %s to relay", summary, request.Header.Get("X-GitHub-Hook-ID"))
+	if filters.debounce > 0 && pendingDebounces.add(request, filters, destinations, requestBody, summary) {
+		responseWriter.Header().Set("X-Filter-Reason", reasonForwardAccepted)
+		responseWriter.WriteHeader(http.StatusAccepted)
+		responseWriter.Write([]byte(fmt.Sprintf("%s passed the filter on Github Webhook Filter server hosted at onrender.com. Debounced for forwarding to relay.", summary)))
+		return true
+	}
+	if filters.batchSize > 0 {
+		return forwardBatched(responseWriter, request, filters, destinations, requestBody, summary)
+	}
+	if filters.asyncForward {
+		return forwardAsync(responseWriter, request, filters, destinations, requestBody, summary)
+	}
+	if filters.retryInBackground {
+		forwardInBackground(request, filters, destinations, requestBody, summary)
+		responseWriter.Header().Set("X-Filter-Reason", reasonForwardAccepted)
+		responseWriter.WriteHeader(http.StatusAccepted)
+		responseWriter.Write([]byte(fmt.Sprintf("%s passed the filter on Github Webhook Filter server hosted at onrender.com. Forwarding to relay in the background.", summary)))
+		return true
+	}
+	if len(destinations) == 1 {
+		reply, err := filters.retry.send(request.Context(), request, destinations[0], requestBody)
+		if reply.servedBy != "" {
+			responseWriter.Header().Set("X-Filter-Served-By", redactURL(reply.servedBy))
+		}
+		if filters.relayPassthrough && reply.status != 0 {
+			if err != nil {
+				filters.deadLetters.add(request, destinations[0], requestBody, err)
+			}
+			passRelayResponse(responseWriter, reply, err == nil)
+			return err == nil
+		}
+		if err != nil {
+			filters.deadLetters.add(request, destinations[0], requestBody, err)
+			reason := reasonRelayError
+			if errors.Is(err, errCircuitOpen) {
+				reason = reasonCircuitOpen
+			} else if errors.Is(err, errRelayTimeout) {
+				reason = reasonRelayTimeout
+			} else if errors.Is(err, errRelayRateLimited) {
+				reason = reasonRelayRateLimited
+			}
+			respondError(responseWriter, reason, err.Error(), http.StatusBadGateway)
+			return false
+		}
+		responseWriter.Header().Set("X-Filter-Reason", reasonForwarded)
+		responseWriter.Write([]byte(fmt.Sprintf("%s passed the filter on Github Webhook Filter server hosted at onrender.com. Forwarded to relay.", summary)))
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), filters.relayWait)
+	defer cancel()
+	outcomes := make([]relayOutcome, len(destinations))
+	var wait sync.WaitGroup
+	for index, destination := range destinations {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			outcome := relayOutcome{URL: destination.url}
+			var err error
+			var reply relayReply
+			if reply, err = filters.retry.send(ctx, request, destination, requestBody); err != nil {
+				outcome.Error = err.Error()
+				filters.deadLetters.add(request, destination, requestBody, err)
+			}
+			outcome.Status, outcome.ServedBy = reply.status, redactURL(reply.servedBy)
+			outcomes[index] = outcome
+		}()
+	}
+	wait.Wait()
+
+	succeeded := 0
+	for _, outcome := range outcomes {
+		if outcome.Error == "" {
+			succeeded++
+			log.Printf("Forwarded %s to %s, status %d", summary, outcome.URL, outcome.Status)
+		} else {
+			log.Printf("Failed to forward %s to %s: %s", summary, outcome.URL, outcome.Error)
+		}
+	}
+	forwarded := succeeded == len(outcomes) || (succeeded > 0 && !filters.relayRequireAll)
+	response := relayResponse{Reason: reasonForwarded, Detail: fmt.Sprintf("%s forwarded to %d of %d relays", summary, succeeded, len(outcomes)), Destinations: outcomes}
+	status := http.StatusOK
+	if !forwarded {
+		response.Reason = reasonRelayError
+		status = http.StatusBadGateway
+	}
+	responseWriter.Header().Set("X-Filter-Reason", response.Reason)
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	json.NewEncoder(responseWriter).Encode(response)
+	return forwarded
+}
+
+// passRelayResponse answers with the status, body and content type of the relay's response
+func passRelayResponse(responseWriter http.ResponseWriter, reply relayReply, forwarded bool) {
+	reason := reasonForwarded
+	if !forwarded {
+		reason = reasonRelayError
+	}
+	responseWriter.Header().Set("X-Filter-Reason", reason)
+	if reply.contentType != "" {
+		responseWriter.Header().Set("Content-Type", reply.contentType)
+	}
+	responseWriter.WriteHeader(reply.status)
+	responseWriter.Write(reply.body)
+}
+
+// forwardInBackground forwards to the destinations after the response was sent, retrying without the retry budget
+func forwardInBackground(request *http.Request, filters *filterConfig, destinations []relayDestination, requestBody []byte, summary string) {
+	detached := request.Clone(context.WithoutCancel(request.Context()))
+	policy := filters.retry
+	policy.budget = 0
+	for _, destination := range destinations {
+		go func() {
+			if _, err := policy.send(detached.Context(), detached, destination, requestBody); err != nil {
+				log.Printf("Failed to forward %s to %s in the background: %v", summary, destination.url, err)
+				filters.deadLetters.add(detached, destination, requestBody, err)
+				deliveryLog.finish(detached.Header.Get("X-GitHub-Delivery"), false)
+				return
+			}
+			log.Printf("Forwarded %s to %s in the background", summary, destination.url)
+			deliveryLog.finish(detached.Header.Get("X-GitHub-Delivery"), true)
+		}()
+	}
+}
+
+// relayOutcome is the result of sending an event to one relay URL. Status is 0 when the relay could not be reached
+type relayOutcome struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// ServedBy is the URL that accepted a forward failing over or balanced
+	ServedBy string `json:"served_by,omitempty"`
+}
+
+// relayResponse is the response body when forwarding to several relay URLs
+type relayResponse struct {
+	Reason       string         `json:"reason"`
+	Detail       string         `json:"detail"`
+	Destinations []relayOutcome `json:"destinations"`
+}
+
+// idempotencyKey identifies the forward of a delivery to downstream systems deduplicating it. It is the delivery ID
+// and a hash of the forwarded body, so it's the same for every retry and redelivery of the delivery, and differs
+// between destinations with different bodies
+func idempotencyKey(header http.Header, body []byte) string {
+	hash := sha256.Sum256(body)
+	key := hex.EncodeToString(hash[:8])
+	if delivery := header.Get("X-GitHub-Delivery"); delivery != "" {
+		key = delivery + "-" + key
+	}
+	return key
+}
+
+// relayReply is the relay's response to a forward. Status is 0 when the relay could not be reached, and body holds up
+// to RELAY_RESPONSE_MAX_BYTES of the response
+type relayReply struct {
+	status      int
+	contentType string
+	body        []byte
+	// retryAfter is the delay the relay asked for with Retry-After on a 429 or 503, 0 when it didn't
+	retryAfter time.Duration
+	// servedBy is the URL that accepted a forward failing over or balanced, empty for other forwards
+	servedBy string
+}
+
+// relayDestination is a relay URL with the extra headers, timeout and body template of the rule or pipeline forwarding
+// to it
+type relayDestination struct {
+	url     string
+	headers map[string]string
+	// timeout is 0 when RELAY_TIMEOUT bounds each attempt
+	timeout time.Duration
+	// template renders the forwarded body from the payload when set
+	template *bodyTemplate
+	// body is the rendered template, forwarded instead of the payload when set
+	body []byte
+	// hedge is nil when the forward isn't hedged
+	hedge *relayHedge
+	// failover is the URL forwarded to when the destination URL fails, empty when it doesn't fail over
+	failover string
+	// balance is nil when every forward goes to the destination URL
+	balance *relayBalance
+	// sink names the declared sink of the destination, empty when it isn't one
+	sink string
+	// method is empty for POST
+	method string
+	// successStatus is nil when 2xx responses are a success
+	successStatus statusSet
+	// retry is nil when the route's retry policy applies
+	retry *sinkRetry
+}
+
+func newRelayDestinations(relayURLs []string) []relayDestination {
+	destinations := make([]relayDestination, len(relayURLs))
+	for index, relayURL := range relayURLs {
+		destinations[index] = relayDestination{url: relayURL}
+	}
+	return destinations
+}
+
+// expandRelayURLs returns the destinations with the {field} placeholders of their http(s) URLs filled from the event.
+// Sink URLs are left as they are, since their templates are filled by the sink
+func expandRelayURLs(destinations []relayDestination, header http.Header, body []byte) ([]relayDestination, error) {
+	expanded := make([]relayDestination, len(destinations))
+	for index, destination := range destinations {
+		expanded[index] = destination
+		if !isTemplatedRelayURL(destination.url) {
+			continue
+		}
+		var err error
+		if expanded[index].url, err = expandRelayURL(destination.url, header, body); err != nil {
+			return nil, fmt.Errorf("relay URL %s: %w", destination.url, err)
+		}
+	}
+	return expanded, nil
+}
+
+// isTemplatedRelayURL reports whether the URL is an http(s) relay URL with placeholders
+func isTemplatedRelayURL(relayURL string) bool {
+	return (strings.HasPrefix(relayURL, "http://") || strings.HasPrefix(relayURL, "https://")) && strings.ContainsAny(relayURL, "{}")
+}
+
+// expandRelayURL fills the placeholders of the URL, path-escaping the values before the query and query-escaping them
+// in the query. Without a header and body, only checks the placeholder syntax
+func expandRelayURL(relayURL string, header http.Header, body []byte) (string, error) {
+	var expanded strings.Builder
+	for index, part := range strings.SplitN(relayURL, "?", 2) {
+		template, err := parseFieldTemplate(part)
+		if err != nil {
+			return "", err
+		}
+		escape := url.PathEscape
+		if index == 1 {
+			expanded.WriteString("?")
+			escape = url.QueryEscape
+		}
+		if header == nil {
+			continue
+		}
+		rendered, err := template.render(header, body, escape)
+		if err != nil {
+			return "", err
+		}
+		expanded.WriteString(rendered)
+	}
+	return expanded.String(), nil
+}
+
+// hopHeaders only apply to a single connection and are never forwarded, whatever FORWARD_HEADERS says
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Host", "Content-Length"}
+
+// copyForwardHeaders copies the inbound headers matching the patterns, leaving out hop-by-hop headers and those named
+// by the Connection header
+func copyForwardHeaders(outbound http.Header, inbound http.Header, patterns globList) {
+	excluded := slices.Clone(hopHeaders)
+	for _, connection := range inbound.Values("Connection") {
+		for _, name := range strings.Split(connection, ",") {
+			excluded = append(excluded, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+	for key, values := range inbound {
+		if slices.Contains(excluded, http.CanonicalHeaderKey(key)) {
+			continue
+		}
+		if _, matched := patterns.match(key); matched {
+			outbound[key] = slices.Clone(values)
+		}
+	}
+}
+
+var errRelayTimeout = errors.New("Relay timed out")
+
+// relayClient sends every forward, sharing connections between them. Its dial and TLS handshake timeouts, TLS and
+// proxy settings are read at startup
+var relayClient *http.Client
+
+// relayUserAgent is the User-Agent of forwards and of the requests of HTTP sinks, set by RELAY_USER_AGENT at startup
+var relayUserAgent = "Go WebHook Filter"
+
+// newRelayClient builds the client from the environment and logs the proxy used for each of the relay URLs. Also sets
+// relayUserAgent
+func newRelayClient(relayURLs []string) (*http.Client, error) {
+	dialTimeout, handshakeTimeout, idleTimeout := 5*time.Second, 5*time.Second, 90*time.Second
+	for envName, setting := range map[string]*time.Duration{"RELAY_DIAL_TIMEOUT": &dialTimeout, "RELAY_TLS_TIMEOUT": &handshakeTimeout, "RELAY_IDLE_CONN_TIMEOUT": &idleTimeout} {
+		if value := os.Getenv(envName); value != "" {
+			var err error
+			if *setting, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", envName, err)
+			}
+		}
+	}
+	if value := os.Getenv("RELAY_USER_AGENT"); value != "" {
+		relayUserAgent = value
+		log.Printf("Sending User-Agent: %s", relayUserAgent)
+	}
+	idleConnections := 16
+	if value := os.Getenv("RELAY_MAX_IDLE_CONNS_PER_HOST"); value != "" {
+		var err error
+		if idleConnections, err = strconv.Atoi(value); err != nil || idleConnections < 1 {
+			return nil, fmt.Errorf("RELAY_MAX_IDLE_CONNS_PER_HOST must be a positive number, got %q", value)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = handshakeTimeout
+	// the default of 2 idle connections per host makes bursts to a single relay open new connections
+	transport.MaxIdleConnsPerHost = idleConnections
+	transport.MaxIdleConns = max(transport.MaxIdleConns, idleConnections)
+	transport.IdleConnTimeout = idleTimeout
+	var err error
+	if transport.TLSClientConfig, err = newRelayTLSConfig(); err != nil {
+		return nil, err
+	}
+	if proxyURL := os.Getenv("RELAY_PROXY_URL"); proxyURL != "" {
+		if parsed, err := url.Parse(proxyURL); err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("RELAY_PROXY_URL must be an absolute URL, got %q", proxyURL)
+		}
+		proxy := (&httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL, NoProxy: getEnvAny("NO_PROXY", "no_proxy")}).ProxyFunc()
+		transport.Proxy = func(request *http.Request) (*url.URL, error) {
+			return proxy(request.URL)
+		}
+	}
+	for _, relayURL := range relayURLs {
+		request, err := http.NewRequest("POST", relayURL, nil)
+		if err != nil {
+			continue
+		}
+		if _, isSink := sinkOpeners[request.URL.Scheme]; isSink {
+			continue
+		}
+		if proxy, err := transport.Proxy(request); err != nil {
+			log.Printf("Invalid proxy for relay %s: %v", relayURL, err)
+		} else if proxy != nil {
+			// never log the proxy credentials
+			log.Printf("Forwarding to relay %s through proxy %s", relayURL, proxy.Redacted())
+		} else {
+			log.Printf("Forwarding to relay %s without proxy", relayURL)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// getEnvAny returns the first of the environment variables that is set
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value, found := os.LookupEnv(name); found {
+			return value
+		}
+	}
+	return ""
+}
+
+// newRelayTLSConfig builds the TLS settings of relay connections from RELAY_CLIENT_CERT, RELAY_CLIENT_KEY,
+// RELAY_CA_FILE and RELAY_INSECURE_SKIP_VERIFY
+func newRelayTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	certFile, keyFile := os.Getenv("RELAY_CLIENT_CERT"), os.Getenv("RELAY_CLIENT_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("RELAY_CLIENT_CERT and RELAY_CLIENT_KEY must be set together")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("RELAY_CLIENT_CERT: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+		log.Printf("Presenting client certificate %s to relays", certFile)
+	}
+	if caFile := os.Getenv("RELAY_CA_FILE"); caFile != "" {
+		content, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("RELAY_CA_FILE: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("RELAY_CA_FILE: no PEM certificates in %s", caFile)
+		}
+		log.Printf("Verifying relay certificates against %s only", caFile)
+	}
+	var err error
+	if config.InsecureSkipVerify, err = lookupBool("RELAY_INSECURE_SKIP_VERIFY", false); err != nil {
+		return nil, err
+	}
+	if config.InsecureSkipVerify {
+		log.Printf("WARNING: RELAY_INSECURE_SKIP_VERIFY is set, relay certificates are NOT verified. Only use this in lab environments")
+	}
+	return config, nil
+}
+
+// sendToRelay posts the body to the relay with the inbound headers selected by the policy, signed with its secret. Returns the relay's response, and
+// an error when the relay can't be reached or doesn't respond 2xx
+func sendToRelay(ctx context.Context, request *http.Request, destination relayDestination, policy retryPolicy, requestBody []byte) (relayReply, error) {
+	if destination.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, destination.timeout)
+		defer cancel()
+	}
+	relayURL := destination.url
+	if destinationSink, err := sinkFor(relayURL); err != nil {
+		return relayReply{}, err
+	} else if destinationSink != nil {
+		reply, err := destinationSink.send(ctx, request, requestBody)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Printf("Destination %s timed out after %s", relayURL, destination.timeout)
+			err = fmt.Errorf("%w after %s: %v", errRelayTimeout, destination.timeout, err)
+		}
+		return reply, err
+	}
+	payload, contentType := requestBody, "application/json"
+	var event cloudEvent
+	if policy.cloudEventsMode != "" {
+		event = newCloudEvent(request.Header, requestBody)
+		if policy.cloudEventsMode == cloudEventsStructured {
+			payload, contentType = event.structured(), "application/cloudevents+json"
+		}
+	}
+	outboundBody := payload
+	compressed := policy.gzipMinBytes > 0 && len(payload) >= policy.gzipMinBytes
+	if compressed {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(payload)
+		writer.Close()
+		outboundBody = buffer.Bytes()
+	}
+	method := destination.method
+	if method == "" {
+		method = "POST"
+	}
+	newRequest, _ := http.NewRequestWithContext(ctx, method, relayURL, bytes.NewReader(outboundBody))
+	copyForwardHeaders(newRequest.Header, request.Header, policy.headers)
+	if policy.secret != "" {
+		// signs the bytes sent, compressed or not, so the relay verifies them before decompressing
+		mac := hmac.New(sha256.New, []byte(policy.secret))
+		mac.Write(outboundBody)
+		newRequest.Header.Set(policy.signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	newRequest.Header.Set("User-Agent", relayUserAgent)
+	newRequest.Header.Set("Content-Type", contentType)
+	if policy.idempotencyHeader != "" {
+		newRequest.Header.Set(policy.idempotencyHeader, idempotencyKey(request.Header, requestBody))
+	}
+	if policy.cloudEventsMode == cloudEventsBinary {
+		event.setBinaryHeaders(newRequest.Header)
+	}
+	if compressed {
+		newRequest.Header.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range policy.relayHeaders {
+		newRequest.Header.Set(key, value)
+	}
+	for key, value := range destination.headers {
+		newRequest.Header.Set(key, value)
+	}
+	httpResponse, err := relayClient.Do(newRequest)
+	if err != nil {
+		var netError net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netError) && netError.Timeout()) {
+			log.Printf("Relay %s timed out after %s", relayURL, destination.timeout)
+			return relayReply{}, fmt.Errorf("%w after %s: %v", errRelayTimeout, destination.timeout, err)
+		}
+		return relayReply{}, fmt.Errorf("Error sending request: %v", err)
+	}
+	defer func() {
+		// the connection is only reused once the body was read to the end
+		io.Copy(io.Discard, io.LimitReader(httpResponse.Body, 64<<10))
+		httpResponse.Body.Close()
+	}()
+
+	log.Printf("Downstream relay %s responded with code: %d", relayURL, httpResponse.StatusCode)
+	reply := relayReply{status: httpResponse.StatusCode, contentType: httpResponse.Header.Get("Content-Type")}
+	reply.body, _ = io.ReadAll(io.LimitReader(httpResponse.Body, int64(policy.responseBytes)))
+
+	statusCode := httpResponse.StatusCode
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+		reply.retryAfter, _ = parseRetryAfter(httpResponse.Header.Get("Retry-After"))
+	}
+	if destination.successStatus != nil {
+		if !destination.successStatus.contains(statusCode) {
+			return reply, fmt.Errorf("Error - Relay returned status: %d, expected %s", statusCode, destination.successStatus)
+		}
+		return reply, nil
+	}
+	if statusCode == http.StatusTooManyRequests {
+		return reply, fmt.Errorf("%w, relay returned status: %d", errRelayRateLimited, statusCode)
+	}
+	if statusCode < 200 || statusCode >= 300 {
+		return reply, fmt.Errorf("Error - Relay returned status: %d", statusCode)
+	}
+	return reply, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// relayRate limits the forwards to each relay URL, e.g. 5/s burst 10
+type relayRate struct {
+	rate  *forwardRate
+	burst int
+	// maxWait is how long a forward may wait for the limiter before it fails
+	maxWait time.Duration
+}
+
+var errRelayRateLimited = errors.New("Relay rate limit reached")
+
+// parseRelayRate parses <count>/<period> with an optional burst, e.g. 5/s burst 10. The burst defaults to the count
+func parseRelayRate(value string) (*relayRate, error) {
+	forwards, burst, hasBurst := strings.Cut(value, "burst")
+	parsed, err := parseForwardRate(strings.TrimSpace(forwards))
+	if err != nil {
+		return nil, err
+	}
+	limit := &relayRate{rate: parsed, burst: parsed.count}
+	if hasBurst {
+		if limit.burst, err = strconv.Atoi(strings.TrimSpace(burst)); err != nil || limit.burst <= 0 {
+			return nil, fmt.Errorf("invalid burst %q", burst)
+		}
+	}
+	return limit, nil
+}
+
+func (limit *relayRate) String() string {
+	return fmt.Sprintf("%s, burst %d, waiting up to %s", limit.rate, limit.burst, limit.maxWait)
+}
+
+// relayLimiter is the limiter of a relay URL with how long forwards waited for it
+type relayLimiter struct {
+	limiter        *rate.Limiter
+	Delayed        int64   `json:"delayed"`
+	Rejected       int64   `json:"rejected"`
+	WaitedSeconds  float64 `json:"waited_seconds"`
+	MaxWaitSeconds float64 `json:"max_wait_seconds"`
+}
+
+type relayLimiters struct {
+	mutex    sync.Mutex
+	limiters map[string]*relayLimiter
+}
+
+var relayRateLimiters = &relayLimiters{limiters: map[string]*relayLimiter{}}
+
+// wait blocks until the relay URL's limiter allows a forward. Fails right away when that would take longer than the
+// maximum wait
+func (limiters *relayLimiters) wait(ctx context.Context, relayURL string, limit *relayRate) error {
+	if limit == nil {
+		return nil
+	}
+	every := rate.Limit(float64(limit.rate.count) / limit.rate.period.Seconds())
+	limiters.mutex.Lock()
+	state, found := limiters.limiters[relayURL]
+	if !found {
+		state = &relayLimiter{limiter: rate.NewLimiter(every, limit.burst)}
+		limiters.limiters[relayURL] = state
+	} else if state.limiter.Limit() != every || state.limiter.Burst() != limit.burst {
+		// the rate changed on reload
+		state.limiter.SetLimit(every)
+		state.limiter.SetBurst(limit.burst)
+	}
+	reservation := state.limiter.Reserve()
+	delay := reservation.Delay()
+	if !reservation.OK() || delay > limit.maxWait {
+		reservation.Cancel()
+		state.Rejected++
+		limiters.mutex.Unlock()
+		log.Printf("Relay rate of %s for %s reached, forward would wait %s", limit, relayURL, delay.Round(time.Millisecond))
+		return fmt.Errorf("%w for %s, %s", errRelayRateLimited, relayURL, limit.rate)
+	}
+	if delay > 0 {
+		state.Delayed++
+		state.WaitedSeconds += delay.Seconds()
+		state.MaxWaitSeconds = max(state.MaxWaitSeconds, delay.Seconds())
+	}
+	limiters.mutex.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	log.Printf("Waiting %s for the relay rate of %s", delay.Round(time.Millisecond), relayURL)
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
+
+func (limiters *relayLimiters) counts() map[string]relayLimiter {
+	limiters.mutex.Lock()
+	defer limiters.mutex.Unlock()
+	counts := map[string]relayLimiter{}
+	for relayURL, state := range limiters.limiters {
+		counts[relayURL] = relayLimiter{Delayed: state.Delayed, Rejected: state.Rejected, WaitedSeconds: state.WaitedSeconds, MaxWaitSeconds: state.MaxWaitSeconds}
+	}
+	return counts
+}
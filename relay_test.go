@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSleepingRelay is a relay that never answers until the end of the test
+func newSleepingRelay(t *testing.T) *httptest.Server {
+	released := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-released
+	}))
+	t.Cleanup(relay.Close)
+	t.Cleanup(func() { close(released) })
+	return relay
+}
+
+func TestRelayTimeout(t *testing.T) {
+	relay := newSleepingRelay(t)
+	serveTestConfig(t, map[string]string{"RELAY_TIMEOUT": "50ms"}, relay.URL)
+	started := time.Now()
+	response := deliver(newDelivery("package", testPackagePayload))
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("forward took %s with a 50ms timeout", elapsed)
+	}
+	if response.Code != http.StatusBadGateway || response.Header().Get("X-Filter-Reason") != reasonRelayTimeout {
+		t.Errorf("response = %d %s, want %d %s", response.Code, response.Header().Get("X-Filter-Reason"), http.StatusBadGateway, reasonRelayTimeout)
+	}
+}
+
+func TestRelayConnectionRefused(t *testing.T) {
+	relay := httptest.NewServer(http.NotFoundHandler())
+	relay.Close()
+	serveTestConfig(t, map[string]string{"RELAY_TIMEOUT": "5s"}, relay.URL)
+	response := deliver(newDelivery("package", testPackagePayload))
+	if response.Code != http.StatusBadGateway || response.Header().Get("X-Filter-Reason") != reasonRelayError {
+		t.Errorf("response = %d %s, want %d %s", response.Code, response.Header().Get("X-Filter-Reason"), http.StatusBadGateway, reasonRelayError)
+	}
+}
+
+func TestSendToRelayErrors(t *testing.T) {
+	sleeping := newSleepingRelay(t)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	tests := []struct {
+		name        string
+		relayURL    string
+		wantTimeout bool
+	}{
+		{name: "sleeping relay", relayURL: sleeping.URL, wantTimeout: true},
+		{name: "connection refused", relayURL: closed.URL, wantTimeout: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newDelivery("package", testPackagePayload)
+			destination := relayDestination{url: test.relayURL, timeout: 50 * time.Millisecond}
+			_, err := sendToRelay(request.Context(), request, destination, retryPolicy{}, []byte(testPackagePayload))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if timedOut := errors.Is(err, errRelayTimeout); timedOut != test.wantTimeout {
+				t.Errorf("error %v is a timeout: %v, want %v", err, timedOut, test.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestRelaySecretSignature(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantHeader string
+	}{
+		{name: "default header", env: map[string]string{"RELAY_SECRET": "relay-secret"}, wantHeader: "X-Hub-Signature-256"},
+		{name: "custom header", env: map[string]string{"RELAY_SECRET": "relay-secret", "RELAY_SIGNATURE_HEADER": "X-Relay-Signature"}, wantHeader: "X-Relay-Signature"},
+		{name: "trimmed body", env: map[string]string{"RELAY_SECRET": "relay-secret", "FORWARD_FIELDS": "action,package.name"}, wantHeader: "X-Hub-Signature-256"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, test.env, relay.URL)
+			if response := deliver(newDelivery("package", testPackagePayload)); response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+			}
+			forwards := relay.forwards()
+			if len(forwards) != 1 {
+				t.Fatalf("relay received %d forwards, want 1", len(forwards))
+			}
+			forward := forwards[0]
+			if test.env["FORWARD_FIELDS"] != "" && forward.body == testPackagePayload {
+				t.Fatal("FORWARD_FIELDS didn't trim the forwarded body")
+			}
+			if !verifySignature("relay-secret", forward.header.Get(test.wantHeader), []byte(forward.body)) {
+				t.Errorf("%s %q doesn't verify against the forwarded body with the relay secret", test.wantHeader, forward.header.Get(test.wantHeader))
+			}
+			if verifySignature(testSecret, forward.header.Get(test.wantHeader), []byte(forward.body)) {
+				t.Errorf("%s still holds the GitHub signature", test.wantHeader)
+			}
+		})
+	}
+}
+
+func TestRelayConnectionReuse(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var connections atomic.Int32
+			relay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+				// a body larger than the relay response kept in the reply, which has to be drained for the connection to be reused
+				w.Write(bytes.Repeat([]byte("x"), 32<<10))
+			}))
+			relay.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					connections.Add(1)
+				}
+			}
+			relay.Start()
+			defer relay.Close()
+			for range 20 {
+				request := newDelivery("package", testPackagePayload)
+				sendToRelay(request.Context(), request, relayDestination{url: relay.URL}, retryPolicy{responseBytes: 1 << 10}, []byte(testPackagePayload))
+			}
+			if opened := connections.Load(); opened != 1 {
+				t.Errorf("20 forwards opened %d connections, want 1", opened)
+			}
+		})
+	}
+}
+
+func TestRelayGzip(t *testing.T) {
+	const smallPayload = `{"action":"published","package":{"package_type":"CONTAINER"}}`
+	tests := []struct {
+		name           string
+		env            map[string]string
+		payload        string
+		wantCompressed bool
+	}{
+		{name: "payload above the threshold", env: map[string]string{"RELAY_GZIP": "true", "RELAY_GZIP_MIN_BYTES": "100"}, payload: testPackagePayload, wantCompressed: true},
+		{name: "payload below the threshold", env: map[string]string{"RELAY_GZIP": "true", "RELAY_GZIP_MIN_BYTES": "100"}, payload: smallPayload, wantCompressed: false},
+		{name: "compression disabled", env: map[string]string{"RELAY_GZIP_MIN_BYTES": "100"}, payload: testPackagePayload, wantCompressed: false},
+		{name: "re-signed payload", env: map[string]string{"RELAY_GZIP": "true", "RELAY_GZIP_MIN_BYTES": "100", "RELAY_SECRET": "relay-secret"}, payload: testPackagePayload, wantCompressed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, test.env, relay.URL)
+			if response := deliver(newDelivery("package", test.payload)); response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+			}
+			forward := relay.forwards()[0]
+			body := forward.body
+			if compressed := forward.header.Get("Content-Encoding") == "gzip"; compressed != test.wantCompressed {
+				t.Fatalf("compressed = %v, want %v", compressed, test.wantCompressed)
+			}
+			if test.wantCompressed {
+				reader, err := gzip.NewReader(strings.NewReader(forward.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressed, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decompressed)
+			}
+			if body != test.payload {
+				t.Errorf("relay received %q, want %q", body, test.payload)
+			}
+			if secret := test.env["RELAY_SECRET"]; secret != "" {
+				signature := forward.header.Get("X-Hub-Signature-256")
+				if !verifySignature(secret, signature, []byte(forward.body)) {
+					t.Error("signature doesn't verify against the raw received bytes")
+				}
+				if verifySignature(secret, signature, []byte(body)) {
+					t.Error("signature verifies against the decompressed body, want the compressed bytes signed")
+				}
+			} else if !verifySignature(testSecret, forward.header.Get("X-Hub-Signature-256"), []byte(body)) {
+				t.Error("GitHub's signature doesn't verify against the decompressed body")
+			}
+		})
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	header := http.Header{"X-Github-Delivery": {"72d3162e-cc78-11e3-81ab-4c9367dc0958"}}
+	key := idempotencyKey(header, []byte(testPackagePayload))
+	if !strings.HasPrefix(key, "72d3162e-cc78-11e3-81ab-4c9367dc0958-") {
+		t.Errorf("key %s doesn't start with the delivery ID", key)
+	}
+	if again := idempotencyKey(header.Clone(), []byte(testPackagePayload)); again != key {
+		t.Errorf("key changed from %s to %s for the same delivery", key, again)
+	}
+	if other := idempotencyKey(http.Header{"X-Github-Delivery": {"other"}}, []byte(testPackagePayload)); other == key {
+		t.Error("another delivery got the same key")
+	}
+	if rendered := idempotencyKey(header, []byte(`{"text":"rendered"}`)); rendered == key {
+		t.Error("another body of the delivery got the same key")
+	}
+	if anonymous := idempotencyKey(http.Header{}, []byte(testPackagePayload)); anonymous == "" || strings.Contains(anonymous, "-") {
+		t.Errorf("key without a delivery ID = %q, want the body hash alone", anonymous)
+	}
+}
+
+func TestIdempotencyKeyStableAcrossRetries(t *testing.T) {
+	var mutex sync.Mutex
+	var keys []string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer relay.Close()
+	serveTestConfig(t, map[string]string{"RELAY_MAX_ATTEMPTS": "3", "RELAY_RETRY_BACKOFF": "1ms"}, relay.URL)
+	request := newDelivery("package", testPackagePayload)
+	redelivery := newDelivery("package", testPackagePayload)
+	redelivery.Header.Set("X-GitHub-Delivery", request.Header.Get("X-GitHub-Delivery"))
+	for _, delivery := range []*http.Request{request, redelivery} {
+		if response := deliver(delivery); response.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(keys) != 3 {
+		t.Fatalf("relay received %d attempts, want a failed attempt, its retry and the redelivery", len(keys))
+	}
+	want := idempotencyKey(request.Header, []byte(testPackagePayload))
+	for _, key := range keys {
+		if key != want {
+			t.Errorf("Idempotency-Key = %q, want %q", key, want)
+		}
+	}
+}
+
+func TestIdempotencyHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantHeader string
+	}{
+		{name: "default header", env: nil, wantHeader: "Idempotency-Key"},
+		{name: "custom header", env: map[string]string{"IDEMPOTENCY_HEADER": "x-request-id"}, wantHeader: "X-Request-Id"},
+		{name: "disabled", env: map[string]string{"IDEMPOTENCY_HEADER": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, test.env, relay.URL)
+			request := newDelivery("package", testPackagePayload)
+			deliver(request)
+			forward := relay.forwards()[0]
+			for _, name := range []string{"Idempotency-Key", "X-Request-Id"} {
+				want := ""
+				if name == test.wantHeader {
+					want = idempotencyKey(request.Header, []byte(testPackagePayload))
+				}
+				if key := forward.header.Get(name); key != want {
+					t.Errorf("%s = %q, want %q", name, key, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyForwardHeaders(t *testing.T) {
+	inbound := http.Header{
+		"X-Github-Event":      {"package"},
+		"X-Github-Delivery":   {"delivery-1"},
+		"X-Github-Hook-Id":    {"1"},
+		"X-Hub-Signature-256": {"sha256=abc"},
+		"X-Custom":            {"custom"},
+		"Host":                {"filter.example.com"},
+		"Content-Length":      {"42"},
+		"Transfer-Encoding":   {"chunked"},
+		"Upgrade":             {"websocket"},
+		"Te":                  {"trailers"},
+		"Connection":          {"keep-alive, X-Custom"},
+		"Keep-Alive":          {"timeout=5"},
+	}
+	tests := []struct {
+		name           string
+		forwardHeaders string
+		want           []string
+	}{
+		{name: "default", forwardHeaders: "X-GitHub-*,X-Hub-Signature-256", want: []string{"X-Github-Delivery", "X-Github-Event", "X-Github-Hook-Id", "X-Hub-Signature-256"}},
+		{name: "allowlist", forwardHeaders: "X-GitHub-Event,X-GitHub-Delivery,X-GitHub-Hook-ID", want: []string{"X-Github-Delivery", "X-Github-Event", "X-Github-Hook-Id"}},
+		{name: "case insensitive", forwardHeaders: "x-github-event", want: []string{"X-Github-Event"}},
+		{name: "empty list", forwardHeaders: "", want: nil},
+		{name: "hop-by-hop, Host and Content-Length excluded whatever the patterns", forwardHeaders: "*", want: []string{"X-Github-Delivery", "X-Github-Event", "X-Github-Hook-Id", "X-Hub-Signature-256"}},
+		{name: "headers named by Connection excluded", forwardHeaders: "X-Custom", want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patterns, err := newGlobList(test.forwardHeaders)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outbound := http.Header{}
+			copyForwardHeaders(outbound, inbound, patterns)
+			var copied []string
+			for key, values := range outbound {
+				copied = append(copied, key)
+				if !slices.Equal(values, inbound[key]) {
+					t.Errorf("%s = %v, want %v", key, values, inbound[key])
+				}
+			}
+			slices.Sort(copied)
+			if !slices.Equal(copied, test.want) {
+				t.Errorf("copied %v, want %v", copied, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardHeadersInvalid(t *testing.T) {
+	t.Setenv("FORWARD_HEADERS", "X-GitHub-[")
+	if _, err := loadFilterConfig(); err == nil || !strings.Contains(err.Error(), "FORWARD_HEADERS") {
+		t.Errorf("expected a FORWARD_HEADERS error, got %v", err)
+	}
+}
+
+func TestRelayForwardHeaders(t *testing.T) {
+	relay := newTestRelay(t, http.StatusOK)
+	serveTestConfig(t, map[string]string{"FORWARD_HEADERS": "X-GitHub-Event,X-GitHub-Delivery"}, relay.URL)
+	request := newDelivery("package", testPackagePayload)
+	request.Header.Set("X-Custom", "custom")
+	if response := deliver(request); response.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+	}
+	header := relay.forwards()[0].header
+	if got := header.Get("X-GitHub-Event"); got != "package" {
+		t.Errorf("X-GitHub-Event = %q, want package", got)
+	}
+	if got, want := header.Get("X-GitHub-Delivery"), request.Header.Get("X-GitHub-Delivery"); got != want {
+		t.Errorf("X-GitHub-Delivery = %q, want %q", got, want)
+	}
+	for _, name := range []string{"X-GitHub-Hook-ID", "X-Custom"} {
+		if got := header.Get(name); got != "" {
+			t.Errorf("%s = %q, want it left out", name, got)
+		}
+	}
+}
+
+func TestRelayUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{name: "default", want: "Go WebHook Filter"},
+		{name: "configured", userAgent: "acme-webhooks/1.0", want: "acme-webhooks/1.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := relayUserAgent
+			t.Cleanup(func() { relayUserAgent = previous })
+			if err := useRelayClient(t, map[string]string{"RELAY_USER_AGENT": test.userAgent}); err != nil {
+				t.Fatal(err)
+			}
+			relay := newTestRelay(t, http.StatusOK)
+			serveTestConfig(t, nil, relay.URL)
+			request := newDelivery("package", testPackagePayload)
+			request.Header.Set("User-Agent", "GitHub-Hookshot/abc")
+			if response := deliver(request); response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", response.Code, http.StatusOK)
+			}
+			if got := relay.forwards()[0].header.Get("User-Agent"); got != test.want {
+				t.Errorf("User-Agent = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate with its key, signed by parent or self-signed when parent is nil
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+// writeFiles writes the PEM certificate and key to the directory and returns their paths
+func (cert *testCertificate) writeFiles(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (cert *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}
+}
+
+// useRelayClient builds the relay client from the environment variables and forwards with it until the end of the test
+func useRelayClient(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	client, err := newRelayClient(nil)
+	if err != nil {
+		return err
+	}
+	previous := relayClient
+	relayClient = client
+	t.Cleanup(func() { relayClient = previous })
+	return nil
+}
+
+func TestRelayMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "relay CA", nil)
+	otherCA := newTestCertificate(t, "other CA", nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	clientCert, clientKey := newTestCertificate(t, "filter", ca).writeFiles(t, dir, "client")
+	untrustedCert, untrustedKey := newTestCertificate(t, "filter", otherCA).writeFiles(t, dir, "untrusted")
+
+	relay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+	relay.TLS = &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "relay", ca).tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	relay.StartTLS()
+	defer relay.Close()
+	otherRelay := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	otherRelay.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "relay", otherCA).tlsCertificate()}}
+	otherRelay.StartTLS()
+	defer otherRelay.Close()
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		relayURL string
+		wantErr  bool
+	}{
+		{name: "client certificate signed by the relay CA", env: map[string]string{"RELAY_CLIENT_CERT": clientCert, "RELAY_CLIENT_KEY": clientKey, "RELAY_CA_FILE": caFile}, relayURL: relay.URL},
+		{name: "no client certificate", env: map[string]string{"RELAY_CA_FILE": caFile}, relayURL: relay.URL, wantErr: true},
+		{name: "client certificate of another CA", env: map[string]string{"RELAY_CLIENT_CERT": untrustedCert, "RELAY_CLIENT_KEY": untrustedKey, "RELAY_CA_FILE": caFile}, relayURL: relay.URL, wantErr: true},
+		{name: "relay certificate outside the pinned CA", env: map[string]string{"RELAY_CA_FILE": caFile}, relayURL: otherRelay.URL, wantErr: true},
+		{name: "relay certificate outside the system pool", env: map[string]string{}, relayURL: otherRelay.URL, wantErr: true},
+		{name: "relay certificate not verified", env: map[string]string{"RELAY_INSECURE_SKIP_VERIFY": "true"}, relayURL: otherRelay.URL},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := useRelayClient(t, test.env); err != nil {
+				t.Fatal(err)
+			}
+			request := newDelivery("package", testPackagePayload)
+			_, err := sendToRelay(request.Context(), request, relayDestination{url: test.relayURL, timeout: 5 * time.Second}, retryPolicy{}, []byte(testPackagePayload))
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelayTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCertificate(t, "filter", nil).writeFiles(t, dir, "client")
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "certificate without key", env: map[string]string{"RELAY_CLIENT_CERT": certFile}},
+		{name: "key without certificate", env: map[string]string{"RELAY_CLIENT_KEY": keyFile}},
+		{name: "missing certificate file", env: map[string]string{"RELAY_CLIENT_CERT": filepath.Join(dir, "missing.crt"), "RELAY_CLIENT_KEY": keyFile}},
+		{name: "key file without a key", env: map[string]string{"RELAY_CLIENT_CERT": certFile, "RELAY_CLIENT_KEY": notPEM}},
+		{name: "missing CA file", env: map[string]string{"RELAY_CA_FILE": filepath.Join(dir, "missing.pem")}},
+		{name: "CA file without certificates", env: map[string]string{"RELAY_CA_FILE": notPEM}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := useRelayClient(t, test.env); err == nil {
+				t.Error("expected the relay client to fail to load")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Reason codes returned in the X-Filter-Reason header and the reason field of the JSON response body
+const (
+	reasonForwarded           = "forwarded"
+	reasonForwardAccepted     = "forward_accepted"
+	reasonRelayError          = "relay_error"
+	reasonSignatureInvalid    = "signature_invalid"
+	reasonBadRequest          = "bad_request"
+	reasonInvalidPayload      = "invalid_payload"
+	reasonSchemaInvalid       = "schema_invalid"
+	reasonEventNotAllowed     = "event_not_allowed"
+	reasonEventActionFiltered = "event_action_filtered"
+	reasonHookFiltered        = "hook_filtered"
+	reasonHookTargetFiltered  = "hook_target_filtered"
+	reasonRepoFiltered        = "repo_filtered"
+	reasonOrgFiltered         = "org_filtered"
+	reasonVisibilityFiltered  = "visibility_filtered"
+	reasonTopicFiltered       = "topic_filtered"
+	reasonSenderFiltered      = "sender_filtered"
+	reasonPackageTypeFiltered = "package_type_filtered"
+	reasonPackageNameFiltered = "package_name_filtered"
+	reasonOwnerFiltered       = "owner_filtered"
+	reasonActionFiltered      = "action_filtered"
+	reasonPackageDeleted      = "package_deleted"
+	reasonTagFiltered         = "tag_filtered"
+	reasonArtifactFiltered    = "artifact_filtered"
+	reasonNamespaceFiltered   = "namespace_filtered"
+	reasonVersionFiltered     = "version_filtered"
+	reasonRefFiltered         = "ref_filtered"
+	reasonWorkflowFiltered    = "workflow_filtered"
+	reasonReleaseFiltered     = "release_filtered"
+	reasonPullRequestFiltered = "pull_request_filtered"
+	reasonRuleFiltered        = "rule_filtered"
+	reasonPipelineFiltered    = "pipeline_filtered"
+	reasonJSONPathFiltered    = "jsonpath_filtered"
+	reasonFieldFiltered       = "field_filtered"
+	reasonExpressionFiltered  = "expression_filtered"
+	reasonExpressionError     = "expression_error"
+	reasonCommandFiltered     = "command_filtered"
+	reasonCommandError        = "command_error"
+	reasonScriptFiltered      = "script_filtered"
+	reasonScriptError         = "script_error"
+	reasonPayloadTooLarge     = "payload_too_large"
+	reasonOutsideWindow       = "outside_window"
+	reasonDuplicateSuppressed = "duplicate_suppressed"
+	reasonRateLimited         = "rate_limited"
+	reasonQueueFull           = "queue_full"
+	reasonCircuitOpen         = "circuit_open"
+	reasonRelayTimeout        = "relay_timeout"
+	reasonRelayRateLimited    = "relay_rate_limited"
+	reasonTemplateError       = "template_error"
+)
+
+// filterReason explains why a request was not forwarded
+type filterReason struct {
+	Code   string `json:"reason"`
+	Detail string `json:"detail"`
+}
+
+func filtered(code string, format string, args ...any) *filterReason {
+	return &filterReason{Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+// respondFiltered answers 200 for a filtered out request, so GitHub doesn't count it as a failed delivery
+func respondFiltered(responseWriter http.ResponseWriter, filters *filterConfig, reason *filterReason) {
+	if filters.dryRun {
+		respondDryRun(responseWriter, "would-drop", reason)
+		return
+	}
+	respondReason(responseWriter, reason, http.StatusOK)
+}
+
+// respondError answers with the status code and a JSON body holding the reason code and message
+func respondError(responseWriter http.ResponseWriter, code string, msg string, status int) {
+	respondReason(responseWriter, &filterReason{Code: code, Detail: msg}, status)
+}
+
+// respondFailed answers a request that can't be filtered with the error status, or in dry run reports the failure as a
+// would-drop verdict so the dry run always answers 200
+func respondFailed(responseWriter http.ResponseWriter, filters *filterConfig, code string, msg string, status int) {
+	if filters.dryRun {
+		respondDryRun(responseWriter, "would-drop", &filterReason{Code: code, Detail: msg})
+		return
+	}
+	respondError(responseWriter, code, msg, status)
+}
+
+// failureReasons are the reason codes of requests that failed rather than were filtered out, which GitHub redelivers
+var failureReasons = newStringSet([]string{reasonBadRequest, reasonSignatureInvalid, reasonInvalidPayload, reasonSchemaInvalid,
+	reasonExpressionError, reasonCommandError, reasonScriptError, reasonTemplateError, reasonRelayError})
+
+// respondDryRun reports the filter verdict without forwarding to the relay
+func respondDryRun(responseWriter http.ResponseWriter, verdict string, reason *filterReason) {
+	log.Printf("Dry run verdict %s", verdict)
+	responseWriter.Header().Set("X-Filter-Verdict", verdict)
+	respondReason(responseWriter, reason, http.StatusOK)
+}
+
+// respondReason logs the detail and answers with the status, the reason code in the X-Filter-Reason header and a JSON
+// body holding the reason code and detail. Every response that doesn't come from the relay goes through it
+func respondReason(responseWriter http.ResponseWriter, reason *filterReason, status int) {
+	log.Printf("%s", reason.Detail)
+	responseWriter.Header().Set("X-Filter-Reason", reason.Code)
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	json.NewEncoder(responseWriter).Encode(reason)
+}
+
+// responseCapture keeps a copy of the status, headers and body a handler responded with, passing the response on to
+// the wrapped ResponseWriter
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// newResponseCapture captures the response of a request handled in-process, such as a redelivery or a test payload,
+// that no client reads
+func newResponseCapture() *responseCapture {
+	return &responseCapture{ResponseWriter: discardedResponse{header: http.Header{}}}
+}
+
+func (capture *responseCapture) WriteHeader(status int) {
+	if capture.status == 0 {
+		capture.status = status
+		capture.header = capture.ResponseWriter.Header().Clone()
+	}
+	capture.ResponseWriter.WriteHeader(status)
+}
+
+func (capture *responseCapture) Write(content []byte) (int, error) {
+	if capture.status == 0 {
+		capture.WriteHeader(http.StatusOK)
+	}
+	capture.body.Write(content)
+	return capture.ResponseWriter.Write(content)
+}
+
+// discardedResponse is the ResponseWriter of a response only captured
+type discardedResponse struct {
+	header http.Header
+}
+
+func (response discardedResponse) Header() http.Header {
+	return response.header
+}
+
+func (discardedResponse) WriteHeader(int) {}
+
+func (discardedResponse) Write(content []byte) (int, error) {
+	return len(content), nil
+}
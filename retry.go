@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy decides how a forward is sent to a relay, and how often and how long it is retried when it fails
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	// budget bounds the total time spent on all attempts, 0 for no bound
+	budget time.Duration
+	// timeout bounds each attempt of destinations without their own timeout, 0 for no bound
+	timeout time.Duration
+	breaker breakerPolicy
+	// failover decides when destinations with a failover URL forward to it first
+	failover failoverPolicy
+	// rate is nil when forwards to relay URLs are not rate limited
+	rate *relayRate
+	// headers selects the inbound headers copied onto the forward
+	headers globList
+	// responseBytes caps the relay response body kept for RELAY_RESPONSE_PASSTHROUGH
+	responseBytes int
+	// gzipMinBytes is the size from which forwards are gzip-compressed, 0 when they never are
+	gzipMinBytes int
+	// relayHeaders are set on every forward, overriding the default headers
+	relayHeaders map[string]string
+	// secret re-signs forwards in signatureHeader when set
+	secret          string
+	signatureHeader string
+	// cloudEventsMode wraps forwards in a CloudEvents envelope when set, empty for the raw payload
+	cloudEventsMode string
+	// maxRetryAfter caps the Retry-After delay honored before retrying
+	maxRetryAfter time.Duration
+	// idempotencyHeader carries the idempotency key of forwards, empty when it isn't sent
+	idempotencyHeader string
+}
+
+// send forwards to the destination, retrying network errors and 5xx or 429 responses with exponential backoff and
+// jitter, or after the relay's Retry-After, until the attempts or the time budget run out. Returns the outcome of the
+// last attempt
+func (policy retryPolicy) send(ctx context.Context, request *http.Request, destination relayDestination, requestBody []byte) (reply relayReply, err error) {
+	started := time.Now()
+	if destination.timeout == 0 {
+		destination.timeout = policy.timeout
+	}
+	if destination.balance != nil {
+		return policy.sendBalanced(ctx, request, destination, requestBody)
+	}
+	if destination.body != nil {
+		requestBody = destination.body
+	}
+	if destination.retry != nil {
+		policy = destination.retry.apply(policy)
+	}
+	if destination.hedge != nil {
+		return policy.sendHedged(ctx, request, destination, requestBody)
+	}
+	if destination.failover != "" {
+		return policy.sendFailover(ctx, request, destination, requestBody)
+	}
+	attempts := 0
+	defer func() {
+		deliveryLog.relayed(request.Header.Get("X-GitHub-Delivery"), destination.url, attempts, reply.status, err)
+		pagerDuty.relayOutcome(destination.url, reply.status, err)
+	}()
+	for attempt := 1; ; attempt++ {
+		attempts = attempt
+		if !circuitBreakers.allow(destination.url, policy.breaker) {
+			log.Printf("Circuit of %s is open, not forwarding", destination.url)
+			return relayReply{}, errCircuitOpen
+		}
+		if err := relayRateLimiters.wait(ctx, destination.url, policy.rate); err != nil {
+			circuitBreakers.release(destination.url, policy.breaker)
+			return relayReply{}, err
+		}
+		reply, err = sendToRelay(ctx, request, destination, policy, requestBody)
+		circuitBreakers.record(destination.url, policy.breaker, err == nil || !retryableStatus(reply.status))
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Attempt %d/%d to %s succeeded", attempt, policy.maxAttempts, destination.url)
+			}
+			return reply, nil
+		}
+		if attempt >= policy.maxAttempts || !retryableStatus(reply.status) || ctx.Err() != nil {
+			if policy.maxAttempts > 1 {
+				log.Printf("Attempt %d/%d to %s failed, giving up: %v", attempt, policy.maxAttempts, destination.url, err)
+			}
+			return reply, err
+		}
+		// full jitter between half and all of the exponential delay
+		delay := policy.backoff << (attempt - 1)
+		delay = delay/2 + rand.N(delay/2+1)
+		if reply.retryAfter > 0 {
+			delay = policy.retryAfterDelay(reply)
+			log.Printf("Relay %s responded %d with Retry-After, backing off for %s", destination.url, reply.status, delay)
+		}
+		if policy.budget > 0 && time.Since(started)+delay > policy.budget {
+			log.Printf("Attempt %d/%d to %s failed, retry budget of %s exhausted: %v", attempt, policy.maxAttempts, destination.url, policy.budget, err)
+			return reply, err
+		}
+		log.Printf("Attempt %d/%d to %s failed, retrying in %s: %v", attempt, policy.maxAttempts, destination.url, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return reply, err
+		}
+	}
+}
+
+// retryAfterDelay is the Retry-After delay of the reply, capped at maxRetryAfter
+func (policy retryPolicy) retryAfterDelay(reply relayReply) time.Duration {
+	return min(reply.retryAfter, policy.maxRetryAfter)
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(time.Until(date), 0), true
+}
+
+// retryableStatus reports whether a forward that failed with the status is retried. Status 0 is a network error
+func retryableStatus(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// relayHedge sends a forward to a second relay URL as well when the first one hasn't succeeded within delay
+type relayHedge struct {
+	url   string
+	delay time.Duration
+}
+
+// newRelayHedge returns the hedge to hedgeURL after hedgeDelay, 2s when empty. Returns nil without hedgeURL
+func newRelayHedge(hedgeURL string, hedgeDelay string) (*relayHedge, error) {
+	if hedgeURL == "" {
+		if hedgeDelay != "" {
+			return nil, fmt.Errorf("hedge_delay needs a hedge_url")
+		}
+		return nil, nil
+	}
+	hedge := &relayHedge{url: hedgeURL, delay: 2 * time.Second}
+	if hedgeDelay != "" {
+		var err error
+		if hedge.delay, err = time.ParseDuration(hedgeDelay); err != nil || hedge.delay < 0 {
+			return nil, fmt.Errorf("hedge delay must be a positive duration, got %q", hedgeDelay)
+		}
+	}
+	return hedge, nil
+}
+
+// hedgedOutcome is the result of the primary or hedge forward
+type hedgedOutcome struct {
+	url   string
+	reply relayReply
+	err   error
+}
+
+// sendHedged forwards to the destination, and to its hedge URL too once the hedge delay passed or the primary failed.
+// The first success wins and cancels the other forward. Both forwards carry X-Filter-Hedge and the delivery ID in
+// X-Filter-Dedupe-Key so the relays can drop the duplicate. Returns the last failure when both fail
+func (policy retryPolicy) sendHedged(ctx context.Context, request *http.Request, destination relayDestination, requestBody []byte) (relayReply, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	outcomes := make(chan hedgedOutcome, 2)
+	launch := func(url string, role string) {
+		target := destination
+		target.url, target.hedge = url, nil
+		target.headers = maps.Clone(destination.headers)
+		if target.headers == nil {
+			target.headers = map[string]string{}
+		}
+		target.headers["X-Filter-Hedge"] = role
+		target.headers["X-Filter-Dedupe-Key"] = request.Header.Get("X-GitHub-Delivery")
+		go func() {
+			reply, err := policy.send(ctx, request, target, requestBody)
+			outcomes <- hedgedOutcome{url: url, reply: reply, err: err}
+		}()
+	}
+	launch(destination.url, "primary")
+	timer := time.NewTimer(destination.hedge.delay)
+	defer timer.Stop()
+	hedgeAfter, pending := timer.C, 1
+	var last hedgedOutcome
+	for {
+		select {
+		case <-hedgeAfter:
+			log.Printf("%s hasn't answered within %s, hedging to %s", destination.url, destination.hedge.delay, destination.hedge.url)
+			hedgeAfter = nil
+			launch(destination.hedge.url, "hedge")
+			pending++
+		case outcome := <-outcomes:
+			pending--
+			if outcome.err == nil {
+				if outcome.url == destination.hedge.url {
+					log.Printf("Hedge %s answered first for %s", outcome.url, destination.url)
+				}
+				return outcome.reply, nil
+			}
+			last = outcome
+			if hedgeAfter != nil {
+				log.Printf("%s failed, hedging to %s right away: %v", destination.url, destination.hedge.url, outcome.err)
+				hedgeAfter = nil
+				launch(destination.hedge.url, "hedge")
+				pending++
+				continue
+			}
+			if pending == 0 {
+				return last.reply, last.err
+			}
+			log.Printf("Hedged forward to %s failed, waiting for the other: %v", outcome.url, outcome.err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hedgeRelay answers with its status after its delay, unless the forward is canceled first
+type hedgeRelay struct {
+	*httptest.Server
+	name     string
+	mutex    sync.Mutex
+	received []http.Header
+	canceled bool
+}
+
+func newHedgeRelay(t *testing.T, name string, delay time.Duration, status int) *hedgeRelay {
+	relay := &hedgeRelay{name: name}
+	relay.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the cancellation of the forward is only noticed once its body was read
+		io.ReadAll(r.Body)
+		relay.mutex.Lock()
+		relay.received = append(relay.received, r.Header.Clone())
+		relay.mutex.Unlock()
+		select {
+		case <-time.After(delay):
+			w.WriteHeader(status)
+			w.Write([]byte(name))
+		case <-r.Context().Done():
+			relay.mutex.Lock()
+			relay.canceled = true
+			relay.mutex.Unlock()
+		}
+	}))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+func (relay *hedgeRelay) forwards() []http.Header {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return relay.received
+}
+
+// waitCanceled reports whether the relay saw its forward canceled within a second
+func (relay *hedgeRelay) waitCanceled() bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		relay.mutex.Lock()
+		canceled := relay.canceled
+		relay.mutex.Unlock()
+		if canceled {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSendHedged(t *testing.T) {
+	const hedgeDelay = 50 * time.Millisecond
+	tests := []struct {
+		name          string
+		primaryDelay  time.Duration
+		primaryStatus int
+		hedgeDelay    time.Duration
+		hedgeStatus   int
+		wantErr       bool
+		wantServedBy  string
+		wantHedged    bool
+		wantCanceled  string
+	}{
+		{name: "primary answers before the hedge delay", primaryStatus: http.StatusOK, hedgeStatus: http.StatusOK, wantServedBy: "primary"},
+		{name: "both succeed, hedge first", primaryDelay: 2 * time.Second, primaryStatus: http.StatusOK, hedgeStatus: http.StatusOK, wantServedBy: "hedge", wantHedged: true, wantCanceled: "primary"},
+		{name: "both succeed, primary first after the hedge fired", primaryDelay: 150 * time.Millisecond, primaryStatus: http.StatusOK, hedgeDelay: 2 * time.Second, hedgeStatus: http.StatusOK, wantServedBy: "primary", wantHedged: true, wantCanceled: "hedge"},
+		{name: "hedge fails, primary succeeds after it", primaryDelay: 150 * time.Millisecond, primaryStatus: http.StatusOK, hedgeStatus: http.StatusInternalServerError, wantServedBy: "primary", wantHedged: true},
+		{name: "both fail", primaryDelay: 100 * time.Millisecond, primaryStatus: http.StatusInternalServerError, hedgeStatus: http.StatusInternalServerError, wantErr: true, wantHedged: true},
+		{name: "primary fails before the hedge delay", primaryStatus: http.StatusInternalServerError, hedgeStatus: http.StatusOK, wantServedBy: "hedge", wantHedged: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary := newHedgeRelay(t, "primary", test.primaryDelay, test.primaryStatus)
+			hedge := newHedgeRelay(t, "hedge", test.hedgeDelay, test.hedgeStatus)
+			policy := loadTestFilters(t, nil).retry
+			policy.responseBytes = 64
+			request := newDelivery("package", testPackagePayload)
+			destination := relayDestination{url: primary.URL, hedge: &relayHedge{url: hedge.URL, delay: hedgeDelay}}
+			reply, err := policy.send(request.Context(), request, destination, []byte(testPackagePayload))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if servedBy := string(reply.body); !test.wantErr && servedBy != test.wantServedBy {
+				t.Errorf("served by %s, want %s", servedBy, test.wantServedBy)
+			}
+			if hedged := len(hedge.forwards()) == 1; hedged != test.wantHedged {
+				t.Errorf("hedge received %d forwards, want hedged %v", len(hedge.forwards()), test.wantHedged)
+			}
+			if len(primary.forwards()) != 1 {
+				t.Errorf("primary received %d forwards, want 1", len(primary.forwards()))
+			}
+			for _, relay := range []*hedgeRelay{primary, hedge} {
+				if relay.name == test.wantCanceled && !relay.waitCanceled() {
+					t.Errorf("forward to the %s wasn't canceled", relay.name)
+				}
+			}
+		})
+	}
+}
+
+func TestSendHedgedHeaders(t *testing.T) {
+	primary := newHedgeRelay(t, "primary", 2*time.Second, http.StatusOK)
+	hedge := newHedgeRelay(t, "hedge", 0, http.StatusOK)
+	request := newDelivery("package", testPackagePayload)
+	destination := relayDestination{url: primary.URL, hedge: &relayHedge{url: hedge.URL, delay: 10 * time.Millisecond}, headers: map[string]string{"X-Custom": "kept"}}
+	if _, err := loadTestFilters(t, nil).retry.send(request.Context(), request, destination, []byte(testPackagePayload)); err != nil {
+		t.Fatal(err)
+	}
+	deliveryID := request.Header.Get("X-GitHub-Delivery")
+	for role, relay := range map[string]*hedgeRelay{"primary": primary, "hedge": hedge} {
+		header := relay.forwards()[0]
+		if header.Get("X-Filter-Hedge") != role || header.Get("X-Filter-Dedupe-Key") != deliveryID || header.Get("X-Custom") != "kept" {
+			t.Errorf("%s headers = %v, want role %s, dedupe key %s and the destination headers", role, header, role, deliveryID)
+		}
+	}
+	if len(destination.headers) != 1 {
+		t.Errorf("hedging changed the destination headers: %v", destination.headers)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// route is a webhook endpoint with its own filters, relay URL and shared secret
+type route struct {
+	path string
+	// relayURLs receive every forwarded event
+	relayURLs []string
+	secret    string
+	filters   *filterConfig
+}
+
+var routesFile = flag.String("routes", "", "YAML routes file declaring webhook paths with their own filters and relay URL. When unset, every path uses the environment variable configuration")
+
+type routesFileContent struct {
+	Routes []routesFileRoute `yaml:"routes"`
+}
+
+type routesFileRoute struct {
+	Path          string `yaml:"path"`
+	RelayURL      string `yaml:"relay_url"`
+	RelayURLs     string `yaml:"relay_urls"`
+	Secret        string `yaml:"secret"`
+	Events        string `yaml:"events"`
+	PackageTypes  string `yaml:"package_types"`
+	TagRegex      string `yaml:"tag_regex"`
+	RepoAllowlist string `yaml:"repo_allowlist"`
+	RepoDenylist  string `yaml:"repo_denylist"`
+}
+
+// loadRoutes reads the routes file. Settings missing from a route are inherited from the base route, and secrets
+// may reference environment variables as ${NAME}
+func loadRoutes(fileName string, base *route) (map[string]*route, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file routesFileContent
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	loaded := map[string]*route{}
+	for index, fileRoute := range file.Routes {
+		newRoute, err := newRoute(fileRoute, base)
+		if err != nil {
+			return nil, fmt.Errorf("route #%d (%s): %w", index+1, fileRoute.Path, err)
+		}
+		if _, found := loaded[newRoute.path]; found {
+			return nil, fmt.Errorf("route #%d (%s): duplicate path", index+1, fileRoute.Path)
+		}
+		loaded[newRoute.path] = newRoute
+	}
+	return loaded, nil
+}
+
+func newRoute(fileRoute routesFileRoute, base *route) (*route, error) {
+	if fileRoute.Path == "" || fileRoute.Path[0] != '/' {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	if fileRoute.Path == "/health" || fileRoute.Path == "/ready" || fileRoute.Path == "/stats/filters" || fileRoute.Path == "/dlq" || strings.HasPrefix(fileRoute.Path, "/dlq/") ||
+		strings.HasPrefix(fileRoute.Path, "/admin/") || fileRoute.Path == "/deliveries" || strings.HasPrefix(fileRoute.Path, "/deliveries/") {
+		return nil, fmt.Errorf("path %s is reserved", fileRoute.Path)
+	}
+	config := *base.filters
+	newRoute := &route{path: fileRoute.Path, relayURLs: base.relayURLs, secret: base.secret, filters: &config}
+	if relayURLs := parseList(fileRoute.RelayURL + "," + fileRoute.RelayURLs); len(relayURLs) > 0 {
+		newRoute.relayURLs = relayURLs
+	}
+	if fileRoute.Secret != "" {
+		newRoute.secret = os.ExpandEnv(fileRoute.Secret)
+	}
+	if (len(newRoute.relayURLs) == 0 && config.sinks[redisStreamSinkName] == nil) || newRoute.secret == "" {
+		return nil, fmt.Errorf("missing relay_url or secret and no WEBHOOKRELAY_URL/RELAY_URLS or GITHUB_WEBHOOK_SECRET to fall back to")
+	}
+
+	var err error
+	if fileRoute.Events != "" {
+		config.events = newStringSet(parseList(fileRoute.Events))
+	}
+	if fileRoute.PackageTypes != "" {
+		config.packageTypes = newPackageTypeSet(fileRoute.PackageTypes)
+	}
+	if fileRoute.TagRegex != "" {
+		if config.tagRegex, err = regexp.Compile(fileRoute.TagRegex); err != nil {
+			return nil, fmt.Errorf("tag_regex: %w", err)
+		}
+	}
+	if fileRoute.RepoAllowlist != "" {
+		if config.repoAllowlist, err = newGlobList(fileRoute.RepoAllowlist); err != nil {
+			return nil, fmt.Errorf("repo_allowlist: %w", err)
+		}
+	}
+	if fileRoute.RepoDenylist != "" {
+		if config.repoDenylist, err = newGlobList(fileRoute.RepoDenylist); err != nil {
+			return nil, fmt.Errorf("repo_denylist: %w", err)
+		}
+	}
+	return newRoute, nil
+}
+
+func describeRoute(route *route) string {
+	return fmt.Sprintf("Route %s forwards to %s with package types: %s, repository allowlist: %s", route.path, strings.Join(route.relayURLs, ", "), route.filters.packageTypes, route.filters.repoAllowlist)
+}
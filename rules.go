@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ruleSet is an ordered list of rules loaded from the rules file. The first matching rule decides the verdict
+type ruleSet struct {
+	rules        []filterRule
+	defaultAllow bool
+}
+
+// filterRule forwards or drops events matching its condition
+type filterRule struct {
+	name      string
+	condition ruleCondition
+	allow     bool
+	// destination is nil when the rule forwards to the route's relay URLs
+	destination *relayDestination
+	// notify is the severity of the PagerDuty event sent for matching deliveries, empty when the rule doesn't notify
+	notify string
+}
+
+// ruleCondition is a node of a rule's condition tree. matches appends the leaf conditions that matched to matched
+type ruleCondition interface {
+	matches(eventType string, event *PackageEvent, matched *[]string) bool
+}
+
+// allCondition matches when every child matches. An empty group matches
+type allCondition []ruleCondition
+
+// anyCondition matches when at least one child matches. An empty group never matches
+type anyCondition []ruleCondition
+
+// leafCondition is a single condition such as repo: myorg/*
+type leafCondition struct {
+	source string
+	test   func(eventType string, event *PackageEvent) bool
+}
+
+type rulesFileContent struct {
+	Default string          `yaml:"default"`
+	Rules   []rulesFileRule `yaml:"rules"`
+}
+
+type rulesFileRule struct {
+	Name               string    `yaml:"name"`
+	Match              yaml.Node `yaml:"match"`
+	Verdict            string    `yaml:"verdict"`
+	Destination        string    `yaml:"destination"`
+	Sink               string    `yaml:"sink"`
+	Notify             string    `yaml:"notify"`
+	NotifySeverity     string    `yaml:"notify_severity"`
+	destinationOptions `yaml:",inline"`
+}
+
+// destinationOptions are the settings of a rule or pipeline destination
+type destinationOptions struct {
+	Headers      map[string]string `yaml:"headers"`
+	Timeout      string            `yaml:"timeout"`
+	BodyTemplate string            `yaml:"body_template"`
+	HedgeURL     string            `yaml:"hedge_url"`
+	HedgeDelay   string            `yaml:"hedge_delay"`
+	FailoverURL  string            `yaml:"failover_url"`
+	// BalanceURLs are balanced with the destination URL, BalanceWeights follow the order of both
+	Balance        string   `yaml:"balance"`
+	BalanceURLs    []string `yaml:"balance_urls"`
+	BalanceWeights []int    `yaml:"balance_weights"`
+}
+
+func loadRules(fileName string, sinks sinkSet) (*ruleSet, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFileContent
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	set := &ruleSet{}
+	if set.defaultAllow, err = parseVerdict(file.Default, "deny"); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	for index, fileRule := range file.Rules {
+		rule, err := newFilterRule(fileRule, sinks)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d (%s): %w", index+1, fileRule.Name, err)
+		}
+		set.rules = append(set.rules, rule)
+	}
+	return set, nil
+}
+
+func newFilterRule(fileRule rulesFileRule, sinks sinkSet) (filterRule, error) {
+	rule := filterRule{name: fileRule.Name}
+	if rule.name == "" {
+		return rule, fmt.Errorf("missing name")
+	}
+	var err error
+	if rule.allow, err = parseVerdict(fileRule.Verdict, ""); err != nil {
+		return rule, err
+	}
+	if rule.destination, err = newRuleDestination(fileRule.Destination, fileRule.destinationOptions); err != nil {
+		return rule, err
+	}
+	if fileRule.Sink != "" {
+		if fileRule.Destination != "" {
+			return rule, fmt.Errorf("destination and sink are exclusive")
+		}
+		if rule.destination, err = sinks.destination(fileRule.Sink); err != nil {
+			return rule, err
+		}
+	}
+	if rule.notify, err = parseNotify(fileRule.Notify, fileRule.NotifySeverity); err != nil {
+		return rule, err
+	}
+	if fileRule.Match.Kind == 0 {
+		rule.condition = allCondition{}
+		return rule, nil
+	}
+	rule.condition, err = parseRuleCondition(&fileRule.Match)
+	return rule, err
+}
+
+// parseRuleCondition parses a mapping of conditions, all of which must match. The all and any keys hold a list of
+// nested condition mappings
+func parseRuleCondition(node *yaml.Node) (ruleCondition, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: conditions must be a mapping", node.Line)
+	}
+	var conditions allCondition
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		switch key {
+		case "all", "any":
+			if value.Kind != yaml.SequenceNode {
+				return nil, fmt.Errorf("line %d: %s must be a list of conditions", value.Line, key)
+			}
+			var group []ruleCondition
+			for _, item := range value.Content {
+				child, err := parseRuleCondition(item)
+				if err != nil {
+					return nil, err
+				}
+				group = append(group, child)
+			}
+			if key == "all" {
+				conditions = append(conditions, allCondition(group))
+			} else {
+				conditions = append(conditions, anyCondition(group))
+			}
+		default:
+			if value.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: %s must be a string", value.Line, key)
+			}
+			leaf, err := newLeafCondition(key, value.Value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", value.Line, err)
+			}
+			conditions = append(conditions, leaf)
+		}
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return conditions, nil
+}
+
+func newLeafCondition(key string, value string) (*leafCondition, error) {
+	leaf := &leafCondition{source: key + "=" + value}
+	switch key {
+	case "event":
+		events := newStringSet(parseList(value))
+		leaf.test = func(eventType string, event *PackageEvent) bool { return events.allows(eventType) }
+	case "package_type":
+		packageTypes := newPackageTypeSet(value)
+		leaf.test = func(eventType string, event *PackageEvent) bool {
+			return packageTypes.allows(normalizePackageType(event.Package.PackageType))
+		}
+	case "repo":
+		repos, err := newGlobList(value)
+		if err != nil {
+			return nil, fmt.Errorf("repo: %w", err)
+		}
+		leaf.test = func(eventType string, event *PackageEvent) bool {
+			_, matched := repos.match(event.Repository.FullName)
+			return len(repos) == 0 || matched
+		}
+	case "action":
+		actions := newStringSet(parseList(value))
+		leaf.test = func(eventType string, event *PackageEvent) bool { return actions.allows(event.Action) }
+	case "tag":
+		tagRegex, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("tag: %w", err)
+		}
+		leaf.test = func(eventType string, event *PackageEvent) bool { return tagRegex.MatchString(event.containerTag()) }
+	default:
+		return nil, fmt.Errorf("unknown condition %q", key)
+	}
+	return leaf, nil
+}
+
+func (leaf *leafCondition) matches(eventType string, event *PackageEvent, matched *[]string) bool {
+	if !leaf.test(eventType, event) {
+		return false
+	}
+	*matched = append(*matched, leaf.source)
+	return true
+}
+
+func (group allCondition) matches(eventType string, event *PackageEvent, matched *[]string) bool {
+	for _, condition := range group {
+		if !condition.matches(eventType, event, matched) {
+			return false
+		}
+	}
+	return true
+}
+
+func (group anyCondition) matches(eventType string, event *PackageEvent, matched *[]string) bool {
+	for _, condition := range group {
+		mark := len(*matched)
+		if condition.matches(eventType, event, matched) {
+			return true
+		}
+		// drop leaves that matched inside a child group that failed as a whole
+		*matched = (*matched)[:mark]
+	}
+	return false
+}
+
+// newRuleDestination builds the destination of a rule or pipeline. Returns nil when no destination URL is given, in
+// which case no destination options are allowed
+func newRuleDestination(url string, options destinationOptions) (*relayDestination, error) {
+	if url == "" {
+		if len(options.Headers) > 0 || options.Timeout != "" || options.BodyTemplate != "" || options.HedgeURL != "" || options.HedgeDelay != "" || options.FailoverURL != "" ||
+			options.Balance != "" || len(options.BalanceURLs) > 0 || len(options.BalanceWeights) > 0 {
+			return nil, fmt.Errorf("headers, timeout, body_template, hedge_url, failover_url and balance_urls need a destination")
+		}
+		return nil, nil
+	}
+	destination := &relayDestination{url: url, headers: options.Headers}
+	var err error
+	if options.Timeout != "" {
+		if destination.timeout, err = time.ParseDuration(options.Timeout); err != nil {
+			return nil, fmt.Errorf("timeout: %w", err)
+		}
+	}
+	if options.BodyTemplate != "" {
+		if destination.template, err = parseBodyTemplate(options.BodyTemplate); err != nil {
+			return nil, fmt.Errorf("body_template: %w", err)
+		}
+	}
+	if destination.hedge, err = newRelayHedge(options.HedgeURL, options.HedgeDelay); err != nil {
+		return nil, err
+	}
+	if err := validateFailoverURL(options.FailoverURL, destination.hedge); err != nil {
+		return nil, err
+	}
+	destination.failover = options.FailoverURL
+	if len(options.BalanceURLs) == 0 {
+		if options.Balance != "" || len(options.BalanceWeights) > 0 {
+			return nil, fmt.Errorf("balance and balance_weights need balance_urls")
+		}
+		return destination, nil
+	}
+	strategy, err := parseBalanceStrategy(options.Balance)
+	if err != nil {
+		return nil, err
+	}
+	if destination.balance, err = newRelayBalance(strategy, append([]string{url}, options.BalanceURLs...), options.BalanceWeights); err != nil {
+		return nil, fmt.Errorf("balance_urls: %w", err)
+	}
+	return destination, nil
+}
+
+// parseNotify returns the PagerDuty severity of a rule with notify: pagerduty, warning by default, or an empty severity
+// when the rule doesn't notify
+func parseNotify(notify string, severity string) (string, error) {
+	switch notify {
+	case "":
+		if severity != "" {
+			return "", fmt.Errorf("notify_severity needs notify: pagerduty")
+		}
+		return "", nil
+	case "pagerduty":
+	default:
+		return "", fmt.Errorf("notify must be pagerduty, got %q", notify)
+	}
+	if os.Getenv("PAGERDUTY_ROUTING_KEY") == "" {
+		return "", fmt.Errorf("notify: pagerduty needs PAGERDUTY_ROUTING_KEY")
+	}
+	switch severity {
+	case "":
+		return pagerDutyWarning, nil
+	case pagerDutyCritical, pagerDutyError, pagerDutyWarning, pagerDutyInfo:
+		return severity, nil
+	}
+	return "", fmt.Errorf("notify_severity must be critical, error, warning or info, got %q", severity)
+}
+
+func parseVerdict(verdict string, fallback string) (bool, error) {
+	if verdict == "" {
+		verdict = fallback
+	}
+	switch verdict {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+	return false, fmt.Errorf("verdict must be allow or deny, got %q", verdict)
+}
+
+func verdictName(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// evaluate walks the rules top-down and returns the name of the deciding rule, whether the event is forwarded, the
+// rule's own destination, if any, and the PagerDuty severity of the rule's notification, empty when it doesn't notify
+func (set *ruleSet) evaluate(eventType string, event *PackageEvent) (string, bool, *relayDestination, string) {
+	for _, rule := range set.rules {
+		var matched []string
+		if rule.condition.matches(eventType, event, &matched) {
+			log.Printf("Rule %s matched on [%s], verdict: %s", rule.name, strings.Join(matched, ", "), verdictName(rule.allow))
+			return rule.name, rule.allow, rule.destination, rule.notify
+		}
+	}
+	log.Printf("No rule matched, default verdict: %s", verdictName(set.defaultAllow))
+	return "default", set.defaultAllow, nil, ""
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseTestCondition parses the condition mapping of a rule's match key
+func parseTestCondition(t *testing.T, source string) ruleCondition {
+	t.Helper()
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(source), &document); err != nil {
+		t.Fatal(err)
+	}
+	condition, err := parseRuleCondition(document.Content[0])
+	if err != nil {
+		t.Fatalf("parsing %s: %v", source, err)
+	}
+	return condition
+}
+
+// nestedCondition is (repo in acme/* AND (tag matches ^v OR action is updated)) OR repo in partner/*, for package events
+const nestedCondition = `
+all:
+  - event: package
+  - any:
+      - all:
+          - repo: acme/*
+          - any:
+              - tag: ^v
+              - action: updated
+      - repo: partner/*
+`
+
+func TestRuleConditionNesting(t *testing.T) {
+	tests := []struct {
+		name        string
+		eventType   string
+		payload     string
+		wantMatch   bool
+		wantMatched []string
+	}{
+		{name: "third level first branch", eventType: "package",
+			payload:     `{"action":"published","repository":{"full_name":"acme/app"},"package":{"package_version":{"container_metadata":{"tag":{"name":"v1"}}}}}`,
+			wantMatch:   true,
+			wantMatched: []string{"event=package", "repo=acme/*", "tag=^v"}},
+		{name: "third level second branch", eventType: "package",
+			payload:     `{"action":"updated","repository":{"full_name":"acme/app"},"package":{"package_version":{"container_metadata":{"tag":{"name":"dev"}}}}}`,
+			wantMatch:   true,
+			wantMatched: []string{"event=package", "repo=acme/*", "action=updated"}},
+		{name: "third level failing drops the leaves of its group", eventType: "package",
+			payload:   `{"action":"published","repository":{"full_name":"acme/app"},"package":{"package_version":{"container_metadata":{"tag":{"name":"dev"}}}}}`,
+			wantMatch: false},
+		{name: "second level alternative", eventType: "package",
+			payload:     `{"action":"published","repository":{"full_name":"partner/app"}}`,
+			wantMatch:   true,
+			wantMatched: []string{"event=package", "repo=partner/*"}},
+		{name: "top level failing", eventType: "push",
+			payload:   `{"action":"published","repository":{"full_name":"partner/app"}}`,
+			wantMatch: false},
+	}
+	condition := parseTestCondition(t, nestedCondition)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var event PackageEvent
+			if err := json.Unmarshal([]byte(test.payload), &event); err != nil {
+				t.Fatal(err)
+			}
+			var matched []string
+			if match := condition.matches(test.eventType, &event, &matched); match != test.wantMatch {
+				t.Fatalf("matches = %v, want %v", match, test.wantMatch)
+			}
+			if test.wantMatch && !slices.Equal(matched, test.wantMatched) {
+				t.Errorf("matched leaves = %v, want %v", matched, test.wantMatched)
+			}
+		})
+	}
+}
+
+func TestRuleConditionEmptyGroups(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		wantMatch bool
+	}{
+		{name: "empty all matches", condition: "all: []", wantMatch: true},
+		{name: "empty any never matches", condition: "any: []", wantMatch: false},
+		{name: "empty all nested in any", condition: "any:\n  - all: []", wantMatch: true},
+		{name: "empty any nested in all", condition: "all:\n  - any: []", wantMatch: false},
+		{name: "empty any next to a matching leaf", condition: "event: package\nany: []", wantMatch: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var matched []string
+			if match := parseTestCondition(t, test.condition).matches("package", &PackageEvent{}, &matched); match != test.wantMatch {
+				t.Errorf("matches = %v, want %v", match, test.wantMatch)
+			}
+		})
+	}
+}
+
+func TestRuleConditionShortCircuits(t *testing.T) {
+	calls := 0
+	counting := &leafCondition{source: "counted", test: func(string, *PackageEvent) bool {
+		calls++
+		return true
+	}}
+	failing := &leafCondition{source: "failing", test: func(string, *PackageEvent) bool { return false }}
+	var matched []string
+	anyCondition{counting, counting}.matches("package", &PackageEvent{}, &matched)
+	allCondition{failing, counting}.matches("package", &PackageEvent{}, &matched)
+	if calls != 1 {
+		t.Errorf("evaluated %d conditions after the verdict was known, want only the first of any", calls)
+	}
+}
+
+func TestLoadRulesFirstMatchWins(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.yaml")
+	content := `
+default: allow
+rules:
+  - name: drop-test-repos
+    match:
+      repo: acme/test-*
+    verdict: deny
+  - name: keep-acme
+    match:
+      repo: acme/*
+    verdict: allow
+`
+	if err := os.WriteFile(fileName, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRules(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for repository, want := range map[string]string{"acme/test-app": "drop-test-repos", "acme/app": "keep-acme", "other/app": "default"} {
+		event := &PackageEvent{}
+		event.Repository.FullName = repository
+		if rule, _, _, _ := rules.evaluate("package", event); rule != want {
+			t.Errorf("%s decided by %s, want %s", repository, rule, want)
+		}
+	}
+}
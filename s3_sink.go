@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3BackgroundTimeout bounds each attempt of a best effort upload
+const s3BackgroundTimeout = 30 * time.Second
+
+// s3Sink archives forwards as objects of an S3 bucket, or of S3-compatible storage such as MinIO, keyed by
+// <prefix>/<year>/<month>/<day>/<delivery ID>.json with the GitHub headers as object metadata. Credentials come from the
+// default AWS chain
+type s3Sink struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	// bestEffort uploads in the background, retrying up to attempts times, and only logs failures, so the archive never
+	// delays or fails the relay forward
+	bestEffort bool
+	attempts   int
+	// backoff is the delay before the second attempt of a best effort upload, doubling after every failed one
+	backoff time.Duration
+	// background tracks the best effort uploads still running, waited for on shutdown, closing is closed on shutdown to
+	// give up the retries waiting for their backoff
+	background sync.WaitGroup
+	closing    chan struct{}
+}
+
+func init() {
+	sinkOpeners["s3"] = openS3Sink
+}
+
+// openS3Sink opens s3://<bucket>[/<prefix>], e.g. s3://audit-archive/github. ?region= sets the region, ?endpoint=
+// overrides the S3 endpoint, e.g. for MinIO, with path-style addressing unless ?path_style=false. ?best_effort=false
+// uploads during the forward and fails like a relay, and ?attempts= bounds the attempts of best effort uploads
+func openS3Sink(destinationURL *url.URL) (sink, error) {
+	if destinationURL.Host == "" {
+		return nil, fmt.Errorf("expected s3://<bucket>[/<prefix>]")
+	}
+	query := destinationURL.Query()
+	archive := &s3Sink{bucket: destinationURL.Host, prefix: strings.Trim(destinationURL.Path, "/"), bestEffort: true, attempts: 5, backoff: time.Second, closing: make(chan struct{})}
+	endpoint := query.Get("endpoint")
+	pathStyle := endpoint != ""
+	var err error
+	for name, setting := range map[string]*bool{"best_effort": &archive.bestEffort, "path_style": &pathStyle} {
+		if value := query.Get(name); value != "" {
+			if *setting, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	if value := query.Get("attempts"); value != "" {
+		if archive.attempts, err = strconv.Atoi(value); err != nil || archive.attempts < 1 {
+			return nil, fmt.Errorf("attempts must be a positive number, got %q", value)
+		}
+	}
+	var options []func(*config.LoadOptions) error
+	if region := query.Get("region"); region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if awsConfig.Region == "" && endpoint != "" {
+		// S3-compatible storage ignores the region but the requests are signed with one
+		awsConfig.Region = "us-east-1"
+	}
+	archive.client = s3.NewFromConfig(awsConfig, func(options *s3.Options) {
+		options.HTTPClient = relayClient
+		options.UsePathStyle = pathStyle
+		if endpoint != "" {
+			options.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return archive, nil
+}
+
+func (archive *s3Sink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	delivery := request.Header.Get("X-GitHub-Delivery")
+	if delivery == "" {
+		err := fmt.Errorf("Error archiving to S3 bucket %s: no X-GitHub-Delivery ID", archive.bucket)
+		if archive.bestEffort {
+			log.Printf("%v, continuing", err)
+			return relayReply{status: http.StatusOK}, nil
+		}
+		return relayReply{status: http.StatusUnprocessableEntity}, err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(archive.bucket),
+		Key:         aws.String(path.Join(archive.prefix, time.Now().UTC().Format("2006/01/02"), delivery+".json")),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		Metadata:    map[string]string{},
+	}
+	for name, values := range request.Header {
+		if strings.HasPrefix(name, "X-Github-") && len(values) > 0 {
+			input.Metadata[strings.ToLower(name)] = values[0]
+		}
+	}
+	if !archive.bestEffort {
+		return archive.upload(ctx, input)
+	}
+	archive.background.Add(1)
+	go func() {
+		defer archive.background.Done()
+		backoff := archive.backoff
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), s3BackgroundTimeout)
+			reply, err := archive.upload(ctx, input)
+			cancel()
+			if err == nil {
+				return
+			}
+			if attempt >= archive.attempts || (reply.status >= 400 && reply.status < 500 && reply.status != http.StatusTooManyRequests) {
+				log.Printf("S3 archive of %s failed after %d attempts, continuing: %v", delivery, attempt, err)
+				return
+			}
+			log.Printf("S3 archive of %s failed, retrying in %s: %v", delivery, backoff, err)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-archive.closing:
+				timer.Stop()
+				log.Printf("S3 archive of %s given up on shutdown after %d attempts", delivery, attempt)
+				return
+			}
+			backoff *= 2
+			input.Body = bytes.NewReader(body)
+		}
+	}()
+	return relayReply{status: http.StatusAccepted}, nil
+}
+
+// upload puts the object, reporting the S3 status of failures
+func (archive *s3Sink) upload(ctx context.Context, input *s3.PutObjectInput) (relayReply, error) {
+	if _, err := archive.client.PutObject(ctx, input); err != nil {
+		reply := relayReply{}
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) {
+			reply.status = responseError.HTTPStatusCode()
+		}
+		return reply, fmt.Errorf("Error archiving to S3 bucket %s: %v", archive.bucket, err)
+	}
+	log.Printf("Archived %s to S3 bucket %s", aws.ToString(input.Key), archive.bucket)
+	return relayReply{status: http.StatusOK}, nil
+}
+
+// close gives up the retries of the best effort uploads and waits for the attempts still running, on shutdown
+func (archive *s3Sink) close() {
+	close(archive.closing)
+	archive.background.Wait()
+}
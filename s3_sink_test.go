@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 records the objects put to it, answering each put with the next status, and 200 once they're used up
+type fakeS3 struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	puts     []relayedForward
+	paths    []string
+}
+
+func newFakeS3(t *testing.T, statuses ...int) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{statuses: statuses}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fake.mutex.Lock()
+		fake.puts = append(fake.puts, relayedForward{header: r.Header.Clone(), body: string(body)})
+		fake.paths = append(fake.paths, r.URL.Path)
+		status := http.StatusOK
+		if len(fake.statuses) > 0 {
+			status, fake.statuses = fake.statuses[0], fake.statuses[1:]
+		}
+		fake.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(fake.Close)
+	// static credentials, without reading the shared AWS files of the machine
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	return fake
+}
+
+// attempts returns the object paths put so far
+func (fake *fakeS3) attempts() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string(nil), fake.paths...)
+}
+
+// waitAttempts waits for the number of puts, close giving up the retries still waiting for their backoff
+func (fake *fakeS3) waitAttempts(t *testing.T, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); len(fake.attempts()) < want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("put %d times, want %d", len(fake.attempts()), want)
+		}
+	}
+}
+
+// open opens the sink of the bucket with the query of the destination URL
+func (fake *fakeS3) open(t *testing.T, query string) *s3Sink {
+	t.Helper()
+	destinationURL, err := url.Parse("s3://audit-archive/github?endpoint=" + url.QueryEscape(fake.URL) + "&" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := openS3Sink(destinationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened.(*s3Sink)
+}
+
+func TestS3SinkObject(t *testing.T) {
+	fake := newFakeS3(t)
+	archive := fake.open(t, "best_effort=false")
+	request := newDelivery("package", testPackagePayload)
+	reply, err := archive.send(t.Context(), request, []byte(testPackagePayload))
+	if err != nil || reply.status != http.StatusOK {
+		t.Fatalf("send = %d, %v, want %d", reply.status, err, http.StatusOK)
+	}
+	archive.close()
+
+	wantPath := "/audit-archive/github/" + time.Now().UTC().Format("2006/01/02") + "/" + request.Header.Get("X-GitHub-Delivery") + ".json"
+	if paths := fake.attempts(); len(paths) != 1 || paths[0] != wantPath {
+		t.Fatalf("put %v, want %s", paths, wantPath)
+	}
+	fake.mutex.Lock()
+	put := fake.puts[0]
+	fake.mutex.Unlock()
+	if put.body != testPackagePayload {
+		t.Errorf("object = %s, want the payload", put.body)
+	}
+	if contentType := put.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	for _, name := range []string{"X-GitHub-Event", "X-GitHub-Delivery", "X-GitHub-Hook-ID"} {
+		if got, want := put.header.Get("X-Amz-Meta-"+name), request.Header.Get(name); got != want {
+			t.Errorf("metadata %s = %q, want %q", name, got, want)
+		}
+	}
+	if signature := put.header.Get("X-Amz-Meta-X-Hub-Signature-256"); signature != "" {
+		t.Errorf("expected only the X-GitHub-* headers as metadata, got the signature %s", signature)
+	}
+}
+
+func TestS3SinkStrictFailure(t *testing.T) {
+	fake := newFakeS3(t, http.StatusForbidden)
+	archive := fake.open(t, "best_effort=false")
+	reply, err := archive.send(t.Context(), newDelivery("package", testPackagePayload), []byte(testPackagePayload))
+	if err == nil || reply.status != http.StatusForbidden {
+		t.Errorf("send = %d, %v, want a %d error", reply.status, err, http.StatusForbidden)
+	}
+	archive.close()
+}
+
+func TestS3SinkBestEffort(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+	}{
+		{name: "uploaded", wantAttempts: 1},
+		{name: "retried until uploaded", statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, wantAttempts: 3},
+		{name: "given up after the attempts", statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests}, wantAttempts: 3},
+		{name: "client error not retried", statuses: []int{http.StatusForbidden}, wantAttempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3(t, test.statuses...)
+			archive := fake.open(t, "attempts=3")
+			archive.backoff = time.Millisecond
+			reply, err := archive.send(t.Context(), newDelivery("package", testPackagePayload), []byte(testPackagePayload))
+			if err != nil || reply.status != http.StatusAccepted {
+				t.Fatalf("send = %d, %v, want %d whatever the upload", reply.status, err, http.StatusAccepted)
+			}
+			fake.waitAttempts(t, test.wantAttempts)
+			archive.close()
+			paths := fake.attempts()
+			if len(paths) != test.wantAttempts {
+				t.Fatalf("put %d times, want %d", len(paths), test.wantAttempts)
+			}
+			fake.mutex.Lock()
+			defer fake.mutex.Unlock()
+			for index, put := range fake.puts {
+				if put.body != testPackagePayload || paths[index] != paths[0] {
+					t.Errorf("attempt %d put %s to %s, want the payload to %s again", index+1, put.body, paths[index], paths[0])
+				}
+			}
+		})
+	}
+}
+
+func TestS3SinkCloseDuringBackoff(t *testing.T) {
+	fake := newFakeS3(t, http.StatusTooManyRequests)
+	archive := fake.open(t, "")
+	archive.backoff = time.Hour
+	archive.send(t.Context(), newDelivery("package", testPackagePayload), []byte(testPackagePayload))
+	fake.waitAttempts(t, 1)
+	closed := make(chan struct{})
+	go func() {
+		archive.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected close to give up the retry waiting for its backoff")
+	}
+	if attempts := len(fake.attempts()); attempts != 1 {
+		t.Errorf("put %d times, want 1", attempts)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// payloadSchemas maps an event type to the JSON Schema its payloads are validated against
+type payloadSchemas map[string]*jsonschema.Schema
+
+// loadPayloadSchemas compiles every <event type>.json file of dir
+func loadPayloadSchemas(dir string) (payloadSchemas, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.json schema files in %s", dir)
+	}
+	compiler := jsonschema.NewCompiler()
+	schemas := payloadSchemas{}
+	for _, file := range files {
+		schema, err := compiler.Compile(file)
+		if err != nil {
+			return nil, err
+		}
+		schemas[canonicalEventType(strings.TrimSuffix(filepath.Base(file), ".json"))] = schema
+	}
+	return schemas, nil
+}
+
+// validate checks the payload against the schema of the event type. Event types without a schema always pass
+func (schemas payloadSchemas) validate(eventType string, body []byte) error {
+	schema, found := schemas[eventType]
+	if !found {
+		return nil
+	}
+	payload, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return schema.Validate(payload)
+}
+
+func (schemas payloadSchemas) String() string {
+	eventTypes := make([]string, 0, len(schemas))
+	for eventType := range schemas {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	return strings.Join(eventTypes, ",")
+}
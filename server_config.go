@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+// serverConfig is the configuration snapshot used to serve requests. It is replaced as a whole on reload so
+// in-flight requests keep a consistent view
+type serverConfig struct {
+	defaultRoute *route
+	// routes maps request paths to their route. When nil, defaultRoute serves every path
+	routes map[string]*route
+	// adminToken is the bearer token of the admin endpoints, which are disabled when empty
+	adminToken string
+}
+
+var currentConfig atomic.Pointer[serverConfig]
+
+// loadServerConfig builds a configuration snapshot from the environment, rules file and routes file
+func loadServerConfig() (*serverConfig, error) {
+	webhookSecret := os.Getenv("GITHUB_WEBHOOK_SECRET")
+	relayURLs := parseList(os.Getenv("WEBHOOKRELAY_URL") + "," + os.Getenv("RELAY_URLS"))
+	if *routesFile == "" && (webhookSecret == "" || (len(relayURLs) == 0 && redisStreamURL() == "" && *pipelinesFile == "")) {
+		return nil, fmt.Errorf("missing required environment variables")
+	}
+	filters, err := loadFilterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter configuration: %w", err)
+	}
+	config := &serverConfig{defaultRoute: &route{path: "/", relayURLs: relayURLs, secret: webhookSecret, filters: filters}, adminToken: os.Getenv("ADMIN_TOKEN")}
+	if *routesFile != "" {
+		if config.routes, err = loadRoutes(*routesFile, config.defaultRoute); err != nil {
+			return nil, fmt.Errorf("invalid routes file %s: %w", *routesFile, err)
+		}
+	}
+	routes := []*route{config.defaultRoute}
+	for _, route := range config.routes {
+		routes = append(routes, route)
+	}
+	for _, route := range routes {
+		if route.filters.balanceStrategy != "" && len(route.relayURLs) > 1 {
+			if _, err := newRelayBalance(route.filters.balanceStrategy, route.relayURLs, route.filters.balanceWeights); err != nil {
+				return nil, fmt.Errorf("RELAY_BALANCE of route %s: %w", route.path, err)
+			}
+		}
+	}
+	for _, relayURL := range config.relayURLs() {
+		if isTemplatedRelayURL(relayURL) {
+			if _, err := expandRelayURL(relayURL, nil, nil); err != nil {
+				return nil, fmt.Errorf("invalid relay URL %s: %w", relayURL, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// lookupRoute returns the route serving path, or nil when routes are configured and none matches
+func (config *serverConfig) lookupRoute(path string) *route {
+	if config.routes == nil {
+		return config.defaultRoute
+	}
+	return config.routes[path]
+}
+
+// describe summarizes the configuration, one setting per line. Secrets are never included
+func (config *serverConfig) describe() []string {
+	lines := []string{fmt.Sprintf("URL: %s", strings.Join(config.defaultRoute.relayURLs, ", "))}
+	lines = append(lines, describeFilterConfig(config.defaultRoute.filters)...)
+	var routeLines []string
+	for _, route := range config.routes {
+		routeLines = append(routeLines, describeRoute(route))
+	}
+	sort.Strings(routeLines)
+	return append(lines, routeLines...)
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP. A configuration that fails to load is logged and the
+// previous one stays active
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("Received SIGHUP, reloading configuration")
+		if *loadEnvFile {
+			if err := godotenv.Overload("variables.env"); err != nil {
+				log.Printf("Error when loading environment variables: %v\n", err)
+			}
+		}
+		config, err := loadServerConfig()
+		if err != nil {
+			log.Printf("Reload failed, keeping previous configuration: %v", err)
+			continue
+		}
+		previous := currentConfig.Swap(config)
+		logConfigChanges(previous.describe(), config.describe())
+	}
+}
+
+func logConfigChanges(previous []string, current []string) {
+	changed := false
+	for _, line := range previous {
+		if !slices.Contains(current, line) {
+			log.Printf("Reload removed: %s", line)
+			changed = true
+		}
+	}
+	for _, line := range current {
+		if !slices.Contains(previous, line) {
+			log.Printf("Reload added: %s", line)
+			changed = true
+		}
+	}
+	if !changed {
+		log.Printf("Reload complete, configuration unchanged")
+		return
+	}
+	log.Printf("Reload complete")
+}
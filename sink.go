@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sink delivers forwards to a destination that isn't an HTTP relay. The scheme of the destination URL selects the
+// sink, so sinks can be used wherever a relay URL can, with the same retries, circuit breaker and dead-letter queue
+type sink interface {
+	// send delivers the body with the inbound request headers. Like sendToRelay, the reply status decides whether a
+	// failure is retried: 0 and 5xx are, 4xx aren't
+	send(ctx context.Context, request *http.Request, body []byte) (relayReply, error)
+}
+
+// closingSink is a sink holding connections or buffered messages to release on shutdown
+type closingSink interface {
+	close()
+}
+
+// readySink is a sink that can report it can't deliver, e.g. while disconnected from its server
+type readySink interface {
+	ready() error
+}
+
+// sinkOpeners open the sink of a destination URL, by URL scheme
+var sinkOpeners = map[string]func(destinationURL *url.URL) (sink, error){}
+
+// openSinks caches the sinks by destination URL so their connections are reused
+var openSinks = struct {
+	mutex sync.Mutex
+	sinks map[string]sink
+}{sinks: map[string]sink{}}
+
+// sinkFor returns the sink of the destination URL, or nil when it is an HTTP relay URL
+func sinkFor(destinationURL string) (sink, error) {
+	parsed, err := url.Parse(destinationURL)
+	if err != nil {
+		return nil, err
+	}
+	open, found := sinkOpeners[parsed.Scheme]
+	if !found {
+		return nil, nil
+	}
+	openSinks.mutex.Lock()
+	defer openSinks.mutex.Unlock()
+	if opened, found := openSinks.sinks[destinationURL]; found {
+		return opened, nil
+	}
+	opened, err := open(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s destination %s: %w", parsed.Scheme, parsed.Redacted(), err)
+	}
+	openSinks.sinks[destinationURL] = opened
+	return opened, nil
+}
+
+// handleReady responds 200 when the sinks of the configured destinations can deliver, 503 listing those that can't
+// otherwise
+func handleReady(responseWriter http.ResponseWriter, request *http.Request) {
+	var failures []string
+	for _, destinationURL := range currentConfig.Load().relayURLs() {
+		destinationSink, err := sinkFor(destinationURL)
+		if err == nil && destinationSink != nil {
+			if checked, ok := destinationSink.(readySink); ok {
+				err = checked.ready()
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", redactURL(destinationURL), err))
+		}
+	}
+	if len(failures) > 0 {
+		http.Error(responseWriter, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	responseWriter.Write([]byte("OK"))
+}
+
+// redactURL hides the password of a destination URL
+func redactURL(destinationURL string) string {
+	if parsed, err := url.Parse(destinationURL); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return destinationURL
+}
+
+// closeSinks flushes and closes the open sinks, on shutdown
+func closeSinks() {
+	openSinks.mutex.Lock()
+	defer openSinks.mutex.Unlock()
+	for destinationURL, opened := range openSinks.sinks {
+		if closing, ok := opened.(closingSink); ok {
+			closing.close()
+		}
+		delete(openSinks.sinks, destinationURL)
+	}
+}
+
+// retryAfterPause holds back every delivery to a rate limited destination until its Retry-After ends
+type retryAfterPause struct {
+	mutex       sync.Mutex
+	pausedUntil time.Time
+}
+
+// pause holds back deliveries for the delay, unless an earlier pause lasts longer
+func (limit *retryAfterPause) pause(delay time.Duration) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	if until := time.Now().Add(delay); until.After(limit.pausedUntil) {
+		limit.pausedUntil = until
+	}
+}
+
+// wait waits until the pause ends, failing right away when it outlasts the context deadline
+func (limit *retryAfterPause) wait(ctx context.Context) error {
+	limit.mutex.Lock()
+	wait := time.Until(limit.pausedUntil)
+	limit.mutex.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	if deadline, found := ctx.Deadline(); found && time.Until(deadline) < wait {
+		return fmt.Errorf("Retry-After of %s exceeds the forward timeout", wait.Round(time.Second))
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
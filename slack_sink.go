@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackSink posts a message rendered from the event to a Slack incoming webhook
+type slackSink struct {
+	webhookURL string
+	text       *fieldTemplate
+	// blocks sends the message as Block Kit section and context blocks besides the plain text
+	blocks bool
+	// bestEffort logs failures and reports the forward as delivered, so Slack never fails the relay forward
+	bestEffort bool
+	// rateLimit holds back messages for the Retry-After of Slack's last 429
+	rateLimit retryAfterPause
+}
+
+func init() {
+	sinkOpeners["slack"] = openSlackSink
+}
+
+// slackEscaper escapes the characters Slack reserves for links and mentions in message text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// openSlackSink opens slack://hooks.slack.com/services/<webhook path>?text=<template>, posting to the https webhook
+// URL. ?blocks=true sends Block Kit blocks and ?best_effort=false makes Slack failures fail the forward
+func openSlackSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	if destinationURL.Host == "" || strings.Trim(destinationURL.Path, "/") == "" || query.Get("text") == "" {
+		return nil, fmt.Errorf("expected slack://<webhook host>/<webhook path>?text=<template>")
+	}
+	text, err := parseFieldTemplate(query.Get("text"))
+	if err != nil {
+		return nil, err
+	}
+	notifier := &slackSink{text: text, bestEffort: true}
+	for name, setting := range map[string]*bool{"blocks": &notifier.blocks, "best_effort": &notifier.bestEffort} {
+		if value := query.Get(name); value != "" {
+			if *setting, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	webhookURL := url.URL{Scheme: "https", Host: destinationURL.Host, Path: destinationURL.Path}
+	notifier.webhookURL = webhookURL.String()
+	return notifier, nil
+}
+
+func (notifier *slackSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	reply, err := notifier.post(ctx, request, body)
+	if err != nil && notifier.bestEffort {
+		log.Printf("Slack notification of %s failed, continuing: %v", request.Header.Get("X-GitHub-Delivery"), err)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	return reply, err
+}
+
+// post sends the message, waiting out Slack's Retry-After on 429 responses as long as the context allows
+func (notifier *slackSink) post(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	text, err := notifier.text.render(request.Header, body, slackEscaper.Replace)
+	if err != nil {
+		return relayReply{status: http.StatusUnprocessableEntity}, fmt.Errorf("Error rendering Slack message: %v", err)
+	}
+	message := map[string]any{"text": text}
+	if notifier.blocks {
+		message["blocks"] = []map[string]any{
+			{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			{"type": "context", "elements": []map[string]string{{"type": "mrkdwn", "text": slackEscaper.Replace(fmt.Sprintf("%s delivery %s", request.Header.Get("X-GitHub-Event"), request.Header.Get("X-GitHub-Delivery")))}}},
+		}
+	}
+	encoded, _ := json.Marshal(message)
+	for {
+		if err := notifier.rateLimit.wait(ctx); err != nil {
+			return relayReply{status: http.StatusTooManyRequests}, fmt.Errorf("Slack rate limit: %v", err)
+		}
+		newRequest, _ := http.NewRequestWithContext(ctx, "POST", notifier.webhookURL, bytes.NewReader(encoded))
+		newRequest.Header.Set("User-Agent", relayUserAgent)
+		newRequest.Header.Set("Content-Type", "application/json")
+		httpResponse, err := relayClient.Do(newRequest)
+		if err != nil {
+			return relayReply{}, fmt.Errorf("Error posting to Slack: %v", err)
+		}
+		reply := relayReply{status: httpResponse.StatusCode, contentType: httpResponse.Header.Get("Content-Type")}
+		reply.body, _ = io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+		httpResponse.Body.Close()
+		if httpResponse.StatusCode == http.StatusTooManyRequests {
+			delay, found := parseRetryAfter(httpResponse.Header.Get("Retry-After"))
+			if !found || delay < time.Second {
+				delay = time.Second
+			}
+			log.Printf("Slack rate limited, retrying after %s", delay)
+			notifier.rateLimit.pause(delay)
+			continue
+		}
+		if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+			return reply, fmt.Errorf("Error - Slack returned status %d: %s", httpResponse.StatusCode, reply.body)
+		}
+		log.Printf("Posted Slack notification of %s", request.Header.Get("X-GitHub-Delivery"))
+		return reply, nil
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sqsMaxMessageBytes is the SQS limit on the size of a message, body and attributes included
+const sqsMaxMessageBytes = 256 * 1024
+
+// sqsAttributes maps the message attributes set on every message to the inbound header they come from
+var sqsAttributes = map[string]string{"delivery_id": "X-GitHub-Delivery", "event_type": "X-GitHub-Event", "hook_id": "X-GitHub-Hook-ID"}
+
+// sqsSink sends forwards as messages to an SQS queue, with the payload as message body. Credentials come from the
+// default AWS chain
+type sqsSink struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func init() {
+	sinkOpeners["sqs"] = openSQSSink
+}
+
+// openSQSSink opens sqs://<queue host>/<account>/<queue>, e.g. sqs://sqs.eu-west-1.amazonaws.com/123456789012/events.
+// The region is taken from the host unless set with ?region=, and ?endpoint= overrides the SQS endpoint
+func openSQSSink(destinationURL *url.URL) (sink, error) {
+	if destinationURL.Host == "" || strings.Count(destinationURL.Path, "/") != 2 {
+		return nil, fmt.Errorf("expected sqs://<queue host>/<account>/<queue>")
+	}
+	query := destinationURL.Query()
+	region := query.Get("region")
+	if labels := strings.Split(destinationURL.Hostname(), "."); region == "" && len(labels) > 2 && labels[0] == "sqs" {
+		region = labels[1]
+	}
+	var options []func(*config.LoadOptions) error
+	if region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	queueURL := "https://" + destinationURL.Host + destinationURL.Path
+	endpoint := query.Get("endpoint")
+	if endpoint != "" {
+		queueURL = strings.TrimSuffix(endpoint, "/") + destinationURL.Path
+	}
+	client := sqs.NewFromConfig(awsConfig, func(options *sqs.Options) {
+		options.HTTPClient = relayClient
+		if endpoint != "" {
+			options.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return &sqsSink{client: client, queueURL: queueURL}, nil
+}
+
+func (queue *sqsSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	input := &sqs.SendMessageInput{QueueUrl: aws.String(queue.queueURL), MessageBody: aws.String(string(body)), MessageAttributes: map[string]types.MessageAttributeValue{}}
+	size := len(body)
+	for attribute, header := range sqsAttributes {
+		if value := request.Header.Get(header); value != "" {
+			input.MessageAttributes[attribute] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+			size += len(attribute) + len("String") + len(value)
+		}
+	}
+	if size > sqsMaxMessageBytes {
+		return relayReply{status: http.StatusRequestEntityTooLarge}, fmt.Errorf("Error - Message of %d bytes exceeds the SQS limit of %d bytes", size, sqsMaxMessageBytes)
+	}
+	output, err := queue.client.SendMessage(ctx, input)
+	if err != nil {
+		reply := relayReply{}
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) {
+			reply.status = responseError.HTTPStatusCode()
+		}
+		return reply, fmt.Errorf("Error sending message to SQS queue %s: %v", queue.queueURL, err)
+	}
+	log.Printf("SQS queue %s accepted message %s", queue.queueURL, aws.ToString(output.MessageId))
+	return relayReply{status: http.StatusOK, contentType: "application/json", body: fmt.Appendf(nil, `{"message_id":%q}`, aws.ToString(output.MessageId))}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// filterScript is a Starlark script defining filter(event, payload, headers). The function returns "forward", "drop"
+// or a dict with a verdict and optionally a reason and a relay_url overriding the route relay URL
+type filterScript struct {
+	file     string
+	function starlark.Callable
+	maxSteps uint64
+}
+
+// scriptVerdict is the outcome of a filter script run
+type scriptVerdict struct {
+	forward  bool
+	reason   string
+	relayURL string
+}
+
+// loadFilterScript runs the script once at startup and looks up its filter function
+func loadFilterScript(file string, maxSteps uint64) (*filterScript, error) {
+	thread := &starlark.Thread{Name: file, Print: func(_ *starlark.Thread, msg string) { log.Printf("%s: %s", file, msg) }}
+	predeclared := starlark.StringDict{"json": starlarkjson.Module}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, file, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	function, ok := globals["filter"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s does not define a filter(event, payload, headers) function", file)
+	}
+	return &filterScript{file: file, function: function, maxSteps: maxSteps}, nil
+}
+
+// run calls the filter function with the decoded payload. Each run is limited to maxSteps execution steps
+func (script *filterScript) run(eventType string, headers http.Header, body []byte) (*scriptVerdict, error) {
+	thread := &starlark.Thread{Name: script.file, Print: func(_ *starlark.Thread, msg string) { log.Printf("%s: %s", script.file, msg) }}
+	payload, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(body)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	headerDict := starlark.NewDict(len(headers))
+	for key := range headers {
+		headerDict.SetKey(starlark.String(strings.ToLower(key)), starlark.String(headers.Get(key)))
+	}
+	// the budget only covers the script, not decoding the payload
+	thread.SetMaxExecutionSteps(thread.ExecutionSteps() + script.maxSteps)
+	result, err := starlark.Call(thread, script.function, starlark.Tuple{starlark.String(eventType), payload, headerDict}, nil)
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			log.Printf("Filter script %s failed:\n%s", script.file, evalErr.Backtrace())
+		}
+		return nil, err
+	}
+	return parseScriptVerdict(result)
+}
+
+func parseScriptVerdict(result starlark.Value) (*scriptVerdict, error) {
+	switch result := result.(type) {
+	case starlark.String:
+		return newScriptVerdict(string(result))
+	case *starlark.Dict:
+		value, found, _ := result.Get(starlark.String("verdict"))
+		verdictName, ok := value.(starlark.String)
+		if !found || !ok {
+			return nil, fmt.Errorf("returned dict has no verdict string")
+		}
+		verdict, err := newScriptVerdict(string(verdictName))
+		if err != nil {
+			return nil, err
+		}
+		for key, field := range map[string]*string{"reason": &verdict.reason, "relay_url": &verdict.relayURL} {
+			if value, found, _ := result.Get(starlark.String(key)); found {
+				text, ok := value.(starlark.String)
+				if !ok {
+					return nil, fmt.Errorf("returned %s must be a string, got %s", key, value.Type())
+				}
+				*field = string(text)
+			}
+		}
+		return verdict, nil
+	}
+	return nil, fmt.Errorf("filter must return forward, drop or a dict, got %s", result.Type())
+}
+
+func newScriptVerdict(name string) (*scriptVerdict, error) {
+	switch name {
+	case "forward":
+		return &scriptVerdict{forward: true}, nil
+	case "drop":
+		return &scriptVerdict{}, nil
+	}
+	return nil, fmt.Errorf("verdict must be forward or drop, got %q", name)
+}
+
+func (script *filterScript) String() string {
+	return script.file
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// builtinFiltersPassed is the statistics key of events that passed every environment variable filter. Events dropped
+// by one of these filters are counted under the reason code of that filter
+const builtinFiltersPassed = "filters_passed"
+
+// filterCounters counts the outcome of the events a rule or event type decided
+type filterCounters struct {
+	Matched   int64 `json:"matched"`
+	Forwarded int64 `json:"forwarded"`
+	Dropped   int64 `json:"dropped"`
+}
+
+// filterStats holds the counters per rule name and per event type. Rules are keyed by name so their counters carry
+// over a rules reload
+type filterStats struct {
+	mutex     sync.Mutex
+	rules     map[string]*filterCounters
+	events    map[string]*filterCounters
+	pipelines map[string]*filterCounters
+}
+
+var filterStatistics = newFilterStats()
+
+func newFilterStats() *filterStats {
+	return &filterStats{rules: map[string]*filterCounters{}, events: map[string]*filterCounters{}, pipelines: map[string]*filterCounters{}}
+}
+
+func (stats *filterStats) record(eventType string, rule string, forwarded bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	counterFor(stats.rules, rule).count(forwarded)
+	counterFor(stats.events, eventType).count(forwarded)
+}
+
+// recordPipeline counts an event matched by a pipeline, forwarded when every destination accepted it
+func (stats *filterStats) recordPipeline(name string, forwarded bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	counterFor(stats.pipelines, name).count(forwarded)
+}
+
+// recordEvent counts an event dispatched to the pipelines, forwarded when at least one pipeline forwarded it
+func (stats *filterStats) recordEvent(eventType string, forwarded bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	counterFor(stats.events, eventType).count(forwarded)
+}
+
+func (counters *filterCounters) count(forwarded bool) {
+	counters.Matched++
+	if forwarded {
+		counters.Forwarded++
+	} else {
+		counters.Dropped++
+	}
+}
+
+func counterFor(counters map[string]*filterCounters, key string) *filterCounters {
+	if counters[key] == nil {
+		counters[key] = &filterCounters{}
+	}
+	return counters[key]
+}
+
+func (stats *filterStats) reset() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.rules = map[string]*filterCounters{}
+	stats.events = map[string]*filterCounters{}
+	stats.pipelines = map[string]*filterCounters{}
+}
+
+// handleFilterStats responds the counters as JSON on GET and resets them on POST, which requires ADMIN_TOKEN as bearer
+// token
+func handleFilterStats(responseWriter http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if !authorizeAdmin(responseWriter, request) {
+			return
+		}
+		filterStatistics.reset()
+		log.Printf("Filter statistics reset")
+	default:
+		responseWriter.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filterStatistics.mutex.Lock()
+	defer filterStatistics.mutex.Unlock()
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(map[string]any{
+		"rules":         filterStatistics.rules,
+		"events":        filterStatistics.events,
+		"pipelines":     filterStatistics.pipelines,
+		"throttle":      forwardThrottle.counts(),
+		"queue":         asyncForwards.depth(),
+		"breakers":      circuitBreakers.states(),
+		"failover":      failoverHealth.states(),
+		"balance":       balancers.counts(),
+		"relay_rate":    relayRateLimiters.counts(),
+		"redis_entries": redisEntries(),
+		"email":         emailCounts(),
+		"dlq_retry":     deadLetterRetries.counts(),
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// teamsMaxMessageBytes is the Teams limit on the size of a webhook message
+const teamsMaxMessageBytes = 28 * 1024
+
+// teamsBackgroundTimeout bounds a best effort post, rate limit waits included
+const teamsBackgroundTimeout = 30 * time.Second
+
+// teamsLinks are the templates of the card button with its title, the first the event has a value for is used
+var teamsLinks = []struct{ title, template string }{
+	{"View package version", "{package.package_version.html_url}"}, {"View package", "{package.html_url}"}, {"View repository", "{repository.html_url}"},
+}
+
+// teamsSink posts an Adaptive Card rendered from the event to a Microsoft Teams incoming webhook or Workflows webhook
+type teamsSink struct {
+	webhookURL string
+	title      *fieldTemplate
+	text       *fieldTemplate
+	// bestEffort posts in the background and only logs failures, so Teams never delays or fails the relay forward
+	bestEffort bool
+	// dryRun logs the rendered card instead of posting it
+	dryRun bool
+	// rateLimit holds back posts for the Retry-After of Teams' last 429
+	rateLimit  retryAfterPause
+	background sync.WaitGroup
+}
+
+func init() {
+	sinkOpeners["teams"] = openTeamsSink
+}
+
+// openTeamsSink opens teams://<webhook host>/<webhook path>, posting to the https webhook URL with the query parameters
+// other than the sink's, e.g. the signature of Workflows webhooks. ?title= and ?text= are the card templates,
+// ?best_effort=false makes Teams failures fail the forward and ?dry_run=true logs the cards instead of posting them
+func openTeamsSink(destinationURL *url.URL) (sink, error) {
+	query := destinationURL.Query()
+	if destinationURL.Host == "" || strings.Trim(destinationURL.Path, "/") == "" {
+		return nil, fmt.Errorf("expected teams://<webhook host>/<webhook path>")
+	}
+	notifier := &teamsSink{bestEffort: true}
+	title := query.Get("title")
+	if title == "" {
+		title = "GitHub {event} event"
+	}
+	var err error
+	if notifier.title, err = parseFieldTemplate(title); err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	if text := query.Get("text"); text != "" {
+		if notifier.text, err = parseFieldTemplate(text); err != nil {
+			return nil, fmt.Errorf("text: %w", err)
+		}
+	}
+	for name, setting := range map[string]*bool{"best_effort": &notifier.bestEffort, "dry_run": &notifier.dryRun} {
+		if value := query.Get(name); value != "" {
+			if *setting, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	for _, name := range []string{"title", "text", "best_effort", "dry_run"} {
+		query.Del(name)
+	}
+	webhookURL := url.URL{Scheme: "https", Host: destinationURL.Host, Path: destinationURL.Path, RawQuery: query.Encode()}
+	notifier.webhookURL = webhookURL.String()
+	return notifier, nil
+}
+
+func (notifier *teamsSink) send(ctx context.Context, request *http.Request, body []byte) (relayReply, error) {
+	delivery := request.Header.Get("X-GitHub-Delivery")
+	message, err := notifier.render(request.Header, body)
+	if err != nil {
+		if notifier.bestEffort {
+			log.Printf("Teams notification of %s failed, continuing: %v", delivery, err)
+			return relayReply{status: http.StatusOK}, nil
+		}
+		return relayReply{status: http.StatusUnprocessableEntity}, err
+	}
+	if notifier.dryRun {
+		log.Printf("Dry run, not posting Teams notification of %s: %s", delivery, message)
+		return relayReply{status: http.StatusOK}, nil
+	}
+	if !notifier.bestEffort {
+		return notifier.post(ctx, delivery, message)
+	}
+	notifier.background.Add(1)
+	go func() {
+		defer notifier.background.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), teamsBackgroundTimeout)
+		defer cancel()
+		if _, err := notifier.post(ctx, delivery, message); err != nil {
+			log.Printf("Teams notification of %s failed, continuing: %v", delivery, err)
+		}
+	}()
+	return relayReply{status: http.StatusAccepted}, nil
+}
+
+// render builds the webhook message with a single Adaptive Card, with the title, the text, the facts and a button
+// linking to the package version, package or repository page. The text is left out of cards over the Teams size limit
+func (notifier *teamsSink) render(header http.Header, body []byte) ([]byte, error) {
+	title, err := notifier.title.render(header, body, strings.TrimSpace)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering Teams title: %v", err)
+	}
+	text := ""
+	if notifier.text != nil {
+		if text, err = notifier.text.render(header, body, strings.TrimSpace); err != nil {
+			return nil, fmt.Errorf("Error rendering Teams text: %v", err)
+		}
+	}
+	var facts []map[string]string
+	for _, field := range discordFields {
+		template, _ := parseFieldTemplate(field.template)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			facts = append(facts, map[string]string{"title": field.name, "value": value})
+		}
+	}
+	var actions []map[string]string
+	for _, link := range teamsLinks {
+		template, _ := parseFieldTemplate(link.template)
+		if value, err := template.render(header, body, strings.TrimSpace); err == nil {
+			actions = append(actions, map[string]string{"type": "Action.OpenUrl", "title": link.title, "url": value})
+			break
+		}
+	}
+	for {
+		cardBody := []map[string]any{{"type": "TextBlock", "text": title, "weight": "Bolder", "size": "Medium", "wrap": true}}
+		if text != "" {
+			cardBody = append(cardBody, map[string]any{"type": "TextBlock", "text": text, "wrap": true})
+		}
+		if len(facts) > 0 {
+			cardBody = append(cardBody, map[string]any{"type": "FactSet", "facts": facts})
+		}
+		card := map[string]any{
+			"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+			"type":    "AdaptiveCard",
+			"version": "1.4",
+			"body":    cardBody,
+		}
+		if len(actions) > 0 {
+			card["actions"] = actions
+		}
+		message, _ := json.Marshal(map[string]any{
+			"type":        "message",
+			"attachments": []map[string]any{{"contentType": "application/vnd.microsoft.card.adaptive", "content": card}},
+		})
+		if len(message) <= teamsMaxMessageBytes {
+			return message, nil
+		}
+		if text == "" {
+			return nil, fmt.Errorf("Teams card of %d bytes exceeds the %d bytes limit", len(message), teamsMaxMessageBytes)
+		}
+		text = ""
+	}
+}
+
+// post sends the message, waiting out Teams' Retry-After on 429 responses as long as the context allows
+func (notifier *teamsSink) post(ctx context.Context, delivery string, message []byte) (relayReply, error) {
+	for {
+		if err := notifier.rateLimit.wait(ctx); err != nil {
+			return relayReply{status: http.StatusTooManyRequests}, fmt.Errorf("Teams rate limit: %v", err)
+		}
+		newRequest, _ := http.NewRequestWithContext(ctx, "POST", notifier.webhookURL, bytes.NewReader(message))
+		newRequest.Header.Set("User-Agent", relayUserAgent)
+		newRequest.Header.Set("Content-Type", "application/json")
+		httpResponse, err := relayClient.Do(newRequest)
+		if err != nil {
+			return relayReply{}, fmt.Errorf("Error posting to Teams: %v", err)
+		}
+		reply := relayReply{status: httpResponse.StatusCode, contentType: httpResponse.Header.Get("Content-Type")}
+		reply.body, _ = io.ReadAll(io.LimitReader(httpResponse.Body, 4096))
+		httpResponse.Body.Close()
+		if httpResponse.StatusCode == http.StatusTooManyRequests {
+			delay, found := parseRetryAfter(httpResponse.Header.Get("Retry-After"))
+			if !found || delay < time.Second {
+				delay = time.Second
+			}
+			log.Printf("Teams rate limited, retrying after %s", delay)
+			notifier.rateLimit.pause(delay)
+			continue
+		}
+		if httpResponse.StatusCode < 200 || httpResponse.StatusCode >= 300 {
+			return reply, fmt.Errorf("Error - Teams returned status %d: %s", httpResponse.StatusCode, reply.body)
+		}
+		log.Printf("Posted Teams notification of %s", delivery)
+		return reply, nil
+	}
+}
+
+func (notifier *teamsSink) close() {
+	notifier.background.Wait()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// templateFields name the common event fields usable in templates, with the inbound header or payload path they
+// resolve to. Other placeholders are payload paths such as {package.name}
+var templateFields = map[string]string{
+	"event":        "header:X-GitHub-Event",
+	"delivery":     "header:X-GitHub-Delivery",
+	"action":       "action",
+	"org":          "repository.owner.login",
+	"repo":         "repository.name",
+	"repository":   "repository.full_name",
+	"sender":       "sender.login",
+	"package":      "package.name",
+	"package_type": "package.package_type",
+	"tag":          "package.package_version.container_metadata.tag.name",
+}
+
+// topicEscaper keeps field values from splitting or wildcarding dot-separated NATS subjects and AMQP routing keys
+var topicEscaper = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_", "#", "_")
+
+// fieldTemplate is a string with {field} placeholders filled from the event
+type fieldTemplate struct {
+	// literals has one more entry than fields, the text around the placeholders
+	literals []string
+	fields   []string
+	paths    [][]any
+}
+
+func parseFieldTemplate(template string) (*fieldTemplate, error) {
+	parsed := &fieldTemplate{}
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return nil, fmt.Errorf("template %q has an unopened }", template)
+			}
+			parsed.literals = append(parsed.literals, rest)
+			return parsed, nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template %q has an unclosed {", template)
+		}
+		field := rest[start+1 : start+end]
+		path := field
+		if known, found := templateFields[field]; found {
+			path = known
+		}
+		var segments []any
+		if !strings.HasPrefix(path, "header:") {
+			var err error
+			if segments, err = parseJSONPath("$." + path); err != nil {
+				return nil, fmt.Errorf("template %q: %w", template, err)
+			}
+		}
+		parsed.literals = append(parsed.literals, rest[:start])
+		parsed.fields = append(parsed.fields, field)
+		parsed.paths = append(parsed.paths, segments)
+		rest = rest[start+end+1:]
+	}
+}
+
+// render fills the placeholders from the inbound headers and payload, each value passed through escape. Fails on the
+// first placeholder the event has no value for
+func (template *fieldTemplate) render(header http.Header, body []byte, escape func(string) string) (string, error) {
+	if len(template.fields) == 0 {
+		return template.literals[0], nil
+	}
+	var payload any
+	json.Unmarshal(body, &payload)
+	var rendered strings.Builder
+	for index, field := range template.fields {
+		rendered.WriteString(template.literals[index])
+		value := ""
+		if name, isHeader := strings.CutPrefix(templateFields[field], "header:"); isHeader {
+			value = header.Get(name)
+		} else if found, ok := lookupPath(payload, template.paths[index]); ok && found != nil {
+			value = formatValue(found)
+		}
+		if value == "" {
+			return "", fmt.Errorf("no value for placeholder {%s}", field)
+		}
+		rendered.WriteString(escape(value))
+	}
+	rendered.WriteString(template.literals[len(template.fields)])
+	return rendered.String(), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardRate is a number of forwards allowed per period, e.g. 20/h
+type forwardRate struct {
+	count  int
+	period time.Duration
+}
+
+var ratePeriods = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+
+// parseForwardRate parses <count>/<period> where the period is s, m, h, d or a duration such as 30m
+func parseForwardRate(value string) (*forwardRate, error) {
+	count, period, found := strings.Cut(value, "/")
+	if !found {
+		return nil, fmt.Errorf("expected <count>/<period>, e.g. 20/h, got %q", value)
+	}
+	rate := &forwardRate{}
+	var err error
+	if rate.count, err = strconv.Atoi(strings.TrimSpace(count)); err != nil || rate.count <= 0 {
+		return nil, fmt.Errorf("invalid count %q", count)
+	}
+	period = strings.TrimSpace(period)
+	if rate.period = ratePeriods[period]; rate.period == 0 {
+		if rate.period, err = time.ParseDuration(period); err != nil || rate.period <= 0 {
+			return nil, fmt.Errorf("invalid period %q", period)
+		}
+	}
+	return rate, nil
+}
+
+func (rate *forwardRate) String() string {
+	return fmt.Sprintf("%d per %s", rate.count, rate.period)
+}
+
+// tokenBucket holds up to rate.count tokens and refills continuously at rate.count per rate.period
+type tokenBucket struct {
+	tokens    float64
+	updated   time.Time
+	Forwarded int64 `json:"forwarded"`
+	Limited   int64 `json:"limited"`
+}
+
+// repoThrottle keeps a token bucket per repository
+type repoThrottle struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var forwardThrottle = &repoThrottle{buckets: map[string]*tokenBucket{}}
+
+// allow takes a token from the bucket of repo. Returns false when the bucket is empty
+func (throttle *repoThrottle) allow(repo string, rate *forwardRate) bool {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	now := time.Now()
+	bucket := throttle.buckets[repo]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(rate.count), updated: now}
+		throttle.buckets[repo] = bucket
+	}
+	refill := now.Sub(bucket.updated).Seconds() / rate.period.Seconds() * float64(rate.count)
+	bucket.tokens = math.Min(float64(rate.count), bucket.tokens+refill)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		bucket.Limited++
+		return false
+	}
+	bucket.tokens--
+	bucket.Forwarded++
+	return true
+}
+
+// evictIdle periodically removes the buckets of repositories that had no event for longer than idle
+func (throttle *repoThrottle) evictIdle(interval time.Duration, idle time.Duration) {
+	for range time.Tick(interval) {
+		throttle.mutex.Lock()
+		for repo, bucket := range throttle.buckets {
+			if time.Since(bucket.updated) > idle {
+				delete(throttle.buckets, repo)
+			}
+		}
+		throttle.mutex.Unlock()
+	}
+}
+
+// counts returns a copy of the forwarded and limited counts per repository
+func (throttle *repoThrottle) counts() map[string]tokenBucket {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	counts := make(map[string]tokenBucket, len(throttle.buckets))
+	for repo, bucket := range throttle.buckets {
+		counts[repo] = *bucket
+	}
+	return counts
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// trimmablePaths lists the bulky payload fields removed, in order, to bring an oversized payload under MAX_FORWARD_BYTES.
+// Identifying fields such as names, versions, tags and the repository are never removed
+var trimmablePaths = [][]string{
+	{"package", "package_version", "container_metadata", "manifest"},
+	{"package", "package_version", "package_files"},
+	{"package", "package_version", "body_html"},
+	{"package", "package_version", "body"},
+	{"package", "package_version", "metadata"},
+	{"package", "package_version", "docker_metadata"},
+	{"package", "package_version", "npm_metadata"},
+	{"package", "package_version", "nuget_metadata"},
+	{"package", "package_version", "rubygems_metadata"},
+	{"package", "package_version", "release"},
+	{"package", "registry"},
+	{"release", "body"},
+	{"release", "assets"},
+	{"pull_request", "body"},
+	{"commits"},
+}
+
+// limitPayloadSize returns the body to forward when it exceeds config.maxForwardBytes: a trimmed payload when
+// TRIM_OVERSIZED is enabled and trimming brings it under the limit, otherwise the reason the event is dropped
+func limitPayloadSize(config *filterConfig, requestBody []byte) ([]byte, *filterReason) {
+	if config.maxForwardBytes <= 0 || len(requestBody) <= config.maxForwardBytes {
+		return requestBody, nil
+	}
+	log.Printf("Payload of %d bytes exceeds MAX_FORWARD_BYTES %d", len(requestBody), config.maxForwardBytes)
+	if !config.trimOversized {
+		return nil, filtered(reasonPayloadTooLarge, "Filtered out payload of %d bytes! Exceeds %d bytes. No forward to relay", len(requestBody), config.maxForwardBytes)
+	}
+
+	// trimming mutates the payload, so work on a private copy
+	var trimmed map[string]any
+	json.Unmarshal(requestBody, &trimmed)
+	for _, path := range trimmablePaths {
+		if !deletePath(trimmed, path) {
+			continue
+		}
+		body, err := json.Marshal(trimmed)
+		if err != nil {
+			break
+		}
+		if len(body) <= config.maxForwardBytes {
+			log.Printf("Trimmed payload from %d to %d bytes", len(requestBody), len(body))
+			return body, nil
+		}
+	}
+	return nil, filtered(reasonPayloadTooLarge, "Filtered out payload of %d bytes! Still exceeds %d bytes after trimming. No forward to relay", len(requestBody), config.maxForwardBytes)
+}
+
+// deletePath removes the field at path, reporting whether it existed
+func deletePath(payload map[string]any, path []string) bool {
+	current := payload
+	for _, key := range path[:len(path)-1] {
+		next, ok := current[key].(map[string]any)
+		if !ok {
+			return false
+		}
+		current = next
+	}
+	last := path[len(path)-1]
+	if _, found := current[last]; !found {
+		return false
+	}
+	delete(current, last)
+	return true
+}
+
+// projectFields rebuilds the payload with only the fields at the FORWARD_FIELDS paths, keeping their nesting. Paths
+// missing from the payload are left out. Returns the body unchanged without paths or when it isn't a JSON object
+func projectFields(paths [][]string, requestBody []byte) []byte {
+	if len(paths) == 0 {
+		return requestBody
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(requestBody, &payload); err != nil {
+		return requestBody
+	}
+	projected := map[string]any{}
+	for _, path := range paths {
+		value, found := any(payload), true
+		for _, key := range path {
+			object, ok := value.(map[string]any)
+			if !ok {
+				found = false
+				break
+			}
+			if value, found = object[key]; !found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		current := projected
+		for _, key := range path[:len(path)-1] {
+			next, ok := current[key].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				current[key] = next
+			}
+			current = next
+		}
+		current[path[len(path)-1]] = value
+	}
+	body, err := json.Marshal(projected)
+	if err != nil {
+		return requestBody
+	}
+	log.Printf("Projected payload from %d to %d bytes", len(requestBody), len(body))
+	return body
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// forwardWindow is a weekly time window such as Mon-Fri 08:00-18:00 Europe/Berlin. The end time is exclusive, and a
+// window ending before it starts spans midnight and belongs to the day it starts on
+type forwardWindow struct {
+	source   string
+	days     [7]bool
+	start    int
+	end      int
+	location *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseForwardWindow parses "<days> <HH:MM>-<HH:MM> [time zone]". Days are a comma-separated list of day names and
+// ranges such as Mon-Fri,Sun or * for every day. The time zone defaults to UTC
+func parseForwardWindow(value string) (*forwardWindow, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected \"<days> <HH:MM>-<HH:MM> [time zone]\", got %q", value)
+	}
+	window := &forwardWindow{source: value, location: time.UTC}
+	if err := window.parseDays(fields[0]); err != nil {
+		return nil, err
+	}
+	start, end, found := strings.Cut(fields[1], "-")
+	if !found {
+		return nil, fmt.Errorf("invalid time range %q", fields[1])
+	}
+	var err error
+	if window.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if window.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if len(fields) == 3 {
+		if window.location, err = time.LoadLocation(fields[2]); err != nil {
+			return nil, err
+		}
+	}
+	return window, nil
+}
+
+func (window *forwardWindow) parseDays(value string) error {
+	if value == "*" {
+		window.days = [7]bool{true, true, true, true, true, true, true}
+		return nil
+	}
+	for _, days := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(days, "-")
+		if !isRange {
+			last = first
+		}
+		from, found := weekdayNames[first]
+		to, lastFound := weekdayNames[last]
+		if !found || !lastFound {
+			return fmt.Errorf("invalid days %q", days)
+		}
+		// ranges such as Fri-Mon wrap around the end of the week
+		for day := from; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock returns the minutes since midnight of HH:MM
+func parseClock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// contains reports whether instant falls inside the window
+func (window *forwardWindow) contains(instant time.Time) bool {
+	local := instant.In(window.location)
+	weekday := local.Weekday()
+	minute := local.Hour()*60 + local.Minute()
+	if window.start < window.end {
+		return window.days[weekday] && minute >= window.start && minute < window.end
+	}
+	// spans midnight, or the whole day when start and end are equal
+	if minute >= window.start {
+		return window.days[weekday]
+	}
+	return minute < window.end && window.days[(weekday+6)%7]
+}
+
+func (window *forwardWindow) String() string {
+	return window.source
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForwardWindowContains(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     string
+		instant    string
+		wantInside bool
+	}{
+		{name: "start is inside", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T08:00:00+02:00", wantInside: true},
+		{name: "minute before start", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T07:59:00+02:00", wantInside: false},
+		{name: "minute before end", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T17:59:59+02:00", wantInside: true},
+		{name: "exactly at the end", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T18:00:00+02:00", wantInside: false},
+		{name: "weekend", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-11T10:00:00+02:00", wantInside: false},
+		{name: "UTC instant inside the local window", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T06:30:00Z", wantInside: true},
+		{name: "UTC instant inside in UTC but after the local end", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-05-06T16:30:00Z", wantInside: false},
+		{name: "winter offset", window: "Mon-Fri 08:00-18:00 Europe/Berlin", instant: "2024-01-08T07:30:00Z", wantInside: true},
+		{name: "local weekday differs from the UTC weekday", window: "Mon 00:00-06:00 Asia/Tokyo", instant: "2024-05-05T20:00:00Z", wantInside: true},
+		{name: "UTC by default", window: "Mon-Fri 08:00-18:00", instant: "2024-05-06T08:00:00Z", wantInside: true},
+		{name: "spanning midnight, before midnight", window: "Fri 22:00-06:00 UTC", instant: "2024-05-10T22:00:00Z", wantInside: true},
+		{name: "spanning midnight, after midnight", window: "Fri 22:00-06:00 UTC", instant: "2024-05-11T05:59:00Z", wantInside: true},
+		{name: "spanning midnight, exactly at the end", window: "Fri 22:00-06:00 UTC", instant: "2024-05-11T06:00:00Z", wantInside: false},
+		{name: "spanning midnight, before the start", window: "Fri 22:00-06:00 UTC", instant: "2024-05-10T21:59:00Z", wantInside: false},
+		{name: "spanning midnight, morning of the start day", window: "Fri 22:00-06:00 UTC", instant: "2024-05-10T02:00:00Z", wantInside: false},
+		{name: "spanning midnight, evening of the next day", window: "Fri 22:00-06:00 UTC", instant: "2024-05-11T22:00:00Z", wantInside: false},
+		{name: "whole day", window: "Mon 00:00-00:00", instant: "2024-05-06T23:59:00Z", wantInside: true},
+		{name: "whole day ends at midnight", window: "Mon 00:00-00:00", instant: "2024-05-07T00:00:00Z", wantInside: false},
+		{name: "day range wrapping the week", window: "Fri-Mon 08:00-18:00", instant: "2024-05-05T12:00:00Z", wantInside: true},
+		{name: "day list", window: "Mon,Wed 08:00-18:00", instant: "2024-05-07T12:00:00Z", wantInside: false},
+		{name: "every day", window: "* 08:00-18:00", instant: "2024-05-11T12:00:00Z", wantInside: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window, err := parseForwardWindow(test.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			instant, err := time.Parse(time.RFC3339, test.instant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inside := window.contains(instant); inside != test.wantInside {
+				t.Errorf("contains(%s) = %v, want %v", test.instant, inside, test.wantInside)
+			}
+		})
+	}
+}
+
+func TestParseForwardWindowInvalid(t *testing.T) {
+	for _, value := range []string{"", "Mon-Fri", "Mon-Fri 08:00-18:00 Europe/Berlin extra", "Mon-Xyz 08:00-18:00", "Mon 8-18", "Mon 08:00", "Mon 25:00-18:00", "Mon 08:00-18:00 Mars/Olympus"} {
+		if _, err := parseForwardWindow(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}